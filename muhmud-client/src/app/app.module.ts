@@ -11,10 +11,14 @@ import { LoginComponent } from './login/login.component';
 import { LoginGuard } from './login-guard.service';
 import { AuthService } from './auth.service';
 import { LogOutComponent } from './log-out/log-out.component';
+import { ResetPasswordComponent } from './reset-password/reset-password.component';
+import { RegisterComponent } from './register/register.component';
 
 const appRoutes: Routes = [
   { path: 'login', component: LoginComponent },
   { path: 'logout', component: LogOutComponent },
+  { path: 'register', component: RegisterComponent },
+  { path: 'password/reset', component: ResetPasswordComponent },
   { path: 'mud', canActivate: [LoginGuard], component: MudClientComponent },
   { path: '', redirectTo: 'mud', pathMatch: 'full'},
   { path: '**', component: PageNotFoundComponent},
@@ -26,7 +30,9 @@ const appRoutes: Routes = [
     PageNotFoundComponent,
     MudClientComponent,
     LoginComponent,
-    LogOutComponent
+    LogOutComponent,
+    ResetPasswordComponent,
+    RegisterComponent
   ],
   imports: [
     RouterModule.forRoot(appRoutes),
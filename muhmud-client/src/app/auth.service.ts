@@ -1,42 +1,170 @@
 import { Injectable } from '@angular/core';
 import { HttpClient, HttpErrorResponse, HttpParams, HttpHeaders } from '@angular/common/http';
 import { environment } from '../environments/environment';
-import { catchError, ignoreElements, map } from 'rxjs/operators';
-import { Observable, throwError } from 'rxjs';
+import { catchError, finalize, map, shareReplay } from 'rxjs/operators';
+import { Observable, of, throwError } from 'rxjs';
 
-interface LoginResult {
+// what the server sends on logging in and refreshing
+interface TokenPair {
   Token: string;
+  RefreshToken: string;
+  // when Token expires, in seconds since the epoch
+  ExpiresAt: number;
 }
 
+// how long before the access token expires to refresh it, in milliseconds
+const REFRESH_MARGIN = 30 * 1000;
+
 @Injectable()
 export class AuthService {
   constructor(private http: HttpClient) { }
 
+  // the refresh under way, if any; refresh tokens only work once, so
+  // everybody wanting a fresh token has to share it
+  private refreshing: Observable<void>;
+
   get token() {
     return window.localStorage.getItem('token');
   }
 
+  get refreshToken() {
+    return window.localStorage.getItem('refreshToken');
+  }
+
+  get expiresAt() {
+    return Number(window.localStorage.getItem('expiresAt')) * 1000;
+  }
+
   authenticate(email: string, password: string): Observable<void> {
     const body = new HttpParams()
       .set('email', email)
       .set('password', password);
-    const response = this.http.post<LoginResult>(environment.server + '/login',
+    const response = this.http.post<TokenPair>(environment.server + '/login',
       body.toString(),
       {
         headers: new HttpHeaders()
           .set('Content-Type', 'application/x-www-form-urlencoded')
       });
 
-    // at some point, store the token for later use!
     return response.pipe(
-      map(x => {
-        window.localStorage.setItem('token', x.Token);
-        return void 0;
-      }),
+      map(pair => this.storeTokens(pair)),
       catchError(this.handleError));
   }
 
-  handleError(error: HttpErrorResponse): Observable<Error> {
+  /**
+   * Returns an access token that's good for a while yet, refreshing it first
+   * if need be. Fails if the session is over and the player has to log in
+   * again, which clears the tokens.
+   */
+  freshToken(): Observable<string> {
+    if (this.token && Date.now() < this.expiresAt - REFRESH_MARGIN) {
+      return of(this.token);
+    }
+    return this.refresh().pipe(map(() => this.token));
+  }
+
+  /**
+   * Exchanges the refresh token for a new pair of tokens.
+   */
+  refresh(): Observable<void> {
+    if (!this.refreshToken) {
+      return throwError(new Error('Not logged in.'));
+    }
+    if (!this.refreshing) {
+      const body = new HttpParams().set('refresh_token', this.refreshToken);
+      this.refreshing = this.http.post<TokenPair>(environment.server + '/token/refresh',
+        body.toString(),
+        {
+          headers: new HttpHeaders()
+            .set('Content-Type', 'application/x-www-form-urlencoded')
+        }).pipe(
+          map(pair => this.storeTokens(pair)),
+          catchError((error: HttpErrorResponse) => {
+            if (error.status === 401) {
+              this.clearToken();
+              return throwError(new Error('Your session has expired.'));
+            }
+            return this.handleError(error);
+          }),
+          finalize(() => this.refreshing = undefined),
+          shareReplay(1));
+    }
+    return this.refreshing;
+  }
+
+  /**
+   * Ends the session on the server and forgets the tokens.
+   */
+  logout(): Observable<void> {
+    const refreshToken = this.refreshToken;
+    this.clearToken();
+    if (!refreshToken) {
+      return of(void 0);
+    }
+    const body = new HttpParams().set('refresh_token', refreshToken);
+    return this.http.post(environment.server + '/logout',
+      body.toString(),
+      {
+        headers: new HttpHeaders()
+          .set('Content-Type', 'application/x-www-form-urlencoded')
+      }).pipe(
+        map(() => void 0),
+        // the tokens are gone either way
+        catchError(() => of(void 0)));
+  }
+
+  /**
+   * Creates an account, which has to be verified with the link emailed to
+   * email before it can be logged in to.
+   */
+  register(email: string, password: string): Observable<void> {
+    const body = new HttpParams()
+      .set('email', email)
+      .set('password', password);
+    return this.http.post(environment.server + '/register',
+      body.toString(),
+      {
+        headers: new HttpHeaders()
+          .set('Content-Type', 'application/x-www-form-urlencoded')
+      }).pipe(
+        map(() => void 0),
+        catchError(this.handleError));
+  }
+
+  /**
+   * Asks for an email with a link to reset the password of the account of
+   * email, if there is one.
+   */
+  forgotPassword(email: string): Observable<void> {
+    const body = new HttpParams().set('email', email);
+    return this.http.post(environment.server + '/password/forgot',
+      body.toString(),
+      {
+        headers: new HttpHeaders()
+          .set('Content-Type', 'application/x-www-form-urlencoded')
+      }).pipe(
+        map(() => void 0),
+        catchError(this.handleError));
+  }
+
+  /**
+   * Sets a new password with the token from a password reset email.
+   */
+  resetPassword(token: string, password: string): Observable<void> {
+    const body = new HttpParams()
+      .set('token', token)
+      .set('password', password);
+    return this.http.post(environment.server + '/password/reset',
+      body.toString(),
+      {
+        headers: new HttpHeaders()
+          .set('Content-Type', 'application/x-www-form-urlencoded')
+      }).pipe(
+        map(() => void 0),
+        catchError(this.handleError));
+  }
+
+  handleError(error: HttpErrorResponse): Observable<never> {
     if (error.error instanceof ErrorEvent) {
       // client-side or network error occurred
       console.error('An error occurred:', error.error.message);
@@ -44,6 +172,9 @@ export class AuthService {
       return throwError(new Error('Unable to connect to server'));
     } else if (error.status === 403) {
       return throwError(new Error('Invalid email/password.'));
+    } else if ((error.status === 400 || error.status === 429) && error.error && error.error.Error) {
+      // e.g. a password that isn't good enough
+      return throwError(new Error(`${error.error.Error}.`));
     }
     // The backend returned an unsuccessful response code.
     // The response body may contain clues as to what went wrong,
@@ -56,6 +187,13 @@ export class AuthService {
 
   clearToken(): void {
     window.localStorage.removeItem('token');
+    window.localStorage.removeItem('refreshToken');
+    window.localStorage.removeItem('expiresAt');
   }
 
+  private storeTokens(pair: TokenPair): void {
+    window.localStorage.setItem('token', pair.Token);
+    window.localStorage.setItem('refreshToken', pair.RefreshToken);
+    window.localStorage.setItem('expiresAt', String(pair.ExpiresAt));
+  }
 }
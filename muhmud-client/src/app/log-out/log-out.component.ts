@@ -12,8 +12,8 @@ export class LogOutComponent implements OnInit {
   constructor(private authService: AuthService, private router: Router) { }
 
   ngOnInit() {
-    this.authService.clearToken();
-    this.router.navigate(['/login']);
+    this.authService.logout()
+      .subscribe(() => this.router.navigate(['/login']));
   }
 
 }
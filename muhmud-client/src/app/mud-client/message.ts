@@ -0,0 +1,21 @@
+/**
+ * The version of the message envelope spoken with the server.
+ */
+export const PROTOCOL_VERSION = 1;
+
+/**
+ * The envelope every frame on the websocket is wrapped in; see the server's
+ * doc/design.md.
+ */
+export interface Message {
+  version: number;
+  type: 'request' | 'response' | 'notification' | 'gmcp';
+  requestId?: string;
+  msg: string;
+  // only set for gmcp messages, e.g. "Room.Info" and the details of the room
+  package?: string;
+  data?: any;
+  // numbers the messages sent by the server, for resuming after the
+  // connection drops
+  seq?: number;
+}
@@ -3,7 +3,9 @@ import { AuthService } from '../auth.service';
 import { DomSanitizer } from '@angular/platform-browser';
 import { SecurityContext } from '@angular/core';
 import { renderMessage } from './render-message';
+import { Message, PROTOCOL_VERSION } from './message';
 import { environment } from '../../environments/environment';
+import { map } from 'rxjs/operators';
 
 @Component({
   selector: 'app-mud-client',
@@ -18,10 +20,58 @@ export class MudClientComponent implements OnInit, AfterViewChecked {
   messages = [];
   command = '';
   authExpired = false;
+  nextRequestId = 1;
+  // the latest data of every GMCP message received, by package
+  gmcp: { [pkg: string]: any } = {};
+
+  // what's needed to resume the connection if it drops; see Core.Session
+  resumeToken: string;
+  resumeGrace = 0;
+  lastSeq = 0;
+  lostAt: number;
 
   messagesScrolledToBottom = true;
 
   ngOnInit() {
+    this.connect();
+  }
+
+  /**
+   * Connects to the server.
+   *
+   * @param resume the token to carry on with after the server restarted or the
+   *  connection dropped, if any
+   * @param refresh whether to refresh the access token even if it looks good,
+   *  because the server just turned it down
+   */
+  connect(resume?: string, refresh = false) {
+    const token = refresh ?
+      this.authService.refresh().pipe(map(() => this.authService.token)) :
+      this.authService.freshToken();
+    token.subscribe(
+      t => this.open(t, resume, refresh),
+      err => {
+        if (!this.authService.token) {
+          // the session is over
+          this.loggedOut(err);
+        } else if (this.lostAt !== undefined) {
+          // probably the same trouble that dropped the connection
+          this.reconnect();
+        } else {
+          this.messages.push(`Unable to connect: ${err.message}`);
+        }
+      });
+  }
+
+  /**
+   * Opens a websocket to the server.
+   *
+   * @param token the access token to authenticate with
+   * @param resume as for connect
+   * @param refreshed whether token was refreshed because the server turned
+   *  down the last one
+   */
+  open(token: string, resume?: string, refreshed = false) {
     // TODO: put ws stuff in its own class
     const wsServer = new URL(environment.server);
     if (wsServer.protocol === 'https:') {
@@ -29,22 +79,109 @@ export class MudClientComponent implements OnInit, AfterViewChecked {
     } else {
       wsServer.protocol = 'ws:';
     }
-    this.websocket = new WebSocket(wsServer.toString() + 'ws?token='
-        + encodeURIComponent(this.authService.token));
+    let url = wsServer.toString() + 'ws?token=' + encodeURIComponent(token);
+    if (resume) {
+      url += '&resume=' + encodeURIComponent(resume) + '&seq=' + this.lastSeq;
+    }
+    let opened = false;
+    this.websocket = new WebSocket(url);
     console.log(this.websocket.url);
     this.websocket.onclose = (ev) => {
       console.log(`DEBUG onclose occurred: ${ev.code}`);
-      if (ev.code === 4000) {
-        // Auth must be expired
-        this.authService.clearToken();
-        this.authExpired = true;
+      if (ev.code === 1006 && !opened) {
+        // The server refused the websocket, and browsers won't say why. If
+        // it was the token, refreshing it either fixes that or shows that
+        // the session is over.
+        if (this.lostAt !== undefined) {
+          this.reconnect(!refreshed);
+        } else if (!refreshed) {
+          this.connect(resume, true);
+        } else {
+          this.messages.push('Unable to connect.');
+        }
+      } else if (ev.code === 4001) {
+        // The server is restarting (a copyover); pick up where we left off.
+        // The new server numbers its messages from scratch.
+        this.lastSeq = 0;
+        this.connect(ev.reason);
+      } else if (ev.code === 1006 && this.resumeToken) {
+        // The connection dropped; the server holds on to it for a while
+        this.reconnect();
+      } else if (ev.reason) {
+        // e.g. the server shutting down
+        this.messages.push(`Disconnected: ${ev.reason}.`);
       }
     };
-    this.websocket.onopen = () => console.log('DEBUG onopen occurred');
-    this.websocket.onerror = () => console.log('DEBUG onerror occurred');
-    this.websocket.onmessage = (event) => {
-      this.messages.push(renderMessage(event.data));
+    this.websocket.onopen = () => {
+      console.log('DEBUG onopen occurred');
+      opened = true;
+      this.lostAt = undefined;
     };
+    this.websocket.onerror = () => console.log('DEBUG onerror occurred');
+    this.websocket.onmessage = (event) => this.handleMessage(JSON.parse(event.data));
+  }
+
+  /**
+   * Gives up on connecting because the player has to log in again.
+   *
+   * @param err why
+   */
+  loggedOut(err: Error) {
+    this.messages.push(err.message);
+    this.authService.clearToken();
+    this.authExpired = true;
+  }
+
+  /**
+   * Handles a message from the server: text is shown, GMCP data is kept.
+   *
+   * @param msg the message
+   */
+  handleMessage(msg: Message) {
+    if (msg.seq) {
+      this.lastSeq = msg.seq;
+    }
+    switch (msg.type) {
+      case 'response':
+      case 'notification':
+        this.messages.push(renderMessage(msg.msg));
+        break;
+      case 'gmcp':
+        this.handleGMCP(msg.package, msg.data);
+        break;
+    }
+  }
+
+  /**
+   * Handles a GMCP message from the server.
+   *
+   * @param pkg the package and message, e.g. "Room.Info"
+   * @param data what it carries
+   */
+  handleGMCP(pkg: string, data: any) {
+    this.gmcp[pkg] = data;
+    if (pkg === 'Core.Session') {
+      this.resumeToken = data.token;
+      this.resumeGrace = data.grace;
+    }
+  }
+
+  /**
+   * Keeps trying to resume a dropped connection for as long as the server
+   * holds on to it.
+   *
+   * @param refresh as for connect
+   */
+  reconnect(refresh = false) {
+    if (this.lostAt === undefined) {
+      this.lostAt = Date.now();
+      this.messages.push('Connection lost, reconnecting...');
+    }
+    if (Date.now() - this.lostAt > this.resumeGrace * 1000) {
+      this.messages.push('Unable to reconnect.');
+      return;
+    }
+    setTimeout(() => this.connect(this.resumeToken, refresh), 2000);
   }
 
   ngAfterViewChecked(): void {
@@ -61,7 +198,13 @@ export class MudClientComponent implements OnInit, AfterViewChecked {
   }
 
   onCommandSubmit() {
-    this.websocket.send(this.command);
+    const request: Message = {
+      version: PROTOCOL_VERSION,
+      type: 'request',
+      requestId: String(this.nextRequestId++),
+      msg: this.command,
+    };
+    this.websocket.send(JSON.stringify(request));
 
     this.command = '';
   }
@@ -1,23 +1,11 @@
-
 /**
  * Renders a message from the server into html.
  *
+ * The server renders its color markup into escaped html with spans for us
+ * (see the muhmud markup package), so all that's left is keeping line breaks.
+ *
  * @param msg message to render
  */
 export function renderMessage(msg: string): string {
-  let esc = escapeHTML(msg);
-  // THIS IS WRONG
-  esc = esc
-      .replace('%r', '<span class="c-r">')
-      .replace('%c', '</span>');
-  return esc;
-}
-
-function escapeHTML(s: string): string {
-  return s
-      .replace(/&/g, '&amp;')
-      .replace(/</g, '&lt;')
-      .replace(/>/g, '&gt;')
-      .replace(/"/g, '&quot;')
-      .replace(/'/g, '&#039;');
+  return msg.replace(/\n/g, '<br>');
 }
@@ -0,0 +1,40 @@
+import { Component, OnInit } from '@angular/core';
+import { AuthService } from '../auth.service';
+
+@Component({
+  selector: 'app-register',
+  templateUrl: './register.component.html',
+  styleUrls: ['./register.component.css']
+})
+export class RegisterComponent implements OnInit {
+  email: string;
+  password: string;
+  confirmation: string;
+  error: string;
+  statusMsg: string;
+  done = false;
+
+  constructor(private authService: AuthService) { }
+
+  ngOnInit() {
+  }
+
+  onSubmit() {
+    this.error = '';
+    if (this.password !== this.confirmation) {
+      this.error = 'The passwords don\'t match.';
+      return;
+    }
+    this.statusMsg = 'Creating your account...';
+    this.authService.register(this.email, this.password)
+      .subscribe(
+        () => {
+          this.statusMsg = 'Check your email for a link to verify your address, then log in.';
+          this.done = true;
+        },
+        (err) => {
+          this.error = err.message;
+          this.statusMsg = '';
+        });
+  }
+}
@@ -0,0 +1,60 @@
+import { Component, OnInit } from '@angular/core';
+import { ActivatedRoute } from '@angular/router';
+import { AuthService } from '../auth.service';
+
+@Component({
+  selector: 'app-reset-password',
+  templateUrl: './reset-password.component.html',
+  styleUrls: ['./reset-password.component.css']
+})
+export class ResetPasswordComponent implements OnInit {
+  // the token from the link in the password reset email, if the player
+  // followed one; without it they're asked for their email address instead
+  token: string;
+  email: string;
+  password: string;
+  confirmation: string;
+  error: string;
+  statusMsg: string;
+  done = false;
+
+  constructor(private authService: AuthService, private route: ActivatedRoute) { }
+
+  ngOnInit() {
+    this.token = this.route.snapshot.queryParamMap.get('token');
+  }
+
+  onRequestSubmit() {
+    this.error = '';
+    this.statusMsg = 'Sending...';
+    this.authService.forgotPassword(this.email)
+      .subscribe(
+        () => {
+          this.statusMsg = 'If that address has an account, an email is on its way with a link to reset your password.';
+          this.done = true;
+        },
+        (err) => {
+          this.error = err.message;
+          this.statusMsg = '';
+        });
+  }
+
+  onResetSubmit() {
+    this.error = '';
+    if (this.password !== this.confirmation) {
+      this.error = 'The passwords don\'t match.';
+      return;
+    }
+    this.statusMsg = 'Resetting...';
+    this.authService.resetPassword(this.token, this.password)
+      .subscribe(
+        () => {
+          this.statusMsg = 'Your password has been reset.';
+          this.done = true;
+        },
+        (err) => {
+          this.error = err.message;
+          this.statusMsg = '';
+        });
+  }
+}
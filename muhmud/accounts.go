@@ -0,0 +1,391 @@
+// Contains account registration, email verification and password resets.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// How long the tokens we mail out stay valid.
+const (
+	verifyEmailTTL   = 48 * time.Hour
+	resetPasswordTTL = time.Hour
+)
+
+// minPasswordLength is the shortest password we accept.
+const minPasswordLength = 8
+
+// ErrInvalidToken is returned when a token doesn't exist, has expired or has
+// already been used.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// ErrAccountExists is returned when registering an email address that already
+// has an account.
+var ErrAccountExists = errors.New("an account already exists for that email address")
+
+// TokenPurpose is what a mailed token may be used for.
+type TokenPurpose string
+
+// The kinds of tokens we mail out.
+const (
+	VerifyEmailToken   TokenPurpose = "verify_email"
+	ResetPasswordToken TokenPurpose = "reset_password"
+)
+
+// AccountToken is a single use token mailed to a player. Only a hash of the
+// token is ever stored, so a leaked database can't be used to take over
+// accounts.
+type AccountToken struct {
+	Hash      string
+	Email     string
+	Purpose   TokenPurpose
+	ExpiresAt time.Time
+}
+
+// newToken generates a random token, returning it along with its hash.
+func newToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+// hashToken returns the hash a token is stored under.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeEmail returns the form of an email address accounts are keyed by.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// checkPasswordStrength returns an error describing why password isn't good
+// enough, or nil if it is.
+func checkPasswordStrength(password, email string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters long", minPasswordLength)
+	}
+	var lower, upper, digit, other bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, b := range []bool{lower, upper, digit, other} {
+		if b {
+			classes++
+		}
+	}
+	if classes < 3 {
+		return errors.New("password must contain at least three of: lower case letters, upper case letters, digits and symbols")
+	}
+	if i := strings.Index(email, "@"); i > 0 && strings.Contains(strings.ToLower(password), strings.ToLower(email[:i])) {
+		return errors.New("password must not contain your email address")
+	}
+	return nil
+}
+
+// RegisterPlayer creates a new, unverified account.
+func (s *GameState) RegisterPlayer(email, password string) (*Player, error) {
+	email = normalizeEmail(email)
+	if err := checkPasswordStrength(password, email); err != nil {
+		return nil, err
+	}
+	p, err := player(email, password)
+	if err != nil {
+		return nil, err
+	}
+
+	s.do(func() {
+		if _, ok := s.Players[email]; ok {
+			err = ErrAccountExists
+			return
+		}
+		p.Admin = s.admins[email]
+		if err = s.Store.SavePlayer(p); err == nil {
+			s.Players[email] = p
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// IssueToken creates a token that can be used once for purpose within ttl.
+func (s *GameState) IssueToken(email string, purpose TokenPurpose, ttl time.Duration) (string, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	t := AccountToken{Hash: hash, Email: email, Purpose: purpose, ExpiresAt: time.Now().Add(ttl).UTC()}
+	if err := s.Store.SaveToken(t); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// VerifyEmail marks the account a verification token was issued to as
+// verified.
+func (s *GameState) VerifyEmail(token string) (string, error) {
+	email, err := s.Store.UseToken(hashToken(token), VerifyEmailToken, time.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+
+	s.do(func() {
+		p, ok := s.Players[email]
+		if !ok {
+			err = ErrInvalidToken
+			return
+		}
+		p.Verified = true
+		err = s.Store.SavePlayer(p)
+	})
+	return email, err
+}
+
+// ResetPassword sets a new password on the account a reset token was issued
+// to. Resetting a password also proves ownership of the email address.
+func (s *GameState) ResetPassword(token, password string) (string, error) {
+	// check the password before using up the token so a typo doesn't cost the
+	// player their reset email
+	hash := hashToken(token)
+	email, err := s.Store.PeekToken(hash, ResetPasswordToken, time.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+	if err := checkPasswordStrength(password, email); err != nil {
+		return "", err
+	}
+	passHash, err := bcrypt.GenerateFromPassword([]byte(password), hashCost)
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.Store.UseToken(hash, ResetPasswordToken, time.Now().UTC()); err != nil {
+		return "", err
+	}
+
+	s.do(func() {
+		p, ok := s.Players[email]
+		if !ok {
+			err = ErrInvalidToken
+			return
+		}
+		p.PassHash = passHash
+		p.Verified = true
+		err = s.Store.SavePlayer(p)
+	})
+	return email, err
+}
+
+// isVerified reports whether the account has verified its email address.
+func (s *GameState) isVerified(email string) (verified bool) {
+	s.do(func() {
+		p, ok := s.Players[email]
+		verified = ok && p.Verified
+	})
+	return verified
+}
+
+// isAdmin reports whether the player with the given email is an admin.
+func (s *GameState) isAdmin(email string) (admin bool) {
+	s.do(func() {
+		p, ok := s.Players[email]
+		admin = ok && p.Admin
+	})
+	return admin
+}
+
+// SetAdmins makes the accounts with the given emails admins, and nobody else,
+// including accounts registered later.
+func (s *GameState) SetAdmins(emails []string) {
+	s.do(func() { s.setAdmins(emails) })
+}
+
+// setAdmins is SetAdmins on the game loop. Anybody who isn't an admin is
+// taken off the channels only admins may be on, including whoever stopped
+// being one while the server was down.
+func (s *GameState) setAdmins(emails []string) {
+	s.admins = make(map[string]bool)
+	for _, email := range emails {
+		s.admins[normalizeEmail(email)] = true
+	}
+	for _, p := range s.Players {
+		p.Admin = s.admins[p.Email]
+		if p.Admin {
+			continue
+		}
+		for _, c := range p.Characters {
+			left := false
+			for _, ch := range s.Channels.Channels() {
+				if _, joined := c.Channels[ch.Name]; joined && ch.AdminOnly {
+					delete(c.Channels, ch.Name)
+					left = true
+				}
+			}
+			if left {
+				s.saveCharacter(c)
+			}
+		}
+	}
+}
+
+type registerForm struct {
+	Email    string `form:"email" binding:"required,email"`
+	Password string `form:"password" binding:"required"`
+}
+
+type resetForm struct {
+	Token    string `form:"token" binding:"required"`
+	Password string `form:"password" binding:"required"`
+}
+
+// registerAccountRoutes adds the HTTP endpoints for managing accounts. Links
+// in the emails sent by mailer point at publicURL, or at clientURL for those
+// that need the web client.
+//
+// Whether an email address has an account is never given away, so the
+// endpoints that send email always claim success. Those endpoints are rate
+// limited, both by client and by the address being sent to; mail over the
+// limit is silently dropped.
+func registerAccountRoutes(r *gin.Engine, s *GameState, sessions *SessionManager, mailer Mailer, publicURL, clientURL string) {
+	perAddress := newRateLimiter(mailsPerAddress, mailRateWindow)
+	perClient := newRateLimiter(mailsPerClient, mailRateWindow)
+	limited := func(c *gin.Context) {
+		if !perClient.Allow(c.ClientIP()) {
+			c.AbortWithStatusJSON(429, struct{ Error string }{"Too many requests; please try again later"})
+			return
+		}
+		c.Next()
+	}
+	send := func(email, subject, body string) {
+		if !perAddress.Allow(email) {
+			log.Printf("Not sending %q to %s, who has been sent too much already\n", subject, email)
+			return
+		}
+		if err := mailer.Send(email, subject, body); err != nil {
+			log.Printf("Got an error when sending %q to %s: %s\n", subject, email, err)
+		}
+	}
+	sendVerification := func(email string) {
+		token, err := s.IssueToken(email, VerifyEmailToken, verifyEmailTTL)
+		if err != nil {
+			log.Println("Got an error when issuing verification token", err)
+			return
+		}
+		link := fmt.Sprintf("%s/verify?token=%s", publicURL, url.QueryEscape(token))
+		send(email, "Welcome to muhmud",
+			fmt.Sprintf("Follow this link within %s to verify your email address:\n\n%s", verifyEmailTTL, link))
+	}
+
+	r.POST("/register", limited, func(c *gin.Context) {
+		var form registerForm
+		if err := c.ShouldBindWith(&form, binding.Form); err != nil {
+			c.JSON(400, struct{ Error string }{"A valid email and password are required"})
+			return
+		}
+		p, err := s.RegisterPlayer(form.Email, form.Password)
+		switch err {
+		case nil:
+			sendVerification(p.Email)
+		case ErrAccountExists:
+			send(normalizeEmail(form.Email), "Your muhmud account",
+				fmt.Sprintf("Someone tried to create a muhmud account with this email address, but you already have one. If it was you, log in at %s, where you can also reset your password if you've forgotten it.\n\nOtherwise you can ignore this email.", clientURL))
+		default:
+			c.JSON(400, struct{ Error string }{err.Error()})
+			return
+		}
+		// the same either way, so this can't be used to discover accounts
+		c.JSON(202, nil)
+	})
+
+	verify := func(c *gin.Context) {
+		token := c.Query("token")
+		if token == "" {
+			token = c.PostForm("token")
+		}
+		email, err := s.VerifyEmail(token)
+		if err != nil {
+			c.JSON(400, struct{ Error string }{err.Error()})
+			return
+		}
+		c.JSON(200, struct{ Email string }{email})
+	}
+	r.GET("/verify", verify)
+	r.POST("/verify", verify)
+
+	r.POST("/verify/resend", limited, func(c *gin.Context) {
+		email := normalizeEmail(c.PostForm("email"))
+		if s.hasPlayer(email) && !s.isVerified(email) {
+			sendVerification(email)
+		}
+		// always claim success so this can't be used to discover accounts
+		c.JSON(202, nil)
+	})
+
+	r.POST("/password/forgot", limited, func(c *gin.Context) {
+		email := normalizeEmail(c.PostForm("email"))
+		if s.hasPlayer(email) {
+			token, err := s.IssueToken(email, ResetPasswordToken, resetPasswordTTL)
+			if err != nil {
+				log.Println("Got an error when issuing password reset token", err)
+			} else {
+				// the web client asks for the new password and posts it back
+				link := fmt.Sprintf("%s/password/reset?token=%s", clientURL, url.QueryEscape(token))
+				send(email, "Resetting your muhmud password",
+					fmt.Sprintf("Someone asked to reset your password. If it was you, follow this link within %s:\n\n%s\n\nOtherwise you can ignore this email.", resetPasswordTTL, link))
+			}
+		}
+		// always claim success so this can't be used to discover accounts
+		c.JSON(202, nil)
+	})
+
+	r.POST("/password/reset", func(c *gin.Context) {
+		var form resetForm
+		if err := c.ShouldBindWith(&form, binding.Form); err != nil {
+			c.JSON(400, struct{ Error string }{"A token and new password are required"})
+			return
+		}
+		email, err := s.ResetPassword(form.Token, form.Password)
+		if err != nil {
+			c.JSON(400, struct{ Error string }{err.Error()})
+			return
+		}
+		// whoever knew the old password shouldn't stay logged in
+		if err := sessions.LogoutEverywhere(email); err != nil {
+			log.Println("Got an error when ending sessions after password reset", err)
+		}
+		c.JSON(200, struct{ Email string }{email})
+	})
+}
+
+// hasPlayer reports whether an account exists for email.
+func (s *GameState) hasPlayer(email string) (ok bool) {
+	s.do(func() { _, ok = s.Players[email] })
+	return ok
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recordingMailer keeps every email it's asked to send.
+type recordingMailer struct {
+	sent []string
+	mux  sync.Mutex
+}
+
+func (m *recordingMailer) Send(to, subject, body string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.sent = append(m.sent, to+": "+subject+"\n"+body)
+	return nil
+}
+
+// take returns the emails sent since last time.
+func (m *recordingMailer) take() []string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	sent := m.sent
+	m.sent = nil
+	return sent
+}
+
+// newAccountServer serves the account routes of a new game.
+func newAccountServer(t *testing.T) (*gin.Engine, *recordingMailer) {
+	gin.SetMode(gin.TestMode)
+	s := newTestGame(t)
+	sessions := NewSessionManager(s, []byte("secret"), time.Minute, time.Hour)
+	mailer := &recordingMailer{}
+	r := gin.New()
+	registerAccountRoutes(r, s, sessions, mailer, "http://server", "http://client")
+	return r, mailer
+}
+
+// post posts form to path on r, returning the status code.
+func post(r *gin.Engine, path string, form url.Values) int {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestRegisterDoesntGiveAwayAccounts(t *testing.T) {
+	r, mailer := newAccountServer(t)
+	form := url.Values{"email": {"New@example.com"}, "password": {"Secret123"}}
+
+	if code := post(r, "/register", form); code != 202 {
+		t.Errorf("registering got %d", code)
+	}
+	if sent := mailer.take(); len(sent) != 1 || !strings.Contains(sent[0], "http://server/verify?token=") {
+		t.Errorf("sent %q rather than a verification email", sent)
+	}
+
+	if code := post(r, "/register", form); code != 202 {
+		t.Errorf("registering again got %d", code)
+	}
+	if sent := mailer.take(); len(sent) != 1 || !strings.Contains(sent[0], "you already have one") {
+		t.Errorf("sent %q rather than telling them they have an account", sent)
+	}
+
+	form.Set("password", "weak")
+	if code := post(r, "/register", form); code != 400 {
+		t.Errorf("registering with a weak password got %d", code)
+	}
+}
+
+func TestPasswordResetLinksToClient(t *testing.T) {
+	r, mailer := newAccountServer(t)
+	post(r, "/register", url.Values{"email": {"a@example.com"}, "password": {"Secret123"}})
+	mailer.take()
+
+	if code := post(r, "/password/forgot", url.Values{"email": {"a@example.com"}}); code != 202 {
+		t.Errorf("forgetting got %d", code)
+	}
+	sent := mailer.take()
+	if len(sent) != 1 {
+		t.Fatalf("sent %q", sent)
+	}
+	i := strings.Index(sent[0], "http://client/password/reset?token=")
+	if i < 0 {
+		t.Fatalf("no link to the client in %q", sent[0])
+	}
+	link, err := url.Parse(strings.Fields(sent[0][i:])[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"token": {link.Query().Get("token")}, "password": {"Secret456"}}
+	if code := post(r, "/password/reset", form); code != 200 {
+		t.Errorf("resetting got %d", code)
+	}
+	if code := post(r, "/password/reset", form); code != 400 {
+		t.Errorf("resetting with a used token got %d", code)
+	}
+}
+
+func TestMailIsRateLimited(t *testing.T) {
+	r, mailer := newAccountServer(t)
+	post(r, "/register", url.Values{"email": {"a@example.com"}, "password": {"Secret123"}})
+	for i := 1; i < mailsPerClient; i++ {
+		if code := post(r, "/verify/resend", url.Values{"email": {"a@example.com"}}); code != 202 {
+			t.Errorf("resending got %d", code)
+		}
+	}
+	if sent := mailer.take(); len(sent) != mailsPerAddress {
+		t.Errorf("sent %d emails to the same address, want %d", len(sent), mailsPerAddress)
+	}
+	if code := post(r, "/password/forgot", url.Values{"email": {"b@example.com"}}); code != 429 {
+		t.Errorf("going over the limit got %d", code)
+	}
+}
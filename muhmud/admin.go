@@ -0,0 +1,29 @@
+// Contains the commands only admins may use. Their handlers live with what they
+// act on: cmdReload in reload.go, cmdCopyover in copyover.go and cmdSessions in
+// multisession.go.
+package main
+
+// registerAdminCommands adds the commands only admins may use.
+func registerAdminCommands(r *CommandRegistry) {
+	r.Register(&Command{
+		Name:      "reload",
+		MinAbbrev: 6,
+		Help:      "Reload the configuration and the world.",
+		Admin:     true,
+		Handler:   cmdReload,
+	})
+	r.Register(&Command{
+		Name:      "copyover",
+		MinAbbrev: 8,
+		Help:      "Restart the server, e.g. on a new binary, without disconnecting anybody.",
+		Admin:     true,
+		Handler:   cmdCopyover,
+	})
+	r.Register(&Command{
+		Name:    "sessions",
+		Usage:   "[<email>|<character>]",
+		Help:    "List the connections of every account, or of one.",
+		Admin:   true,
+		Handler: cmdSessions,
+	})
+}
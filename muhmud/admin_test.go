@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAdminCommandsNeedAnAdmin(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	alice, out := enterGame(t, s, "a@example.com", "Alice")
+
+	r := NewCommandRegistry()
+	registerAdminCommands(r)
+	for _, cmd := range r.Commands() {
+		if got, ok := s.Commands.Lookup(cmd.Name); !ok || got.Name != cmd.Name || !got.Admin {
+			t.Errorf("%s isn't registered with the game as an admin command", cmd.Name)
+		}
+		s.HandleCommand(alice, "", cmd.Name)
+		if got := received(out); got != "Only admins can do that." {
+			t.Errorf("%s by a player who isn't an admin: %q", cmd.Name, got)
+		}
+	}
+}
+
+func TestHelpHidesAdminCommands(t *testing.T) {
+	s := newTestGame(t, "a@example.com", "b@example.com")
+	s.SetAdmins([]string{"b@example.com"})
+	alice, aliceOut := enterGame(t, s, "a@example.com", "Alice")
+	bob, bobOut := enterGame(t, s, "b@example.com", "Bob")
+
+	s.HandleCommand(alice, "", "help")
+	if got := received(aliceOut); !strings.Contains(got, "look") || strings.Contains(got, "copyover") {
+		t.Errorf("help for a player who isn't an admin got:\n%s", got)
+	}
+	s.HandleCommand(alice, "", "help copyover")
+	if got := received(aliceOut); got != "There is no command called 'copyover'." {
+		t.Errorf("help copyover for a player who isn't an admin got %q", got)
+	}
+
+	s.HandleCommand(bob, "", "help")
+	if got := received(bobOut); !strings.Contains(got, "copyover - Restart the server") {
+		t.Errorf("help for an admin got:\n%s", got)
+	}
+	s.HandleCommand(bob, "", "help copyover")
+	if got := received(bobOut); !strings.HasPrefix(got, "Usage: copyover\n") {
+		t.Errorf("help copyover for an admin got %q", got)
+	}
+}
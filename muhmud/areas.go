@@ -0,0 +1,662 @@
+// Contains the loader for area files: the YAML files under world/ describing
+// the rooms, items, NPCs and resets the world is made of.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// areaFile is the layout of an area file. Everything is numbered by vnum,
+// which must be unique across every area of the world.
+type areaFile struct {
+	// Area is the name of the area.
+	Area string `yaml:"area"`
+	// Start is the room new characters appear in. Exactly one area of the
+	// world must set it.
+	Start  RoomID      `yaml:"start"`
+	Rooms  []areaRoom  `yaml:"rooms"`
+	Items  []areaItem  `yaml:"items"`
+	NPCs   []areaNPC   `yaml:"npcs"`
+	Resets []areaReset `yaml:"resets"`
+}
+
+type areaRoom struct {
+	Vnum        RoomID     `yaml:"vnum"`
+	Name        string     `yaml:"name"`
+	Description string     `yaml:"description"`
+	Exits       []areaExit `yaml:"exits"`
+	// Items are the items lying in the room when the game starts.
+	Items []areaPlacement `yaml:"items"`
+}
+
+// areaExit is an exit in a direction, or a named exit such as a portal. Exits
+// only lead one way; a door in an exit is shared with the exit leading back,
+// which must have a door as well.
+type areaExit struct {
+	Dir  string    `yaml:"dir"`
+	Name string    `yaml:"name"`
+	To   RoomID    `yaml:"to"`
+	Door *areaDoor `yaml:"door"`
+}
+
+type areaDoor struct {
+	Name     string   `yaml:"name"`
+	Keywords []string `yaml:"keywords"`
+	// State is "open", "closed" or "locked"; doors start out closed.
+	State string `yaml:"state"`
+	// Key is the vnum of the item that locks and unlocks the door. Doors
+	// without one have no lock, so they can't be locked.
+	Key ItemPrototypeID `yaml:"key"`
+}
+
+// areaPlacement puts an item in a room, or in the first item of prototype In
+// placed in the room before it.
+type areaPlacement struct {
+	Item ItemPrototypeID `yaml:"item"`
+	In   ItemPrototypeID `yaml:"in"`
+}
+
+type areaItem struct {
+	Vnum        ItemPrototypeID `yaml:"vnum"`
+	Keywords    []string        `yaml:"keywords"`
+	Short       string          `yaml:"short"`
+	Long        string          `yaml:"long"`
+	Description string          `yaml:"description"`
+	Weight      int             `yaml:"weight"`
+	Value       int             `yaml:"value"`
+	Flags       []string        `yaml:"flags"`
+	Slot        string          `yaml:"slot"`
+	Capacity    int             `yaml:"capacity"`
+	Damage      string          `yaml:"damage"`
+}
+
+type areaNPC struct {
+	Vnum         NPCPrototypeID `yaml:"vnum"`
+	Keywords     []string       `yaml:"keywords"`
+	Short        string         `yaml:"short"`
+	Long         string         `yaml:"long"`
+	Description  string         `yaml:"description"`
+	Level        int            `yaml:"level"`
+	Strength     int            `yaml:"strength"`
+	Dexterity    int            `yaml:"dexterity"`
+	Constitution int            `yaml:"constitution"`
+	Intelligence int            `yaml:"intelligence"`
+	Wisdom       int            `yaml:"wisdom"`
+	HP           int            `yaml:"hp"`
+	Mana         int            `yaml:"mana"`
+	Move         int            `yaml:"move"`
+	Gold         int            `yaml:"gold"`
+	Damage       string         `yaml:"damage"`
+	Flags        []string       `yaml:"flags"`
+}
+
+type areaReset struct {
+	NPC   NPCPrototypeID    `yaml:"npc"`
+	Room  RoomID            `yaml:"room"`
+	Max   int               `yaml:"max"`
+	Equip []ItemPrototypeID `yaml:"equip"`
+	Give  []ItemPrototypeID `yaml:"give"`
+}
+
+// WorldError is a problem found in an area file.
+type WorldError struct {
+	File string
+	// Line is the line the problem is on, or zero if it isn't on any line in
+	// particular.
+	Line int
+	Msg  string
+}
+
+func (e WorldError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// WorldErrors are all the problems found while loading a world.
+type WorldErrors []WorldError
+
+func (es WorldErrors) Error() string {
+	lines := make([]string, len(es))
+	for i, e := range es {
+		lines[i] = e.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// area is an area file being loaded.
+type area struct {
+	file  string
+	lines map[string]int
+	areaFile
+}
+
+// where returns "file:line" for the value at path, e.g. "rooms[2].exits[0]".
+func (a *area) where(path string) string {
+	if line := a.line(path); line > 0 {
+		return fmt.Sprintf("%s:%d", a.file, line)
+	}
+	return a.file
+}
+
+// line returns the line the value at path is on, or the closest enclosing
+// value that could be found.
+func (a *area) line(path string) int {
+	for path != "" {
+		if line, ok := a.lines[path]; ok {
+			return line
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 0
+}
+
+// definition is where something was defined in an area.
+type definition struct {
+	a    *area
+	path string
+}
+
+func (d definition) String() string {
+	return d.a.where(d.path)
+}
+
+// doorSide is an exit with a door, waiting to be paired with the exit leading
+// back.
+type doorSide struct {
+	a    *area
+	path string
+	room *Room
+	exit *Exit
+}
+
+// worldLoader builds a world out of areas, collecting every problem with them
+// rather than stopping at the first.
+type worldLoader struct {
+	w      *World
+	errs   WorldErrors
+	starts []string
+	// where each vnum was defined, for reporting duplicates
+	rooms map[RoomID]definition
+	items map[ItemPrototypeID]definition
+	npcs  map[NPCPrototypeID]definition
+	doors []doorSide
+}
+
+func (l *worldLoader) errorf(a *area, path, format string, args ...interface{}) {
+	l.errs = append(l.errs, WorldError{File: a.file, Line: a.line(path), Msg: fmt.Sprintf(format, args...)})
+}
+
+// LoadWorld loads the world from the area files, ending in .yaml, in dir. If
+// anything in them is wrong or doesn't fit together the error is WorldErrors,
+// listing every problem found with the file and line it's on.
+func LoadWorld(dir string) (*World, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no area files in %s", dir)
+	}
+	sort.Strings(files)
+	l := &worldLoader{
+		w:     NewWorld(),
+		rooms: make(map[RoomID]definition),
+		items: make(map[ItemPrototypeID]definition),
+		npcs:  make(map[NPCPrototypeID]definition),
+	}
+	var areas []*area
+	for _, file := range files {
+		if a := l.read(file); a != nil {
+			areas = append(areas, a)
+		}
+	}
+	// everything has to be defined before anything can refer to it
+	for _, a := range areas {
+		l.define(a)
+	}
+	for _, a := range areas {
+		l.connect(a)
+	}
+	l.pairDoors()
+	for _, a := range areas {
+		l.populate(a)
+	}
+	switch len(l.starts) {
+	case 0:
+		if len(areas) < len(files) {
+			// it may be in one that couldn't be read
+			break
+		}
+		l.errs = append(l.errs, WorldError{File: dir, Msg: "no area sets the start room"})
+	case 1:
+	default:
+		l.errs = append(l.errs, WorldError{File: dir, Msg: "more than one area sets the start room: " + strings.Join(l.starts, ", ")})
+	}
+	if len(l.errs) > 0 {
+		sort.SliceStable(l.errs, func(i, j int) bool {
+			a, b := l.errs[i], l.errs[j]
+			return a.File < b.File || a.File == b.File && a.Line < b.Line
+		})
+		return nil, l.errs
+	}
+	return l.w, nil
+}
+
+// yamlErrorLine matches the line number yaml.v2 puts in its errors.
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// read parses an area file, returning nil if it couldn't be.
+func (l *worldLoader) read(file string) *area {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		l.errs = append(l.errs, WorldError{File: file, Msg: err.Error()})
+		return nil
+	}
+	a := &area{file: file, lines: yamlLines(bs)}
+	err = yaml.UnmarshalStrict(bs, &a.areaFile)
+	if err == nil {
+		return a
+	}
+	msgs := []string{err.Error()}
+	if te, ok := err.(*yaml.TypeError); ok {
+		msgs = te.Errors
+	}
+	for _, msg := range msgs {
+		e := WorldError{File: file, Msg: strings.TrimPrefix(msg, "yaml: ")}
+		if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			e.Msg = m[2]
+		}
+		l.errs = append(l.errs, e)
+	}
+	return nil
+}
+
+// define adds the rooms and prototypes of an area to the world.
+func (l *worldLoader) define(a *area) {
+	if a.Start != 0 {
+		l.starts = append(l.starts, a.where("start"))
+		l.w.Start = a.Start
+	}
+	for i, r := range a.Rooms {
+		path := fmt.Sprintf("rooms[%d]", i)
+		prev, dup := l.rooms[r.Vnum]
+		switch {
+		case r.Vnum <= 0:
+			l.errorf(a, path, "room needs a positive vnum")
+		case dup:
+			l.errorf(a, path, "room %d is already defined at %s", r.Vnum, prev)
+		case r.Name == "":
+			l.errorf(a, path, "room %d needs a name", r.Vnum)
+		default:
+			l.rooms[r.Vnum] = definition{a, path}
+			l.w.Rooms[r.Vnum] = &Room{ID: r.Vnum, Name: r.Name, Description: strings.TrimSpace(r.Description)}
+		}
+	}
+	for i, it := range a.Items {
+		path := fmt.Sprintf("items[%d]", i)
+		prev, dup := l.items[it.Vnum]
+		switch {
+		case it.Vnum <= 0:
+			l.errorf(a, path, "item needs a positive vnum")
+		case dup:
+			l.errorf(a, path, "item %d is already defined at %s", it.Vnum, prev)
+		default:
+			l.items[it.Vnum] = definition{a, path}
+			if p := l.itemPrototype(a, path, it); p != nil {
+				l.w.Prototypes[p.ID] = p
+			}
+		}
+	}
+	for i, n := range a.NPCs {
+		path := fmt.Sprintf("npcs[%d]", i)
+		prev, dup := l.npcs[n.Vnum]
+		switch {
+		case n.Vnum <= 0:
+			l.errorf(a, path, "NPC needs a positive vnum")
+		case dup:
+			l.errorf(a, path, "NPC %d is already defined at %s", n.Vnum, prev)
+		default:
+			l.npcs[n.Vnum] = definition{a, path}
+			if p := l.npcPrototype(a, path, n); p != nil {
+				l.w.NPCPrototypes[p.ID] = p
+			}
+		}
+	}
+}
+
+func (l *worldLoader) itemPrototype(a *area, path string, it areaItem) *ItemPrototype {
+	p := &ItemPrototype{
+		ID:          it.Vnum,
+		Keywords:    it.Keywords,
+		Short:       it.Short,
+		Long:        it.Long,
+		Description: strings.TrimSpace(it.Description),
+		Weight:      it.Weight,
+		Value:       it.Value,
+		Capacity:    it.Capacity,
+	}
+	ok := true
+	if len(it.Keywords) == 0 || it.Short == "" || it.Long == "" {
+		l.errorf(a, path, "item %d needs keywords, short and long", it.Vnum)
+		ok = false
+	}
+	for j, name := range it.Flags {
+		f, known := itemFlagNames[strings.ToLower(name)]
+		if !known {
+			l.errorf(a, fmt.Sprintf("%s.flags[%d]", path, j), "unknown item flag %q", name)
+			ok = false
+		}
+		p.Flags |= f
+	}
+	if it.Slot != "" {
+		if err := p.Slot.UnmarshalText([]byte(it.Slot)); err != nil {
+			l.errorf(a, path+".slot", "%s", err)
+			ok = false
+		}
+	}
+	if it.Damage != "" {
+		var err error
+		if p.Damage, err = ParseDice(it.Damage); err != nil {
+			l.errorf(a, path+".damage", "%s", err)
+			ok = false
+		}
+	}
+	if !ok {
+		return nil
+	}
+	return p
+}
+
+func (l *worldLoader) npcPrototype(a *area, path string, n areaNPC) *NPCPrototype {
+	p := &NPCPrototype{
+		ID:          n.Vnum,
+		Keywords:    n.Keywords,
+		Short:       n.Short,
+		Long:        n.Long,
+		Description: strings.TrimSpace(n.Description),
+		Stats: Stats{
+			Level: n.Level, Strength: n.Strength, Dexterity: n.Dexterity, Constitution: n.Constitution,
+			Intelligence: n.Intelligence, Wisdom: n.Wisdom, MaxHP: n.HP, MaxMana: n.Mana, MaxMove: n.Move, Gold: n.Gold,
+		},
+	}
+	ok := true
+	if len(n.Keywords) == 0 || n.Short == "" || n.Long == "" {
+		l.errorf(a, path, "NPC %d needs keywords, short and long", n.Vnum)
+		ok = false
+	}
+	if n.HP <= 0 {
+		l.errorf(a, path, "NPC %d needs positive hp", n.Vnum)
+		ok = false
+	}
+	for j, name := range n.Flags {
+		f, known := npcFlagNames[strings.ToLower(name)]
+		if !known {
+			l.errorf(a, fmt.Sprintf("%s.flags[%d]", path, j), "unknown NPC flag %q", name)
+			ok = false
+		}
+		p.Flags |= f
+	}
+	if n.Damage != "" {
+		var err error
+		if p.Damage, err = ParseDice(n.Damage); err != nil {
+			l.errorf(a, path+".damage", "%s", err)
+			ok = false
+		}
+	}
+	if !ok {
+		return nil
+	}
+	return p
+}
+
+// connect adds the exits of an area's rooms.
+func (l *worldLoader) connect(a *area) {
+	for i, r := range a.Rooms {
+		room, ok := l.w.Rooms[r.Vnum]
+		if !ok || l.rooms[r.Vnum] != (definition{a, fmt.Sprintf("rooms[%d]", i)}) {
+			// broken or a duplicate, which has already been reported
+			continue
+		}
+		for j, e := range r.Exits {
+			path := fmt.Sprintf("rooms[%d].exits[%d]", i, j)
+			exit := &Exit{Direction: NoDirection, Name: e.Name, To: e.To}
+			switch {
+			case (e.Dir == "") == (e.Name == ""):
+				l.errorf(a, path, "exit needs either a dir or a name")
+				continue
+			case e.Dir != "":
+				d, ok := ParseDirection(e.Dir)
+				if !ok || d.String() != strings.ToLower(e.Dir) {
+					l.errorf(a, path+".dir", "unknown direction %q", e.Dir)
+					continue
+				}
+				if room.Exit(d) != nil {
+					l.errorf(a, path, "room %d already has an exit %s", r.Vnum, d)
+					continue
+				}
+				exit.Direction = d
+			}
+			if _, ok := l.w.Rooms[e.To]; !ok {
+				l.errorf(a, path+".to", "exit %s of room %d leads to unknown room %d", exit.Label(), r.Vnum, e.To)
+				continue
+			}
+			if e.Door != nil {
+				door := &Door{Name: e.Door.Name, Keywords: e.Door.Keywords, State: DoorClosed, Key: e.Door.Key}
+				if door.Name == "" {
+					l.errorf(a, path+".door", "door needs a name")
+					continue
+				}
+				if _, ok := l.w.Prototypes[door.Key]; door.Key != 0 && !ok {
+					l.errorf(a, path+".door.key", "door %s of room %d has unknown item %d as its key", exit.Label(), r.Vnum, door.Key)
+					continue
+				}
+				if len(door.Keywords) == 0 {
+					door.Keywords = strings.Fields(door.Name)
+				}
+				if e.Door.State != "" {
+					state, ok := parseDoorState(e.Door.State)
+					if !ok {
+						l.errorf(a, path+".door.state", "unknown door state %q", e.Door.State)
+						continue
+					}
+					door.State = state
+				}
+				if door.State == DoorLocked && door.Key == 0 {
+					l.errorf(a, path+".door", "door %s of room %d is locked but has no key", exit.Label(), r.Vnum)
+					continue
+				}
+				exit.Door = door
+				l.doors = append(l.doors, doorSide{a: a, path: path, room: room, exit: exit})
+			}
+			room.Exits = append(room.Exits, exit)
+		}
+	}
+}
+
+// pairDoors makes the doors on both sides of a pair of exits the same door, so
+// that opening it from one side opens it from the other.
+func (l *worldLoader) pairDoors() {
+	paired := make(map[*Exit]bool)
+	for _, side := range l.doors {
+		e := side.exit
+		if paired[e] || e.Direction == NoDirection {
+			continue
+		}
+		var back *Exit
+		for _, other := range l.w.Rooms[e.To].Exits {
+			if other.Direction == e.Direction.Opposite() && other.To == side.room.ID {
+				back = other
+			}
+		}
+		switch {
+		case back == nil:
+			// a one way exit, so there's only the one side
+		case back.Door == nil:
+			l.errorf(side.a, side.path+".door", "door %s of room %d has no door on the way back from room %d", e.Label(), side.room.ID, e.To)
+		case back.Door.State != e.Door.State:
+			l.errorf(side.a, side.path+".door", "door %s of room %d is %s, but on the way back from room %d it's %s", e.Label(), side.room.ID, e.Door.State, e.To, back.Door.State)
+		case back.Door.Key != e.Door.Key:
+			l.errorf(side.a, side.path+".door.key", "door %s of room %d has key %d, but on the way back from room %d it has %d", e.Label(), side.room.ID, e.Door.Key, e.To, back.Door.Key)
+		default:
+			back.Door = e.Door
+			paired[back] = true
+		}
+	}
+}
+
+// populate places an area's items and adds its resets.
+func (l *worldLoader) populate(a *area) {
+	for i, r := range a.Rooms {
+		if l.rooms[r.Vnum] != (definition{a, fmt.Sprintf("rooms[%d]", i)}) {
+			continue
+		}
+		for j, pl := range r.Items {
+			if err := l.w.Place(r.Vnum, pl.Item, pl.In); err != nil {
+				l.errorf(a, fmt.Sprintf("rooms[%d].items[%d]", i, j), "%s", err)
+			}
+		}
+	}
+	for i, r := range a.Resets {
+		path := fmt.Sprintf("resets[%d]", i)
+		if r.Max < 1 {
+			l.errorf(a, path, "reset needs a max of at least 1")
+			continue
+		}
+		reset := &Reset{NPC: r.NPC, Room: r.Room, Max: r.Max, Equip: r.Equip, Give: r.Give}
+		if err := l.w.AddReset(reset); err != nil {
+			l.errorf(a, path, "%s", err)
+		}
+	}
+	if a.Start != 0 {
+		if _, ok := l.w.Rooms[a.Start]; !ok {
+			l.errorf(a, "start", "start room %d doesn't exist", a.Start)
+		}
+	}
+}
+
+// yamlKey matches a line starting with a key of a mapping, as in "name: foo".
+var yamlKey = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*:(?:\s+(.*))?$`)
+
+// yamlLines maps the paths of the keys and list entries in a YAML document,
+// e.g. "rooms[2].exits[0].to", to the lines they're on. yaml.v2 doesn't say
+// where values came from, so this follows the indentation of block style
+// YAML itself; anything in flow style, like "[a, b]", counts as one value.
+func yamlLines(src []byte) map[string]int {
+	type frame struct {
+		indent int
+		path   string
+		entry  bool
+		// entries counts the list entries under a key so far
+		entries int
+	}
+	lines := make(map[string]int)
+	var stack []*frame
+	// the indent of a key whose block scalar ("|" or ">") is being skipped
+	block := -1
+	// how many brackets of a flow style value spanning lines are still open
+	flow := 0
+	for n, line := range strings.Split(string(src), "\n") {
+		text := strings.TrimLeft(line, " ")
+		indent := len(line) - len(text)
+		text = strings.TrimSpace(text)
+		if flow > 0 {
+			flow += flowDepth(text)
+			continue
+		}
+		if text == "" || strings.HasPrefix(text, "#") || text == "---" {
+			continue
+		}
+		if block >= 0 && indent > block {
+			continue
+		}
+		block = -1
+
+		for text == "-" || strings.HasPrefix(text, "- ") {
+			for len(stack) > 0 {
+				top := stack[len(stack)-1]
+				if top.indent < indent || top.indent == indent && !top.entry {
+					break
+				}
+				stack = stack[:len(stack)-1]
+			}
+			parent, index := "", 0
+			if len(stack) > 0 {
+				top := stack[len(stack)-1]
+				parent, index = top.path, top.entries
+				top.entries++
+			}
+			path := fmt.Sprintf("%s[%d]", parent, index)
+			lines[path] = n + 1
+			stack = append(stack, &frame{indent: indent, path: path, entry: true})
+			rest := strings.TrimLeft(text[1:], " ")
+			indent += len(text) - len(rest)
+			text = rest
+		}
+
+		m := yamlKey.FindStringSubmatch(text)
+		if m == nil {
+			flow = openFlow(text)
+			continue
+		}
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		path := m[1]
+		if len(stack) > 0 {
+			path = stack[len(stack)-1].path + "." + path
+		}
+		lines[path] = n + 1
+		stack = append(stack, &frame{indent: indent, path: path})
+		if strings.HasPrefix(m[2], "|") || strings.HasPrefix(m[2], ">") {
+			block = indent
+		}
+		flow = openFlow(m[2])
+	}
+	return lines
+}
+
+// openFlow returns how many brackets are left open at the end of value if it's
+// in flow style.
+func openFlow(value string) int {
+	if !strings.HasPrefix(value, "{") && !strings.HasPrefix(value, "[") {
+		return 0
+	}
+	return flowDepth(value)
+}
+
+// flowDepth returns how many more brackets s opens than it closes, ignoring any
+// in quotes.
+func flowDepth(s string) int {
+	depth := 0
+	var quote rune
+	for _, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return depth
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestYamlLines(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want map[string]int
+	}{
+		{
+			name: "mapping",
+			src: `# a comment
+---
+area: Town
+
+start: 1
+`,
+			want: map[string]int{"area": 3, "start": 5},
+		},
+		{
+			name: "nested lists",
+			src: `rooms:
+  - vnum: 1
+    exits:
+      - dir: north
+        to: 2
+      - dir: east
+        to: 3
+  - vnum: 2
+    exits:
+    - dir: south
+      to: 1
+resets:
+- npc: 1
+  room: 2
+`,
+			want: map[string]int{
+				"rooms":    1,
+				"rooms[0]": 2, "rooms[0].vnum": 2, "rooms[0].exits": 3,
+				"rooms[0].exits[0]": 4, "rooms[0].exits[0].dir": 4, "rooms[0].exits[0].to": 5,
+				"rooms[0].exits[1]": 6, "rooms[0].exits[1].dir": 6, "rooms[0].exits[1].to": 7,
+				"rooms[1]": 8, "rooms[1].vnum": 8, "rooms[1].exits": 9,
+				"rooms[1].exits[0]": 10, "rooms[1].exits[0].dir": 10, "rooms[1].exits[0].to": 11,
+				"resets":    12,
+				"resets[0]": 13, "resets[0].npc": 13, "resets[0].room": 14,
+			},
+		},
+		{
+			name: "lists of lists and scalars",
+			src: `grid:
+  - - a
+    - b
+  - - c
+keywords:
+  - sword
+  -
+    long
+`,
+			want: map[string]int{
+				"grid":    1,
+				"grid[0]": 2, "grid[0][0]": 2, "grid[0][1]": 3,
+				"grid[1]": 4, "grid[1][0]": 4,
+				"keywords":    5,
+				"keywords[0]": 6, "keywords[1]": 7,
+			},
+		},
+		{
+			name: "block scalars",
+			src: `rooms:
+  - name: Square
+    description: >
+      A square.
+
+      exits: none, the text says
+    extra: |-
+      - not a list entry
+    exits:
+      - to: 2
+description: |
+  name: not a key
+after: 1
+`,
+			want: map[string]int{
+				"rooms":    1,
+				"rooms[0]": 2, "rooms[0].name": 2, "rooms[0].description": 3,
+				"rooms[0].extra": 7, "rooms[0].exits": 9,
+				"rooms[0].exits[0]": 10, "rooms[0].exits[0].to": 10,
+				"description": 11, "after": 13,
+			},
+		},
+		{
+			name: "flow style",
+			src: `exits:
+  - dir: east
+    door: {name: door, keywords: [door, gate], state: closed}
+  - dir: west
+keywords: [sword, long]
+stats: {hp: 10,
+  mana: 5}
+gate: {name: "} quoted [",
+  state: closed}
+after: 1
+`,
+			want: map[string]int{
+				"exits":    1,
+				"exits[0]": 2, "exits[0].dir": 2, "exits[0].door": 3,
+				"exits[1]": 4, "exits[1].dir": 4,
+				"keywords": 5, "stats": 6, "gate": 8, "after": 10,
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := yamlLines([]byte(test.src)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: yamlLines() =\n%v\nwant\n%v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLoadWorldChecksDoorKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "muhmud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	area := `area: Keys
+start: 1
+rooms:
+  - vnum: 1
+    name: Hall
+    exits:
+      - dir: north
+        to: 2
+        door: {name: door, state: locked}
+      - dir: east
+        to: 3
+        door: {name: gate, key: 9}
+      - dir: west
+        to: 4
+        door: {name: hatch, key: 1}
+  - vnum: 2
+    name: Vault
+    exits:
+      - dir: south
+        to: 1
+        door: {name: door, state: locked}
+  - vnum: 3
+    name: Garden
+  - vnum: 4
+    name: Cupboard
+    exits:
+      - dir: east
+        to: 1
+        door: {name: hatch}
+items:
+  - vnum: 1
+    keywords: [key]
+    short: a key
+    long: A key lies here.
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "keys.yaml"), []byte(area), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadWorld(dir)
+	errs, ok := err.(WorldErrors)
+	if !ok {
+		t.Fatalf("LoadWorld() = %v, want WorldErrors", err)
+	}
+	var got []string
+	for _, e := range errs {
+		got = append(got, e.Error())
+	}
+	file := filepath.Join(dir, "keys.yaml")
+	want := []string{
+		file + ":9: door north of room 1 is locked but has no key",
+		file + ":12: door east of room 1 has unknown item 9 as its key",
+		file + ":15: door west of room 1 has key 1, but on the way back from room 4 it has 0",
+		file + ":21: door south of room 2 is locked but has no key",
+		file + ":29: door east of room 4 has key 0, but on the way back from room 1 it has 1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadWorld() errors:\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestShippedWorldLoads(t *testing.T) {
+	if _, err := LoadWorld("world"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,253 @@
+// Contains characters and the character select menu.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/diddydum/muhmud/muhmud/markup"
+)
+
+// maxCharacters is the most characters a single account may own.
+const maxCharacters = 5
+
+// Character is someone a player plays as in the game. Everything other players
+// can see about a player comes from the character, never from the account.
+type Character struct {
+	Name string
+	// Account is the email of the player owning the character.
+	Account string
+	// Location is the room the character is standing in.
+	Location RoomID
+	Stats    Stats
+	// Inventory are the items the character is carrying, including the ones
+	// it's wearing.
+	Inventory []*Item
+	// Connections are the connections currently playing the character, of
+	// which there's never more than one; see enterWorld.
+	Connections map[ConnectionID]bool
+	// Channels maps the names of the channels the character has joined to
+	// whether it has muted them.
+	Channels map[string]bool
+	// replyTo is the name of whoever last sent the character a tell.
+	replyTo string
+	// NPC is the prototype the character was spawned from if it's a
+	// non-player character, and reset the reset that spawned it. NPCs have no
+	// account and are never saved.
+	NPC   *NPCPrototype
+	reset *Reset
+	// fighting is who the character is attacking, if anyone.
+	fighting *Character
+	// wait is how many pulses are left before the character may act again,
+	// and queue the commands waiting until then.
+	wait  int
+	queue []queuedCommand
+}
+
+// Stats are the numbers describing what a character is capable of, and how
+// much of its hit points, mana and movement it has left.
+type Stats struct {
+	Level        int
+	Strength     int
+	Dexterity    int
+	Constitution int
+	Intelligence int
+	Wisdom       int
+	HP           int
+	MaxHP        int
+	Mana         int
+	MaxMana      int
+	Move         int
+	MaxMove      int
+	Gold         int
+}
+
+// defaultStats are the stats every new character starts out with.
+var defaultStats = Stats{
+	Level: 1, Strength: 10, Dexterity: 10, Constitution: 10, Intelligence: 10, Wisdom: 10,
+	HP: 20, MaxHP: 20, Mana: 10, MaxMana: 10, Move: 50, MaxMove: 50, Gold: 20,
+}
+
+// fillVitals gives characters saved before they had hit points, mana and
+// movement the ones new characters start out with.
+func (st *Stats) fillVitals() {
+	if st.MaxHP == 0 {
+		st.HP, st.MaxHP = defaultStats.HP, defaultStats.MaxHP
+		st.Mana, st.MaxMana = defaultStats.Mana, defaultStats.MaxMana
+		st.Move, st.MaxMove = defaultStats.Move, defaultStats.MaxMove
+	}
+}
+
+func newCharacter(name, account string, location RoomID) *Character {
+	return &Character{
+		Name:        name,
+		Account:     account,
+		Location:    location,
+		Stats:       defaultStats,
+		Connections: make(map[ConnectionID]bool),
+		Channels:    make(map[string]bool),
+	}
+}
+
+// InWorld reports whether the character is in the world, i.e. whether it's an
+// NPC or anybody is currently playing it.
+func (c *Character) InWorld() bool {
+	return c.NPC != nil || len(c.Connections) > 0
+}
+
+// Keywords are the words the character can be referred to by.
+func (c *Character) Keywords() []string {
+	if c.NPC != nil {
+		return c.NPC.Keywords
+	}
+	return []string{c.Name}
+}
+
+// normalizeCharacterName checks that name is usable as a character name and
+// returns it capitalized the way it will be displayed.
+func normalizeCharacterName(name string) (string, error) {
+	if len(name) < 3 || len(name) > 12 {
+		return "", errors.New("names must be between 3 and 12 letters long")
+	}
+	for _, c := range name {
+		if c > unicode.MaxASCII || !unicode.IsLetter(c) {
+			return "", errors.New("names may only contain the letters a to z")
+		}
+	}
+	return strings.ToUpper(name[:1]) + strings.ToLower(name[1:]), nil
+}
+
+// CreateCharacter creates a new character for a player. It must be called from
+// the game loop.
+func (s *GameState) CreateCharacter(p *Player, name string) (*Character, error) {
+	name, err := normalizeCharacterName(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s.Characters[strings.ToLower(name)]; ok {
+		return nil, fmt.Errorf("the name %s is already taken", name)
+	}
+	if len(p.Characters) >= maxCharacters {
+		return nil, fmt.Errorf("you may not have more than %d characters", maxCharacters)
+	}
+	c := newCharacter(name, p.Email, s.World.Start)
+	for _, ch := range s.Channels.Channels() {
+		if ch.Default {
+			c.Channels[ch.Name] = false
+		}
+	}
+	if err := s.Store.SaveCharacter(c); err != nil {
+		return nil, err
+	}
+	s.Characters[strings.ToLower(name)] = c
+	p.Characters = append(p.Characters, c)
+	return c, nil
+}
+
+// AccountSummary describes an account for its owner.
+type AccountSummary struct {
+	Email      string
+	Characters []string
+}
+
+// AccountSummary returns a summary of the account for email.
+func (s *GameState) AccountSummary(email string) (summary AccountSummary, err error) {
+	s.do(func() {
+		p, ok := s.Players[email]
+		if !ok {
+			err = fmt.Errorf("no account for %s", email)
+			return
+		}
+		summary = AccountSummary{Email: p.Email, Characters: []string{}}
+		for _, c := range p.Characters {
+			summary.Characters = append(summary.Characters, c.Name)
+		}
+	})
+	return summary, err
+}
+
+// findCharacter finds one of the player's own characters by name.
+func findCharacter(p *Player, name string) *Character {
+	for _, c := range p.Characters {
+		if strings.EqualFold(c.Name, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// characterMenu renders the character select menu for a player.
+func characterMenu(p *Player) string {
+	if len(p.Characters) == 0 {
+		return "You don't have any characters yet. Type 'create <name>' to make one."
+	}
+	var names []string
+	for _, c := range p.Characters {
+		names = append(names, c.Name)
+	}
+	return "Your characters: " + strings.Join(names, ", ") + "\n" +
+		"Type 'play <name>' to enter the game or 'create <name>' to make a new character."
+}
+
+// registerSelectCommands adds the commands available at the character select
+// menu.
+func registerSelectCommands(r *CommandRegistry) {
+	r.Register(&Command{
+		Name:    "play",
+		Usage:   "<name>",
+		Help:    "Enter the game as one of your characters.",
+		Handler: cmdPlay,
+	})
+	r.Register(&Command{
+		Name:    "create",
+		Usage:   "<name>",
+		Help:    "Create a new character.",
+		Handler: cmdCreate,
+	})
+	r.Register(&Command{
+		Name:    "characters",
+		Help:    "List your characters.",
+		Handler: func(ctx *CommandContext) { ctx.Respond(characterMenu(ctx.Player)) },
+	})
+	r.Register(&Command{
+		Name:    "help",
+		Usage:   "[command]",
+		Help:    "List the available commands, or describe one of them.",
+		Handler: cmdHelp,
+	})
+	r.Register(&Command{
+		Name:      "quit",
+		MinAbbrev: 4,
+		Help:      "Disconnect from the game.",
+		Handler:   cmdDisconnect,
+	})
+}
+
+func cmdPlay(ctx *CommandContext) {
+	if len(ctx.Args) == 0 {
+		ctx.Respond("Play which character?")
+		return
+	}
+	c := findCharacter(ctx.Player, ctx.Args[0])
+	if c == nil {
+		ctx.Respondf("You don't have a character called %s.", markup.Escape(ctx.Args[0]))
+		return
+	}
+	ctx.State.enterWorld(ctx.Conn, c)
+	ctx.Respondf("You are now playing %s.\n%s", c.Name, ctx.State.describeRoom(c, ctx.State.currentRoom(c)))
+}
+
+func cmdCreate(ctx *CommandContext) {
+	if len(ctx.Args) == 0 {
+		ctx.Respond("What should your character be called?")
+		return
+	}
+	c, err := ctx.State.CreateCharacter(ctx.Player, ctx.Args[0])
+	if err != nil {
+		ctx.Respondf("You can't create that character: %s.", err)
+		return
+	}
+	ctx.Respondf("Created %s. Type 'play %s' to enter the game.", c.Name, c.Name)
+}
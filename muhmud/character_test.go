@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/diddydum/muhmud/muhmud/markup"
+)
+
+func TestNormalizeCharacterName(t *testing.T) {
+	for _, tt := range []struct{ name, want string }{
+		{"alice", "Alice"},
+		{"ALICE", "Alice"},
+		{"bOB", "Bob"},
+		{"Abcdefghijkl", "Abcdefghijkl"},
+	} {
+		if got, err := normalizeCharacterName(tt.name); err != nil || got != tt.want {
+			t.Errorf("normalizeCharacterName(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+	for _, name := range []string{"", "Al", "Abcdefghijklm", "Al1ce", "Al ice", "Ælice", "a@example.com"} {
+		if got, err := normalizeCharacterName(name); err == nil {
+			t.Errorf("normalizeCharacterName(%q) = %q, want an error", name, got)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	s := newTestGame(t, "a@example.com", "b@example.com")
+	alice, out, err := s.ConnectPlayer("a@example.com", "", markup.ANSI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runLines(t, s, alice, out, []struct{ line, want string }{
+		{"characters", "You don't have any characters yet."},
+		{"create", "What should your character be called?"},
+		{"create Al", "You can't create that character: names must be between 3 and 12 letters long."},
+		{"create Al1ce", "You can't create that character: names may only contain the letters a to z."},
+		{"create alice", "Created Alice. Type 'play Alice' to enter the game."},
+		{"create ALICE", "You can't create that character: the name Alice is already taken."},
+		{"characters", "Your characters: Alice\n"},
+	})
+
+	// names are taken across accounts too
+	bob, bobOut, err := s.ConnectPlayer("b@example.com", "", markup.ANSI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runLines(t, s, bob, bobOut, []struct{ line, want string }{
+		{"create Alice", "You can't create that character: the name Alice is already taken."},
+	})
+
+	for _, name := range []string{"Anna", "Amy", "Abby", "Ada"} {
+		s.HandleCommand(alice, "", "create "+name)
+	}
+	runLines(t, s, alice, out, []struct{ line, want string }{
+		{"create Agnes", "You can't create that character: you may not have more than 5 characters."},
+		{"characters", "Your characters: Alice, Anna, Amy, Abby, Ada\n"},
+	})
+	s.do(func() {
+		if len(s.Players["a@example.com"].Characters) != maxCharacters {
+			t.Errorf("Alice's account has %d characters, want %d", len(s.Players["a@example.com"].Characters), maxCharacters)
+		}
+		if c := s.character("Agnes"); c != nil {
+			t.Errorf("created %s past the limit", c.Name)
+		}
+	})
+	// the limit is per account
+	runLines(t, s, bob, bobOut, []struct{ line, want string }{
+		{"create Bob", "Created Bob."},
+	})
+}
+
+func TestPlayAndQuit(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	alice, out, err := s.ConnectPlayer("a@example.com", "", markup.ANSI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runLines(t, s, alice, out, []struct{ line, want string }{
+		{"create Alice", "Created Alice."},
+		{"play", "Play which character?"},
+		{"play Nobody", "You don't have a character called Nobody."},
+		{"play alice", "You are now playing Alice.\nThe Town Square"},
+		// quitting in the game only goes back to the menu
+		{"quit", "You stop playing Alice.\nYour characters: Alice\n"},
+		{"say hello", "Huh?"},
+	})
+	s.do(func() {
+		if c := s.character("Alice"); c.InWorld() {
+			t.Error("Alice is still in the world after quitting")
+		}
+		if _, ok := s.Connections[alice]; !ok {
+			t.Error("quitting the game disconnected Alice")
+		}
+	})
+
+	// quitting at the menu disconnects
+	runLines(t, s, alice, out, []struct{ line, want string }{
+		{"quit", "Goodbye."},
+	})
+	s.do(func() {
+		if _, ok := s.Connections[alice]; ok {
+			t.Error("Alice is still connected after quitting at the menu")
+		}
+	})
+	if !out.Closed() {
+		t.Error("quitting at the menu didn't close the outbox")
+	}
+}
+
+func TestOutputShowsNamesNotEmails(t *testing.T) {
+	s := newTestGame(t, "a@example.com", "b@example.com")
+	_, bobOut := enterGame(t, s, "b@example.com", "Bob")
+	alice, aliceOut := enterGame(t, s, "a@example.com", "Alice")
+	for _, line := range []string{"say hello", "who", "emote waves.", "quit"} {
+		s.HandleCommand(alice, "", line)
+	}
+	got := received(bobOut)
+	for _, want := range []string{
+		"Alice has entered the game.",
+		"Alice says, \"hello\"",
+		"Alice waves.",
+		"Alice has left the game.",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Bob didn't get %q; got:\n%s", want, got)
+		}
+	}
+	if got += received(aliceOut); strings.Contains(got, "@example.com") {
+		t.Errorf("output shows an email address:\n%s", got)
+	}
+}
@@ -0,0 +1,117 @@
+// Contains the clocks driving the game's pulse.
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is where the game gets the time from. The real clock is used when
+// running the server; tests use a FakeClock to control time exactly.
+type Clock interface {
+	Now() time.Time
+	// Every calls fn every d until stop is called. Calls never overlap.
+	Every(d time.Duration, fn func()) (stop func())
+}
+
+// RealClock is the wall clock.
+type RealClock struct{}
+
+// Now implements Clock.
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// Every implements Clock.
+func (RealClock) Every(d time.Duration, fn func()) func() {
+	ticker := time.NewTicker(d)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
+
+// FakeClock is a Clock that only moves when told to, so tests can run the
+// game deterministically.
+type FakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+	mux    sync.Mutex
+}
+
+type fakeTimer struct {
+	next    time.Time
+	every   time.Duration
+	fn      func()
+	stopped bool
+}
+
+// NewFakeClock creates a FakeClock reading start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now implements Clock.
+func (c *FakeClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+// Every implements Clock.
+func (c *FakeClock) Every(d time.Duration, fn func()) func() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	t := &fakeTimer{next: c.now.Add(d), every: d, fn: fn}
+	c.timers = append(c.timers, t)
+	return func() {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		t.stopped = true
+	}
+}
+
+// Advance moves the clock forward by d, calling every function that falls due
+// on the way in order. It returns once they have all finished.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mux.Lock()
+	end := c.now.Add(d)
+	c.mux.Unlock()
+
+	for {
+		c.mux.Lock()
+		var due []*fakeTimer
+		for _, t := range c.timers {
+			if !t.stopped && !t.next.After(end) {
+				due = append(due, t)
+			}
+		}
+		if len(due) == 0 {
+			c.now = end
+			c.mux.Unlock()
+			return
+		}
+		sort.SliceStable(due, func(i, j int) bool { return due[i].next.Before(due[j].next) })
+		t := due[0]
+		c.now = t.next
+		t.next = t.next.Add(t.every)
+		c.mux.Unlock()
+
+		t.fn()
+	}
+}
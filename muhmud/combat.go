@@ -0,0 +1,200 @@
+// Contains the combat math, kept apart from the game state so that it can be
+// tested with a seeded RNG.
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RNG is where combat gets its randomness from. A *rand.Rand will do; seed it
+// to make fights repeatable.
+type RNG interface {
+	// Intn returns a number in [0, n).
+	Intn(n int) int
+}
+
+// Dice are an amount of dice to roll and add up, plus a bonus, as in "2d4+1".
+type Dice struct {
+	Count int
+	Sides int
+	Bonus int
+}
+
+// Roll rolls the dice.
+func (d Dice) Roll(rng RNG) int {
+	total := d.Bonus
+	for i := 0; i < d.Count && d.Sides > 0; i++ {
+		total += rng.Intn(d.Sides) + 1
+	}
+	return total
+}
+
+func (d Dice) String() string {
+	s := fmt.Sprintf("%dd%d", d.Count, d.Sides)
+	if d.Bonus > 0 {
+		s += fmt.Sprintf("+%d", d.Bonus)
+	} else if d.Bonus < 0 {
+		s += strconv.Itoa(d.Bonus)
+	}
+	return s
+}
+
+// ParseDice parses dice written as in "2d4", "1d6+1" or "3d8-2".
+func ParseDice(s string) (Dice, error) {
+	var d Dice
+	bad := fmt.Errorf("%q isn't dice like 2d4+1", s)
+	i := strings.IndexAny(s, "dD")
+	if i < 0 {
+		return d, bad
+	}
+	rest := s[i+1:]
+	bonus := ""
+	if j := strings.IndexAny(rest, "+-"); j >= 0 {
+		rest, bonus = rest[:j], rest[j:]
+	}
+	var err error
+	if d.Count, err = strconv.Atoi(s[:i]); err != nil || d.Count < 0 {
+		return d, bad
+	}
+	if d.Sides, err = strconv.Atoi(rest); err != nil || d.Sides < 1 {
+		return d, bad
+	}
+	if bonus != "" {
+		if d.Bonus, err = strconv.Atoi(bonus); err != nil {
+			return d, bad
+		}
+	}
+	return d, nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Dice) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Dice) UnmarshalText(text []byte) error {
+	parsed, err := ParseDice(string(text))
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// fistDice is the damage done by somebody fighting without a weapon.
+var fistDice = Dice{Count: 1, Sides: 3}
+
+// Combatant is everything the combat math needs to know about one side of a
+// fight.
+type Combatant struct {
+	Level     int
+	Strength  int
+	Dexterity int
+	HP        int
+	MaxHP     int
+	// Damage is the damage done by a hit, usually that of the weapon wielded.
+	Damage Dice
+}
+
+// CombatRules decide how fights go.
+type CombatRules interface {
+	// Attack works out a single attack, returning the damage done or zero for
+	// a miss.
+	Attack(rng RNG, attacker, defender Combatant) int
+	// Flee reports whether an attempt by fleer to get away from a fight with
+	// from succeeds.
+	Flee(rng RNG, fleer, from Combatant) bool
+	// Consider rates how dangerous defender would be for attacker, from
+	// around -5 (no contest) to 5 (certain death).
+	Consider(attacker, defender Combatant) int
+}
+
+// StandardRules are the game's combat rules. Higher levels and dexterity hit
+// more often, strength adds to damage.
+type StandardRules struct{}
+
+// hitChance is the percentage chance of attacker hitting defender, between 5
+// and 95.
+func hitChance(attacker, defender Combatant) int {
+	chance := 60 + 5*(attacker.Level-defender.Level) + 2*(attacker.Dexterity-defender.Dexterity)
+	switch {
+	case chance < 5:
+		return 5
+	case chance > 95:
+		return 95
+	}
+	return chance
+}
+
+// Attack implements CombatRules.
+func (StandardRules) Attack(rng RNG, attacker, defender Combatant) int {
+	if rng.Intn(100) >= hitChance(attacker, defender) {
+		return 0
+	}
+	damage := attacker.Damage.Roll(rng) + (attacker.Strength-10)/2
+	if damage < 1 {
+		damage = 1
+	}
+	return damage
+}
+
+// Flee implements CombatRules.
+func (StandardRules) Flee(rng RNG, fleer, from Combatant) bool {
+	return rng.Intn(100) < 50+5*(fleer.Dexterity-from.Dexterity)
+}
+
+// Consider implements CombatRules.
+func (StandardRules) Consider(attacker, defender Combatant) int {
+	rating := defender.Level - attacker.Level
+	if attacker.HP > 0 && defender.HP > 2*attacker.HP {
+		rating++
+	} else if defender.HP > 0 && attacker.HP > 2*defender.HP {
+		rating--
+	}
+	return rating
+}
+
+// damageVerb is how an amount of damage is described.
+type damageVerb struct {
+	// second is the verb as in "You scratch Bob", third as in "Bob scratches
+	// you".
+	second, third string
+}
+
+// damageVerbs describe damage by how much of the victim's maximum hit points
+// it took, in percent.
+var damageVerbs = []struct {
+	upTo int
+	verb damageVerb
+}{
+	{0, damageVerb{"miss", "misses"}},
+	{5, damageVerb{"scratch", "scratches"}},
+	{10, damageVerb{"graze", "grazes"}},
+	{15, damageVerb{"hit", "hits"}},
+	{20, damageVerb{"injure", "injures"}},
+	{30, damageVerb{"wound", "wounds"}},
+	{40, damageVerb{"maul", "mauls"}},
+	{50, damageVerb{"decimate", "decimates"}},
+	{75, damageVerb{"devastate", "devastates"}},
+}
+
+// describeDamage picks the verb for damage done to a victim with maxHP hit
+// points.
+func describeDamage(damage, maxHP int) damageVerb {
+	if maxHP < 1 {
+		maxHP = 1
+	}
+	percent := damage * 100 / maxHP
+	if damage > 0 && percent == 0 {
+		percent = 1
+	}
+	for _, v := range damageVerbs {
+		if percent <= v.upTo {
+			return v.verb
+		}
+	}
+	return damageVerb{"MASSACRE", "MASSACRES"}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// scriptedRNG returns the numbers it was given in turn, to work out exactly
+// how an attack goes.
+type scriptedRNG []int
+
+func (r *scriptedRNG) Intn(n int) int {
+	if len(*r) == 0 {
+		panic("ran out of numbers")
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	if v < 0 || v >= n {
+		panic("number out of range")
+	}
+	return v
+}
+
+func TestParseDice(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want Dice
+		ok   bool
+	}{
+		{"2d4", Dice{2, 4, 0}, true},
+		{"1D6+1", Dice{1, 6, 1}, true},
+		{"3d8-2", Dice{3, 8, -2}, true},
+		{"0d4", Dice{0, 4, 0}, true},
+		{"d6", Dice{}, false},
+		{"2d0", Dice{}, false},
+		{"2d", Dice{}, false},
+		{"-1d4", Dice{}, false},
+		{"2d4+", Dice{}, false},
+		{"2x4", Dice{}, false},
+	} {
+		got, err := ParseDice(tt.in)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("ParseDice(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+	for _, d := range []Dice{{2, 4, 0}, {1, 6, 1}, {3, 8, -2}} {
+		if got, err := ParseDice(d.String()); err != nil || got != d {
+			t.Errorf("%v didn't round trip: %v, %v", d, got, err)
+		}
+	}
+}
+
+func TestDiceRoll(t *testing.T) {
+	rng := scriptedRNG{0, 3, 1}
+	if got := (Dice{3, 4, 2}).Roll(&rng); got != 1+4+2+2 {
+		t.Errorf("rolled %d", got)
+	}
+
+	// a seeded RNG never rolls outside the dice's range, and gets to both ends
+	seeded := rand.New(rand.NewSource(1))
+	d := Dice{2, 6, -1}
+	seen := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		got := d.Roll(seeded)
+		if got < 1 || got > 11 {
+			t.Fatalf("rolled %d with %v", got, d)
+		}
+		seen[got] = true
+	}
+	if !seen[1] || !seen[11] {
+		t.Errorf("never rolled the lowest or highest of %v: %v", d, seen)
+	}
+}
+
+func TestAttack(t *testing.T) {
+	fighter := Combatant{Level: 1, Strength: 14, Dexterity: 10, Damage: Dice{1, 6, 0}}
+	weakling := Combatant{Level: 1, Strength: 3, Dexterity: 10, Damage: Dice{1, 2, 0}}
+	for _, tt := range []struct {
+		name               string
+		attacker, defender Combatant
+		rolls              scriptedRNG
+		want               int
+	}{
+		// hitChance is 60 between equals
+		{"miss", fighter, weakling, scriptedRNG{60}, 0},
+		{"hit", fighter, weakling, scriptedRNG{59, 3}, 4 + 2},
+		{"weak hits still hurt", weakling, fighter, scriptedRNG{0, 0}, 1},
+	} {
+		rolls := tt.rolls
+		if got := (StandardRules{}).Attack(&rolls, tt.attacker, tt.defender); got != tt.want {
+			t.Errorf("%s: did %d damage, want %d", tt.name, got, tt.want)
+		}
+		if len(rolls) != 0 {
+			t.Errorf("%s: didn't roll %v", tt.name, rolls)
+		}
+	}
+}
+
+func TestHitChance(t *testing.T) {
+	for _, tt := range []struct {
+		attacker, defender Combatant
+		want               int
+	}{
+		{Combatant{Level: 1, Dexterity: 10}, Combatant{Level: 1, Dexterity: 10}, 60},
+		{Combatant{Level: 3, Dexterity: 12}, Combatant{Level: 1, Dexterity: 10}, 74},
+		{Combatant{Level: 30}, Combatant{Level: 1}, 95},
+		{Combatant{Level: 1}, Combatant{Level: 30}, 5},
+	} {
+		if got := hitChance(tt.attacker, tt.defender); got != tt.want {
+			t.Errorf("hitChance(%+v, %+v) = %d, want %d", tt.attacker, tt.defender, got, tt.want)
+		}
+	}
+}
+
+func TestHitRate(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	a := Combatant{Level: 1, Dexterity: 10, Damage: fistDice}
+	hits := 0
+	const attacks = 10000
+	for i := 0; i < attacks; i++ {
+		if (StandardRules{}).Attack(rng, a, a) > 0 {
+			hits++
+		}
+	}
+	if percent := hits * 100 / attacks; percent < 57 || percent > 63 {
+		t.Errorf("hit %d%% of the time between equals, want about 60%%", percent)
+	}
+}
+
+func TestDescribeDamage(t *testing.T) {
+	for _, tt := range []struct {
+		damage, maxHP int
+		want          string
+	}{
+		{0, 20, "miss"},
+		{1, 1000, "scratch"},
+		{1, 20, "scratch"},
+		{3, 20, "hit"},
+		{10, 20, "decimate"},
+		{15, 20, "devastate"},
+		{16, 20, "MASSACRE"},
+		{5, 0, "MASSACRE"},
+	} {
+		if got := describeDamage(tt.damage, tt.maxHP).second; got != tt.want {
+			t.Errorf("describeDamage(%d, %d) = %q, want %q", tt.damage, tt.maxHP, got, tt.want)
+		}
+	}
+}
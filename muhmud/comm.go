@@ -0,0 +1,470 @@
+// Contains the ways players talk to each other: saying, emoting, tells and
+// channels.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/diddydum/muhmud/muhmud/markup"
+)
+
+// channelHistorySize is how many messages each channel remembers, to catch
+// up whoever joins it.
+const channelHistorySize = 20
+
+// Channel is a chat channel characters can talk on wherever they are.
+type Channel struct {
+	// Name is the lower cased name of the channel, which is also the command
+	// for talking on it.
+	Name string
+	// Help is a sentence describing what the channel is for.
+	Help string
+	// AdminOnly channels may only be joined by admins.
+	AdminOnly bool
+	// Default channels are joined by every new character.
+	Default bool
+	history []channelMessage
+}
+
+// channelMessage is something said on a channel.
+type channelMessage struct {
+	from string
+	text string
+}
+
+// ChannelRegistry holds the channels of the game.
+type ChannelRegistry struct {
+	channels []*Channel
+	byName   map[string]*Channel
+}
+
+// NewChannelRegistry creates an empty registry.
+func NewChannelRegistry() *ChannelRegistry {
+	return &ChannelRegistry{byName: make(map[string]*Channel)}
+}
+
+// Register adds a channel to the registry. It panics if a channel with the
+// same name was already registered, since that's a programming error.
+func (r *ChannelRegistry) Register(ch *Channel) {
+	if _, ok := r.byName[ch.Name]; ok {
+		panic(fmt.Sprintf("channel %s registered twice", ch.Name))
+	}
+	r.byName[ch.Name] = ch
+	r.channels = append(r.channels, ch)
+}
+
+// Lookup returns the channel called name, ignoring case, or nil.
+func (r *ChannelRegistry) Lookup(name string) *Channel {
+	return r.byName[strings.ToLower(name)]
+}
+
+// Channels returns every channel in the order they were registered.
+func (r *ChannelRegistry) Channels() []*Channel {
+	return r.channels
+}
+
+// registerChannels adds the channels every game has.
+func registerChannels(r *ChannelRegistry) {
+	r.Register(&Channel{Name: "gossip", Help: "Chat about anything and everything.", Default: true})
+	r.Register(&Channel{Name: "newbie", Help: "Ask for help finding your way around.", Default: true})
+	r.Register(&Channel{Name: "admin", Help: "Talk to the other admins.", AdminOnly: true})
+}
+
+// mayJoin reports whether p's characters are allowed on the channel.
+func (ch *Channel) mayJoin(p *Player) bool {
+	return !ch.AdminOnly || p.Admin
+}
+
+// mayUse reports whether c is allowed on ch, which may have changed since it
+// joined. It must be called from the game loop.
+func (s *GameState) mayUse(ch *Channel, c *Character) bool {
+	p, ok := s.Players[c.Account]
+	return ok && ch.mayJoin(p)
+}
+
+// line renders a message as shown on the channel.
+func (ch *Channel) line(from, text string) string {
+	return fmt.Sprintf("%%c[%s]%%n %s: %s", strings.Title(ch.Name), from, markup.Escape(text))
+}
+
+// commText is the data of Comm.Channel.Text, sent for every message on a
+// channel and every tell.
+type commText struct {
+	Channel string `json:"channel"`
+	Talker  string `json:"talker"`
+	Text    string `json:"text"`
+}
+
+// ignoring reports whether p doesn't want to hear from c. Ignoring a
+// character ignores every character of the same account, so that nobody can
+// get around it by switching to another one. It must be called from the game
+// loop.
+func (s *GameState) ignoring(p *Player, c *Character) bool {
+	for _, name := range p.Ignoring {
+		if ignored, ok := s.Characters[strings.ToLower(name)]; ok && ignored.Account == c.Account {
+			return true
+		}
+	}
+	return false
+}
+
+// ignores reports whether the player of c doesn't want to hear from from. It
+// must be called from the game loop.
+func (s *GameState) ignores(c, from *Character) bool {
+	p, ok := s.Players[c.Account]
+	return ok && s.ignoring(p, from)
+}
+
+// notifyRoomFrom sends msg, which from said or did, to everyone else in from's
+// room who isn't ignoring them. It must be called from the game loop.
+func (s *GameState) notifyRoomFrom(from *Character, msg string) {
+	for _, c := range s.CharactersIn(from.Location) {
+		if c != from && !s.ignores(c, from) {
+			s.NotifyCharacter(c, msg)
+		}
+	}
+}
+
+// talkOn says text on a channel, remembering it in the channel's history. It
+// must be called from the game loop.
+func (s *GameState) talkOn(ch *Channel, from *Character, text string) {
+	ch.history = append(ch.history, channelMessage{from: from.Name, text: text})
+	if len(ch.history) > channelHistorySize {
+		ch.history = ch.history[len(ch.history)-channelHistorySize:]
+	}
+	msg := ch.line(from.Name, text)
+	for _, c := range s.Characters {
+		if muted, joined := c.Channels[ch.Name]; !joined || muted || !c.InWorld() || !s.mayUse(ch, c) {
+			continue
+		}
+		if c != from && s.ignores(c, from) {
+			continue
+		}
+		if c != from {
+			s.NotifyCharacter(c, msg)
+		}
+		s.SendGMCPCharacter(c, "Comm.Channel.Text", commText{Channel: ch.Name, Talker: from.Name, Text: text})
+	}
+}
+
+// channelHistory renders what was said on a channel lately, leaving out
+// whoever c is ignoring. It must be called from the game loop.
+func (s *GameState) channelHistory(ch *Channel, c *Character) string {
+	if !s.mayUse(ch, c) {
+		return fmt.Sprintf("There's no channel called %s.", ch.Name)
+	}
+	lines := []string{fmt.Sprintf("Recently on %s:", ch.Name)}
+	for _, m := range ch.history {
+		if from, ok := s.Characters[strings.ToLower(m.from)]; ok && s.ignores(c, from) {
+			continue
+		}
+		lines = append(lines, ch.line(m.from, m.text))
+	}
+	if len(lines) == 1 {
+		return fmt.Sprintf("Nothing has been said on %s lately.", ch.Name)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// registerCommCommands adds the commands for talking, including one for each
+// channel.
+func registerCommCommands(r *CommandRegistry, channels *ChannelRegistry) {
+	r.Register(&Command{
+		Name:    "say",
+		Aliases: []string{"'"},
+		Usage:   "<message>",
+		Help:    "Say something to everyone in the room.",
+		Handler: cmdSay,
+	})
+	r.Register(&Command{
+		Name:    "emote",
+		Aliases: []string{"pose", ":"},
+		Usage:   "<action>",
+		Help:    "Show everyone in the room what you're doing, e.g. \"emote waves.\"",
+		Handler: cmdEmote,
+	})
+	r.Register(&Command{
+		Name:    "tell",
+		Usage:   "<character> <message>",
+		Help:    "Say something to a single character, wherever they are.",
+		Handler: cmdTell,
+	})
+	r.Register(&Command{
+		Name:    "reply",
+		Usage:   "<message>",
+		Help:    "Answer whoever last sent you a tell.",
+		Handler: cmdReply,
+	})
+	for _, ch := range channels.Channels() {
+		ch := ch
+		r.Register(&Command{
+			Name:    ch.Name,
+			Usage:   "[message]",
+			Help:    ch.Help + " Without a message, shows what was said lately.",
+			Handler: func(ctx *CommandContext) { cmdChannel(ctx, ch) },
+		})
+	}
+	r.Register(&Command{
+		Name:    "channels",
+		Help:    "List the channels and which of them you're on.",
+		Handler: cmdChannels,
+	})
+	r.Register(&Command{
+		Name:    "join",
+		Usage:   "<channel>",
+		Help:    "Start listening to a channel.",
+		Handler: cmdJoin,
+	})
+	r.Register(&Command{
+		Name:    "leave",
+		Usage:   "<channel>",
+		Help:    "Leave a channel.",
+		Handler: cmdLeave,
+	})
+	r.Register(&Command{
+		Name:    "mute",
+		Usage:   "<channel>",
+		Help:    "Stop hearing a channel for now without leaving it.",
+		Handler: func(ctx *CommandContext) { setMuted(ctx, true) },
+	})
+	r.Register(&Command{
+		Name:    "unmute",
+		Usage:   "<channel>",
+		Help:    "Hear a muted channel again.",
+		Handler: func(ctx *CommandContext) { setMuted(ctx, false) },
+	})
+	r.Register(&Command{
+		Name:    "ignore",
+		Usage:   "[character]",
+		Help:    "Stop hearing anything a character or their alts say, or list who you're ignoring.",
+		Handler: cmdIgnore,
+	})
+	r.Register(&Command{
+		Name:    "unignore",
+		Usage:   "<character>",
+		Help:    "Stop ignoring a character.",
+		Handler: cmdUnignore,
+	})
+}
+
+func cmdSay(ctx *CommandContext) {
+	if ctx.ArgString == "" {
+		ctx.Respond("Say what?")
+		return
+	}
+	text := markup.Escape(ctx.ArgString)
+	ctx.Respondf("You say, \"%s\"", text)
+	ctx.State.notifyRoomFrom(ctx.Character, fmt.Sprintf("%s says, \"%s\"", ctx.Character.Name, text))
+}
+
+func cmdEmote(ctx *CommandContext) {
+	if ctx.ArgString == "" {
+		ctx.Respond("Emote what?")
+		return
+	}
+	msg := ctx.Character.Name + " " + markup.Escape(ctx.ArgString)
+	ctx.Respond(msg)
+	ctx.State.notifyRoomFrom(ctx.Character, msg)
+}
+
+func cmdTell(ctx *CommandContext) {
+	name, text := splitVerb(ctx.ArgString)
+	if name == "" {
+		ctx.Respond("Tell whom what?")
+		return
+	}
+	tell(ctx, name, text)
+}
+
+func cmdReply(ctx *CommandContext) {
+	if ctx.Character.replyTo == "" {
+		ctx.Respond("Nobody has sent you a tell yet.")
+		return
+	}
+	tell(ctx, ctx.Character.replyTo, ctx.ArgString)
+}
+
+// tell sends text from the acting character to the character called name.
+func tell(ctx *CommandContext, name, text string) {
+	s, from := ctx.State, ctx.Character
+	to, ok := s.Characters[strings.ToLower(name)]
+	switch {
+	case !ok || !to.InWorld():
+		ctx.Respondf("Nobody called %s is playing.", markup.Escape(strings.Title(strings.ToLower(name))))
+		return
+	case to == from:
+		ctx.Respond("You mutter something to yourself.")
+		return
+	case text == "":
+		ctx.Respondf("Tell %s what?", to.Name)
+		return
+	case s.ignoring(ctx.Player, to):
+		ctx.Respondf("You're ignoring %s.", to.Name)
+		return
+	case s.ignores(to, from):
+		ctx.Respondf("%s isn't listening to you.", to.Name)
+		return
+	}
+	ctx.Respondf("You tell %s, \"%s\"", to.Name, markup.Escape(text))
+	s.NotifyCharacter(to, fmt.Sprintf("%s tells you, \"%s\"", from.Name, markup.Escape(text)))
+	to.replyTo = from.Name
+	data := commText{Channel: "tell", Talker: from.Name, Text: text}
+	s.SendGMCPCharacter(from, "Comm.Channel.Text", data)
+	s.SendGMCPCharacter(to, "Comm.Channel.Text", data)
+}
+
+func cmdChannel(ctx *CommandContext, ch *Channel) {
+	c := ctx.Character
+	muted, joined := c.Channels[ch.Name]
+	switch {
+	case !ch.mayJoin(ctx.Player):
+		ctx.Respond("Huh? Type 'help' for a list of commands.")
+	case !joined:
+		ctx.Respondf("You aren't on %s; type 'join %s' first.", ch.Name, ch.Name)
+	case ctx.ArgString == "":
+		ctx.Respond(ctx.State.channelHistory(ch, c))
+	case muted:
+		ctx.Respondf("You've muted %s; type 'unmute %s' to talk on it.", ch.Name, ch.Name)
+	default:
+		ctx.Respond(ch.line(c.Name, ctx.ArgString))
+		ctx.State.talkOn(ch, c, ctx.ArgString)
+	}
+}
+
+func cmdChannels(ctx *CommandContext) {
+	var lines []string
+	for _, ch := range ctx.State.Channels.Channels() {
+		if !ch.mayJoin(ctx.Player) {
+			continue
+		}
+		status := "not joined"
+		if muted, joined := ctx.Character.Channels[ch.Name]; muted {
+			status = "muted"
+		} else if joined {
+			status = "joined"
+		}
+		lines = append(lines, fmt.Sprintf("%s (%s) - %s", ch.Name, status, ch.Help))
+	}
+	ctx.Respond("Channels:\n" + strings.Join(lines, "\n"))
+}
+
+// channelArg finds the channel named by the command's argument, responding
+// and returning nil if there isn't one the player may use. A channel the
+// character is still on can always be named, so that it can be left.
+func channelArg(ctx *CommandContext) *Channel {
+	if len(ctx.Args) == 0 {
+		ctx.Respondf("%s which channel?", strings.Title(ctx.Command.Name))
+		return nil
+	}
+	ch := ctx.State.Channels.Lookup(ctx.Args[0])
+	if ch == nil {
+		ctx.Respondf("There's no channel called %s.", markup.Escape(ctx.Args[0]))
+		return nil
+	}
+	if _, joined := ctx.Character.Channels[ch.Name]; !joined && !ch.mayJoin(ctx.Player) {
+		ctx.Respondf("There's no channel called %s.", markup.Escape(ctx.Args[0]))
+		return nil
+	}
+	return ch
+}
+
+func cmdJoin(ctx *CommandContext) {
+	ch := channelArg(ctx)
+	if ch == nil {
+		return
+	}
+	c := ctx.Character
+	if _, joined := c.Channels[ch.Name]; joined {
+		ctx.Respondf("You're already on %s.", ch.Name)
+		return
+	}
+	c.Channels[ch.Name] = false
+	ctx.State.saveCharacter(c)
+	ctx.Respondf("You join %s.\n%s", ch.Name, ctx.State.channelHistory(ch, c))
+}
+
+func cmdLeave(ctx *CommandContext) {
+	ch := channelArg(ctx)
+	if ch == nil {
+		return
+	}
+	c := ctx.Character
+	if _, joined := c.Channels[ch.Name]; !joined {
+		ctx.Respondf("You aren't on %s.", ch.Name)
+		return
+	}
+	delete(c.Channels, ch.Name)
+	ctx.State.saveCharacter(c)
+	ctx.Respondf("You leave %s.", ch.Name)
+}
+
+// setMuted mutes or unmutes the channel named by the command's argument.
+func setMuted(ctx *CommandContext, mute bool) {
+	ch := channelArg(ctx)
+	if ch == nil {
+		return
+	}
+	c := ctx.Character
+	muted, joined := c.Channels[ch.Name]
+	switch {
+	case !joined:
+		ctx.Respondf("You aren't on %s.", ch.Name)
+	case muted == mute:
+		ctx.Respondf("You've already %sd %s.", ctx.Command.Name, ch.Name)
+	default:
+		c.Channels[ch.Name] = mute
+		ctx.State.saveCharacter(c)
+		ctx.Respondf("You %s %s.", ctx.Command.Name, ch.Name)
+	}
+}
+
+func cmdIgnore(ctx *CommandContext) {
+	p := ctx.Player
+	if len(ctx.Args) == 0 {
+		if len(p.Ignoring) == 0 {
+			ctx.Respond("You aren't ignoring anyone.")
+			return
+		}
+		names := append([]string(nil), p.Ignoring...)
+		sort.Strings(names)
+		ctx.Respond("You're ignoring: " + strings.Join(names, ", "))
+		return
+	}
+	c, ok := ctx.State.Characters[strings.ToLower(ctx.Args[0])]
+	switch {
+	case !ok:
+		ctx.Respondf("There's no character called %s.", markup.Escape(ctx.Args[0]))
+		return
+	case c.Account == p.Email:
+		ctx.Respond("You can't ignore your own characters.")
+		return
+	}
+	for _, name := range p.Ignoring {
+		if strings.EqualFold(name, c.Name) {
+			ctx.Respondf("You're already ignoring %s.", c.Name)
+			return
+		}
+	}
+	p.Ignoring = append(p.Ignoring, c.Name)
+	ctx.State.savePlayer(p)
+	ctx.Respondf("You're now ignoring %s, and any other characters they play.", c.Name)
+}
+
+func cmdUnignore(ctx *CommandContext) {
+	if len(ctx.Args) == 0 {
+		ctx.Respond("Stop ignoring whom?")
+		return
+	}
+	p := ctx.Player
+	for i, name := range p.Ignoring {
+		if strings.EqualFold(name, ctx.Args[0]) {
+			p.Ignoring = append(p.Ignoring[:i], p.Ignoring[i+1:]...)
+			ctx.State.savePlayer(p)
+			ctx.Respondf("You stop ignoring %s.", name)
+			return
+		}
+	}
+	ctx.Respondf("You aren't ignoring %s.", markup.Escape(ctx.Args[0]))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPlayersCantUseMarkup(t *testing.T) {
+	s := newTestGame(t, "a@example.com", "b@example.com")
+	alice, aliceOut := enterGame(t, s, "a@example.com", "Alice")
+	_, bobOut := enterGame(t, s, "b@example.com", "Bob")
+
+	for _, tt := range []struct{ line, want string }{
+		{"say %Rhi\x1b[2J%%", "Alice says, \"%Rhi[2J%%\""},
+		{"emote %hwaves", "Alice %hwaves"},
+		{"tell bob 50%b off", "Alice tells you, \"50%b off\""},
+		{"gossip %(%n)", "\x1b[0;36m[Gossip]\x1b[0m Alice: %(%n)"},
+	} {
+		s.HandleCommand(alice, "", tt.line)
+		received(aliceOut)
+		if got := received(bobOut); got != tt.want {
+			t.Errorf("after %q Bob got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestDemotedAdminsLeaveAdminChannels(t *testing.T) {
+	s := newTestGame(t, "a@example.com", "b@example.com")
+	s.SetAdmins([]string{"a@example.com", "b@example.com"})
+	alice, aliceOut := enterGame(t, s, "a@example.com", "Alice")
+	bob, bobOut := enterGame(t, s, "b@example.com", "Bob")
+	s.HandleCommand(alice, "", "join admin")
+	s.HandleCommand(bob, "", "join admin")
+	s.HandleCommand(bob, "", "admin first plans")
+	if got := received(aliceOut); !strings.Contains(got, "first plans") {
+		t.Fatalf("Alice didn't hear Bob as an admin:\n%s", got)
+	}
+
+	s.SetAdmins([]string{"b@example.com"})
+	var joined bool
+	s.do(func() { _, joined = s.character("Alice").Channels["admin"] })
+	if joined {
+		t.Error("Alice is still on admin after being demoted")
+	}
+	players, err := s.Store.LoadPlayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range players {
+		for _, c := range p.Characters {
+			if _, joined := c.Channels["admin"]; joined && c.Name == "Alice" {
+				t.Error("Alice is still saved as being on admin")
+			}
+		}
+	}
+
+	// even if she's somehow still on it, she neither hears nor talks on it,
+	// but can leave it
+	s.do(func() { s.character("Alice").Channels["admin"] = false })
+	received(aliceOut)
+	received(bobOut)
+	s.HandleCommand(bob, "", "admin secret plans")
+	if got := received(aliceOut); strings.Contains(got, "secret plans") {
+		t.Errorf("Alice heard admin once demoted:\n%s", got)
+	}
+	s.HandleCommand(alice, "", "admin hello")
+	if got := received(aliceOut); got != "Huh? Type 'help' for a list of commands." {
+		t.Errorf("Alice talking on admin got %q", got)
+	}
+	if got := received(bobOut); strings.Contains(got, "hello") {
+		t.Errorf("Bob heard Alice on admin once she was demoted:\n%s", got)
+	}
+	s.HandleCommand(alice, "", "leave admin")
+	if got := received(aliceOut); got != "You leave admin." {
+		t.Errorf("leave admin got %q", got)
+	}
+	s.HandleCommand(alice, "", "join admin")
+	if got := received(aliceOut); got != "There's no channel called admin." {
+		t.Errorf("join admin got %q", got)
+	}
+}
+
+func TestAdminsDemotedWhileDownLeaveAdminChannels(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	s.SetAdmins([]string{"a@example.com"})
+	alice, _ := enterGame(t, s, "a@example.com", "Alice")
+	s.HandleCommand(alice, "", "join admin")
+	s.DisconnectPlayer(alice)
+
+	// the server restarts with Alice no longer in the configuration
+	s, err := InitialState(s.Store, testWorld(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetAdmins(nil)
+	s.do(func() {
+		if s.Players["a@example.com"].Admin {
+			t.Error("Alice is still an admin")
+		}
+		if _, joined := s.character("Alice").Channels["admin"]; joined {
+			t.Error("Alice is still on admin")
+		}
+	})
+
+	s.SetAdmins([]string{"a@example.com"})
+	if !s.isAdmin("a@example.com") {
+		t.Error("Alice isn't an admin once she's back in the configuration")
+	}
+}
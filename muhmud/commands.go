@@ -0,0 +1,346 @@
+// Contains the command parser and dispatcher.
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/diddydum/muhmud/muhmud/markup"
+)
+
+// CommandHandler executes a single command on behalf of a player.
+type CommandHandler func(ctx *CommandContext)
+
+// Command describes a verb that players can type.
+type Command struct {
+	// Name is the full name of the command, e.g. "look".
+	Name string
+	// Aliases are other words that invoke the command exactly, e.g. "l".
+	Aliases []string
+	// MinAbbrev is the length of the shortest prefix of Name that still invokes
+	// the command. Zero means any prefix will do.
+	MinAbbrev int
+	// Usage is a short synopsis of the arguments, e.g. "<target>".
+	Usage string
+	// Help is a sentence or two describing what the command does.
+	Help string
+	// Admin commands may only be used by admins, and are left out of help
+	// for everybody else.
+	Admin bool
+	// Handler is called to execute the command.
+	Handler CommandHandler
+}
+
+// CommandRegistry holds the commands known to the game. When an abbreviation is
+// ambiguous the command registered first wins, so register the most commonly
+// used commands (e.g. "north" before "news") first.
+type CommandRegistry struct {
+	commands []*Command
+	exact    map[string]*Command
+}
+
+// NewCommandRegistry creates an empty registry.
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{exact: make(map[string]*Command)}
+}
+
+// Register adds cmd to the registry. It panics if the name or one of the
+// aliases is already taken, since that is always a programming error.
+func (r *CommandRegistry) Register(cmd *Command) {
+	for _, word := range append([]string{cmd.Name}, cmd.Aliases...) {
+		word = strings.ToLower(word)
+		if _, ok := r.exact[word]; ok {
+			panic(fmt.Sprintf("command %q registered twice", word))
+		}
+		r.exact[word] = cmd
+	}
+	r.commands = append(r.commands, cmd)
+}
+
+// Lookup finds the command invoked by verb. Exact names and aliases are
+// preferred; otherwise the first registered command that verb abbreviates is
+// returned.
+func (r *CommandRegistry) Lookup(verb string) (*Command, bool) {
+	verb = strings.ToLower(verb)
+	if verb == "" {
+		return nil, false
+	}
+	if cmd, ok := r.exact[verb]; ok {
+		return cmd, true
+	}
+	for _, cmd := range r.commands {
+		if len(verb) >= cmd.MinAbbrev && strings.HasPrefix(cmd.Name, verb) {
+			return cmd, true
+		}
+	}
+	return nil, false
+}
+
+// Commands returns every registered command sorted by name.
+func (r *CommandRegistry) Commands() []*Command {
+	cmds := make([]*Command, len(r.commands))
+	copy(cmds, r.commands)
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// CommandContext is everything a handler needs to know about the command it is
+// executing. Handlers run on the game loop.
+type CommandContext struct {
+	State *GameState
+	Conn  *Connection
+	// Player is the account issuing the command.
+	Player *Player
+	// Character is the character acting, or nil at the character select menu.
+	Character *Character
+	ConnID    ConnectionID
+	RequestID string
+	// Registry is the registry the command was found in.
+	Registry *CommandRegistry
+	// Command is the command being executed.
+	Command *Command
+	// Verb is the word the player actually typed to invoke the command.
+	Verb string
+	// Args is the rest of the line split into words, honoring quotes.
+	Args []string
+	// ArgString is the rest of the line exactly as typed, minus surrounding
+	// whitespace.
+	ArgString string
+}
+
+// Respond sends msg back to the player as the response to their request.
+func (ctx *CommandContext) Respond(msg string) {
+	ctx.State.Respond(ctx.ConnID, ctx.RequestID, msg)
+}
+
+// Respondf is like Respond but takes a format string.
+func (ctx *CommandContext) Respondf(format string, args ...interface{}) {
+	ctx.Respond(fmt.Sprintf(format, args...))
+}
+
+// Dispatch parses line and runs the matching command. It must be called from
+// the game loop.
+func (r *CommandRegistry) Dispatch(ctx *CommandContext, line string) {
+	ctx.Registry = r
+	verb, rest := splitVerb(line)
+	if verb == "" {
+		ctx.Respond("")
+		return
+	}
+	cmd, ok := r.Lookup(verb)
+	if !ok {
+		ctx.Respond("Huh? Type 'help' for a list of commands.")
+		return
+	}
+	if cmd.Admin && !ctx.Player.Admin {
+		ctx.Respond("Only admins can do that.")
+		return
+	}
+	ctx.Command = cmd
+	ctx.Verb = verb
+	ctx.ArgString = rest
+	ctx.Args = tokenize(rest)
+	cmd.Handler(ctx)
+}
+
+// splitVerb splits a line into the verb and the rest of the line. A leading
+// punctuation character is a verb on its own, so that "'hello" means "' hello".
+func splitVerb(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", ""
+	}
+	first := []rune(line)[0]
+	if !unicode.IsLetter(first) && !unicode.IsDigit(first) {
+		n := len(string(first))
+		return line[:n], strings.TrimSpace(line[n:])
+	}
+	i := strings.IndexFunc(line, unicode.IsSpace)
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], strings.TrimSpace(line[i:])
+}
+
+// tokenize splits s into words. A word starting with a single or double quote
+// runs until the matching quote, so `put "big sword" chest` yields two words.
+// An unterminated quote runs to the end of the line.
+func tokenize(s string) []string {
+	var words []string
+	var cur []rune
+	inWord := false
+	var quote rune
+	for _, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				cur = append(cur, c)
+			}
+		case unicode.IsSpace(c):
+			if inWord {
+				words = append(words, string(cur))
+				cur = cur[:0]
+				inWord = false
+			}
+		case (c == '"' || c == '\'') && !inWord:
+			quote = c
+			inWord = true
+		default:
+			cur = append(cur, c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, string(cur))
+	}
+	return words
+}
+
+// Target is a reference to one or more things by keyword, as typed by a player:
+// "sword" is the first sword, "2.sword" the second and "all.sword" every one.
+type Target struct {
+	Keyword string
+	// Index is the 1-based position of the wanted match.
+	Index int
+	// All is set when every match is wanted.
+	All bool
+}
+
+// ParseTarget parses a target argument such as "2.sword".
+func ParseTarget(arg string) Target {
+	t := Target{Keyword: strings.ToLower(arg), Index: 1}
+	i := strings.Index(arg, ".")
+	if i < 0 {
+		if t.Keyword == "all" {
+			t.Keyword = ""
+			t.All = true
+		}
+		return t
+	}
+	prefix, keyword := strings.ToLower(arg[:i]), strings.ToLower(arg[i+1:])
+	if prefix == "all" {
+		return Target{Keyword: keyword, Index: 1, All: true}
+	}
+	if n, err := strconv.Atoi(prefix); err == nil && n > 0 {
+		return Target{Keyword: keyword, Index: n}
+	}
+	return t
+}
+
+// Matches reports whether any of keywords starts with the target's keyword. An
+// empty keyword (as in a bare "all") matches everything.
+func (t Target) Matches(keywords []string) bool {
+	if t.Keyword == "" {
+		return true
+	}
+	for _, k := range keywords {
+		if strings.HasPrefix(strings.ToLower(k), t.Keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// Select returns the indexes of the candidates picked by the target, where
+// keywords(i) gives the keywords of the i-th of n candidates. The result has at
+// most one element unless the target is an "all" target.
+func (t Target) Select(n int, keywords func(i int) []string) []int {
+	var picked []int
+	seen := 0
+	for i := 0; i < n; i++ {
+		if !t.Matches(keywords(i)) {
+			continue
+		}
+		seen++
+		if t.All {
+			picked = append(picked, i)
+		} else if seen == t.Index {
+			return []int{i}
+		}
+	}
+	return picked
+}
+
+// registerGeneralCommands adds commands that don't belong to any particular
+// part of the game.
+func registerGeneralCommands(r *CommandRegistry) {
+	r.Register(&Command{
+		Name:    "who",
+		Help:    "List everyone who is currently playing.",
+		Handler: cmdWho,
+	})
+	r.Register(&Command{
+		Name:    "help",
+		Usage:   "[command]",
+		Help:    "List the available commands, or describe one of them.",
+		Handler: cmdHelp,
+	})
+	r.Register(&Command{
+		Name:      "quit",
+		MinAbbrev: 4,
+		Help:      "Stop playing and return to the character select menu.",
+		Handler:   cmdQuit,
+	})
+}
+
+func cmdWho(ctx *CommandContext) {
+	var names []string
+	for _, c := range ctx.State.Characters {
+		if c.InWorld() {
+			names = append(names, c.Name)
+		}
+	}
+	sort.Strings(names)
+	ctx.Respondf("Players online (%d):\n%s", len(names), strings.Join(names, "\n"))
+}
+
+func cmdHelp(ctx *CommandContext) {
+	commands := ctx.Registry
+	if len(ctx.Args) == 0 {
+		var lines []string
+		for _, cmd := range commands.Commands() {
+			if cmd.Admin && !ctx.Player.Admin {
+				continue
+			}
+			line := cmd.Name
+			if len(cmd.Aliases) > 0 {
+				line += " (" + strings.Join(cmd.Aliases, ", ") + ")"
+			}
+			lines = append(lines, line+" - "+cmd.Help)
+		}
+		ctx.Respond("Available commands:\n" + strings.Join(lines, "\n"))
+		return
+	}
+	cmd, ok := commands.Lookup(ctx.Args[0])
+	if !ok || (cmd.Admin && !ctx.Player.Admin) {
+		ctx.Respondf("There is no command called '%s'.", markup.Escape(ctx.Args[0]))
+		return
+	}
+	usage := cmd.Name
+	if cmd.Usage != "" {
+		usage += " " + cmd.Usage
+	}
+	msg := "Usage: " + usage + "\n" + cmd.Help
+	if len(cmd.Aliases) > 0 {
+		msg += "\nAliases: " + strings.Join(cmd.Aliases, ", ")
+	}
+	ctx.Respond(msg)
+}
+
+func cmdQuit(ctx *CommandContext) {
+	ctx.Respondf("You stop playing %s.\n%s", ctx.Character.Name, characterMenu(ctx.Player))
+	ctx.State.leaveWorld(ctx.Conn)
+}
+
+func cmdDisconnect(ctx *CommandContext) {
+	ctx.Respond("Goodbye.")
+	if err := ctx.State.disconnect(ctx.ConnID); err != nil {
+		log.Println(err)
+	}
+}
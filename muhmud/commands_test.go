@@ -0,0 +1,169 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"sword", []string{"sword"}},
+		{"  get   sword  chest ", []string{"get", "sword", "chest"}},
+		{"tab\tseparated", []string{"tab", "separated"}},
+		{`"big sword" chest`, []string{"big sword", "chest"}},
+		{`'big sword' "old chest"`, []string{"big sword", "old chest"}},
+		{`"it's" here`, []string{"it's", "here"}},
+		{`'say "hi"'`, []string{`say "hi"`}},
+		{"don't stop", []string{"don't", "stop"}},
+		{`"unterminated quote`, []string{"unterminated quote"}},
+		{`"" empty`, []string{"", "empty"}},
+		{`"big"sword`, []string{"bigsword"}},
+		{"2.sword all.coin", []string{"2.sword", "all.coin"}},
+	}
+	for _, test := range tests {
+		if got := tokenize(test.in); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestSplitVerb(t *testing.T) {
+	tests := []struct {
+		in, verb, rest string
+	}{
+		{"", "", ""},
+		{"  look  ", "look", ""},
+		{"get sword from chest", "get", "sword from chest"},
+		{"say   hello there ", "say", "hello there"},
+		{"'hello", "'", "hello"},
+		{"' hello", "'", "hello"},
+		{":waves", ":", "waves"},
+		{"2.sword", "2.sword", ""},
+	}
+	for _, test := range tests {
+		if verb, rest := splitVerb(test.in); verb != test.verb || rest != test.rest {
+			t.Errorf("splitVerb(%q) = %q, %q; want %q, %q", test.in, verb, rest, test.verb, test.rest)
+		}
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Target
+	}{
+		{"sword", Target{Keyword: "sword", Index: 1}},
+		{"SWord", Target{Keyword: "sword", Index: 1}},
+		{"2.sword", Target{Keyword: "sword", Index: 2}},
+		{"10.Sword", Target{Keyword: "sword", Index: 10}},
+		{"all", Target{All: true, Index: 1}},
+		{"ALL", Target{All: true, Index: 1}},
+		{"all.coin", Target{Keyword: "coin", Index: 1, All: true}},
+		{"all.", Target{Index: 1, All: true}},
+		// not ordinals, so the dot is part of the keyword
+		{"0.sword", Target{Keyword: "0.sword", Index: 1}},
+		{"-1.sword", Target{Keyword: "-1.sword", Index: 1}},
+		{"big.sword", Target{Keyword: "big.sword", Index: 1}},
+	}
+	for _, test := range tests {
+		if got := ParseTarget(test.in); got != test.want {
+			t.Errorf("ParseTarget(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestTargetMatches(t *testing.T) {
+	keywords := []string{"long", "Sword"}
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"sword", true},
+		{"sw", true},
+		{"s", true},
+		{"SWO", true},
+		{"lo", true},
+		{"swords", false},
+		{"word", false},
+		{"axe", false},
+		{"all", true},
+		{"all.sw", true},
+		{"2.long", true},
+	}
+	for _, test := range tests {
+		if got := ParseTarget(test.target).Matches(keywords); got != test.want {
+			t.Errorf("%q matches %q = %v, want %v", test.target, keywords, got, test.want)
+		}
+	}
+}
+
+func TestTargetSelect(t *testing.T) {
+	items := []string{"long sword", "small dagger", "short sword", "sword cane", "shield"}
+	keywords := func(i int) []string { return strings.Fields(items[i]) }
+	tests := []struct {
+		target string
+		want   []int
+	}{
+		{"sword", []int{0}},
+		{"1.sword", []int{0}},
+		{"2.sword", []int{2}},
+		{"3.sword", []int{3}},
+		{"4.sword", nil},
+		{"sh", []int{2}},
+		{"2.sh", []int{4}},
+		{"all.sword", []int{0, 2, 3}},
+		{"all.s", []int{0, 1, 2, 3, 4}},
+		{"all", []int{0, 1, 2, 3, 4}},
+		{"all.axe", nil},
+		{"axe", nil},
+	}
+	for _, test := range tests {
+		if got := ParseTarget(test.target).Select(len(items), keywords); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Select(%q) = %v, want %v", test.target, got, test.want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	r := NewCommandRegistry()
+	for _, cmd := range []*Command{
+		{Name: "north", Aliases: []string{"n"}},
+		{Name: "news"},
+		{Name: "look", Aliases: []string{"l"}},
+		{Name: "quit", MinAbbrev: 4},
+	} {
+		r.Register(cmd)
+	}
+	tests := []struct {
+		verb, want string
+	}{
+		{"north", "north"},
+		{"n", "north"},
+		{"ne", "news"},
+		{"no", "north"},
+		{"new", "news"},
+		{"NEWS", "news"},
+		{"l", "look"},
+		{"lo", "look"},
+		{"quit", "quit"},
+		{"qui", ""},
+		{"looking", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		cmd, ok := r.Lookup(test.verb)
+		got := ""
+		if ok {
+			got = cmd.Name
+		}
+		if got != test.want {
+			t.Errorf("Lookup(%q) = %q, want %q", test.verb, got, test.want)
+		}
+	}
+}
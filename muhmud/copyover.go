@@ -0,0 +1,550 @@
+// Contains copyover: restarting the server, e.g. to run a new binary, without
+// disconnecting anybody.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/diddydum/muhmud/muhmud/markup"
+	"github.com/diddydum/muhmud/muhmud/telnet"
+)
+
+// copyoverEnv is the environment variable telling a server that it was started
+// by a copyover, naming the file the previous process left its state in.
+const copyoverEnv = "MUHMUD_COPYOVER"
+
+// closeResume is the websocket close code telling a client that the server is
+// restarting and that it should reconnect straight away, passing the reason
+// of the close frame as the resume query parameter.
+const closeResume = 4001
+
+// resumeTTL is how long websocket clients have to reconnect after a copyover
+// before they're sent to the character select menu like any other.
+const resumeTTL = 2 * time.Minute
+
+// A copyover goes like this:
+//
+//  1. The new binary is checked by running its validate-world command, so a
+//     broken deploy doesn't take everybody down with it.
+//  2. On the game loop, which stays blocked from here on so nothing changes
+//     under our feet, the listeners are made to survive exec and the file
+//     the state is handed over in is created. If either fails, the copyover
+//     is called off before anything has changed.
+//  3. Every outbox is closed for copyover. Websocket clients are sent a
+//     closeResume frame carrying a resume token and disconnect; telnet
+//     writers stop without closing their connections, and telnet readers
+//     are stopped with a read deadline.
+//  4. Once the writers and readers have stopped, compression on telnet
+//     connections is ended and the telnet sockets are made to survive exec.
+//     The state of the telnet connections and the resume tokens are written
+//     to the file, every character in the world is saved, and the binary is
+//     executed in place of the current process.
+//  5. The new process finds the file through copyoverEnv, takes over the
+//     listeners and telnet sockets and puts each connection back to playing
+//     what it was playing. Websocket clients do the same when they reconnect
+//     with their resume token.
+//
+// Whatever isn't saved is lost as it would be in a restart: fights, NPCs,
+// items lying around and telnet players still logging in. If writing the
+// state or exec fails after step 3 there's nobody left to carry on with, so
+// the file is removed and the server shuts down.
+
+// copyoverState is what one process hands over to the next.
+type copyoverState struct {
+	// HTTPListener and TelnetListener are the file descriptors of the
+	// listeners; TelnetListener is -1 if telnet is turned off.
+	HTTPListener   int
+	TelnetListener int
+	Telnet         []telnetHandover
+	Resumes        []resumeTicket
+}
+
+// telnetHandover is a telnet connection handed over by a copyover.
+type telnetHandover struct {
+	FD        int
+	Email     string
+	SessionID string
+	// Character is the name of the character being played, or empty if the
+	// connection was at the character select menu.
+	Character string
+	GMCP      []string
+	Telnet    telnet.State
+}
+
+// resumeTicket lets a websocket client disconnected by a copyover carry on
+// where it left off.
+type resumeTicket struct {
+	// Hash is the hash of the resume token given to the client.
+	Hash      string
+	Email     string
+	SessionID string
+	Character string
+	GMCP      []string
+}
+
+// Copyover restarts the server in place, handing its connections over to the
+// new process.
+type Copyover struct {
+	// mux makes sure only one copyover is attempted at a time.
+	mux    sync.Mutex
+	live   *LiveConfig
+	game   *GameState
+	http   net.Listener
+	telnet net.Listener
+	// shutdown takes the server down if a copyover fails half way.
+	shutdown *Shutdown
+}
+
+// NewCopyover creates a Copyover for the server made up of game and the
+// listeners, which shuts down with shutdown if it fails half way; telnet is
+// nil if telnet is turned off.
+func NewCopyover(live *LiveConfig, game *GameState, http, telnet net.Listener, shutdown *Shutdown) *Copyover {
+	return &Copyover{live: live, game: game, http: http, telnet: telnet, shutdown: shutdown}
+}
+
+// Run executes the server's binary again, handing everything over to it. It
+// only returns if the copyover failed: if it couldn't start nothing has
+// changed, otherwise the server is shutting down. It must not be called from
+// the game loop.
+func (co *Copyover) Run() error {
+	co.mux.Lock()
+	defer co.mux.Unlock()
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if out, err := exec.Command(exe, "validate-world").CombinedOutput(); err != nil {
+		return fmt.Errorf("%s validate-world failed: %s\n%s", exe, err, bytes.TrimSpace(out))
+	}
+	co.game.do(func() { err = co.handOver(exe) })
+	if _, ok := err.(copyoverAborted); ok {
+		log.Println("Shutting down after the copyover failed:", err)
+		go co.shutdown.RunNow()
+	}
+	return err
+}
+
+// handOver does the copyover once the new binary has been checked. It must be
+// called from the game loop. If it fails after the connections were closed for
+// the copyover it returns a copyoverAborted, and the server has to shut down.
+func (co *Copyover) handOver(exe string) error {
+	s := co.game
+	if s.closing {
+		return errShuttingDown
+	}
+	st := copyoverState{TelnetListener: -1}
+	var err error
+	if st.HTTPListener, err = inheritable(co.http); err != nil {
+		return err
+	}
+	if co.telnet != nil {
+		if st.TelnetListener, err = inheritable(co.telnet); err != nil {
+			// keep the HTTP listener out of whatever gets executed next
+			syscall.CloseOnExec(st.HTTPListener)
+			return err
+		}
+	}
+	// the state has to be written somewhere once it's too late to back out
+	f, err := createCopyoverFile()
+	if err != nil {
+		syscall.CloseOnExec(st.HTTPListener)
+		if st.TelnetListener >= 0 {
+			syscall.CloseOnExec(st.TelnetListener)
+		}
+		return err
+	}
+
+	// there's no going back from here on
+	log.Printf("Copying over to %s\n", exe)
+	var telnets []*Connection
+	st.Resumes, telnets = s.closeForCopyover()
+	s.dropLogins(co.live.Get().WriteTimeout)
+
+	// wait for the writers to finish and the telnet readers to stop, so that
+	// whatever the players typed stays in the telnet connections' buffers
+	var stopping []<-chan struct{}
+	for _, conn := range s.Connections {
+		stopping = append(stopping, conn.out.Finished())
+	}
+	for _, conn := range telnets {
+		conn.telnet.SetReadDeadline(time.Now())
+		stopping = append(stopping, conn.readStopped)
+	}
+	timeout := time.After(co.live.Get().WriteTimeout)
+wait:
+	for _, stopped := range stopping {
+		select {
+		case <-stopped:
+		case <-timeout:
+			break wait
+		}
+	}
+	for _, conn := range telnets {
+		select {
+		case <-conn.out.Finished():
+		default:
+			log.Printf("Dropping %s, whose telnet connection didn't finish writing in time", conn.Player.Email)
+			continue
+		}
+		select {
+		case <-conn.readStopped:
+		default:
+			log.Printf("Dropping %s, whose telnet connection didn't stop reading in time", conn.Player.Email)
+			continue
+		}
+		h, err := handOverTelnet(conn)
+		if err != nil {
+			log.Printf("Unable to hand over the telnet connection of %s: %s", conn.Player.Email, err)
+			continue
+		}
+		st.Telnet = append(st.Telnet, h)
+	}
+	if err := saveCopyover(f, st); err != nil {
+		return s.abortCopyover(f.Name(), telnets, err)
+	}
+	s.autosave()
+	if err := s.Store.Close(); err != nil {
+		log.Println("Got error when closing the database", err)
+	}
+
+	log.Printf("Handing over %d telnet connections and %d websocket clients\n", len(st.Telnet), len(st.Resumes))
+	env := []string{copyoverEnv + "=" + f.Name()}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, copyoverEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	err = syscall.Exec(exe, os.Args, env)
+	return s.abortCopyover(f.Name(), telnets, err)
+}
+
+// copyoverAborted is the error of a copyover that failed after the connections
+// were closed for it.
+type copyoverAborted struct{ err error }
+
+func (e copyoverAborted) Error() string {
+	return "copyover failed half way: " + e.err.Error()
+}
+
+// abortCopyover cleans up after a copyover that failed half way: the state
+// file is removed, the telnet players are told to connect again and their
+// readers are sent back to closing their connections. Everybody else's
+// outboxes are already closed, so all that's left is to shut down. It must be
+// called from the game loop.
+func (s *GameState) abortCopyover(file string, telnets []*Connection, err error) error {
+	os.Remove(file)
+	for _, conn := range telnets {
+		conn.telnet.SetWriteDeadline(time.Now().Add(time.Second))
+		fmt.Fprint(conn.telnet, "\nThe server couldn't restart; please connect again in a moment.\n")
+	}
+	close(s.copyoverFailed)
+	return copyoverAborted{err}
+}
+
+// closeForCopyover closes every outbox for copyover, returning the tickets the
+// websocket clients can resume with and the telnet connections to hand over
+// once their writers have stopped. It must be called from the game loop.
+func (s *GameState) closeForCopyover() (resumes []resumeTicket, telnets []*Connection) {
+	for _, conn := range s.Connections {
+		conn.send(NewNotification("%rThe world pauses for a moment while the server restarts...%n"))
+		if conn.telnet != nil {
+			telnets = append(telnets, conn)
+			conn.out.CloseForCopyover("")
+			continue
+		}
+		// the client may well come back with the token it resumes link-dead
+		// connections with, so that's the one to use
+		token := conn.resume
+		if token == "" {
+			var err error
+			if token, _, err = newToken(); err != nil {
+				log.Printf("Unable to make a resume token for %s: %s", conn.Player.Email, err)
+				s.disconnect(conn.ID)
+				continue
+			}
+		}
+		resumes = append(resumes, resumeTicket{
+			Hash:      hashToken(token),
+			Email:     conn.Player.Email,
+			SessionID: conn.SessionID,
+			Character: playing(conn),
+			GMCP:      gmcpPackages(conn),
+		})
+		conn.out.CloseForCopyover(token)
+	}
+	return resumes, telnets
+}
+
+// dropLogins tells the telnet players still logging in to connect again, as
+// their connections close with the exec. It must be called from the game loop.
+func (s *GameState) dropLogins(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for conn := range s.loggingIn {
+		conn.SetWriteDeadline(deadline)
+		fmt.Fprint(conn, "\nThe server is restarting; please connect again in a moment.\n")
+	}
+}
+
+// handOverTelnet gets a telnet connection whose writer and reader have stopped
+// ready for the next process.
+func handOverTelnet(conn *Connection) (telnetHandover, error) {
+	ts, err := conn.telnet.Suspend()
+	if err != nil {
+		return telnetHandover{}, err
+	}
+	fd, err := inheritable(conn.netConn)
+	if err != nil {
+		return telnetHandover{}, err
+	}
+	return telnetHandover{
+		FD:        fd,
+		Email:     conn.Player.Email,
+		SessionID: conn.SessionID,
+		Character: playing(conn),
+		GMCP:      gmcpPackages(conn),
+		Telnet:    ts,
+	}, nil
+}
+
+// playing returns the name of the character being played on conn, or "" if
+// there isn't one.
+func playing(conn *Connection) string {
+	if conn.Character == nil {
+		return ""
+	}
+	return conn.Character.Name
+}
+
+// gmcpPackages lists the GMCP packages conn asked for.
+func gmcpPackages(conn *Connection) []string {
+	var pkgs []string
+	for p, on := range conn.GMCP {
+		if on {
+			pkgs = append(pkgs, p)
+		}
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+// inheritable returns the file descriptor of a listener or connection, after
+// making sure it stays open across exec.
+func inheritable(v interface{}) (int, error) {
+	sc, ok := v.(syscall.Conn)
+	if !ok {
+		return -1, fmt.Errorf("can't get the file descriptor of a %T", v)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	var ferr error
+	err = raw.Control(func(p uintptr) {
+		// clearing FD_CLOEXEC, which Go sets on everything it opens
+		if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, p, syscall.F_SETFD, 0); errno != 0 {
+			ferr = errno
+			return
+		}
+		fd = int(p)
+	})
+	if err == nil {
+		err = ferr
+	}
+	return fd, err
+}
+
+// createCopyoverFile creates the file the state is handed over in.
+func createCopyoverFile() (*os.File, error) {
+	file := filepath.Join(os.TempDir(), fmt.Sprintf("muhmud-copyover-%d.json", os.Getpid()))
+	return os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+}
+
+// saveCopyover writes st to f for the next process, closing it.
+func saveCopyover(f *os.File, st copyoverState) error {
+	err := json.NewEncoder(f).Encode(st)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// loadCopyover reads the state left behind by the previous process, if this
+// one was started by a copyover, and returns nil otherwise.
+func loadCopyover() (*copyoverState, error) {
+	file := os.Getenv(copyoverEnv)
+	if file == "" {
+		return nil, nil
+	}
+	os.Unsetenv(copyoverEnv)
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(file)
+	var st copyoverState
+	if err := json.Unmarshal(bs, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// listen listens on addr, or takes over the listener inherited as fd unless
+// it's -1.
+func listen(addr string, fd int) (net.Listener, error) {
+	if fd < 0 {
+		return net.Listen("tcp", addr)
+	}
+	f := os.NewFile(uintptr(fd), addr)
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// restoreCopyover picks up the connections handed over by the previous
+// process.
+func restoreCopyover(st *copyoverState, s *GameState, sessions *SessionManager, live *LiveConfig) {
+	s.do(func() {
+		for _, t := range st.Resumes {
+			hash := t.Hash
+			s.resumes[hash] = t
+			s.After(resumeTTL, func() { delete(s.resumes, hash) })
+		}
+	})
+	config := live.Get()
+	for _, h := range st.Telnet {
+		go resumeTelnet(s, sessions, config, h)
+	}
+	log.Printf("Picked up %d telnet connections and %d websocket clients after copyover\n", len(st.Telnet), len(st.Resumes))
+}
+
+// Rejoin connects a player whose connection was handed over by a copyover,
+// like ConnectPlayer, going back to playing the character they were playing.
+func (s *GameState) Rejoin(email, sessionID string, r markup.Renderer, character string, gmcp []string) (connID ConnectionID, out *Outbox, err error) {
+	s.do(func() { connID, out, err = s.rejoin(email, sessionID, r, character, gmcp) })
+	return connID, out, err
+}
+
+// Resume connects a websocket client that reconnected with the token it was
+// given, like ConnectPlayer. If its connection is still around, having lost
+// its link, the client takes it over and replay holds the messages after the
+// one numbered seq that it should be sent first; see linkdead.go. Otherwise
+// the connection was handed over by a copyover, whose tokens are only good
+// once. Without a good token the client starts at the character select menu.
+func (s *GameState) Resume(email, sessionID string, r markup.Renderer, token string, seq uint64) (connID ConnectionID, out *Outbox, replay []Message, err error) {
+	var conn *Connection
+	var finished <-chan struct{}
+	s.do(func() { conn, finished = s.beginTakeOver(email, token) })
+	if conn != nil {
+		// the old link's writer is waited for here rather than on the game
+		// loop, which has better things to do
+		timeout := time.NewTimer(takeOverTimeout)
+		defer timeout.Stop()
+		stopped := false
+		select {
+		case <-finished:
+			stopped = true
+		case <-timeout.C:
+		}
+		s.do(func() {
+			if replay, err = s.finishTakeOver(conn, seq, stopped); err == nil {
+				conn.SessionID, conn.Renderer = sessionID, r
+				connID, out = conn.ID, conn.out
+			}
+		})
+		return connID, out, replay, err
+	}
+
+	s.do(func() {
+		hash := hashToken(token)
+		t, ok := s.resumes[hash]
+		if !ok || t.Email != email {
+			connID, out, err = s.connect(email, sessionID, r)
+			return
+		}
+		delete(s.resumes, hash)
+		connID, out, err = s.rejoin(email, sessionID, r, t.Character, t.GMCP)
+	})
+	return connID, out, replay, err
+}
+
+// rejoin is Rejoin on the game loop. The player may have connected again
+// since the copyover, so the session policy applies as usual, and the
+// character is taken over from any connection playing it.
+func (s *GameState) rejoin(email, sessionID string, r markup.Renderer, character string, gmcp []string) (ConnectionID, *Outbox, error) {
+	conn, err := s.newConnection(email, sessionID, r)
+	if err != nil {
+		return -1, nil, err
+	}
+	if err := s.applySessionPolicy(conn); err != nil {
+		s.disconnect(conn.ID)
+		return -1, nil, err
+	}
+	for _, p := range gmcp {
+		conn.GMCP[p] = true
+	}
+	c := findCharacter(conn.Player, character)
+	if c == nil {
+		conn.send(NewNotification(characterMenu(conn.Player)))
+		return conn.ID, conn.out, nil
+	}
+	// nobody needs to hear about the character entering the game again
+	s.playCharacter(conn, c)
+	conn.send(NewNotification("The world comes back into focus.\n" + s.describeRoom(c, s.currentRoom(c))))
+	return conn.ID, conn.out, nil
+}
+
+// AttachTelnet records the telnet connection underneath a connection, so that
+// it can be handed over by a copyover. It returns the channel for the reader
+// of the connection to close once it stops for a copyover.
+func (s *GameState) AttachTelnet(connID ConnectionID, tc *telnet.Conn, netConn net.Conn) chan<- struct{} {
+	stopped := make(chan struct{})
+	s.do(func() {
+		if conn, ok := s.Connections[connID]; ok {
+			conn.telnet, conn.netConn, conn.readStopped = tc, netConn, stopped
+		}
+	})
+	return stopped
+}
+
+// copyoverOnSignal copies over whenever the server gets SIGUSR2.
+func copyoverOnSignal(co *Copyover) {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	for range usr2 {
+		log.Println("Got SIGUSR2, copying over")
+		if err := co.Run(); err != nil {
+			log.Println("Copyover failed:", err)
+		}
+	}
+}
+
+func cmdCopyover(ctx *CommandContext) {
+	s := ctx.State
+	if s.Copyover == nil {
+		ctx.Respond("Copyover isn't possible on this server.")
+		return
+	}
+	ctx.Respond("Copying over...")
+	c := ctx.Character
+	// copying over waits on the game loop, so it can't happen on it
+	go func() {
+		// only returns if the copyover didn't happen
+		err := s.Copyover()
+		log.Printf("Copyover requested by %s failed: %s", c.Name, err)
+		s.do(func() { s.NotifyCharacter(c, "Copyover failed: "+err.Error()) })
+	}()
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/diddydum/muhmud/muhmud/markup"
+	"github.com/diddydum/muhmud/muhmud/telnet"
+)
+
+// handedOver makes s pick up a copyover that handed over a websocket client
+// of email playing character, which resumes with token.
+func handedOver(s *GameState, email, character, token string) {
+	st := &copyoverState{TelnetListener: -1, Resumes: []resumeTicket{
+		{Hash: hashToken(token), Email: email, Character: character, GMCP: []string{"Char"}},
+	}}
+	restoreCopyover(st, s, nil, NewLiveConfig(defaultConfig()))
+}
+
+func TestResumeAfterCopyoverTakesCharacterOver(t *testing.T) {
+	for _, policy := range []SessionPolicy{AllowSessions, TakeoverSessions} {
+		s := newTestGame(t, "a@example.com")
+		s.do(func() { s.SessionPolicy = policy })
+		// the player connected again and picked the character before the
+		// client came back with its token
+		fresh, freshOut := enterGame(t, s, "a@example.com", "Alice")
+		handedOver(s, "a@example.com", "Alice", "token")
+
+		connID, out, _, err := s.Resume("a@example.com", "", markup.ANSI{}, "token", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := received(out); !strings.Contains(got, "The world comes back into focus.") {
+			t.Errorf("%s: resuming got:\n%s", policy, got)
+		}
+		var conns map[ConnectionID]bool
+		var freshPlaying *Character
+		s.do(func() {
+			conns = s.character("Alice").Connections
+			if conn, ok := s.Connections[fresh]; ok {
+				freshPlaying = conn.Character
+			}
+		})
+		if len(conns) != 1 || !conns[connID] {
+			t.Errorf("%s: Alice is played on %v, want only %d", policy, conns, connID)
+		}
+		if freshPlaying != nil {
+			t.Errorf("%s: the fresh connection is still playing %s", policy, freshPlaying.Name)
+		}
+		got := received(freshOut)
+		switch policy {
+		case AllowSessions:
+			if !strings.Contains(got, "Alice is being played from somewhere else now.") {
+				t.Errorf("%s: the fresh connection got:\n%s", policy, got)
+			}
+		case TakeoverSessions:
+			if !freshOut.Closed() {
+				t.Errorf("%s: the fresh connection wasn't closed", policy)
+			}
+		}
+	}
+}
+
+func TestResumeAfterCopyoverHonoursDenySessions(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	s.do(func() { s.SessionPolicy = DenySessions })
+	_, freshOut := enterGame(t, s, "a@example.com", "Alice")
+	handedOver(s, "a@example.com", "Alice", "token")
+
+	if _, _, _, err := s.Resume("a@example.com", "", markup.ANSI{}, "token", 0); err != errAlreadyConnected {
+		t.Errorf("Resume() = %v, want errAlreadyConnected", err)
+	}
+	if freshOut.Closed() {
+		t.Error("the fresh connection was closed")
+	}
+}
+
+func TestCopyoverHandsWebsocketClientsOver(t *testing.T) {
+	old := newTestGame(t, "a@example.com")
+	connID, out := enterGame(t, old, "a@example.com", "Alice")
+	var resumes []resumeTicket
+	var telnets []*Connection
+	old.do(func() {
+		old.Connections[connID].GMCP["Char"] = true
+		resumes, telnets = old.closeForCopyover()
+	})
+	if len(telnets) != 0 {
+		t.Errorf("closeForCopyover() handed over %d telnet connections, want none", len(telnets))
+	}
+	if got := received(out); !strings.Contains(got, "The world pauses for a moment while the server restarts...") {
+		t.Errorf("the client got:\n%s", got)
+	}
+	token, ok := out.ClosedForCopyover()
+	if !ok || token == "" {
+		t.Fatalf("ClosedForCopyover() = %q, %v, want a token", token, ok)
+	}
+	if len(resumes) != 1 {
+		t.Fatalf("closeForCopyover() gave %d resume tickets, want 1", len(resumes))
+	}
+	if r := resumes[0]; r.Hash != hashToken(token) || r.Email != "a@example.com" || r.Character != "Alice" || len(r.GMCP) != 1 || r.GMCP[0] != "Char" {
+		t.Errorf("closeForCopyover() gave the ticket %+v", r)
+	}
+
+	// the next process picks the state up from the file
+	f, err := createCopyoverFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveCopyover(f, copyoverState{TelnetListener: -1, Resumes: resumes}); err != nil {
+		t.Fatal(err)
+	}
+	file := f.Name()
+	os.Setenv(copyoverEnv, file)
+	st, err := loadCopyover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st == nil || len(st.Resumes) != 1 || st.Resumes[0].Hash != resumes[0].Hash {
+		t.Fatalf("loadCopyover() = %+v", st)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("loadCopyover() left %s behind", file)
+	}
+	if os.Getenv(copyoverEnv) != "" {
+		t.Errorf("loadCopyover() left %s set", copyoverEnv)
+	}
+
+	// the new process starts over the store the old one saved to
+	s, err := InitialState(old.Store, old.World)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoreCopyover(st, s, nil, NewLiveConfig(defaultConfig()))
+	_, out, _, err = s.Resume("a@example.com", "", markup.ANSI{}, token, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := received(out); !strings.Contains(got, "The world comes back into focus.") {
+		t.Errorf("resuming got:\n%s", got)
+	}
+	// the ticket is only good once
+	_, out, _, err = s.Resume("a@example.com", "", markup.ANSI{}, token, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := received(out); strings.Contains(got, "The world comes back into focus.") {
+		t.Errorf("resuming again got:\n%s", got)
+	}
+}
+
+func TestCopyoverTellsLoginsToConnectAgain(t *testing.T) {
+	s := newTestGame(t)
+	fake := &fakeTelnetConn{}
+	loggedIn := s.trackLogin(telnet.NewConn(fake))
+	s.do(func() { s.dropLogins(time.Second) })
+	if got := fake.out.String(); !strings.Contains(got, "The server is restarting; please connect again in a moment.") {
+		t.Errorf("the player logging in got %q", got)
+	}
+
+	loggedIn()
+	fake.out.Reset()
+	s.do(func() { s.dropLogins(time.Second) })
+	if fake.out.Len() != 0 {
+		t.Errorf("the player who logged in got %q", fake.out.String())
+	}
+}
+
+// closeOnExec reports whether the file descriptor of l is closed on exec.
+func closeOnExec(t *testing.T, l net.Listener) bool {
+	t.Helper()
+	raw, err := l.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flags uintptr
+	var errno syscall.Errno
+	if err := raw.Control(func(fd uintptr) {
+		flags, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFD, 0)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	return flags&syscall.FD_CLOEXEC != 0
+}
+
+// plainListener hides the file descriptor of a listener.
+type plainListener struct{ net.Listener }
+
+func TestFailedCopyoverKeepsListenersClosedOnExec(t *testing.T) {
+	s := newTestGame(t)
+	http, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer http.Close()
+	if !closeOnExec(t, http) {
+		t.Fatal("the listener isn't closed on exec to start with")
+	}
+
+	co := NewCopyover(NewLiveConfig(defaultConfig()), s, http, plainListener{http}, nil)
+	s.do(func() { err = co.handOver("/bin/true") })
+	if err == nil {
+		t.Fatal("copied over without the telnet listener")
+	}
+	if !closeOnExec(t, http) {
+		t.Error("the HTTP listener is left open on exec")
+	}
+}
+
+func TestCopyoverNeedsItsStateFile(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	_, out := enterGame(t, s, "a@example.com", "Alice")
+	http, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer http.Close()
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", "/nonexistent")
+
+	co := NewCopyover(NewLiveConfig(defaultConfig()), s, http, nil, nil)
+	s.do(func() { err = co.handOver("/bin/true") })
+	if _, aborted := err.(copyoverAborted); err == nil || aborted {
+		t.Fatalf("handOver() = %v, want it called off", err)
+	}
+	if out.Closed() {
+		t.Error("closed the outbox without anywhere to write the state")
+	}
+	if !closeOnExec(t, http) {
+		t.Error("the HTTP listener is left open on exec")
+	}
+}
+
+func TestAbortedCopyover(t *testing.T) {
+	s := newTestGame(t)
+	f, err := createCopyoverFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	fake := &fakeTelnetConn{}
+	telnets := []*Connection{{telnet: telnet.NewConn(fake)}}
+	s.do(func() { err = s.abortCopyover(f.Name(), telnets, syscall.ENOEXEC) })
+	if _, ok := err.(copyoverAborted); !ok {
+		t.Errorf("abortCopyover() = %v", err)
+	}
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("left %s behind", f.Name())
+	}
+	if got := fake.out.String(); !strings.Contains(got, "The server couldn't restart; please connect again in a moment.") {
+		t.Errorf("the telnet player got %q", got)
+	}
+	select {
+	case <-s.copyoverFailed:
+	default:
+		t.Error("the telnet readers weren't sent back to closing their connections")
+	}
+}
@@ -0,0 +1,350 @@
+// Contains fighting: combat rounds, death and the commands for starting and
+// getting out of fights.
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diddydum/muhmud/muhmud/markup"
+)
+
+// combatRoundLength is how often everybody in a fight gets to attack.
+const combatRoundLength = 3 * time.Second
+
+// regenInterval is how often characters get back some of their hit points,
+// mana and movement.
+const regenInterval = 10 * time.Second
+
+// corpseDecay is how long a corpse lies around before rotting away.
+const corpseDecay = 5 * time.Minute
+
+// corpsePrototypeID is the id of the prototypes made up for corpses. It isn't
+// a prototype of the world, so a corpse that somehow ended up being saved
+// would be thrown away on loading; see World.ResolveItems.
+const corpsePrototypeID ItemPrototypeID = -1
+
+// combatant describes the character for the combat rules.
+func (c *Character) combatant() Combatant {
+	cb := Combatant{
+		Level:     c.Stats.Level,
+		Strength:  c.Stats.Strength,
+		Dexterity: c.Stats.Dexterity,
+		HP:        c.Stats.HP,
+		MaxHP:     c.Stats.MaxHP,
+		Damage:    fistDice,
+	}
+	if c.NPC != nil && c.NPC.Damage.Count > 0 {
+		cb.Damage = c.NPC.Damage
+	}
+	if w := wearing(c, WearWield); w != nil && w.Proto.Damage.Count > 0 {
+		cb.Damage = w.Proto.Damage
+	}
+	return cb
+}
+
+// combatRound has everybody who's fighting attack once. It must be called from
+// the game loop.
+func (s *GameState) combatRound() {
+	var fighters []*Character
+	for _, c := range s.everyone() {
+		if c.fighting != nil {
+			fighters = append(fighters, c)
+		}
+	}
+	for _, c := range fighters {
+		// somebody earlier in the round may have ended the fight
+		target := c.fighting
+		if target == nil {
+			continue
+		}
+		if target.Location != c.Location || !target.InWorld() {
+			c.fighting = nil
+			continue
+		}
+		s.attack(c, target)
+	}
+}
+
+// startFight has c start fighting target, getting the first blow in. It must
+// be called from the game loop.
+func (s *GameState) startFight(c, target *Character) {
+	c.fighting = target
+	s.attack(c, target)
+}
+
+// attack has attacker take a single swing at victim. It must be called from
+// the game loop.
+func (s *GameState) attack(attacker, victim *Character) {
+	damage := s.Rules.Attack(s.Rand, attacker.combatant(), victim.combatant())
+	verb := describeDamage(damage, victim.Stats.MaxHP)
+	s.NotifyCharacter(attacker, fmt.Sprintf("You %s %s.", verb.second, victim.Name))
+	s.NotifyCharacter(victim, fmt.Sprintf("%%r%s %s you.%%n", capitalize(attacker.Name), verb.third))
+	for _, c := range s.CharactersIn(attacker.Location) {
+		if c != attacker && c != victim {
+			s.NotifyCharacter(c, fmt.Sprintf("%s %s %s.", capitalize(attacker.Name), verb.third, victim.Name))
+		}
+	}
+	if victim.fighting == nil {
+		victim.fighting = attacker
+	}
+	victim.Stats.HP -= damage
+	s.sendVitals(victim)
+	if victim.Stats.HP <= 0 {
+		s.die(victim, attacker)
+	}
+}
+
+// stopFighting ends every fight c is in. It must be called from the game loop.
+func (s *GameState) stopFighting(c *Character) {
+	c.fighting = nil
+	for _, other := range s.everyone() {
+		if other.fighting == c {
+			other.fighting = nil
+		}
+	}
+}
+
+// die kills victim, leaving a corpse holding everything they carried. Players
+// are sent back to the start of the world, NPCs are gone until their reset
+// spawns another. It must be called from the game loop.
+func (s *GameState) die(victim, killer *Character) {
+	s.stopFighting(victim)
+	victim.wait, victim.queue = 0, nil
+	room := s.currentRoom(victim)
+
+	corpse := newItem(&ItemPrototype{
+		ID:       corpsePrototypeID,
+		Keywords: []string{"corpse", strings.ToLower(victim.Name)},
+		Short:    "the corpse of " + victim.Name,
+		Long:     fmt.Sprintf("The corpse of %s lies here.", victim.Name),
+		Flags:    ItemNoTake,
+		Capacity: totalWeight(victim.Inventory) + 1,
+	})
+	for _, it := range victim.Inventory {
+		it.Worn = WearNone
+	}
+	corpse.Contents, victim.Inventory = victim.Inventory, nil
+	room.Items = append(room.Items, corpse)
+	s.After(corpseDecay, func() { s.decay(room.ID, corpse) })
+
+	s.NotifyCharacter(victim, "%rYou have been KILLED!%n")
+	s.NotifyRoom(room.ID, fmt.Sprintf("%s has been killed by %s!", capitalize(victim.Name), killer.Name), victim)
+	if killer.NPC == nil && victim.Stats.Gold > 0 {
+		s.NotifyCharacter(killer, fmt.Sprintf("You take %d gold from the body.", victim.Stats.Gold))
+		killer.Stats.Gold += victim.Stats.Gold
+		victim.Stats.Gold = 0
+		s.saveCharacter(killer)
+	}
+	if victim.NPC != nil {
+		s.removeNPC(victim)
+		return
+	}
+
+	victim.Stats.HP = 1
+	victim.Location = s.World.Start
+	start := s.currentRoom(victim)
+	s.NotifyRoom(start.ID, fmt.Sprintf("%s appears in a flash of light, looking shaken.", victim.Name), victim)
+	s.NotifyCharacter(victim, "You wake up somewhere familiar.\n"+s.describeRoom(victim, start))
+	s.sendItems(victim)
+	s.SendGMCPCharacter(victim, "Room.Info", newRoomInfo(start))
+	s.sendVitals(victim)
+	s.saveCharacter(victim)
+}
+
+// decay rots a corpse away, spilling whatever was in it onto the floor. The
+// room is looked up again in case the world was reloaded in the meantime. It
+// must be called from the game loop.
+func (s *GameState) decay(id RoomID, corpse *Item) {
+	room, ok := s.World.Rooms[id]
+	if !ok {
+		return
+	}
+	for _, it := range room.Items {
+		if it == corpse {
+			room.Items = append(removeItem(room.Items, corpse), corpse.Contents...)
+			s.NotifyRoom(room.ID, capitalize(corpse.Name())+" rots away.", nil)
+			return
+		}
+	}
+}
+
+// regen gives everybody who isn't fighting back some of their hit points, mana
+// and movement. It must be called from the game loop.
+func (s *GameState) regen() {
+	for _, c := range s.everyone() {
+		if c.fighting != nil {
+			continue
+		}
+		st := &c.Stats
+		before := *st
+		st.HP = regenerate(st.HP, st.MaxHP)
+		st.Mana = regenerate(st.Mana, st.MaxMana)
+		st.Move = regenerate(st.Move, st.MaxMove)
+		if *st != before {
+			s.sendVitals(c)
+		}
+	}
+}
+
+// regenerate returns cur plus a tenth of max, but no more than max.
+func regenerate(cur, max int) int {
+	gain := max / 10
+	if gain < 1 {
+		gain = 1
+	}
+	if cur+gain > max {
+		return max
+	}
+	return cur + gain
+}
+
+// registerCombatCommands adds the commands for fighting.
+func registerCombatCommands(r *CommandRegistry) {
+	r.Register(&Command{
+		Name:      "kill",
+		MinAbbrev: 1,
+		Usage:     "<character>",
+		Help:      "Attack someone.",
+		Handler:   cmdKill,
+	})
+	r.Register(&Command{
+		Name:    "flee",
+		Help:    "Try to run away from a fight.",
+		Handler: cmdFlee,
+	})
+	r.Register(&Command{
+		Name:    "consider",
+		Usage:   "<character>",
+		Help:    "Size up how a fight with someone would go.",
+		Handler: cmdConsider,
+	})
+	r.Register(&Command{
+		Name:    "score",
+		Help:    "Show your character's level, attributes, hit points, mana and movement.",
+		Handler: cmdScore,
+	})
+}
+
+// findOpponent finds the character named by the command's argument in the
+// acting character's room, responding and returning nil if there isn't one.
+func findOpponent(ctx *CommandContext) *Character {
+	if len(ctx.Args) == 0 {
+		ctx.Respondf("%s whom?", capitalize(ctx.Command.Name))
+		return nil
+	}
+	chars := ctx.State.CharactersIn(ctx.Character.Location)
+	t := ParseTarget(ctx.Args[0])
+	t.All = false
+	picked := t.Select(len(chars), func(i int) []string { return chars[i].Keywords() })
+	if len(picked) == 0 {
+		ctx.Respondf("There's nobody called %s here.", markup.Escape(ctx.Args[0]))
+		return nil
+	}
+	return chars[picked[0]]
+}
+
+func cmdKill(ctx *CommandContext) {
+	c := ctx.Character
+	target := findOpponent(ctx)
+	switch {
+	case target == nil:
+		return
+	case target == c:
+		ctx.Respond("You give yourself a stern talking to.")
+		return
+	case c.fighting == target:
+		ctx.Respondf("You're doing your best to kill %s already!", target.Name)
+		return
+	case c.fighting != nil:
+		ctx.Respondf("You're busy fighting %s!", c.fighting.Name)
+		return
+	}
+	ctx.Respondf("You attack %s!", target.Name)
+	ctx.State.startFight(c, target)
+	ctx.Lag(combatRoundLength)
+}
+
+func cmdFlee(ctx *CommandContext) {
+	s, c := ctx.State, ctx.Character
+	if c.fighting == nil {
+		ctx.Respond("You aren't fighting anyone.")
+		return
+	}
+	ctx.Lag(combatRoundLength)
+	exit := s.randomExit(s.currentRoom(c))
+	if exit == nil || !s.Rules.Flee(s.Rand, c.combatant(), c.fighting.combatant()) {
+		ctx.Respond("You try to get away, but can't!")
+		s.NotifyRoom(c.Location, fmt.Sprintf("%s tries to flee, but can't get away.", c.Name), c)
+		return
+	}
+	to := s.World.Rooms[exit.To]
+	s.stopFighting(c)
+	s.NotifyRoom(c.Location, fmt.Sprintf("%s panics and flees!", c.Name), c)
+	s.move(c, exit, to)
+	ctx.Respondf("You flee %s!\n%s", exit.Label(), s.describeRoom(c, to))
+}
+
+// randomExit picks one of the exits of room a character could leave through, or
+// returns nil if there aren't any. It must be called from the game loop.
+func (s *GameState) randomExit(room *Room) *Exit {
+	var exits []*Exit
+	for _, e := range room.Exits {
+		if _, ok := s.World.Rooms[e.To]; ok && e.Passable() {
+			exits = append(exits, e)
+		}
+	}
+	if len(exits) == 0 {
+		return nil
+	}
+	return exits[s.Rand.Intn(len(exits))]
+}
+
+// considerMessages describe the ratings of CombatRules.Consider from -5 up.
+var considerMessages = []string{
+	"You could beat %s with your eyes closed.",
+	"%s is no match for you.",
+	"%s looks like an easy fight.",
+	"%s shouldn't give you much trouble.",
+	"%s would put up a bit of a fight.",
+	"It would be a fair fight with %s.",
+	"%s might just get the better of you.",
+	"%s looks tough.",
+	"You'd need a lot of luck to beat %s.",
+	"%s would make short work of you.",
+	"Fighting %s would be suicide.",
+}
+
+func cmdConsider(ctx *CommandContext) {
+	target := findOpponent(ctx)
+	if target == nil {
+		return
+	}
+	if target == ctx.Character {
+		ctx.Respond("You're about as tough as you are.")
+		return
+	}
+	rating := ctx.State.Rules.Consider(ctx.Character.combatant(), target.combatant()) + 5
+	if rating < 0 {
+		rating = 0
+	} else if rating >= len(considerMessages) {
+		rating = len(considerMessages) - 1
+	}
+	ctx.Respond(capitalize(fmt.Sprintf(considerMessages[rating], target.Name)))
+}
+
+func cmdScore(ctx *CommandContext) {
+	c := ctx.Character
+	st := c.Stats
+	lines := []string{
+		fmt.Sprintf("%s, level %d", c.Name, st.Level),
+		fmt.Sprintf("Hit points: %d/%d  Mana: %d/%d  Movement: %d/%d", st.HP, st.MaxHP, st.Mana, st.MaxMana, st.Move, st.MaxMove),
+		fmt.Sprintf("Str: %d  Dex: %d  Con: %d  Int: %d  Wis: %d", st.Strength, st.Dexterity, st.Constitution, st.Intelligence, st.Wisdom),
+		fmt.Sprintf("Gold: %d", st.Gold),
+	}
+	if c.fighting != nil {
+		lines = append(lines, fmt.Sprintf("You are fighting %s.", c.fighting.Name))
+	}
+	ctx.Respond(strings.Join(lines, "\n"))
+}
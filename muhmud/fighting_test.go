@@ -0,0 +1,197 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// character returns the character called name. It must be called from the
+// game loop.
+func (s *GameState) character(name string) *Character {
+	return s.Characters[strings.ToLower(name)]
+}
+
+// fightUntil runs combat rounds until done reports true, failing if that takes
+// too long.
+func fightUntil(t *testing.T, s *GameState, clock *FakeClock, done func() bool) {
+	t.Helper()
+	for round := 0; round < 100; round++ {
+		if done() {
+			return
+		}
+		clock.Advance(combatRoundLength)
+	}
+	t.Fatal("the fight went on and on")
+}
+
+// corpseIn returns the corpse in room, or nil. It must be called from the
+// game loop.
+func (s *GameState) corpseIn(room RoomID) *Item {
+	for _, it := range s.World.Rooms[room].Items {
+		if it.Proto.ID == corpsePrototypeID {
+			return it
+		}
+	}
+	return nil
+}
+
+func TestKillingPlayer(t *testing.T) {
+	s := newTestGame(t, "a@example.com", "b@example.com")
+	clock := startFakeClock(s)
+	alice, aliceOut := enterGame(t, s, "a@example.com", "Alice")
+	bob, bobOut := enterGame(t, s, "b@example.com", "Bob")
+	s.HandleCommand(bob, "", "get sword")
+	s.do(func() {
+		s.Rand = rand.New(rand.NewSource(1))
+		s.character("Alice").Stats.HP = 1000
+		s.character("Bob").Stats.HP = 8
+	})
+	received(aliceOut)
+	received(bobOut)
+
+	s.HandleCommand(alice, "", "kill bob")
+	var bobSaw []string
+	fightUntil(t, s, clock, func() bool {
+		bobSaw = append(bobSaw, received(bobOut))
+		return strings.Contains(bobSaw[len(bobSaw)-1], "You have been KILLED!")
+	})
+	if got := received(aliceOut); !strings.Contains(got, "Bob has been killed by Alice!") || !strings.Contains(got, "You take 20 gold from the body.") {
+		t.Errorf("Alice saw:\n%s", got)
+	}
+
+	var start RoomID
+	s.do(func() {
+		a, b := s.character("Alice"), s.character("Bob")
+		start = s.World.Start
+		if a.fighting != nil || b.fighting != nil {
+			t.Error("still fighting after Bob died")
+		}
+		if b.Stats.HP != 1 || b.Location != start || len(b.Inventory) != 0 || b.Stats.Gold != 0 {
+			t.Errorf("Bob came back with %+v in %d carrying %v", b.Stats, b.Location, b.Inventory)
+		}
+		if a.Stats.Gold != 40 {
+			t.Errorf("Alice has %d gold", a.Stats.Gold)
+		}
+		corpse := s.corpseIn(a.Location)
+		if corpse == nil || corpse.Name() != "the corpse of Bob" {
+			t.Fatalf("left behind %v", corpse)
+		}
+		if len(corpse.Contents) != 1 || corpse.Contents[0].Name() != "a rusty sword" {
+			t.Errorf("the corpse holds %v", corpse.Contents)
+		}
+	})
+
+	// the corpse rots away, dropping the sword
+	clock.Advance(corpseDecay)
+	s.do(func() {
+		room := s.World.Rooms[start]
+		if s.corpseIn(start) != nil {
+			t.Error("the corpse didn't rot away")
+		}
+		found := false
+		for _, it := range room.Items {
+			found = found || it.Name() == "a rusty sword"
+		}
+		if !found {
+			t.Errorf("the sword didn't fall out of the corpse: %v", room.Items)
+		}
+	})
+}
+
+// weaklingRules are CombatRules under which the strong always hit for 2 and
+// the weak always miss.
+type weaklingRules struct{ StandardRules }
+
+func (weaklingRules) Attack(rng RNG, attacker, defender Combatant) int {
+	if attacker.Strength < 5 {
+		return 0
+	}
+	return 2
+}
+
+func TestDamageAddsUp(t *testing.T) {
+	s := newTestGame(t, "a@example.com", "b@example.com")
+	clock := startFakeClock(s)
+	alice, aliceOut := enterGame(t, s, "a@example.com", "Alice")
+	enterGame(t, s, "b@example.com", "Bob")
+	s.do(func() {
+		s.Rules = weaklingRules{}
+		s.character("Bob").Stats.Strength = 1
+	})
+	received(aliceOut)
+
+	s.HandleCommand(alice, "", "kill bob")
+	for i := 0; i < 8; i++ {
+		clock.Advance(combatRoundLength)
+	}
+	s.do(func() {
+		// there's no regenerating while fighting
+		if hp := s.character("Bob").Stats.HP; hp != 20-9*2 {
+			t.Errorf("Bob has %d hit points after 9 hits", hp)
+		}
+		if hp := s.character("Alice").Stats.HP; hp != 20 {
+			t.Errorf("Alice has %d hit points without being hit", hp)
+		}
+	})
+	got := received(aliceOut)
+	if n := strings.Count(got, "You graze Bob."); n != 9 {
+		t.Errorf("Alice hit Bob %d times:\n%s", n, got)
+	}
+	if n := strings.Count(got, "Bob misses you."); n != 8 {
+		t.Errorf("Bob swung at Alice %d times:\n%s", n, got)
+	}
+}
+
+func TestKillingNPC(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	clock := startFakeClock(s)
+	alice, aliceOut := enterGame(t, s, "a@example.com", "Alice")
+	s.do(func() {
+		s.Rand = rand.New(rand.NewSource(2))
+		s.character("Alice").Stats.HP = 1000
+	})
+	received(aliceOut)
+
+	s.HandleCommand(alice, "", "kill guard")
+	fightUntil(t, s, clock, func() bool {
+		return strings.Contains(received(aliceOut), "A town guard has been killed by Alice!")
+	})
+	s.do(func() {
+		a := s.character("Alice")
+		for _, c := range s.CharactersIn(a.Location) {
+			if c.NPC != nil && c.NPC.ID == 1 {
+				t.Error("the guard is still around")
+			}
+		}
+		if a.Stats.Gold != 20+15 {
+			t.Errorf("Alice has %d gold", a.Stats.Gold)
+		}
+		if corpse := s.corpseIn(a.Location); corpse == nil || corpse.Name() != "the corpse of a town guard" {
+			t.Errorf("left behind %v", corpse)
+		}
+	})
+}
+
+func TestResolveCorpses(t *testing.T) {
+	s := newTestGame(t)
+	startFakeClock(s)
+	s.do(func() {
+		rabbit := s.npcsOf(4)[0]
+		s.die(rabbit, s.npcsOf(1)[0])
+		corpse := s.corpseIn(rabbit.Location)
+		if corpse == nil {
+			t.Fatal("the rabbit left no corpse")
+		}
+
+		// a reload keeps the corpses lying around
+		if got := s.World.ResolveItems("room", []*Item{corpse}); len(got) != 1 || got[0] != corpse {
+			t.Errorf("resolved a corpse left over from a reload to %v", got)
+		}
+		// but one that was saved comes back without a name, so it's thrown away
+		saved := itemsFromRecords(itemRecords([]*Item{corpse}))
+		if got := s.World.ResolveItems("Alice", saved); len(got) != 0 {
+			t.Errorf("resolved a saved corpse to %v", got)
+		}
+	})
+}
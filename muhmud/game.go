@@ -2,53 +2,194 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
-	"sync"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/diddydum/muhmud/muhmud/markup"
+	"github.com/diddydum/muhmud/muhmud/telnet"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // The current hash cost to use for bcrypt - up this as needed.
 var hashCost = 4
 
-// GameState is a container for all state related to the game
+// unknownUserHash is compared against when logging in to an account that
+// doesn't exist, so that takes as long as getting the password wrong and
+// doesn't give away which accounts there are.
+var unknownUserHash, _ = bcrypt.GenerateFromPassword([]byte("unknown user"), hashCost)
+
+// GameState is a container for all state related to the game. It belongs to the
+// game loop; see loop.go.
 type GameState struct {
 	// Mapping from email to player
-	Players          map[string]Player
-	Connections      map[ConnectionID]chan<- string
+	Players map[string]*Player
+	// Mapping from lower cased name to character
+	Characters map[string]*Character
+	// NPCs are the non-player characters in the world; see npcs.go.
+	NPCs             []*Character
+	Connections      map[ConnectionID]*Connection
+	World            *World
 	NextConnectionID ConnectionID
-	mux              sync.Mutex
+	// Commands are available while playing a character, SelectCommands while
+	// choosing one.
+	Commands       *CommandRegistry
+	SelectCommands *CommandRegistry
+	// GMCPPackages are the GMCP packages clients may ask for.
+	GMCPPackages *GMCPRegistry
+	// Channels are the chat channels characters can join.
+	Channels *ChannelRegistry
+	// Store is where accounts, characters and world changes are persisted.
+	Store Store
+	// OutboxSize and OverflowPolicy configure the outbox of every new
+	// connection.
+	OutboxSize     int
+	OverflowPolicy OverflowPolicy
+	// LinkDeadGrace is how long a websocket connection whose link dropped
+	// waits for its client to resume it; see linkdead.go.
+	LinkDeadGrace time.Duration
+	// SessionPolicy decides what happens when a player connects more than
+	// once; see multisession.go.
+	SessionPolicy SessionPolicy
+	// Clock is where the game gets the time from, and PulseLength how often
+	// it ticks; see scheduler.go. Pulse counts the ticks so far.
+	Clock       Clock
+	PulseLength time.Duration
+	Pulse       uint64
+	// Rules decide how fights go, drawing on Rand; see fighting.go.
+	Rules CombatRules
+	Rand  RNG
+	// Reload reloads the configuration and the world, for the reload
+	// command. It's nil if the server can't reload.
+	Reload func() ReloadReport
+	// Copyover restarts the server without disconnecting anybody, for the
+	// copyover command. It's nil if the server can't copy over, and only
+	// returns if the copyover didn't happen.
+	Copyover func() error
+	// resumes are the tickets of websocket clients yet to reconnect after a
+	// copyover, by the hash of their token; see copyover.go.
+	resumes map[string]resumeTicket
+	// loggingIn are the telnet connections still at the login prompt, which
+	// a copyover can't hand over; see telnet.go.
+	loggingIn map[*telnet.Conn]bool
+	// copyoverFailed is closed when a copyover fails after stopping the
+	// telnet readers, which then go back to closing their connections.
+	copyoverFailed chan struct{}
+	// admins are the emails of the accounts that are admins; see SetAdmins.
+	admins map[string]bool
+	// closing is set once the server starts shutting down, after which no new
+	// connections are accepted; see shutdown.go.
+	closing   bool
+	scheduled []*scheduledEvent
+	events    chan event
 }
 
-// InitialState sets up a new initial state for the game
-func InitialState() (*GameState, error) {
-	state := GameState{}
-	state.Players = make(map[string]Player)
-	state.Connections = make(map[ConnectionID]chan<- string)
+// InitialState sets up a new initial state for the game in world, loading
+// whatever was saved in store, and starts the game loop.
+func InitialState(store Store, world *World) (*GameState, error) {
+	state := GameState{Store: store}
+	state.Players = make(map[string]*Player)
+	state.Characters = make(map[string]*Character)
+	state.Connections = make(map[ConnectionID]*Connection)
+	state.resumes = make(map[string]resumeTicket)
+	state.loggingIn = make(map[*telnet.Conn]bool)
+	state.copyoverFailed = make(chan struct{})
 	state.NextConnectionID = 0
-	state.mux = sync.Mutex{}
+	state.OutboxSize = defaultOutboxSize
+	state.OverflowPolicy = DropNotifications
+	state.LinkDeadGrace = defaultLinkDeadGrace
+	state.SessionPolicy = AllowSessions
+	state.Clock = RealClock{}
+	state.PulseLength = defaultPulseLength
+	state.Rules = StandardRules{}
+	state.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	state.events = make(chan event, eventQueueSize)
+	state.Channels = NewChannelRegistry()
+	registerChannels(state.Channels)
+	state.Commands = NewCommandRegistry()
+	registerMovementCommands(state.Commands)
+	registerGeneralCommands(state.Commands)
+	registerCommCommands(state.Commands, state.Channels)
+	registerItemCommands(state.Commands)
+	registerCombatCommands(state.Commands)
+	registerShopCommands(state.Commands)
+	registerAdminCommands(state.Commands)
+	state.SelectCommands = NewCommandRegistry()
+	registerSelectCommands(state.SelectCommands)
+	state.GMCPPackages = NewGMCPRegistry()
+	registerGMCPPackages(state.GMCPPackages)
 
-	me, err := player("diddydum@gmail.com", "foobar")
+	state.World = world
+	doors, err := store.LoadDoorStates()
 	if err != nil {
 		return nil, err
 	}
-	state.Players[me.Email] = *me
-	you, err := player("bazbam@gmail.com", "bazbam")
+	world.ApplyDoorStates(doors)
+
+	players, err := store.LoadPlayers()
 	if err != nil {
 		return nil, err
 	}
-	state.Players[you.Email] = *you
+	for _, p := range players {
+		state.Players[p.Email] = p
+		for _, c := range p.Characters {
+			c.Inventory = world.ResolveItems(c.Name, c.Inventory)
+			c.Stats.fillVitals()
+			state.Characters[strings.ToLower(c.Name)] = c
+		}
+	}
 
+	state.Every(autosaveInterval, state.autosave)
+	state.Every(combatRoundLength, state.combatRound)
+	state.Every(regenInterval, state.regen)
+	state.reset()
+	state.Every(resetInterval, state.reset)
+	state.Every(npcInterval, state.npcsAct)
+	go state.run()
 	return &state, nil
 }
 
+// seedPlayers creates two accounts with well-known passwords to try things out
+// with if store doesn't have any accounts yet. It's only for development.
+func seedPlayers(store Store) error {
+	players, err := store.LoadPlayers()
+	if err != nil || len(players) > 0 {
+		return err
+	}
+	for _, login := range [][2]string{{"diddydum@gmail.com", "foobar"}, {"bazbam@gmail.com", "bazbam"}} {
+		p, err := player(login[0], login[1])
+		if err != nil {
+			return err
+		}
+		p.Verified = true
+		if err := store.SavePlayer(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Player describes a user that plays on the system. The player is distinct from
-// a character in the game.
+// a character in the game; a player's account may own several characters.
 type Player struct {
 	Email       string
 	PassHash    []byte
 	Connections map[ConnectionID]bool
+	Characters  []*Character
+	// Verified is set once the player has proven they own Email.
+	Verified bool
+	// Admin is set for the people running the game. It comes from the
+	// configuration rather than the store; see SetAdmins.
+	Admin bool
+	// Ignoring are the names of the characters the player doesn't want to
+	// hear from; see ignoring.
+	Ignoring []string
 }
 
 func player(email, password string) (*Player, error) {
@@ -66,81 +207,369 @@ type ConnectionID int
 // CheckPassword checks if the provided password is valid for the given
 // username. Returns nil on success, error on failure.
 func (s *GameState) CheckPassword(username, password string) error {
-	user, ok := s.Players[username]
+	var hash []byte
+	s.do(func() {
+		if user, ok := s.Players[username]; ok {
+			hash = user.PassHash
+		}
+	})
 
-	if !ok {
-		// TDO: Make sure to burn some cpu time so as not to discover unknown users
+	// compare outside of the game loop; bcrypt is deliberately slow
+	if hash == nil {
+		bcrypt.CompareHashAndPassword(unknownUserHash, []byte(password))
 		return errors.New("Unknown username " + username)
 	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password))
+}
+
+// Connection is a single client connected to the game.
+type Connection struct {
+	ID     ConnectionID
+	Player *Player
+	// SessionID is the login session the connection was authenticated with.
+	SessionID string
+	// Connected is when the connection was made.
+	Connected time.Time
+	// Character is the character being played on this connection, or nil
+	// while the player is still choosing one.
+	Character *Character
+	// Renderer turns the markup in messages into whatever the client
+	// understands.
+	Renderer markup.Renderer
+	// GMCP holds the lower cased names of the GMCP packages the client asked
+	// for.
+	GMCP map[string]bool
+	out  *Outbox
+	// telnet is the telnet connection of clients playing over telnet, and
+	// netConn the socket underneath it, for handing them over in a copyover.
+	// Both are nil for websockets. readStopped is closed once the reader of
+	// the telnet connection has stopped for a copyover.
+	telnet      *telnet.Conn
+	netConn     net.Conn
+	readStopped chan struct{}
+	// resume is the token a websocket client can resume the connection with
+	// after losing its link. link counts the websockets the connection has
+	// been linked to, dropLink closes the current one, and linkDead is set
+	// while there isn't one. resuming is set while a client is taking the
+	// connection over. See linkdead.go.
+	resume   string
+	link     int
+	dropLink func()
+	linkDead bool
+	resuming bool
+}
+
+// send renders the markup in msg for the connection's client and queues it.
+func (c *Connection) send(msg Message) {
+	msg.Msg = markup.Render(c.Renderer, msg.Msg)
+	c.out.Push(msg)
+}
 
-	return bcrypt.CompareHashAndPassword(user.PassHash, []byte(password))
+// ConnectPlayer connects a player to the game. The returned outbox receives
+// every message destined for the new connection and is closed on disconnect.
+// New connections start out at the character select menu. Text sent to the
+// connection is rendered with r.
+func (s *GameState) ConnectPlayer(email, sessionID string, r markup.Renderer) (connID ConnectionID, out *Outbox, err error) {
+	s.do(func() { connID, out, err = s.connect(email, sessionID, r) })
+	return connID, out, err
 }
 
-// ConnectPlayer connects a player to the game.
-func (s *GameState) ConnectPlayer(email string) (ConnectionID, <-chan string, error) {
-	s.mux.Lock()
-	defer s.mux.Unlock()
+// connect is ConnectPlayer on the game loop.
+func (s *GameState) connect(email, sessionID string, r markup.Renderer) (ConnectionID, *Outbox, error) {
+	conn, err := s.newConnection(email, sessionID, r)
+	if err != nil {
+		return -1, nil, err
+	}
+	if err := s.applySessionPolicy(conn); err != nil {
+		s.disconnect(conn.ID)
+		return -1, nil, err
+	}
+	conn.send(NewNotification(WelcomeMsg()))
+	conn.send(NewNotification(characterMenu(conn.Player)))
 
+	return conn.ID, conn.out, nil
+}
+
+// newConnection adds a connection for a player, with nothing sent to it yet.
+// It must be called from the game loop.
+func (s *GameState) newConnection(email, sessionID string, r markup.Renderer) (*Connection, error) {
+	if s.closing {
+		return nil, errShuttingDown
+	}
 	player, ok := s.Players[email]
 	if !ok {
-		return -1, nil, fmt.Errorf("tried to connect player %s but doesn't exist in our list", email)
+		return nil, fmt.Errorf("tried to connect player %s but doesn't exist in our list", email)
 	}
-	// for now, message everyone
-	if len(player.Connections) == 0 {
-		s.NotifyEveryone(fmt.Sprintf("%s has connected.", email))
-	}
-	mbox := make(chan string, 100)
-	mbox <- WelcomeMsg()
+	out := NewOutbox(s.OutboxSize, s.OverflowPolicy)
 
 	connID := s.NextConnectionID
 	s.NextConnectionID = s.NextConnectionID + 1
 
-	s.Connections[connID] = mbox
+	conn := &Connection{ID: connID, Player: player, SessionID: sessionID, Connected: s.Clock.Now(), Renderer: r, GMCP: make(map[string]bool), out: out}
+	s.Connections[connID] = conn
 	player.Connections[connID] = true
-
-	return connID, mbox, nil
+	return conn, nil
 }
 
 // DisconnectPlayer removes a connection from the game.
-func (s *GameState) DisconnectPlayer(connID ConnectionID) error {
-	s.mux.Lock()
-	defer s.mux.Unlock()
-	// TODO consider adding map connection->player
-	var player Player
-	for _, p := range s.Players {
-		if _, ok := p.Connections[connID]; ok {
-			player = p
-			break
+func (s *GameState) DisconnectPlayer(connID ConnectionID) (err error) {
+	s.do(func() { err = s.disconnect(connID) })
+	return err
+}
+
+// DisconnectSession closes every connection authenticated with a session,
+// telling them why first.
+func (s *GameState) DisconnectSession(sessionID, reason string) {
+	s.do(func() {
+		for connID, conn := range s.Connections {
+			if conn.SessionID == sessionID {
+				s.Notify(connID, reason)
+				s.disconnect(connID)
+			}
 		}
-	}
-	// check if we didn't find anything and complain
-	if player.Email == "" {
+	})
+}
+
+// DisconnectAccount closes every connection of a player, telling them why
+// first.
+func (s *GameState) DisconnectAccount(email, reason string) {
+	s.do(func() {
+		p, ok := s.Players[email]
+		if !ok {
+			return
+		}
+		for connID := range p.Connections {
+			s.Notify(connID, reason)
+			s.disconnect(connID)
+		}
+	})
+}
+
+// disconnect is DisconnectPlayer on the game loop.
+func (s *GameState) disconnect(connID ConnectionID) error {
+	conn, ok := s.Connections[connID]
+	if !ok {
 		return fmt.Errorf("can't find connectionID %v", connID)
 	}
 
-	// remove the connection, close the mbox, then notify everyone.
-	delete(player.Connections, connID)
-	mbox, ok := s.Connections[connID]
-	if !ok {
-		return fmt.Errorf("connection was found for player %s but not in connection map", player.Email)
+	// take the character out of the world, then remove the connection and
+	// close the outbox.
+	if conn.Character != nil {
+		s.leaveWorld(conn)
 	}
+	delete(conn.Player.Connections, connID)
 	delete(s.Connections, connID)
-	close(mbox)
+	conn.out.Close()
+	return nil
+}
+
+// enterWorld starts playing c on conn like playCharacter, letting the room know
+// if c wasn't in the world yet. It must be called from the game loop.
+func (s *GameState) enterWorld(conn *Connection, c *Character) {
+	entering := !c.InWorld()
+	s.playCharacter(conn, c)
+	if entering {
+		s.NotifyRoom(c.Location, fmt.Sprintf("%s has entered the game.", c.Name), c)
+	}
+}
 
-	if len(player.Connections) == 0 {
-		s.NotifyEveryone(fmt.Sprintf("%s has disconnected.", player.Email))
+// playCharacter starts playing c on conn, taking it over from any other
+// connection playing it, which goes back to the character select menu. It must
+// be called from the game loop.
+func (s *GameState) playCharacter(conn *Connection, c *Character) {
+	if _, ok := s.World.Rooms[c.Location]; !ok {
+		c.Location = s.World.Start
 	}
+	for connID := range c.Connections {
+		s.returnToMenu(s.Connections[connID])
+	}
+	conn.Character = c
+	c.Connections[conn.ID] = true
+	s.syncGMCP(conn)
+}
+
+// leaveWorld stops playing the character on conn, returning the connection to
+// the character select menu. It must be called from the game loop.
+func (s *GameState) leaveWorld(conn *Connection) {
+	c := conn.Character
+	delete(c.Connections, conn.ID)
+	conn.Character = nil
+	if !c.InWorld() {
+		s.stopFighting(c)
+		c.wait, c.queue = 0, nil
+		s.NotifyRoom(c.Location, fmt.Sprintf("%s has left the game.", c.Name), nil)
+		s.saveCharacter(c)
+	}
+}
+
+// saveCharacter persists c, logging rather than failing since there's nothing
+// the player could do about it. NPCs aren't saved; resets bring them back
+// instead. It must be called from the game loop.
+func (s *GameState) saveCharacter(c *Character) {
+	if c.NPC != nil {
+		return
+	}
+	if err := s.Store.SaveCharacter(c); err != nil {
+		log.Printf("Unable to save character %s: %s", c.Name, err)
+	}
+}
+
+// savePlayer persists p, logging rather than failing like saveCharacter. It
+// must be called from the game loop.
+func (s *GameState) savePlayer(p *Player) {
+	if err := s.Store.SavePlayer(p); err != nil {
+		log.Printf("Unable to save account %s: %s", p.Email, err)
+	}
+}
+
+// HandleRequest processes a raw frame sent by the client on connID by running
+// the command it contains. Anything said in reply to the request is sent back
+// to connID as a response carrying the same request id.
+func (s *GameState) HandleRequest(connID ConnectionID, frame []byte) (err error) {
+	s.do(func() { err = s.handleRequest(connID, frame) })
+	return err
+}
+
+// handleRequest is HandleRequest on the game loop.
+func (s *GameState) handleRequest(connID ConnectionID, frame []byte) error {
+	conn, ok := s.Connections[connID]
+	if !ok {
+		return fmt.Errorf("can't find connectionID %v", connID)
+	}
+	var req Message
+	if err := json.Unmarshal(frame, &req); err != nil {
+		s.Notify(connID, "Unable to understand that message.")
+		return fmt.Errorf("got a malformed message from %s: %s", conn.Player.Email, err)
+	}
+	if req.Type == GMCP && req.Version == ProtocolVersion {
+		return s.handleGMCP(conn, req.Package, req.Data)
+	}
+	if err := validateRequest(req); err != nil {
+		s.Respond(connID, req.RequestID, err.Error())
+		return nil
+	}
+	s.runCommand(conn, req.RequestID, req.Msg)
 	return nil
 }
 
-// NotifyEveryone sends a raw message to everyone.
+// HandleCommand runs a line typed by the client on connID, for clients that
+// don't speak in Messages such as telnet. Anything said in reply is sent back
+// as a response to requestID.
+func (s *GameState) HandleCommand(connID ConnectionID, requestID, line string) (err error) {
+	s.do(func() {
+		conn, ok := s.Connections[connID]
+		if !ok {
+			err = fmt.Errorf("can't find connectionID %v", connID)
+			return
+		}
+		s.runCommand(conn, requestID, line)
+	})
+	return err
+}
+
+// runCommand runs line as a command from conn, or queues it if the character
+// being played has to wait first. It must be called from the game loop.
+func (s *GameState) runCommand(conn *Connection, requestID, line string) {
+	c := conn.Character
+	if c == nil || (c.wait == 0 && len(c.queue) == 0) {
+		s.dispatch(conn, requestID, line)
+		return
+	}
+	if len(c.queue) >= maxQueuedCommands {
+		s.Respond(conn.ID, requestID, "You're trying to do too much at once; slow down.")
+		return
+	}
+	c.queue = append(c.queue, queuedCommand{connID: conn.ID, requestID: requestID, line: line})
+}
+
+// dispatch runs line with the commands available to conn straight away. It
+// must be called from the game loop.
+func (s *GameState) dispatch(conn *Connection, requestID, line string) {
+	ctx := &CommandContext{
+		State:     s,
+		Conn:      conn,
+		Player:    conn.Player,
+		Character: conn.Character,
+		ConnID:    conn.ID,
+		RequestID: requestID,
+	}
+	if conn.Character == nil {
+		s.SelectCommands.Dispatch(ctx, line)
+	} else {
+		s.Commands.Dispatch(ctx, line)
+	}
+}
+
+// Respond sends msg to a single connection as the response to requestID. It
+// must be called from the game loop.
+func (s *GameState) Respond(connID ConnectionID, requestID, msg string) {
+	if conn, ok := s.Connections[connID]; ok {
+		conn.send(NewResponse(requestID, msg))
+	}
+}
+
+// Notify sends msg to a single connection as a notification. It must be called
+// from the game loop.
+func (s *GameState) Notify(connID ConnectionID, msg string) {
+	if conn, ok := s.Connections[connID]; ok {
+		conn.send(NewNotification(msg))
+	}
+}
+
+// NotifyEveryone sends a notification to everyone. It must be called from the
+// game loop.
 func (s *GameState) NotifyEveryone(msg string) {
-	for _, mbox := range s.Connections {
-		mbox <- msg
+	for _, conn := range s.Connections {
+		conn.send(NewNotification(msg))
+	}
+}
+
+// NotifyCharacter sends a notification to every connection playing a
+// character. It must be called from the game loop.
+func (s *GameState) NotifyCharacter(c *Character, msg string) {
+	for connID := range c.Connections {
+		s.Notify(connID, msg)
+	}
+}
+
+// NotifyRoom sends a notification to every character in a room except for
+// exclude, which may be nil. It must be called from the game loop.
+func (s *GameState) NotifyRoom(room RoomID, msg string, exclude *Character) {
+	for _, c := range s.CharactersIn(room) {
+		if c != exclude {
+			s.NotifyCharacter(c, msg)
+		}
+	}
+}
+
+// CharactersIn returns the characters in the world standing in a room,
+// players and NPCs alike. It must be called from the game loop.
+func (s *GameState) CharactersIn(room RoomID) []*Character {
+	var chars []*Character
+	for _, c := range s.everyone() {
+		if c.Location == room {
+			chars = append(chars, c)
+		}
+	}
+	return chars
+}
+
+// everyone returns every character in the world, players and NPCs alike,
+// sorted by name. It must be called from the game loop.
+func (s *GameState) everyone() []*Character {
+	var chars []*Character
+	for _, c := range s.Characters {
+		if c.InWorld() {
+			chars = append(chars, c)
+		}
 	}
+	chars = append(chars, s.NPCs...)
+	// stable so that NPCs of the same name keep the order they spawned in
+	sort.SliceStable(chars, func(i, j int) bool { return chars[i].Name < chars[j].Name })
+	return chars
 }
 
 // WelcomeMsg is a welcome message
 func WelcomeMsg() string {
-	return "Welcome to muhmud; the mud with %rfantastic%c colors."
+	return "Welcome to muhmud; the mud with %rfantastic%n colors."
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/diddydum/muhmud/muhmud/markup"
+)
+
+// testWorld loads the world in testdata, which tests can rely on not
+// changing under them the way the shipped one does.
+func testWorld(t *testing.T) *World {
+	t.Helper()
+	world, err := LoadWorld(filepath.Join("testdata", "world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return world
+}
+
+// newTestGame starts a game in the test world on a MemoryStore, with a
+// verified account for each of emails.
+func newTestGame(t *testing.T, emails ...string) *GameState {
+	t.Helper()
+	world := testWorld(t)
+	store := NewMemoryStore()
+	for _, email := range emails {
+		p, err := player(email, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Verified = true
+		if err := store.SavePlayer(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := InitialState(store, world)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// drainAll reads out everything sent to out until it's closed, returning the
+// messages' text once it is.
+func drainAll(out *Outbox) <-chan []string {
+	result := make(chan []string, 1)
+	go func() {
+		var lines []string
+		for range out.Ready() {
+			msgs, open := out.Drain()
+			for _, msg := range msgs {
+				lines = append(lines, msg.Msg)
+			}
+			if !open {
+				out.Finish()
+				result <- lines
+				return
+			}
+		}
+	}()
+	return result
+}
+
+// enterGame connects email and plays a new character called name, returning the
+// connection and what it gets sent.
+func enterGame(t *testing.T, s *GameState, email, name string) (ConnectionID, *Outbox) {
+	t.Helper()
+	connID, out, err := s.ConnectPlayer(email, "", markup.ANSI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"create " + name, "play " + name} {
+		if err := s.HandleCommand(connID, "", line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out.Drain()
+	return connID, out
+}
+
+// received returns the text of everything sent to out since last time.
+func received(out *Outbox) string {
+	msgs, _ := out.Drain()
+	var lines []string
+	for _, msg := range msgs {
+		lines = append(lines, msg.Msg)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestConnectPlayer(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	connID, out, err := s.ConnectPlayer("a@example.com", "", markup.Plain{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := drainAll(out)
+	for _, line := range []string{"create Alice", "play Alice", "say hello"} {
+		if err := s.HandleCommand(connID, "", line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DisconnectPlayer(connID); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(<-received, "\n")
+	if !strings.Contains(got, "You say, \"hello\"") {
+		t.Errorf("didn't get to say hello; got:\n%s", got)
+	}
+	if _, _, err := s.ConnectPlayer("nobody@example.com", "", markup.Plain{}); err == nil {
+		t.Error("connected an unknown account")
+	}
+}
+
+func TestResponsesCarryRequestID(t *testing.T) {
+	s := newTestGame(t, "a@example.com", "b@example.com")
+	clock := startFakeClock(s)
+	alice, aliceOut := enterGame(t, s, "a@example.com", "Alice")
+	_, bobOut := enterGame(t, s, "b@example.com", "Bob")
+	aliceOut.Drain()
+	request := func(id, line string) {
+		t.Helper()
+		frame, err := json.Marshal(Message{Version: ProtocolVersion, Type: Request, RequestID: id, Msg: line})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.HandleRequest(alice, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// responses are the response to each request, in order
+	var responses []string
+	// notifications counts those Bob got
+	var notifications int
+	check := func(out *Outbox) {
+		t.Helper()
+		msgs, _ := out.Drain()
+		for _, msg := range msgs {
+			switch msg.Type {
+			case Response:
+				if out == bobOut {
+					t.Errorf("Bob got a response to Alice's request: %+v", msg)
+				}
+				responses = append(responses, msg.RequestID+": "+msg.Msg)
+			case Notification:
+				if msg.RequestID != "" {
+					t.Errorf("got a notification with requestId %q: %s", msg.RequestID, msg.Msg)
+				}
+				if out == bobOut {
+					notifications++
+				}
+			}
+		}
+	}
+
+	// walking lags Alice, so the next two requests wait in the queue
+	request("walk", "north")
+	request("back", "south")
+	request("talk", "say hello")
+	for i := 0; i < 2*s.pulses(movementLag); i++ {
+		clock.Advance(defaultPulseLength)
+	}
+	check(aliceOut)
+	check(bobOut)
+
+	want := []string{"walk: North Road", "back: The Town Square", "talk: You say, \"hello\""}
+	if len(responses) != len(want) {
+		t.Fatalf("got responses:\n%s", strings.Join(responses, "\n"))
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(responses[i], prefix) {
+			t.Errorf("response %d is %q, want it to start with %q", i, responses[i], prefix)
+		}
+	}
+	// Bob saw Alice leave, come back and say hello
+	if notifications < 3 {
+		t.Errorf("got %d notifications, want at least 3", notifications)
+	}
+
+	// a request the server turns down is still answered with its requestId
+	frame := []byte(`{"version": 0, "type": "request", "requestId": "old", "msg": "look"}`)
+	if err := s.HandleRequest(alice, frame); err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ := aliceOut.Drain()
+	if len(msgs) != 1 || msgs[0].Type != Response || msgs[0].RequestID != "old" {
+		t.Errorf("turning down a request sent %+v", msgs)
+	}
+}
+
+// TestConcurrentPlayers has many clients connecting, playing and
+// disconnecting at once while the clock ticks, for the race detector to look
+// at.
+func TestConcurrentPlayers(t *testing.T) {
+	const accounts, clients, rounds = 4, 16, 20
+	var emails []string
+	for i := 0; i < accounts; i++ {
+		emails = append(emails, fmt.Sprintf("player%d@example.com", i))
+	}
+	s := newTestGame(t, emails...)
+	for i, email := range emails {
+		connID, out, err := s.ConnectPlayer(email, "", markup.Plain{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		received := drainAll(out)
+		s.HandleCommand(connID, "", fmt.Sprintf("create Player%c", 'a'+i))
+		s.DisconnectPlayer(connID)
+		<-received
+	}
+
+	clock := NewFakeClock(time.Now())
+	stop := s.StartClock(clock, defaultPulseLength)
+	defer stop()
+	ticking := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticking:
+				return
+			default:
+				clock.Advance(defaultPulseLength)
+			}
+		}
+	}()
+	defer close(ticking)
+
+	commands := []string{"look", "say hi", "north", "south", "open door", "get all", "inventory", "who", "gossip hello", "quit"}
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(i)))
+			email := emails[i%accounts]
+			for round := 0; round < rounds; round++ {
+				connID, out, err := s.ConnectPlayer(email, "", markup.Plain{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				received := drainAll(out)
+				s.HandleCommand(connID, "", fmt.Sprintf("play Player%c", 'a'+i%accounts))
+				for n := r.Intn(5); n > 0; n-- {
+					s.HandleCommand(connID, "", commands[r.Intn(len(commands))])
+				}
+				s.DisconnectPlayer(connID)
+				<-received
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var connected int
+	s.do(func() { connected = len(s.Connections) })
+	if connected != 0 {
+		t.Errorf("%d connections are left over", connected)
+	}
+}
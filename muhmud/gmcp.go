@@ -0,0 +1,243 @@
+// Contains GMCP, the channel for structured out of band data.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// GMCP (the Generic MUD Communication Protocol) carries structured data
+// alongside the text of the game, so that clients can show things like maps or
+// health bars without scraping the screen. Every GMCP message is named by its
+// package and message, such as "Room.Info", and carries a JSON value. Telnet
+// clients speak it in subnegotiations of option 201; websocket clients send
+// and receive Messages of type "gmcp" instead.
+//
+// Clients choose which packages they want with Core.Supports.Set, .Add and
+// .Remove; nothing outside of Core is sent to a client that didn't ask for it.
+
+// GMCPPackage is a package of GMCP messages the server can send.
+type GMCPPackage struct {
+	// Name is the name of the package, e.g. "Room" or "Char.Items".
+	Name    string
+	Version int
+}
+
+// GMCPRegistry holds the GMCP packages known to the server. Game subsystems
+// register the packages they publish so clients can opt into them.
+type GMCPRegistry struct {
+	packages map[string]*GMCPPackage
+}
+
+// NewGMCPRegistry creates an empty registry.
+func NewGMCPRegistry() *GMCPRegistry {
+	return &GMCPRegistry{packages: make(map[string]*GMCPPackage)}
+}
+
+// Register adds a package to the registry. It panics if a package with the same
+// name was already registered, since that's a programming error.
+func (r *GMCPRegistry) Register(p *GMCPPackage) {
+	key := strings.ToLower(p.Name)
+	if _, ok := r.packages[key]; ok {
+		panic(fmt.Sprintf("GMCP package %s registered twice", p.Name))
+	}
+	r.packages[key] = p
+}
+
+// Lookup returns the package called name, ignoring case, or nil.
+func (r *GMCPRegistry) Lookup(name string) *GMCPPackage {
+	return r.packages[strings.ToLower(name)]
+}
+
+// registerGMCPPackages adds the packages published by the game itself.
+func registerGMCPPackages(r *GMCPRegistry) {
+	r.Register(&GMCPPackage{Name: "Core", Version: 1})
+	r.Register(&GMCPPackage{Name: "Char", Version: 1})
+	r.Register(&GMCPPackage{Name: "Char.Items", Version: 1})
+	r.Register(&GMCPPackage{Name: "Room", Version: 1})
+	r.Register(&GMCPPackage{Name: "Comm", Version: 1})
+}
+
+// SupportsGMCP reports whether the client on conn asked for the package msg
+// belongs to, or one of its parents. Core is always supported.
+func (conn *Connection) SupportsGMCP(msg string) bool {
+	name := strings.ToLower(msg)
+	for {
+		i := strings.LastIndex(name, ".")
+		if i < 0 {
+			return false
+		}
+		name = name[:i]
+		if name == "core" || conn.GMCP[name] {
+			return true
+		}
+	}
+}
+
+// SendGMCP sends the GMCP message msg carrying data, which is marshalled to
+// JSON, to a single connection if it supports msg's package. It must be called
+// from the game loop.
+func (s *GameState) SendGMCP(connID ConnectionID, msg string, data interface{}) {
+	conn, ok := s.Connections[connID]
+	if !ok || !conn.SupportsGMCP(msg) {
+		return
+	}
+	var raw json.RawMessage
+	if data != nil {
+		var err error
+		if raw, err = json.Marshal(data); err != nil {
+			log.Printf("Unable to marshal GMCP message %s: %s", msg, err)
+			return
+		}
+	}
+	conn.out.Push(NewGMCP(msg, raw))
+}
+
+// SendGMCPCharacter sends a GMCP message to every connection playing a
+// character. It must be called from the game loop.
+func (s *GameState) SendGMCPCharacter(c *Character, msg string, data interface{}) {
+	for connID := range c.Connections {
+		s.SendGMCP(connID, msg, data)
+	}
+}
+
+// HandleGMCP processes a GMCP message sent by the client on connID.
+func (s *GameState) HandleGMCP(connID ConnectionID, msg string, data []byte) (err error) {
+	s.do(func() {
+		conn, ok := s.Connections[connID]
+		if !ok {
+			err = fmt.Errorf("can't find connectionID %v", connID)
+			return
+		}
+		err = s.handleGMCP(conn, msg, data)
+	})
+	return err
+}
+
+// handleGMCP is HandleGMCP on the game loop. Messages we don't understand are
+// ignored, as the GMCP conventions ask.
+func (s *GameState) handleGMCP(conn *Connection, msg string, data []byte) error {
+	switch strings.ToLower(msg) {
+	case "core.supports.set", "core.supports.add", "core.supports.remove":
+		var list []string
+		if err := json.Unmarshal(data, &list); err != nil {
+			return fmt.Errorf("got a malformed %s from %s: %s", msg, conn.Player.Email, err)
+		}
+		if strings.EqualFold(msg, "core.supports.set") {
+			conn.GMCP = make(map[string]bool)
+		}
+		remove := strings.EqualFold(msg, "core.supports.remove")
+		for _, entry := range list {
+			name := gmcpPackageName(entry)
+			if remove {
+				delete(conn.GMCP, strings.ToLower(name))
+			} else if s.GMCPPackages.Lookup(name) != nil {
+				conn.GMCP[strings.ToLower(name)] = true
+			}
+		}
+		s.syncGMCP(conn)
+	case "core.ping":
+		s.SendGMCP(conn.ID, "Core.Ping", nil)
+	}
+	return nil
+}
+
+// gmcpPackageName returns the package name from an entry of a Core.Supports
+// list, e.g. "Room" from "Room 1". We only have one version of each package,
+// so the version is ignored.
+func gmcpPackageName(entry string) string {
+	fields := strings.Fields(entry)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// charStatus is the data of Char.Status.
+type charStatus struct {
+	Name  string `json:"name"`
+	Level int    `json:"level"`
+}
+
+// charVitals is the data of Char.Vitals.
+type charVitals struct {
+	HP      int `json:"hp"`
+	MaxHP   int `json:"maxhp"`
+	Mana    int `json:"mp"`
+	MaxMana int `json:"maxmp"`
+	Move    int `json:"mv"`
+	MaxMove int `json:"maxmv"`
+}
+
+// charItems is the data of Char.Items.List.
+type charItems struct {
+	// Location is where the items are; we only list the inventory.
+	Location string     `json:"location"`
+	Items    []charItem `json:"items"`
+}
+
+// charItem is a single item in Char.Items.List.
+type charItem struct {
+	Name string   `json:"name"`
+	Worn WearSlot `json:"worn,omitempty"`
+}
+
+// roomInfo is the data of Room.Info.
+type roomInfo struct {
+	Num   RoomID            `json:"num"`
+	Name  string            `json:"name"`
+	Exits map[string]RoomID `json:"exits"`
+}
+
+// syncGMCP sends everything a client would otherwise have to wait for a change
+// to learn, such as when it starts playing a character. It must be called
+// from the game loop.
+func (s *GameState) syncGMCP(conn *Connection) {
+	c := conn.Character
+	if c == nil {
+		return
+	}
+	s.SendGMCP(conn.ID, "Char.Status", charStatus{Name: c.Name, Level: c.Stats.Level})
+	s.SendGMCP(conn.ID, "Char.Vitals", newCharVitals(c))
+	s.SendGMCP(conn.ID, "Char.Items.List", newCharItems(c))
+	s.SendGMCP(conn.ID, "Room.Info", newRoomInfo(s.currentRoom(c)))
+}
+
+// sendVitals tells every client playing c how it's doing. It must be called
+// from the game loop.
+func (s *GameState) sendVitals(c *Character) {
+	s.SendGMCPCharacter(c, "Char.Vitals", newCharVitals(c))
+}
+
+// sendItems tells every client playing c what it's carrying, after it changed.
+// It must be called from the game loop.
+func (s *GameState) sendItems(c *Character) {
+	s.SendGMCPCharacter(c, "Char.Items.List", newCharItems(c))
+}
+
+// newCharVitals describes the hit points, mana and movement of a character for
+// Char.Vitals.
+func newCharVitals(c *Character) charVitals {
+	st := c.Stats
+	return charVitals{HP: st.HP, MaxHP: st.MaxHP, Mana: st.Mana, MaxMana: st.MaxMana, Move: st.Move, MaxMove: st.MaxMove}
+}
+
+// newCharItems lists the inventory of a character for Char.Items.List.
+func newCharItems(c *Character) charItems {
+	items := charItems{Location: "inv", Items: []charItem{}}
+	for _, it := range c.Inventory {
+		items.Items = append(items.Items, charItem{Name: it.Name(), Worn: it.Worn})
+	}
+	return items
+}
+
+// newRoomInfo describes a room for Room.Info.
+func newRoomInfo(room *Room) roomInfo {
+	info := roomInfo{Num: room.ID, Name: room.Name, Exits: make(map[string]RoomID)}
+	for _, e := range room.Exits {
+		info.Exits[e.Label()] = e.To
+	}
+	return info
+}
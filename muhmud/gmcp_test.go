@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCoreSupports(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	alice, out := enterGame(t, s, "a@example.com", "Alice")
+	tests := []struct {
+		msg, data string
+		want      map[string]bool
+	}{
+		{"Core.Supports.Set", `["Char 1", "room 1", "Nonsense 1"]`, map[string]bool{"char": true, "room": true}},
+		{"Core.Supports.Add", `["Comm 1", "Char.Items 1"]`, map[string]bool{"char": true, "room": true, "comm": true, "char.items": true}},
+		{"core.supports.remove", `["Char", "ROOM 1", "Nonsense"]`, map[string]bool{"comm": true, "char.items": true}},
+		{"Core.Supports.Set", `["Room 1"]`, map[string]bool{"room": true}},
+		{"Core.Supports.Set", `[]`, map[string]bool{}},
+	}
+	for _, test := range tests {
+		if err := s.HandleGMCP(alice, test.msg, []byte(test.data)); err != nil {
+			t.Fatal(err)
+		}
+		var got map[string]bool
+		s.do(func() { got = s.Connections[alice].GMCP })
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("after %s %s supporting %v, want %v", test.msg, test.data, got, test.want)
+		}
+	}
+	received(out)
+
+	// what the client now supports is sent straight away
+	if err := s.HandleGMCP(alice, "Core.Supports.Add", []byte(`["Room 1"]`)); err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ := out.Drain()
+	if len(msgs) != 1 || msgs[0].Package != "Room.Info" {
+		t.Errorf("adding Room sent %v, want only Room.Info", msgs)
+	}
+	if err := s.HandleGMCP(alice, "Core.Supports.Set", []byte(`"Room 1"`)); err == nil {
+		t.Error("a malformed Core.Supports.Set was accepted")
+	}
+}
+
+func TestSupportsGMCP(t *testing.T) {
+	conn := &Connection{GMCP: map[string]bool{"char.items": true, "room": true}}
+	tests := []struct {
+		msg  string
+		want bool
+	}{
+		{"Core.Ping", true},
+		{"Core.Supports.Set", true},
+		{"Room.Info", true},
+		{"room.info", true},
+		{"Room.Info.Extra", true},
+		{"Char.Items.List", true},
+		{"Char.Vitals", false},
+		{"Char", false},
+		{"Rooms.Info", false},
+		{"Comm.Channel.Text", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := conn.SupportsGMCP(test.msg); got != test.want {
+			t.Errorf("SupportsGMCP(%q) = %v, want %v", test.msg, got, test.want)
+		}
+	}
+}
+
+func TestSplitGMCP(t *testing.T) {
+	tests := []struct {
+		data, msg, payload string
+	}{
+		{"Core.Ping", "Core.Ping", ""},
+		{`Core.Supports.Set ["Room 1"]`, "Core.Supports.Set", `["Room 1"]`},
+		{"Core.Hello  {\"client\": \"x\"} \n", "Core.Hello", `{"client": "x"}`},
+		{"Core.Ping ", "Core.Ping", ""},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		msg, payload := splitGMCP([]byte(test.data))
+		if msg != test.msg || string(payload) != test.payload {
+			t.Errorf("splitGMCP(%q) = %q, %q; want %q, %q", test.data, msg, payload, test.msg, test.payload)
+		}
+	}
+}
+
+// itemsSent returns the items in the last Char.Items.List sent to out, or nil
+// if none was sent.
+func itemsSent(t *testing.T, out *Outbox) []string {
+	t.Helper()
+	msgs, _ := out.Drain()
+	var items []string
+	for _, msg := range msgs {
+		if msg.Package != "Char.Items.List" {
+			continue
+		}
+		var list charItems
+		if err := json.Unmarshal(msg.Data, &list); err != nil {
+			t.Fatal(err)
+		}
+		items = []string{}
+		for _, it := range list.Items {
+			if it.Worn != WearNone {
+				items = append(items, fmt.Sprintf("%s (%s)", it.Name, it.Worn))
+			} else {
+				items = append(items, it.Name)
+			}
+		}
+	}
+	return items
+}
+
+func TestCharItems(t *testing.T) {
+	s := newTestGame(t, "a@example.com", "b@example.com")
+	alice, aliceOut := enterGame(t, s, "a@example.com", "Alice")
+	bob, bobOut := enterGame(t, s, "b@example.com", "Bob")
+	// the inn, where there's a tankard and the innkeeper sells bread
+	s.do(func() {
+		s.character("Alice").Location = 3
+		s.character("Bob").Location = 3
+	})
+	for _, connID := range []ConnectionID{alice, bob} {
+		if err := s.HandleGMCP(connID, "Core.Supports.Set", []byte(`["Char 1"]`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := itemsSent(t, aliceOut); !reflect.DeepEqual(got, []string{}) {
+		t.Errorf("supporting Char sent items %q", got)
+	}
+	received(bobOut)
+
+	for _, test := range []struct {
+		line string
+		want []string
+	}{
+		{"get tankard", []string{"a pewter tankard"}},
+		{"hold tankard", []string{"a pewter tankard (hold)"}},
+		{"buy bread", []string{"a pewter tankard (hold)", "a loaf of bread"}},
+		{"remove tankard", []string{"a pewter tankard", "a loaf of bread"}},
+		{"sell tankard", []string{"a loaf of bread"}},
+		{"drop bread", []string{}},
+		{"get bread", []string{"a loaf of bread"}},
+		{"give bread bob", []string{}},
+		// nothing changed
+		{"look", nil},
+	} {
+		if err := s.HandleCommand(alice, "", test.line); err != nil {
+			t.Fatal(err)
+		}
+		if got := itemsSent(t, aliceOut); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("after %q sent items %q, want %q", test.line, got, test.want)
+		}
+	}
+	if got := itemsSent(t, bobOut); !reflect.DeepEqual(got, []string{"a loaf of bread"}) {
+		t.Errorf("Bob was sent items %q after being given the bread", got)
+	}
+}
@@ -0,0 +1,464 @@
+// Contains the commands for picking up, carrying and wearing items.
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/diddydum/muhmud/muhmud/markup"
+)
+
+// registerItemCommands adds the commands for handling items.
+func registerItemCommands(r *CommandRegistry) {
+	r.Register(&Command{
+		Name:    "get",
+		Aliases: []string{"take"},
+		Usage:   "<item|all> [container]",
+		Help:    "Pick something up, or take it out of a container.",
+		Handler: cmdGet,
+	})
+	r.Register(&Command{
+		Name:    "drop",
+		Usage:   "<item|all>",
+		Help:    "Put something you're carrying down.",
+		Handler: cmdDrop,
+	})
+	r.Register(&Command{
+		Name:    "put",
+		Usage:   "<item|all> <container>",
+		Help:    "Put something you're carrying in a container.",
+		Handler: cmdPut,
+	})
+	r.Register(&Command{
+		Name:    "give",
+		Usage:   "<item> <character>",
+		Help:    "Hand something you're carrying to someone else.",
+		Handler: cmdGive,
+	})
+	r.Register(&Command{
+		Name:    "wear",
+		Aliases: []string{"wield", "hold"},
+		Usage:   "<item|all>",
+		Help:    "Wear, wield or hold something you're carrying.",
+		Handler: cmdWear,
+	})
+	r.Register(&Command{
+		Name:    "remove",
+		Usage:   "<item|all>",
+		Help:    "Stop wearing, wielding or holding something.",
+		Handler: cmdRemove,
+	})
+	r.Register(&Command{
+		Name:    "inventory",
+		Aliases: []string{"i"},
+		Help:    "List what you're carrying.",
+		Handler: cmdInventory,
+	})
+	r.Register(&Command{
+		Name:    "equipment",
+		Aliases: []string{"eq"},
+		Help:    "List what you're wearing.",
+		Handler: cmdEquipment,
+	})
+}
+
+// maxCarryWeight is the most weight c can carry.
+func maxCarryWeight(c *Character) int {
+	return c.Stats.Strength * 10
+}
+
+// carried returns the items c is carrying but not wearing.
+func carried(c *Character) []*Item {
+	var items []*Item
+	for _, it := range c.Inventory {
+		if it.Worn == WearNone {
+			items = append(items, it)
+		}
+	}
+	return items
+}
+
+// wearing returns the item c is wearing in slot, or nil.
+func wearing(c *Character, slot WearSlot) *Item {
+	for _, it := range c.Inventory {
+		if it.Worn == slot {
+			return it
+		}
+	}
+	return nil
+}
+
+// capitalize upper cases the first letter of s, for items starting a sentence.
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// objectArgs splits the command's arguments into what to act on and what to
+// act with, skipping a preposition between them as in "put bread in pack".
+func objectArgs(ctx *CommandContext) (string, string) {
+	args := ctx.Args
+	if len(args) == 3 {
+		switch strings.ToLower(args[1]) {
+		case "in", "into", "from", "to":
+			args = []string{args[0], args[2]}
+		}
+	}
+	switch len(args) {
+	case 0:
+		return "", ""
+	case 1:
+		return args[0], ""
+	}
+	return args[0], args[1]
+}
+
+// findContainer finds a container the acting character is carrying or that's
+// lying in the room.
+func findContainer(ctx *CommandContext, word string) *Item {
+	t := ParseTarget(word)
+	t.All = false
+	candidates := append(carried(ctx.Character), ctx.State.currentRoom(ctx.Character).Items...)
+	picked := selectItems(t, candidates)
+	if len(picked) == 0 {
+		return nil
+	}
+	return picked[0]
+}
+
+func cmdGet(ctx *CommandContext) {
+	what, from := objectArgs(ctx)
+	if what == "" {
+		ctx.Respond("Get what?")
+		return
+	}
+	s, c := ctx.State, ctx.Character
+	room := s.currentRoom(c)
+	var container *Item
+	source := room.Items
+	if from != "" {
+		if container = findContainer(ctx, from); container == nil {
+			ctx.Respondf("You don't see any %s here.", markup.Escape(from))
+			return
+		}
+		if !container.IsContainer() {
+			ctx.Respondf("%s isn't a container.", capitalize(container.Name()))
+			return
+		}
+		source = container.Contents
+	}
+	t := ParseTarget(what)
+	items := selectItems(t, source)
+	if len(items) == 0 {
+		if container != nil {
+			ctx.Respondf("There's nothing like that in %s.", container.Name())
+		} else {
+			ctx.Respond("You don't see that here.")
+		}
+		return
+	}
+	// taking something out of a container you're carrying doesn't make you
+	// carry any more than you already were
+	fromCarried := container != nil && containsItem(c.Inventory, container)
+	carrying := totalWeight(c.Inventory)
+	var lines []string
+	for _, it := range items {
+		switch {
+		case it.Proto.Flags.Has(ItemNoTake):
+			if !t.All {
+				lines = append(lines, fmt.Sprintf("You can't take %s.", it.Name()))
+			}
+			continue
+		case !fromCarried && carrying+it.Weight() > maxCarryWeight(c):
+			lines = append(lines, fmt.Sprintf("%s is too heavy for you to carry.", capitalize(it.Name())))
+			continue
+		}
+		if container != nil {
+			container.Contents = removeItem(container.Contents, it)
+			lines = append(lines, fmt.Sprintf("You get %s from %s.", it.Name(), container.Name()))
+			s.NotifyRoom(room.ID, fmt.Sprintf("%s gets %s from %s.", c.Name, it.Name(), container.Name()), c)
+		} else {
+			room.Items = removeItem(room.Items, it)
+			lines = append(lines, fmt.Sprintf("You get %s.", it.Name()))
+			s.NotifyRoom(room.ID, fmt.Sprintf("%s gets %s.", c.Name, it.Name()), c)
+		}
+		if !fromCarried {
+			carrying += it.Weight()
+		}
+		c.Inventory = append(c.Inventory, it)
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "There's nothing there you can take.")
+	}
+	s.saveCharacter(c)
+	s.sendItems(c)
+	ctx.Respond(strings.Join(lines, "\n"))
+}
+
+// containsItem reports whether it is one of items or inside one of them.
+func containsItem(items []*Item, it *Item) bool {
+	for _, other := range items {
+		if other.contains(it) {
+			return true
+		}
+	}
+	return false
+}
+
+func cmdDrop(ctx *CommandContext) {
+	what, _ := objectArgs(ctx)
+	if what == "" {
+		ctx.Respond("Drop what?")
+		return
+	}
+	s, c := ctx.State, ctx.Character
+	items := selectItems(ParseTarget(what), carried(c))
+	if len(items) == 0 {
+		ctx.Respond("You aren't carrying that.")
+		return
+	}
+	room := s.currentRoom(c)
+	var lines []string
+	for _, it := range items {
+		if it.Proto.Flags.Has(ItemNoDrop) {
+			lines = append(lines, fmt.Sprintf("You can't let go of %s.", it.Name()))
+			continue
+		}
+		c.Inventory = removeItem(c.Inventory, it)
+		room.Items = append(room.Items, it)
+		lines = append(lines, fmt.Sprintf("You drop %s.", it.Name()))
+		s.NotifyRoom(room.ID, fmt.Sprintf("%s drops %s.", c.Name, it.Name()), c)
+	}
+	s.saveCharacter(c)
+	s.sendItems(c)
+	ctx.Respond(strings.Join(lines, "\n"))
+}
+
+func cmdPut(ctx *CommandContext) {
+	what, into := objectArgs(ctx)
+	if what == "" || into == "" {
+		ctx.Respond("Put what in what?")
+		return
+	}
+	s, c := ctx.State, ctx.Character
+	container := findContainer(ctx, into)
+	if container == nil {
+		ctx.Respondf("You don't see any %s here.", markup.Escape(into))
+		return
+	}
+	if !container.IsContainer() {
+		ctx.Respondf("%s isn't a container.", capitalize(container.Name()))
+		return
+	}
+	items := selectItems(ParseTarget(what), carried(c))
+	if len(items) == 0 {
+		ctx.Respond("You aren't carrying that.")
+		return
+	}
+	var lines []string
+	for _, it := range items {
+		switch {
+		case it.contains(container):
+			if len(items) == 1 {
+				lines = append(lines, fmt.Sprintf("You can't put %s inside itself.", it.Name()))
+			}
+			continue
+		case it.Proto.Flags.Has(ItemNoDrop):
+			lines = append(lines, fmt.Sprintf("You can't let go of %s.", it.Name()))
+			continue
+		case totalWeight(container.Contents)+it.Weight() > container.Proto.Capacity:
+			lines = append(lines, fmt.Sprintf("%s won't fit in %s.", capitalize(it.Name()), container.Name()))
+			continue
+		}
+		c.Inventory = removeItem(c.Inventory, it)
+		container.Contents = append(container.Contents, it)
+		lines = append(lines, fmt.Sprintf("You put %s in %s.", it.Name(), container.Name()))
+		s.NotifyRoom(c.Location, fmt.Sprintf("%s puts %s in %s.", c.Name, it.Name(), container.Name()), c)
+	}
+	if len(lines) == 0 {
+		lines = append(lines, fmt.Sprintf("You have nothing else to put in %s.", container.Name()))
+	}
+	s.saveCharacter(c)
+	s.sendItems(c)
+	ctx.Respond(strings.Join(lines, "\n"))
+}
+
+func cmdGive(ctx *CommandContext) {
+	what, who := objectArgs(ctx)
+	if what == "" || who == "" {
+		ctx.Respond("Give what to whom?")
+		return
+	}
+	s, c := ctx.State, ctx.Character
+	t := ParseTarget(what)
+	t.All = false
+	items := selectItems(t, carried(c))
+	if len(items) == 0 {
+		ctx.Respond("You aren't carrying that.")
+		return
+	}
+	it := items[0]
+	var to *Character
+	chars := s.CharactersIn(c.Location)
+	if picked := ParseTarget(who).Select(len(chars), func(i int) []string { return chars[i].Keywords() }); len(picked) > 0 {
+		to = chars[picked[0]]
+	}
+	switch {
+	case to == nil:
+		ctx.Respondf("There's nobody called %s here.", markup.Escape(who))
+	case to == c:
+		ctx.Respond("You already have it.")
+	case it.Proto.Flags.Has(ItemNoDrop):
+		ctx.Respondf("You can't let go of %s.", it.Name())
+	case totalWeight(to.Inventory)+it.Weight() > maxCarryWeight(to):
+		ctx.Respondf("%s can't carry that much.", to.Name)
+	default:
+		c.Inventory = removeItem(c.Inventory, it)
+		to.Inventory = append(to.Inventory, it)
+		s.saveCharacter(c)
+		s.saveCharacter(to)
+		s.sendItems(c)
+		s.sendItems(to)
+		ctx.Respondf("You give %s to %s.", it.Name(), to.Name)
+		s.NotifyCharacter(to, fmt.Sprintf("%s gives you %s.", c.Name, it.Name()))
+		for _, other := range s.CharactersIn(c.Location) {
+			if other != c && other != to {
+				s.NotifyCharacter(other, fmt.Sprintf("%s gives %s to %s.", c.Name, it.Name(), to.Name))
+			}
+		}
+	}
+}
+
+// wearVerb is the verb for putting an item on in slot, e.g. "wield".
+func wearVerb(slot WearSlot) string {
+	switch slot {
+	case WearWield:
+		return "wield"
+	case WearHold:
+		return "hold"
+	}
+	return "wear"
+}
+
+func cmdWear(ctx *CommandContext) {
+	what, _ := objectArgs(ctx)
+	if what == "" {
+		ctx.Respondf("%s what?", capitalize(ctx.Verb))
+		return
+	}
+	s, c := ctx.State, ctx.Character
+	t := ParseTarget(what)
+	items := selectItems(t, carried(c))
+	if len(items) == 0 {
+		ctx.Respond("You aren't carrying that.")
+		return
+	}
+	var lines []string
+	for _, it := range items {
+		slot := it.Proto.Slot
+		if slot == WearNone {
+			if !t.All {
+				lines = append(lines, fmt.Sprintf("You can't wear %s.", it.Name()))
+			}
+			continue
+		}
+		if other := wearing(c, slot); other != nil {
+			if !t.All {
+				lines = append(lines, fmt.Sprintf("You're already using %s %s.", other.Name(), slot.where()))
+			}
+			continue
+		}
+		it.Worn = slot
+		verb := wearVerb(slot)
+		if verb == "wear" {
+			lines = append(lines, fmt.Sprintf("You wear %s %s.", it.Name(), slot.where()))
+		} else {
+			lines = append(lines, fmt.Sprintf("You %s %s.", verb, it.Name()))
+		}
+		s.NotifyRoom(c.Location, fmt.Sprintf("%s %ss %s.", c.Name, verb, it.Name()), c)
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "You have nothing else to wear.")
+	}
+	s.saveCharacter(c)
+	s.sendItems(c)
+	ctx.Respond(strings.Join(lines, "\n"))
+}
+
+func cmdRemove(ctx *CommandContext) {
+	what, _ := objectArgs(ctx)
+	if what == "" {
+		ctx.Respond("Remove what?")
+		return
+	}
+	s, c := ctx.State, ctx.Character
+	var worn []*Item
+	for _, it := range c.Inventory {
+		if it.Worn != WearNone {
+			worn = append(worn, it)
+		}
+	}
+	items := selectItems(ParseTarget(what), worn)
+	if len(items) == 0 {
+		ctx.Respond("You aren't using that.")
+		return
+	}
+	var lines []string
+	for _, it := range items {
+		it.Worn = WearNone
+		lines = append(lines, fmt.Sprintf("You stop using %s.", it.Name()))
+		s.NotifyRoom(c.Location, fmt.Sprintf("%s stops using %s.", c.Name, it.Name()), c)
+	}
+	s.saveCharacter(c)
+	s.sendItems(c)
+	ctx.Respond(strings.Join(lines, "\n"))
+}
+
+func cmdInventory(ctx *CommandContext) {
+	c := ctx.Character
+	items := carried(c)
+	if len(items) == 0 {
+		ctx.Respond("You aren't carrying anything.")
+		return
+	}
+	lines := []string{fmt.Sprintf("You are carrying (%d/%d pounds):", totalWeight(c.Inventory), maxCarryWeight(c))}
+	for _, it := range items {
+		lines = append(lines, "  "+it.Name())
+	}
+	ctx.Respond(strings.Join(lines, "\n"))
+}
+
+func cmdEquipment(ctx *CommandContext) {
+	var lines []string
+	for _, slot := range wearSlots {
+		if it := wearing(ctx.Character, slot); it != nil {
+			lines = append(lines, fmt.Sprintf("  <%s> %s", slot, it.Name()))
+		}
+	}
+	if len(lines) == 0 {
+		ctx.Respond("You aren't using anything.")
+		return
+	}
+	ctx.Respond("You are using:\n" + strings.Join(lines, "\n"))
+}
+
+// describeItem renders what a character sees when looking at an item.
+func describeItem(it *Item) string {
+	desc := it.Proto.Description
+	if desc == "" {
+		desc = fmt.Sprintf("You see nothing special about %s.", it.Name())
+	}
+	if !it.IsContainer() {
+		return desc
+	}
+	if len(it.Contents) == 0 {
+		return desc + "\nIt's empty."
+	}
+	lines := []string{desc, "It contains:"}
+	for _, inner := range it.Contents {
+		lines = append(lines, "  "+inner.Name())
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/diddydum/muhmud/muhmud/markup"
+)
+
+// spawnItems makes a new item of each of the prototypes ids, handing them to
+// put on the game loop.
+func spawnItems(t *testing.T, s *GameState, put func(it *Item), ids ...ItemPrototypeID) {
+	t.Helper()
+	var err error
+	s.do(func() {
+		for _, id := range ids {
+			var it *Item
+			if it, err = s.World.Spawn(id); err != nil {
+				return
+			}
+			put(it)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// spawnCarried gives the character called name new items of the prototypes
+// ids.
+func spawnCarried(t *testing.T, s *GameState, name string, ids ...ItemPrototypeID) {
+	t.Helper()
+	spawnItems(t, s, func(it *Item) {
+		c := s.character(name)
+		c.Inventory = append(c.Inventory, it)
+	}, ids...)
+}
+
+// spawnInRoom puts new items of the prototypes ids in room.
+func spawnInRoom(t *testing.T, s *GameState, room RoomID, ids ...ItemPrototypeID) {
+	t.Helper()
+	spawnItems(t, s, func(it *Item) {
+		r := s.World.Rooms[room]
+		r.Items = append(r.Items, it)
+	}, ids...)
+}
+
+// runLines runs each line as a command from connID, checking that what out is
+// sent in reply contains want.
+func runLines(t *testing.T, s *GameState, connID ConnectionID, out *Outbox, tests []struct{ line, want string }) {
+	t.Helper()
+	received(out)
+	for _, tt := range tests {
+		s.HandleCommand(connID, "", tt.line)
+		if got := received(out); !strings.Contains(got, tt.want) {
+			t.Errorf("after %q got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestGetWeightLimit(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	alice, out := enterGame(t, s, "a@example.com", "Alice")
+	// Alice can carry 10 pounds; the sword in the square weighs 8
+	s.do(func() { s.character("Alice").Stats.Strength = 1 })
+	spawnCarried(t, s, "Alice", 3, 4)
+
+	runLines(t, s, alice, out, []struct{ line, want string }{
+		{"put bread in backpack", "You put a loaf of bread in a canvas backpack."},
+		{"get sword", "A rusty sword is too heavy for you to carry."},
+		// taking something out of a carried container weighs nothing more
+		{"get bread from backpack", "You get a loaf of bread from a canvas backpack."},
+		{"drop backpack", "You drop a canvas backpack."},
+		{"get sword", "You get a rusty sword."},
+		{"get backpack", "A canvas backpack is too heavy for you to carry."},
+		{"inventory", "You are carrying (9/10 pounds):"},
+	})
+}
+
+func TestPut(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	alice, out := enterGame(t, s, "a@example.com", "Alice")
+	// the backpack holds 30 pounds and each sword weighs 8
+	spawnCarried(t, s, "Alice", 3, 1, 1, 1, 1)
+
+	runLines(t, s, alice, out, []struct{ line, want string }{
+		{"put backpack in backpack", "You can't put a canvas backpack inside itself."},
+		{"put all.sword in backpack", "You put a rusty sword in a canvas backpack."},
+		{"look backpack", "It contains:\n  a rusty sword\n  a rusty sword\n  a rusty sword"},
+		{"put sword in backpack", "A rusty sword won't fit in a canvas backpack."},
+		// the backpack itself is quietly left out
+		{"put all in backpack", "A rusty sword won't fit in a canvas backpack."},
+		{"put sword in sword", "A rusty sword isn't a container."},
+	})
+	s.do(func() {
+		c := s.character("Alice")
+		if len(c.Inventory) != 2 || len(c.Inventory[0].Contents) != 3 {
+			t.Errorf("Alice is carrying %v with %v in the backpack", c.Inventory, c.Inventory[0].Contents)
+		}
+	})
+}
+
+func TestNoTakeAndNoDrop(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	alice, out := enterGame(t, s, "a@example.com", "Alice")
+	s.do(func() {
+		s.World.Prototypes[100] = &ItemPrototype{
+			ID:       100,
+			Keywords: []string{"ring", "cursed"},
+			Short:    "a cursed ring",
+			Long:     "A cursed ring glints on the ground.",
+			Weight:   1,
+			Flags:    ItemNoDrop,
+		}
+	})
+	spawnInRoom(t, s, 1, 5)
+	spawnCarried(t, s, "Alice", 100, 3)
+
+	runLines(t, s, alice, out, []struct{ line, want string }{
+		{"get crate", "You can't take a sturdy crate."},
+		{"drop ring", "You can't let go of a cursed ring."},
+		{"put ring in crate", "You can't let go of a cursed ring."},
+		{"put ring in backpack", "You can't let go of a cursed ring."},
+		{"drop all", "You can't let go of a cursed ring.\nYou drop a canvas backpack."},
+	})
+	// getting everything quietly leaves the crate behind
+	s.HandleCommand(alice, "", "get all")
+	if got := received(out); strings.Contains(got, "crate") || !strings.Contains(got, "You get a rusty sword.") {
+		t.Errorf("after getting everything got %q", got)
+	}
+	s.do(func() {
+		var names []string
+		for _, it := range s.character("Alice").Inventory {
+			names = append(names, it.Name())
+		}
+		if want := []string{"a cursed ring", "a rusty sword", "a canvas backpack"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("Alice is carrying %v, want %v", names, want)
+		}
+	})
+}
+
+func TestWearSlotClash(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	alice, out := enterGame(t, s, "a@example.com", "Alice")
+	spawnCarried(t, s, "Alice", 2, 2, 6)
+
+	runLines(t, s, alice, out, []struct{ line, want string }{
+		{"wear cap", "You wear a leather cap on your head."},
+		{"wear cap", "You're already using a leather cap on your head."},
+		{"wear all", "You hold a pewter tankard."},
+		{"wear all", "You have nothing else to wear."},
+		{"equipment", "You are using:\n  <hold> a pewter tankard\n  <head> a leather cap"},
+		{"inventory", "You are carrying (3/100 pounds):\n  a leather cap"},
+		{"remove cap", "You stop using a leather cap."},
+		{"wear cap", "You wear a leather cap on your head."},
+	})
+}
+
+func TestInventoryIsSaved(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		p, err := player("a@example.com", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Verified = true
+		if err := store.SavePlayer(p); err != nil {
+			t.Fatal(err)
+		}
+		world := testWorld(t)
+		s, err := InitialState(store, world)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice, out := enterGame(t, s, "a@example.com", "Alice")
+		spawnInRoom(t, s, 1, 2, 3, 4)
+		runLines(t, s, alice, out, []struct{ line, want string }{
+			{"get cap", "You get a leather cap."},
+			{"wear cap", "You wear a leather cap on your head."},
+			{"get backpack", "You get a canvas backpack."},
+			{"get bread", "You get a loaf of bread."},
+			{"put bread in backpack", "You put a loaf of bread in a canvas backpack."},
+		})
+		var saved []itemRecord
+		s.do(func() { saved = itemRecords(s.character("Alice").Inventory) })
+
+		// the server restarts
+		world = testWorld(t)
+		s, err = InitialState(store, world)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.do(func() {
+			inv := s.character("Alice").Inventory
+			if got := itemRecords(inv); !reflect.DeepEqual(got, saved) {
+				t.Errorf("loaded %+v, want %+v", got, saved)
+			}
+			if len(inv) != 2 {
+				return
+			}
+			worn, pack := inv[0], inv[1]
+			if worn.Proto != world.Prototypes[2] || worn.Worn != WearHead {
+				t.Errorf("loaded the cap as %+v", worn)
+			}
+			if pack.Proto != world.Prototypes[3] || len(pack.Contents) != 1 || pack.Contents[0].Proto != world.Prototypes[4] {
+				t.Errorf("loaded the backpack as %+v holding %v", pack, pack.Contents)
+			}
+		})
+		alice, out, err = s.ConnectPlayer("a@example.com", "", markup.ANSI{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		runLines(t, s, alice, out, []struct{ line, want string }{
+			{"play Alice", "Alice"},
+			{"equipment", "<head> a leather cap"},
+			{"look backpack", "It contains:\n  a loaf of bread"},
+		})
+	})
+}
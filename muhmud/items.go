@@ -0,0 +1,263 @@
+// Contains items: the things characters can pick up, carry, wear and put in
+// each other.
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ItemPrototypeID identifies a kind of item in the world.
+type ItemPrototypeID int
+
+// ItemFlags are yes or no properties of a kind of item.
+type ItemFlags uint
+
+// The flags an item prototype can have.
+const (
+	// ItemNoTake items can't be picked up, e.g. a fountain.
+	ItemNoTake ItemFlags = 1 << iota
+	// ItemNoDrop items can't be let go of once picked up.
+	ItemNoDrop
+)
+
+// itemFlagNames are what the flags are called in area files.
+var itemFlagNames = map[string]ItemFlags{"notake": ItemNoTake, "nodrop": ItemNoDrop}
+
+// Has reports whether every flag in f2 is set in f.
+func (f ItemFlags) Has(f2 ItemFlags) bool {
+	return f&f2 == f2
+}
+
+// WearSlot is where on a character an item can be worn.
+type WearSlot int
+
+// The slots an item can be worn in. WearNone is for items that can't be worn,
+// or that are carried rather than worn.
+const (
+	WearNone WearSlot = iota
+	WearHead
+	WearNeck
+	WearBody
+	WearHands
+	WearLegs
+	WearFeet
+	WearWield
+	WearHold
+)
+
+var wearSlotNames = [...]string{"", "head", "neck", "body", "hands", "legs", "feet", "wield", "hold"}
+
+// wearSlots are the slots an item can be worn in, in the order equipment is
+// listed.
+var wearSlots = []WearSlot{WearWield, WearHold, WearHead, WearNeck, WearBody, WearHands, WearLegs, WearFeet}
+
+func (w WearSlot) String() string {
+	if w < 0 || int(w) >= len(wearSlotNames) {
+		return "unknown"
+	}
+	return wearSlotNames[w]
+}
+
+// where describes the slot as in "You wear a leather cap on your head".
+func (w WearSlot) where() string {
+	switch w {
+	case WearNeck:
+		return "around your neck"
+	case WearWield:
+		return "as your weapon"
+	case WearHold:
+		return "in your off hand"
+	}
+	return "on your " + w.String()
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (w WearSlot) MarshalText() ([]byte, error) {
+	return []byte(w.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (w *WearSlot) UnmarshalText(text []byte) error {
+	for i, name := range wearSlotNames {
+		if strings.EqualFold(name, string(text)) {
+			*w = WearSlot(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown wear slot %q", text)
+}
+
+// ItemPrototype describes a kind of item. Every item is an instance of a
+// prototype, and everything about an item but where it is comes from it.
+type ItemPrototype struct {
+	ID ItemPrototypeID
+	// Keywords are the words a player can use to refer to the item.
+	Keywords []string
+	// Short is what the item is called in sentences, e.g. "a rusty sword".
+	Short string
+	// Long is the line shown when the item is lying in a room, e.g. "A rusty
+	// sword lies in the dust."
+	Long string
+	// Description is what a character sees when looking at the item.
+	Description string
+	Weight      int
+	Value       int
+	Flags       ItemFlags
+	// Slot is where the item is worn, or WearNone if it can't be.
+	Slot WearSlot
+	// Capacity is how much weight the item can hold, or zero if it isn't a
+	// container.
+	Capacity int
+	// Damage is the damage done by a weapon.
+	Damage Dice
+}
+
+// Item is a single item in the world.
+type Item struct {
+	Proto *ItemPrototype
+	// Worn is the slot the item is worn in by the character carrying it, or
+	// WearNone.
+	Worn WearSlot
+	// Contents are the items inside a container.
+	Contents []*Item
+}
+
+func newItem(proto *ItemPrototype) *Item {
+	return &Item{Proto: proto}
+}
+
+// Name is what the item is called in sentences.
+func (it *Item) Name() string {
+	return it.Proto.Short
+}
+
+// Keywords are the words the item can be referred to by.
+func (it *Item) Keywords() []string {
+	return it.Proto.Keywords
+}
+
+// IsContainer reports whether items can be put in the item.
+func (it *Item) IsContainer() bool {
+	return it.Proto.Capacity > 0
+}
+
+// Weight is the weight of the item and everything in it.
+func (it *Item) Weight() int {
+	return it.Proto.Weight + totalWeight(it.Contents)
+}
+
+// totalWeight is the weight of items and everything in them.
+func totalWeight(items []*Item) int {
+	w := 0
+	for _, it := range items {
+		w += it.Weight()
+	}
+	return w
+}
+
+// contains reports whether other is it or anywhere inside it.
+func (it *Item) contains(other *Item) bool {
+	if it == other {
+		return true
+	}
+	for _, inner := range it.Contents {
+		if inner.contains(other) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeItem returns items without it.
+func removeItem(items []*Item, it *Item) []*Item {
+	for i, other := range items {
+		if other == it {
+			return append(items[:i], items[i+1:]...)
+		}
+	}
+	return items
+}
+
+// selectItems returns the items picked by t.
+func selectItems(t Target, items []*Item) []*Item {
+	var picked []*Item
+	for _, i := range t.Select(len(items), func(i int) []string { return items[i].Keywords() }) {
+		picked = append(picked, items[i])
+	}
+	return picked
+}
+
+// itemRecord is how an item is saved with the character carrying it. Items are
+// saved by the id of their prototype, so that changes to a prototype apply to
+// every copy of it.
+type itemRecord struct {
+	Proto    ItemPrototypeID `json:"proto"`
+	Worn     WearSlot        `json:"worn,omitempty"`
+	Contents []itemRecord    `json:"contents,omitempty"`
+}
+
+// itemRecords converts items to records for saving.
+func itemRecords(items []*Item) []itemRecord {
+	records := []itemRecord{}
+	for _, it := range items {
+		r := itemRecord{Proto: it.Proto.ID, Worn: it.Worn}
+		if len(it.Contents) > 0 {
+			r.Contents = itemRecords(it.Contents)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// itemsFromRecords converts saved records back to items. Stores don't know
+// about the world, so the items only have a placeholder prototype carrying the
+// id until World.ResolveItems replaces it.
+func itemsFromRecords(records []itemRecord) []*Item {
+	var items []*Item
+	for _, r := range records {
+		it := &Item{Proto: &ItemPrototype{ID: r.Proto}, Worn: r.Worn}
+		it.Contents = itemsFromRecords(r.Contents)
+		items = append(items, it)
+	}
+	return items
+}
+
+// Spawn creates a new item from a prototype.
+func (w *World) Spawn(id ItemPrototypeID) (*Item, error) {
+	p, ok := w.Prototypes[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown item prototype %d", id)
+	}
+	return newItem(p), nil
+}
+
+// ResolveItems points items loaded from a Store, or left over from a world
+// that was reloaded, at their prototypes in the world. Items whose prototype no
+// longer exists are thrown away, along with whatever is in them. Corpses don't
+// belong to the world, so those left over from a reload are kept as they are,
+// while loaded ones, which only have a placeholder prototype, are thrown away.
+func (w *World) ResolveItems(owner string, items []*Item) []*Item {
+	var resolved []*Item
+	for _, it := range items {
+		if it.Proto.ID == corpsePrototypeID {
+			if it.Proto.Short == "" {
+				log.Printf("Throwing away a saved corpse of %s", owner)
+				continue
+			}
+			it.Contents = w.ResolveItems(owner, it.Contents)
+			resolved = append(resolved, it)
+			continue
+		}
+		p, ok := w.Prototypes[it.Proto.ID]
+		if !ok {
+			log.Printf("Throwing away item of %s with unknown prototype %d", owner, it.Proto.ID)
+			continue
+		}
+		it.Proto = p
+		it.Contents = w.ResolveItems(owner, it.Contents)
+		resolved = append(resolved, it)
+	}
+	return resolved
+}
@@ -0,0 +1,153 @@
+// Contains holding on to websocket connections whose link dropped, so that
+// their clients can resume them.
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"time"
+)
+
+// defaultLinkDeadGrace is how long a link-dead connection waits for its client
+// to come back.
+const defaultLinkDeadGrace = time.Minute
+
+// takeOverTimeout is how long resuming a connection waits for the writer of
+// its old link to stop.
+const takeOverTimeout = 5 * time.Second
+
+// A websocket connection can outlive the websocket, or link, it started on:
+//
+//  1. Every link is sent the connection's resume token in a Core.Session GMCP
+//     message, and every message sent to the connection is numbered.
+//  2. If the link drops without the client closing it, the connection goes
+//     link-dead: its character stays in the world and its outbox keeps
+//     filling up.
+//  3. A client reconnecting with the token and the number of the last message
+//     it got takes the connection over, dropping the old link if the server
+//     hadn't noticed it was gone yet. Instead of a welcome it's sent whatever
+//     it missed that the outbox still holds.
+//  4. Otherwise the connection is disconnected once LinkDeadGrace is over, as
+//     if the client had closed it.
+//
+// Message numbers start over when the server restarts, including in a
+// copyover, whose resume tokens are the connections' own.
+
+// sessionInfo is the data of Core.Session.
+type sessionInfo struct {
+	// Token is what the client resumes the connection with.
+	Token string `json:"token"`
+	// Grace is how many seconds the client has to do so once the link drops.
+	Grace int `json:"grace"`
+}
+
+// AttachLink records a client's websocket as the link of a connection. drop
+// closes it, for when the client resumes on another link before this one is
+// noticed to be gone. The returned number identifies the link to LinkLost.
+func (s *GameState) AttachLink(connID ConnectionID, drop func()) (link int, err error) {
+	s.do(func() {
+		conn, ok := s.Connections[connID]
+		if !ok {
+			err = fmt.Errorf("can't find connectionID %v", connID)
+			return
+		}
+		if conn.resume == "" {
+			if conn.resume, _, err = newToken(); err != nil {
+				return
+			}
+		}
+		conn.link++
+		conn.dropLink, conn.linkDead = drop, false
+		link = conn.link
+		s.SendGMCP(connID, "Core.Session", sessionInfo{Token: conn.resume, Grace: int(s.LinkDeadGrace / time.Second)})
+	})
+	return link, err
+}
+
+// LinkLost is called when a link of a connection drops without the client
+// closing it, making the connection link-dead.
+func (s *GameState) LinkLost(connID ConnectionID, link int) {
+	s.do(func() { s.linkLost(connID, link) })
+}
+
+// linkLost is LinkLost on the game loop.
+func (s *GameState) linkLost(connID ConnectionID, link int) {
+	conn, ok := s.Connections[connID]
+	if !ok || conn.link != link {
+		// disconnected already, or resumed on another link
+		return
+	}
+	conn.dropLink = nil
+	if s.LinkDeadGrace <= 0 || conn.out.Closed() {
+		s.disconnect(connID)
+		return
+	}
+	log.Printf("Lost the link to %s, holding on to it for %s\n", conn.Player.Email, s.LinkDeadGrace)
+	conn.linkDead = true
+	s.After(s.LinkDeadGrace, func() {
+		if conn, ok := s.Connections[connID]; ok && conn.linkDead && conn.link == link {
+			log.Printf("Giving up on %s, who didn't come back in time\n", conn.Player.Email)
+			s.disconnect(connID)
+		}
+	})
+}
+
+// beginTakeOver starts taking over the connection of email that token
+// resumes for a new link, dropping its old link, or returns nil if there isn't
+// one. The writer of the old link may still be going, so the caller has to
+// wait for the returned channel to be closed before calling finishTakeOver,
+// outside the game loop. It must be called from the game loop.
+func (s *GameState) beginTakeOver(email, token string) (*Connection, <-chan struct{}) {
+	conn := s.resumable(email, token)
+	if conn == nil {
+		return nil, nil
+	}
+	if conn.dropLink != nil {
+		conn.dropLink()
+		conn.dropLink = nil
+	}
+	// so that the old link going away isn't mistaken for the new one, and
+	// the grace period doesn't run out while waiting
+	conn.link++
+	conn.resuming = true
+	return conn, conn.out.Finished()
+}
+
+// finishTakeOver readies conn for its new link once the old link's writer has
+// stopped, returning the messages after the one numbered seq to send again.
+// If the writer didn't stop in time the connection is given up on. It must be
+// called from the game loop.
+func (s *GameState) finishTakeOver(conn *Connection, seq uint64, stopped bool) ([]Message, error) {
+	conn.resuming = false
+	if s.Connections[conn.ID] != conn {
+		return nil, fmt.Errorf("the connection of %s went away while being resumed", conn.Player.Email)
+	}
+	if !stopped {
+		s.disconnect(conn.ID)
+		return nil, fmt.Errorf("the old link of %s didn't let go in time", conn.Player.Email)
+	}
+	replay, complete := conn.out.TakeOver(seq)
+	conn.linkDead = false
+	if !complete {
+		conn.send(NewNotification("%rSome of what happened while you were away was lost.%n"))
+	}
+	return replay, nil
+}
+
+// resumable finds the open connection of email whose resume token is token,
+// or returns nil. A connection that's already being resumed isn't. It must be
+// called from the game loop.
+func (s *GameState) resumable(email, token string) *Connection {
+	p, ok := s.Players[email]
+	if !ok {
+		return nil
+	}
+	for connID := range p.Connections {
+		conn := s.Connections[connID]
+		if conn.resume != "" && !conn.resuming && subtle.ConstantTimeCompare([]byte(conn.resume), []byte(token)) == 1 && !conn.out.Closed() {
+			return conn
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/diddydum/muhmud/muhmud/markup"
+)
+
+func TestResumeTakesOverConnection(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	connID, out, err := s.ConnectPlayer("a@example.com", "", markup.Plain{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped := make(chan struct{})
+	if _, err := s.AttachLink(connID, func() { close(dropped) }); err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ := out.Drain()
+	last := msgs[len(msgs)-1].Seq
+	s.do(func() { s.Notify(connID, "Missed this.") })
+	var token string
+	s.do(func() { token = s.Connections[connID].resume })
+
+	// the old link's writer only stops once the game has carried on without
+	// it, which it couldn't if resuming held up the game loop
+	go func() {
+		<-dropped
+		s.do(func() { s.NotifyEveryone("Still going.") })
+		out.Drain()
+		out.Finish()
+	}()
+	resumed, _, replay, err := s.Resume("a@example.com", "", markup.Plain{}, token, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed != connID {
+		t.Errorf("resumed connection %d rather than %d", resumed, connID)
+	}
+	if len(replay) != 2 || replay[0].Msg != "Missed this." || replay[1].Msg != "Still going." {
+		t.Errorf("got replay %+v", replay)
+	}
+
+	// a client with the wrong token starts afresh
+	other, _, _, err := s.Resume("a@example.com", "", markup.Plain{}, "wrong", last)
+	if err != nil || other == connID {
+		t.Errorf("resumed with the wrong token: %d, %v", other, err)
+	}
+}
+
+func TestLinkDeadGraceRunsOut(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	clock := startFakeClock(s)
+	connID, _, err := s.ConnectPlayer("a@example.com", "", markup.Plain{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := s.AttachLink(connID, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.LinkLost(connID, link)
+
+	connected := func() (ok bool) {
+		s.do(func() { _, ok = s.Connections[connID] })
+		return ok
+	}
+	clock.Advance(defaultLinkDeadGrace - time.Second)
+	if !connected() {
+		t.Fatal("disconnected before the grace period was over")
+	}
+	clock.Advance(2 * time.Second)
+	if connected() {
+		t.Error("still connected after the grace period")
+	}
+}
@@ -0,0 +1,56 @@
+// Contains the game loop, the single goroutine that owns all game state.
+package main
+
+import (
+	"log"
+	"runtime/debug"
+)
+
+// eventQueueSize is how many events may be waiting for the game loop before
+// whoever sends the next one has to wait.
+const eventQueueSize = 256
+
+// Everything reachable from a GameState - players, characters, connections and
+// the world - belongs to the game loop and may only be read or changed from
+// it, which is what the "must be called from the game loop" notes on methods
+// refer to. The loop runs events one at a time, so no locks are needed and no
+// command ever sees the world half way through another one.
+//
+// Other goroutines, such as HTTP handlers and the readers of each connection,
+// hand their work to the loop with do. Sending to a connection only queues
+// the message in its Outbox, so a slow client can't stall the loop.
+
+// event is a function to run on the game loop, and a channel closed once it
+// has run.
+type event struct {
+	fn   func()
+	done chan struct{}
+}
+
+// run is the game loop. It runs every event sent to s.events in order.
+func (s *GameState) run() {
+	for e := range s.events {
+		s.runEvent(e)
+	}
+}
+
+// runEvent runs a single event. An event that panics is logged and given up
+// on rather than taking the whole game down with it, and whoever sent it
+// still stops waiting.
+func (s *GameState) runEvent(e event) {
+	defer close(e.done)
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovered from panic in the game loop: %v\n%s", r, debug.Stack())
+		}
+	}()
+	e.fn()
+}
+
+// do runs fn on the game loop and waits for it to finish. It must not be
+// called from the game loop itself, which would deadlock.
+func (s *GameState) do(fn func()) {
+	e := event{fn: fn, done: make(chan struct{})}
+	s.events <- e
+	<-e.done
+}
@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestRunRecoversFromPanics(t *testing.T) {
+	s := &GameState{events: make(chan event)}
+	go s.run()
+	defer close(s.events)
+
+	s.do(func() { panic("oops") })
+	ran := false
+	s.do(func() { ran = true })
+	if !ran {
+		t.Error("the game loop stopped running events after one panicked")
+	}
+}
@@ -0,0 +1,65 @@
+// Contains the ways we can send email to players.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Mailer delivers email to players.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// NewMailer creates the mailer named by kind. Only "log" and "file" are
+// supported for now; dir is where the file mailer writes its messages.
+func NewMailer(kind, dir string) (Mailer, error) {
+	switch kind {
+	case "", "log":
+		return LogMailer{}, nil
+	case "file":
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		return &FileMailer{Dir: dir}, nil
+	}
+	return nil, fmt.Errorf("unknown mailer %q", kind)
+}
+
+// LogMailer "sends" email by writing it to the log. Use it for local
+// development.
+type LogMailer struct{}
+
+// Send implements Mailer.
+func (LogMailer) Send(to, subject, body string) error {
+	log.Printf("Mail to %s: %s\n%s\n", to, subject, body)
+	return nil
+}
+
+// FileMailer writes every email to its own file in Dir, which makes it easy for
+// tests and scripts to pick out links.
+type FileMailer struct {
+	Dir string
+	n   int
+	mux sync.Mutex
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9@._-]`)
+
+// Send implements Mailer.
+func (m *FileMailer) Send(to, subject, body string) error {
+	m.mux.Lock()
+	m.n++
+	n := m.n
+	m.mux.Unlock()
+
+	name := fmt.Sprintf("%d-%03d-%s.eml", time.Now().Unix(), n, unsafeFileChars.ReplaceAllString(to, "_"))
+	msg := fmt.Sprintf("To: %s\nSubject: %s\n\n%s\n", to, subject, body)
+	return ioutil.WriteFile(filepath.Join(m.Dir, name), []byte(msg), 0600)
+}
@@ -1,17 +1,22 @@
 package main
 
 import (
+	"compress/flate"
+	"encoding/json"
+	"expvar"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/diddydum/muhmud/muhmud/markup"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	"gopkg.in/yaml.v2"
 )
 
 // Configuration represents high-level configuration for how the mud operates.
@@ -20,17 +25,95 @@ type Configuration struct {
 	JWTSecret string `yaml:"jwt_secret"`
 	// AllowedOrigins represents valid Origins to accept requests from
 	AllowedOrigins []string `yaml:"allowed_origins"`
+	// Admins are the email addresses of the accounts allowed to use admin
+	// commands and the admin channel.
+	Admins []string `yaml:"admins"`
+	// DevMode fills a fresh database with two accounts with well-known
+	// passwords, for development. Never turn it on in production.
+	DevMode bool `yaml:"dev_mode"`
+	// Database is the path to the SQLite database holding the game's state.
+	Database string `yaml:"database"`
+	// MigrationsDir is the directory containing the database migrations.
+	MigrationsDir string `yaml:"migrations_dir"`
+	// WorldDir is the directory containing the area files the world is
+	// loaded from.
+	WorldDir string `yaml:"world_dir"`
+	// PublicURL is the address players reach the server at, used for links
+	// in emails.
+	PublicURL string `yaml:"public_url"`
+	// ClientURL is the address of the web client, for links that need it,
+	// such as for resetting a password or creating an account.
+	ClientURL string `yaml:"client_url"`
+	// Mailer is how email is sent: "log" or "file".
+	Mailer string `yaml:"mailer"`
+	// MailDir is where the file mailer writes emails.
+	MailDir string `yaml:"mail_dir"`
+	// AccessTokenTTL is how long an access token is valid for.
+	AccessTokenTTL time.Duration `yaml:"access_token_ttl"`
+	// SessionTTL is how long a login lasts before the player has to enter
+	// their password again.
+	SessionTTL time.Duration `yaml:"session_ttl"`
+	// OutboxSize is how many messages may be waiting to be written to a
+	// connection before OverflowPolicy kicks in.
+	OutboxSize int `yaml:"outbox_size"`
+	// OverflowPolicy is what happens to a client that can't keep up:
+	// "drop_oldest", "drop_notifications" or "disconnect".
+	OverflowPolicy OverflowPolicy `yaml:"overflow_policy"`
+	// WriteTimeout is how long writing a single message may take before the
+	// connection is given up on.
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// PingInterval is how often connections are pinged. Clients that haven't
+	// answered anything within PongTimeout are disconnected.
+	PingInterval time.Duration `yaml:"ping_interval"`
+	PongTimeout  time.Duration `yaml:"pong_timeout"`
+	// LinkDeadGrace is how long a websocket client that lost its connection
+	// without closing it has to resume it before it's disconnected, or 0 to
+	// disconnect it straight away.
+	LinkDeadGrace time.Duration `yaml:"link_dead_grace"`
+	// SessionPolicy is what happens when a player connects while already
+	// connected: "allow", "takeover" or "deny".
+	SessionPolicy SessionPolicy `yaml:"session_policy"`
+	// TelnetAddress is where to listen for telnet connections, or empty to
+	// not allow them.
+	TelnetAddress string `yaml:"telnet_address"`
+	// Compression turns on permessage-deflate for websockets and MCCP2 for
+	// telnet, for clients that support them.
+	Compression bool `yaml:"compression"`
+	// CompressionThreshold is the size in bytes of the smallest websocket
+	// message worth compressing. MCCP2 compresses the whole stream, so it
+	// doesn't apply to telnet.
+	CompressionThreshold int `yaml:"compression_threshold"`
+	// CompressionLevel is the flate level to compress with, from 1 (fastest)
+	// to 9 (smallest), or -1 for flate's default and -2 for Huffman coding
+	// only.
+	CompressionLevel int `yaml:"compression_level"`
+	// PulseLength is how often the game ticks. Command lag and scheduled
+	// events are measured in pulses.
+	PulseLength time.Duration `yaml:"pulse_length"`
+	// ShutdownWarning is how long players are warned for before the server
+	// shuts down, and ShutdownDeadline how long shutting down may take in
+	// all, warning included.
+	ShutdownWarning  time.Duration `yaml:"shutdown_warning"`
+	ShutdownDeadline time.Duration `yaml:"shutdown_deadline"`
 }
 
-func setupRouter(s *GameState, jwtSecret []byte, origins []string) *gin.Engine {
+// Defaults for keeping websocket connections alive.
+const (
+	defaultWriteTimeout = 10 * time.Second
+	defaultPingInterval = 30 * time.Second
+	defaultPongTimeout  = 60 * time.Second
+)
+
+func setupRouter(s *GameState, sessions *SessionManager, mailer Mailer, live *LiveConfig) *gin.Engine {
+	config := live.Get()
 	// Disable Console Color
 	// gin.DisableConsoleColor()
 	r := gin.Default()
 
 	r.Use(cors.New(cors.Config{
-		AllowOrigins:     origins,
+		AllowOriginFunc:  live.AllowsOrigin,
 		AllowMethods:     []string{"GET", "POST"},
-		AllowHeaders:     []string{"Origin", "Bearer"},
+		AllowHeaders:     []string{"Origin", "Authorization"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -40,152 +123,446 @@ func setupRouter(s *GameState, jwtSecret []byte, origins []string) *gin.Engine {
 		c.String(200, "pong")
 	})
 
+	// Metrics, such as messages dropped for slow clients, for admins only
+	r.GET("/debug/vars", authRequired(sessions), adminRequired(s), gin.WrapH(expvar.Handler()))
+
+	// Registration, verification and password resets
+	registerAccountRoutes(r, s, sessions, mailer, config.PublicURL, config.ClientURL)
+	// Refreshing tokens and logging out
+	registerSessionRoutes(r, sessions)
+
 	// Login
 	r.POST("/login", func(c *gin.Context) {
-		email := c.PostForm("email")
+		if !s.AcceptingLogins() {
+			c.JSON(503, struct{ Error string }{"The server is shutting down; please try again later"})
+			return
+		}
+		email := normalizeEmail(c.PostForm("email"))
 		password := c.PostForm("password")
 
 		if s.CheckPassword(email, password) != nil {
 			c.JSON(403, struct{ Error string }{"Invalid email/password"})
 			return
 		}
-		// TODO this is an abuse of jwts - implement a better system with refresh
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"iss":   "muhmud",
-			"exp":   time.Now().Add(time.Hour * 24),
-			"nbf":   time.Now(),
-			"email": email,
-		})
-
-		tokenString, err := token.SignedString([]byte(jwtSecret))
+		if !s.isVerified(email) {
+			c.JSON(403, struct{ Error string }{"Please verify your email address first"})
+			return
+		}
+		pair, err := sessions.Start(email)
 		if err != nil {
-			log.Println("Got an error when signing token", err)
+			log.Println("Got an error when starting session", err)
 			c.JSON(500, nil)
 			return
 		}
-		c.JSON(200, struct{ Token string }{tokenString})
+		c.JSON(200, pair)
 	})
 
-	// Websocket echo server
-	r.GET("ws", func(c *gin.Context) {
-		upgrader := websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-			CheckOrigin:     checkOrigin(origins),
+	// Details of the logged in account
+	r.GET("/account", authRequired(sessions), func(c *gin.Context) {
+		summary, err := s.AccountSummary(principal(c).Email)
+		if err != nil {
+			c.JSON(404, struct{ Error string }{err.Error()})
+			return
 		}
+		c.JSON(200, summary)
+	})
 
-		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	// Websocket game connection. Text is sent as HTML unless the client asks
+	// for another renderer with the markup query parameter.
+	r.GET("ws", authRequired(sessions), func(c *gin.Context) {
+		// settings may have been reloaded since the router was set up
+		config := live.Get()
+		if !s.AcceptingLogins() {
+			c.JSON(503, struct{ Error string }{"The server is shutting down; please try again later"})
+			return
+		}
+		renderer, err := markup.ByName(c.DefaultQuery("markup", "html"))
 		if err != nil {
-			log.Println(err)
+			c.JSON(400, struct{ Error string }{err.Error()})
 			return
 		}
+		upgrader := websocket.Upgrader{
+			ReadBufferSize:    4096,
+			WriteBufferSize:   4096,
+			Subprotocols:      []string{wsProtocol},
+			CheckOrigin:       checkOrigin(live),
+			EnableCompression: config.Compression,
+		}
 
-		// TODO eventually factor out jwt auth into middleware
-		tokenString := c.Query("token")
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-			}
-
-			return jwtSecret, nil
-		})
+		p := principal(c)
+		email := p.Email
+		traffic := trackTraffic(email, "websocket")
+		defer traffic.Done()
+		conn, err := upgrader.Upgrade(countingWriter{ResponseWriter: c.Writer, traffic: traffic}, c.Request, nil)
 		if err != nil {
-			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "Invalid token"))
+			log.Println(err)
+			return
+		}
+		if err := conn.SetCompressionLevel(config.CompressionLevel); err != nil {
+			log.Println(err)
 			conn.Close()
 			return
 		}
 
-		var email string
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			email = claims["email"].(string)
+		log.Printf("Email %s has connected\n", email)
+		var connID ConnectionID
+		var out *Outbox
+		var replay []Message
+		if token := c.Query("resume"); token != "" {
+			// reconnecting after losing the connection or a copyover
+			seq, _ := strconv.ParseUint(c.Query("seq"), 10, 64)
+			connID, out, replay, err = s.Resume(email, p.SessionID, renderer, token, seq)
 		} else {
-			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4000, "Invalid token"))
-			conn.Close()
+			connID, out, err = s.ConnectPlayer(email, p.SessionID, renderer)
+		}
+		if err == errAlreadyConnected {
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()), time.Now().Add(config.WriteTimeout))
 		}
-		log.Printf("Email %s has connected\n", email)
-		connID, mbox, err := s.ConnectPlayer(email)
 		if err != nil {
 			log.Println(err)
 			conn.Close()
 			return
 		}
-		controlLoop(s, email, conn, connID, mbox)
+		traffic.SetConnection(connID)
+		controlLoop(s, email, conn, connID, out, replay, traffic, config)
 	})
 
 	return r
 }
 
-func controlLoop(s *GameState, email string, conn *websocket.Conn, connID ConnectionID, mbox <-chan string) {
-	// Write forever until mbox says to close
+// controlLoop runs a client's websocket as the link of connection connID,
+// first sending it the messages in replay.
+func controlLoop(s *GameState, email string, conn *websocket.Conn, connID ConnectionID, out *Outbox, replay []Message, traffic *Traffic, config Configuration) {
+	// stop tells the writer to let go of the connection, once the link is
+	// gone or has been replaced by another
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	drop := func() {
+		stopOnce.Do(func() { close(stop) })
+		conn.Close()
+	}
+	link, err := s.AttachLink(connID, drop)
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		return
+	}
+
+	// Write until the outbox is closed, pinging the client every so often. If
+	// a write fails or takes too long the connection is closed, which in turn
+	// stops the reader below.
 	go func() {
-		for {
-			msg, ok := <-mbox
-			if !ok {
-				// Go ahead and close
-				conn.Close()
-				break
+		defer out.Finish()
+		defer conn.Close()
+		write := func(msgs []Message) bool {
+			for _, msg := range msgs {
+				b, err := json.Marshal(msg)
+				if err != nil {
+					log.Printf("Unable to marshal message for %s: %s", email, err)
+					continue
+				}
+				// small messages come out bigger when compressed
+				conn.EnableWriteCompression(len(b) >= config.CompressionThreshold)
+				traffic.AddRaw(len(b))
+				conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+				if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+					log.Printf("Got an error while writing to %s: %s", email, err.Error())
+					return false
+				}
 			}
-			err := conn.WriteMessage(websocket.TextMessage, []byte(msg))
-			if err != nil {
-				log.Printf("Got an error while writing: %s", err.Error())
+			return true
+		}
+		if !write(replay) {
+			return
+		}
+		ping := time.NewTicker(config.PingInterval)
+		defer ping.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-out.Ready():
+				msgs, open := out.Drain()
+				if !write(msgs) {
+					return
+				}
+				if !open {
+					closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+					if out.Evicted() {
+						log.Printf("Disconnecting %s for not keeping up with its messages\n", email)
+						closeMsg = websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow")
+					} else if out.ClosedForShutdown() {
+						closeMsg = websocket.FormatCloseMessage(websocket.CloseGoingAway, shutdownCloseReason)
+					} else if resume, ok := out.ClosedForCopyover(); ok {
+						closeMsg = websocket.FormatCloseMessage(closeResume, resume)
+					}
+					conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(config.WriteTimeout))
+					return
+				}
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(config.WriteTimeout)); err != nil {
+					return
+				}
 			}
 		}
 	}()
 
+	// Any frame, including a pong, shows the client is still there
+	alive := func() {
+		conn.SetReadDeadline(time.Now().Add(config.PongTimeout))
+	}
+	alive()
+	conn.SetPongHandler(func(string) error {
+		alive()
+		return nil
+	})
+
 	// Read forever until error
 	for {
 		messageType, p, err := conn.ReadMessage()
 		if err != nil {
-			// Disconnect the user and return
-			s.DisconnectPlayer(connID)
+			drop()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				// the client left on purpose
+				s.DisconnectPlayer(connID)
+			} else {
+				// hold on to the connection in case the client comes back
+				s.LinkLost(connID, link)
+			}
 			break
 		}
+		alive()
 		if messageType != websocket.TextMessage {
 			// ignore?
 			log.Println("Got a non text message on socket, ignoring")
 			continue
 		}
 
-		// broadcast p to everyone
-		s.NotifyEveryone(fmt.Sprintf("%s: %s", email, string(p)))
+		if err := s.HandleRequest(connID, p); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// configFile is where the configuration is read from, at startup and whenever
+// it's reloaded.
+const configFile = "muhmud.conf.yaml"
+
+// defaultConfig is the configuration used for settings missing from the
+// configuration file.
+func defaultConfig() Configuration {
+	return Configuration{
+		Database:             "muhmud.db",
+		MigrationsDir:        "migrations",
+		WorldDir:             "world",
+		PublicURL:            "http://localhost:8080",
+		ClientURL:            "http://localhost:4200",
+		Mailer:               "log",
+		MailDir:              "mail",
+		AccessTokenTTL:       defaultAccessTokenTTL,
+		SessionTTL:           defaultSessionTTL,
+		OutboxSize:           defaultOutboxSize,
+		OverflowPolicy:       DropNotifications,
+		WriteTimeout:         defaultWriteTimeout,
+		PingInterval:         defaultPingInterval,
+		PongTimeout:          defaultPongTimeout,
+		LinkDeadGrace:        defaultLinkDeadGrace,
+		SessionPolicy:        AllowSessions,
+		TelnetAddress:        ":4000",
+		Compression:          true,
+		CompressionThreshold: 256,
+		CompressionLevel:     flate.DefaultCompression,
+		PulseLength:          defaultPulseLength,
+		ShutdownWarning:      defaultShutdownWarning,
+		ShutdownDeadline:     defaultShutdownDeadline,
 	}
 }
 
 func main() {
 	// load configuration
-	bs, err := ioutil.ReadFile("muhmud.conf.yaml")
+	config, err := loadConfig(configFile)
+	if err != nil {
+		log.Fatalf("Got error when attempting to read config file %s: %s\n", configFile, err)
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			if err := migrateCommand(config, os.Args[2:]); err != nil {
+				log.Fatalln(err)
+			}
+		case "validate-world":
+			if err := validateWorldCommand(config, os.Args[2:]); err != nil {
+				log.Fatalln(err)
+			}
+		default:
+			log.Fatalf("Unknown command %s; usage: %s [migrate [up|down [n]|status] | validate-world [dir]]\n", os.Args[1], os.Args[0])
+		}
+		return
+	}
+
+	// Pick up where the previous process left off if this is a copyover
+	handover, err := loadCopyover()
+	if err != nil {
+		log.Fatalln("Got error when loading state left by copyover", err)
+	}
+
+	world, err := LoadWorld(config.WorldDir)
 	if err != nil {
-		log.Fatalln("Got errror when attempting to open config file muhmud.conf.yaml:", err)
+		log.Fatalln("Got error when loading the world:\n" + err.Error())
 	}
-	var config Configuration
-	err = yaml.UnmarshalStrict(bs, &config)
+
+	// Open the database, bringing the schema up to date
+	store, err := OpenSQLite(config.Database)
+	if err != nil {
+		log.Fatalln("Got error when opening database", err)
+	}
+	defer store.Close()
+	migrations, err := LoadMigrations(config.MigrationsDir)
 	if err != nil {
-		log.Fatalln("Got error when attempting to read config:", err)
+		log.Fatalln("Got error when loading migrations", err)
+	}
+	if _, err := MigrateUp(store.DB(), migrations); err != nil {
+		log.Fatalln("Got error when migrating database", err)
+	}
+	if config.DevMode {
+		if err := seedPlayers(store); err != nil {
+			log.Fatalln("Got error when seeding accounts", err)
+		}
 	}
 
 	// Startup the game
-	game, err := InitialState()
+	game, err := InitialState(store, world)
 	if err != nil {
 		log.Fatalln("Got error when initializing state", err)
 	}
+	game.OutboxSize = config.OutboxSize
+	game.OverflowPolicy = config.OverflowPolicy
+	game.LinkDeadGrace = config.LinkDeadGrace
+	game.SessionPolicy = config.SessionPolicy
+	game.SetAdmins(config.Admins)
+	stopClock := game.StartClock(RealClock{}, config.PulseLength)
+	mailer, err := NewMailer(config.Mailer, config.MailDir)
+	if err != nil {
+		log.Fatalln("Got error when setting up mailer", err)
+	}
 	// Setup our router/handlers
-	r := setupRouter(game, []byte(config.JWTSecret), config.AllowedOrigins)
+	sessions := NewSessionManager(game, []byte(config.JWTSecret), config.AccessTokenTTL, config.SessionTTL)
+	live := NewLiveConfig(config)
+	// Reload the configuration and the world on SIGHUP or when an admin asks
+	reloader := NewReloader(configFile, live, game, sessions, stopClock)
+	game.Reload = reloader.Reload
+	go reloadOnHangup(reloader)
+	server := &http.Server{Addr: ":8080", Handler: setupRouter(game, sessions, mailer, live)}
+	httpFD, telnetFD := -1, -1
+	if handover != nil {
+		httpFD, telnetFD = handover.HTTPListener, handover.TelnetListener
+	}
 	// Listen and Server in 0.0.0.0:8080
-	r.Run(":8080")
+	httpListener, err := listen(server.Addr, httpFD)
+	if err != nil {
+		log.Fatalln("Got error when listening for HTTP", err)
+	}
+	var telnetListener net.Listener
+	if config.TelnetAddress != "" || telnetFD >= 0 {
+		if telnetListener, err = listen(config.TelnetAddress, telnetFD); err != nil {
+			log.Fatalln("Got error when listening for telnet connections", err)
+		}
+		log.Printf("Listening for telnet connections on %s\n", telnetListener.Addr())
+		go func() {
+			err := serveTelnet(telnetListener, game, sessions, live)
+			if game.AcceptingLogins() {
+				log.Fatalln("Got error when accepting telnet connections", err)
+			}
+		}()
+	}
+	// Shut down gracefully on SIGTERM or SIGINT
+	shutdown := NewShutdown(live, game, server, telnetListener)
+	go shutdownOnSignal(shutdown)
+	// Restart without disconnecting anybody on SIGUSR2 or when an admin asks
+	copyover := NewCopyover(live, game, httpListener, telnetListener, shutdown)
+	game.Copyover = copyover.Run
+	go copyoverOnSignal(copyover)
+	if handover != nil {
+		restoreCopyover(handover, game, sessions, live)
+	}
+	if err := server.Serve(httpListener); err != http.ErrServerClosed {
+		log.Fatalln("Got error when serving HTTP", err)
+	}
+	<-shutdown.Done()
+	log.Println("Shut down")
 }
 
-func checkOrigin(allowedOrigins []string) func(r *http.Request) bool {
+// migrateCommand implements the "migrate" subcommand, which applies or reverts
+// migrations by hand.
+func migrateCommand(config Configuration, args []string) error {
+	store, err := OpenSQLite(config.Database)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	migrations, err := LoadMigrations(config.MigrationsDir)
+	if err != nil {
+		return err
+	}
+
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	switch action {
+	case "up":
+		n, err := MigrateUp(store.DB(), migrations)
+		log.Printf("Applied %d migrations\n", n)
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		n, err := MigrateDown(store.DB(), migrations, steps)
+		log.Printf("Reverted %d migrations\n", n)
+		return err
+	case "status":
+		lines, err := MigrationStatus(store.DB(), migrations)
+		for _, l := range lines {
+			fmt.Println(l)
+		}
+		return err
+	}
+	return fmt.Errorf("unknown migrate action %q; expected up, down or status", action)
+}
+
+// validateWorldCommand implements the "validate-world" subcommand, which checks
+// the area files in the given directory, or the configured one, without
+// starting the game. Every problem found is printed on its own line.
+func validateWorldCommand(config Configuration, args []string) error {
+	dir := config.WorldDir
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	w, err := LoadWorld(dir)
+	if errs, ok := err.(WorldErrors); ok {
+		for _, e := range errs {
+			fmt.Println(e)
+		}
+		return fmt.Errorf("found %d problems in %s", len(errs), dir)
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("%s is fine: %d rooms, %d items, %d NPCs and %d resets\n", dir, len(w.Rooms), len(w.Prototypes), len(w.NPCPrototypes), len(w.Resets))
+	return nil
+}
+
+func checkOrigin(live *LiveConfig) func(r *http.Request) bool {
 	return func(r *http.Request) bool {
 		origin := r.Header["Origin"]
 
 		if len(origin) == 0 {
 			return true
 		}
-		for _, o := range allowedOrigins {
-			if o == origin[0] {
-				return true
-			}
-		}
-		return false
+		return live.AllowsOrigin(origin[0])
 	}
 }
@@ -0,0 +1,172 @@
+// Package markup implements the color markup used in all text the game sends
+// to players, and renders it for the different kinds of clients.
+//
+// A code is a % followed by a single character:
+//
+//	%b %r %g %y %u %m %c %w   foreground black, red, green, yellow, blue,
+//	                          magenta, cyan or white
+//	%B %R %G %Y %U %M %C %W   the same colors as background
+//	%h                        bold ("highlight")
+//	%n                        back to normal, i.e. no colors and not bold
+//	%( %)                     start and end a group; the style in effect when
+//	                          the group started is restored when it ends
+//	%%                        a literal %
+//
+// Codes are cumulative, so "%h%r%Uhi" is bold red on blue. Anything else after
+// a %, including the end of the text, is left alone, so stray percent signs
+// come through as they were typed.
+package markup
+
+import (
+	"errors"
+	"strings"
+)
+
+// Color is one of the eight standard terminal colors, or Default.
+type Color int
+
+// The colors, in ANSI order after Default.
+const (
+	Default Color = iota
+	Black
+	Red
+	Green
+	Yellow
+	Blue
+	Magenta
+	Cyan
+	White
+)
+
+// colorCodes maps the lower case code of each color to it.
+var colorCodes = map[byte]Color{
+	'b': Black,
+	'r': Red,
+	'g': Green,
+	'y': Yellow,
+	'u': Blue,
+	'm': Magenta,
+	'c': Cyan,
+	'w': White,
+}
+
+// code returns the lower case markup code of c.
+func (c Color) code() byte {
+	for code, color := range colorCodes {
+		if color == c {
+			return code
+		}
+	}
+	return 0
+}
+
+// Style is how a piece of text should look.
+type Style struct {
+	FG   Color
+	BG   Color
+	Bold bool
+}
+
+// IsDefault reports whether s is the terminal's normal style.
+func (s Style) IsDefault() bool {
+	return s == Style{}
+}
+
+// Token is a run of text in a single style.
+type Token struct {
+	Text  string
+	Style Style
+}
+
+// Parse breaks marked up text into tokens. Adjacent tokens always have
+// different styles and Text is never empty.
+func Parse(s string) []Token {
+	var (
+		tokens []Token
+		text   strings.Builder
+		style  Style
+		groups []Style
+	)
+	flush := func() {
+		if text.Len() == 0 {
+			return
+		}
+		if n := len(tokens); n > 0 && tokens[n-1].Style == style {
+			tokens[n-1].Text += text.String()
+		} else {
+			tokens = append(tokens, Token{Text: text.String(), Style: style})
+		}
+		text.Reset()
+	}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+1 == len(s) {
+			text.WriteByte(s[i])
+			continue
+		}
+		code := s[i+1]
+		next := style
+		switch {
+		case code == '%':
+			text.WriteByte('%')
+		case code == 'h':
+			next.Bold = true
+		case code == 'n':
+			next = Style{}
+		case code == '(':
+			groups = append(groups, style)
+		case code == ')':
+			if len(groups) > 0 {
+				next = groups[len(groups)-1]
+				groups = groups[:len(groups)-1]
+			}
+		case colorCodes[code] != Default:
+			next.FG = colorCodes[code]
+		case code >= 'A' && code <= 'Z' && colorCodes[code-'A'+'a'] != Default:
+			next.BG = colorCodes[code-'A'+'a']
+		default:
+			// not a code after all
+			text.WriteByte('%')
+			continue
+		}
+		if next != style {
+			flush()
+			style = next
+		}
+		i++
+	}
+	flush()
+	return tokens
+}
+
+// Escape returns s with every % doubled, so that it comes out exactly as
+// written when rendered.
+func Escape(s string) string {
+	return strings.Replace(s, "%", "%%", -1)
+}
+
+// Renderer turns tokens into text for a particular kind of client.
+type Renderer interface {
+	Render(tokens []Token) string
+}
+
+// Render parses s and renders it with r.
+func Render(r Renderer, s string) string {
+	return r.Render(Parse(s))
+}
+
+// The renderers, by the names clients ask for them with.
+var renderers = map[string]Renderer{
+	"ansi":  ANSI{},
+	"html":  HTML{},
+	"plain": Plain{},
+}
+
+// ByName returns the renderer called name: "ansi", "html" or "plain".
+func ByName(name string) (Renderer, error) {
+	r, ok := renderers[strings.ToLower(name)]
+	if !ok {
+		return nil, errors.New("unknown markup renderer " + name + "; expected ansi, html or plain")
+	}
+	return r, nil
+}
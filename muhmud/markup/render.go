@@ -0,0 +1,102 @@
+package markup
+
+import (
+	"html"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ANSI renders tokens with ANSI SGR escape sequences, for terminals. The
+// output always ends in the default style so colors never bleed into whatever
+// comes next. Control characters in the text are dropped; see StripControls.
+type ANSI struct{}
+
+// Render implements Renderer.
+func (ANSI) Render(tokens []Token) string {
+	var b strings.Builder
+	current := Style{}
+	for _, t := range tokens {
+		if t.Style != current {
+			b.WriteString(sgr(t.Style))
+			current = t.Style
+		}
+		b.WriteString(StripControls(t.Text))
+	}
+	if !current.IsDefault() {
+		b.WriteString(sgr(Style{}))
+	}
+	return b.String()
+}
+
+// sgr returns the escape sequence switching a terminal to s from any other
+// style.
+func sgr(s Style) string {
+	params := []string{"0"}
+	if s.Bold {
+		params = append(params, "1")
+	}
+	if s.FG != Default {
+		params = append(params, strconv.Itoa(30+int(s.FG-Black)))
+	}
+	if s.BG != Default {
+		params = append(params, strconv.Itoa(40+int(s.BG-Black)))
+	}
+	return "\x1b[" + strings.Join(params, ";") + "m"
+}
+
+// HTML renders tokens as HTML, escaping the text and wrapping styled runs in
+// spans. Colors are given as classes: c-<code> for the foreground, bg-<code>
+// for the background and bold, so "%rred" becomes
+// <span class="c-r">red</span>.
+type HTML struct{}
+
+// Render implements Renderer.
+func (HTML) Render(tokens []Token) string {
+	var b strings.Builder
+	for _, t := range tokens {
+		if t.Style.IsDefault() {
+			b.WriteString(html.EscapeString(t.Text))
+			continue
+		}
+		var classes []string
+		if t.Style.FG != Default {
+			classes = append(classes, "c-"+string(t.Style.FG.code()))
+		}
+		if t.Style.BG != Default {
+			classes = append(classes, "bg-"+string(t.Style.BG.code()))
+		}
+		if t.Style.Bold {
+			classes = append(classes, "bold")
+		}
+		b.WriteString(`<span class="` + strings.Join(classes, " ") + `">`)
+		b.WriteString(html.EscapeString(t.Text))
+		b.WriteString("</span>")
+	}
+	return b.String()
+}
+
+// Plain renders tokens as text without any styling, for logs and clients that
+// can't show colors. Like ANSI it drops control characters.
+type Plain struct{}
+
+// Render implements Renderer.
+func (Plain) Render(tokens []Token) string {
+	var b strings.Builder
+	for _, t := range tokens {
+		b.WriteString(StripControls(t.Text))
+	}
+	return b.String()
+}
+
+// StripControls returns s without its control characters other than newlines,
+// so that text a player typed can't move the cursor, change colors or
+// otherwise mess with somebody else's terminal.
+func StripControls(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r != '\n' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,79 @@
+package markup
+
+import "testing"
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		in                string
+		ansi, html, plain string
+	}{
+		{
+			in:    "plain text",
+			ansi:  "plain text",
+			html:  "plain text",
+			plain: "plain text",
+		},
+		{
+			in:    "%rred%n and %h%Ubold on blue",
+			ansi:  "\x1b[0;31mred\x1b[0m and \x1b[0;1;44mbold on blue\x1b[0m",
+			html:  `<span class="c-r">red</span> and <span class="bg-u bold">bold on blue</span>`,
+			plain: "red and bold on blue",
+		},
+		{
+			in:    "%g(%(%rnested%)) back",
+			ansi:  "\x1b[0;32m(\x1b[0;31mnested\x1b[0;32m) back\x1b[0m",
+			html:  `<span class="c-g">(</span><span class="c-r">nested</span><span class="c-g">) back</span>`,
+			plain: "(nested) back",
+		},
+		{
+			in:    "100%% sure, 50% maybe, %",
+			ansi:  "100% sure, 50% maybe, %",
+			html:  "100% sure, 50% maybe, %",
+			plain: "100% sure, 50% maybe, %",
+		},
+		{
+			in:    "<b>&amp;</b>",
+			ansi:  "<b>&amp;</b>",
+			html:  "&lt;b&gt;&amp;amp;&lt;/b&gt;",
+			plain: "<b>&amp;</b>",
+		},
+		{
+			// control characters a player might sneak in to mess with
+			// terminals, in and out of styled text
+			in:    "one\ntwo\x1b[2J\r\a%rthree\x1b]0;title\x07\x7f\u009b31m%n",
+			ansi:  "one\ntwo[2J\x1b[0;31mthree]0;title31m\x1b[0m",
+			html:  "one\ntwo\x1b[2J\r\a<span class=\"c-r\">three\x1b]0;title\x07\x7f\u009b31m</span>",
+			plain: "one\ntwo[2Jthree]0;title31m",
+		},
+	}
+	for _, tt := range tests {
+		if got := Render(ANSI{}, tt.in); got != tt.ansi {
+			t.Errorf("ANSI rendered %q as %q, want %q", tt.in, got, tt.ansi)
+		}
+		if got := Render(HTML{}, tt.in); got != tt.html {
+			t.Errorf("HTML rendered %q as %q, want %q", tt.in, got, tt.html)
+		}
+		if got := Render(Plain{}, tt.in); got != tt.plain {
+			t.Errorf("Plain rendered %q as %q, want %q", tt.in, got, tt.plain)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	for _, s := range []string{"", "%r not red", "100%", "%%", "%(%h%)"} {
+		if got := Render(Plain{}, Escape(s)); got != s {
+			t.Errorf("escaped %q came out as %q", s, got)
+		}
+	}
+}
+
+func TestByName(t *testing.T) {
+	for name, want := range map[string]Renderer{"ansi": ANSI{}, "HTML": HTML{}, "Plain": Plain{}} {
+		if r, err := ByName(name); err != nil || r != want {
+			t.Errorf("ByName(%q) = %v, %v", name, r, err)
+		}
+	}
+	if _, err := ByName("vt100"); err == nil {
+		t.Error("ByName accepted an unknown renderer")
+	}
+}
@@ -0,0 +1,76 @@
+// Contains the envelope used for all messages on the websocket.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ProtocolVersion is the version of the message envelope spoken by the server.
+// Bump it whenever the shape of Message changes in an incompatible way.
+const ProtocolVersion = 1
+
+// MessageType describes which kind of frame a Message is.
+type MessageType string
+
+const (
+	// Request is sent by a client to issue a command.
+	Request MessageType = "request"
+	// Response is sent by the server in reply to exactly one request.
+	Response MessageType = "response"
+	// Notification is sent by the server whenever something happens that wasn't
+	// directly caused by one of the client's own requests.
+	Notification MessageType = "notification"
+	// GMCP carries structured out of band data, such as the room a character
+	// is in, in either direction. See gmcp.go.
+	GMCP MessageType = "gmcp"
+)
+
+// Message is the envelope every frame on the websocket is wrapped in. See
+// doc/design.md for a description of the protocol.
+type Message struct {
+	Version   int         `json:"version"`
+	Type      MessageType `json:"type"`
+	RequestID string      `json:"requestId,omitempty"`
+	Msg       string      `json:"msg"`
+	// Package and Data are only set for GMCP messages, e.g. "Room.Info" and
+	// the details of the room.
+	Package string          `json:"package,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	// Seq numbers the messages sent to a connection, so that a client
+	// resuming after losing its link can say which it last got. See
+	// linkdead.go.
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// NewResponse creates a response to the request with the given id.
+func NewResponse(requestID, msg string) Message {
+	return Message{Version: ProtocolVersion, Type: Response, RequestID: requestID, Msg: msg}
+}
+
+// NewNotification creates a notification carrying msg.
+func NewNotification(msg string) Message {
+	return Message{Version: ProtocolVersion, Type: Notification, Msg: msg}
+}
+
+// NewGMCP creates a GMCP message for package pkg carrying data, which may be
+// nil.
+func NewGMCP(pkg string, data json.RawMessage) Message {
+	return Message{Version: ProtocolVersion, Type: GMCP, Package: pkg, Data: data}
+}
+
+// validateRequest checks that a message received from a client is a well formed
+// request that we know how to answer.
+func validateRequest(m Message) error {
+	if m.Version != ProtocolVersion {
+		return fmt.Errorf("unsupported protocol version %d (server speaks %d)", m.Version, ProtocolVersion)
+	}
+	if m.Type != Request {
+		return fmt.Errorf("expected a message of type %q but got %q", Request, m.Type)
+	}
+	if m.RequestID == "" {
+		return errors.New("request is missing a requestId")
+	}
+	return nil
+}
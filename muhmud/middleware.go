@@ -0,0 +1,77 @@
+// Contains gin middleware shared by the HTTP routes and the websocket.
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// principalKey is the key the authenticated principal is stored under in the
+// gin context.
+const principalKey = "principal"
+
+// wsProtocol is the websocket subprotocol spoken on /ws. Browsers can't set
+// headers on websocket requests, so they may instead offer an extra
+// "bearer.<token>" subprotocol carrying the access token.
+const (
+	wsProtocol           = "muhmud"
+	bearerProtocolPrefix = "bearer."
+)
+
+// Principal is who an authenticated request was made by.
+type Principal struct {
+	Email     string
+	SessionID string
+}
+
+// authRequired rejects requests without a valid access token with a 401 and
+// otherwise stores the Principal in the context for the handlers after it.
+// Since it runs before any handler, websocket upgrades are rejected with a
+// plain HTTP error rather than after the upgrade.
+func authRequired(sessions *SessionManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := sessions.Validate(accessToken(c.Request))
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer realm="muhmud"`)
+			c.AbortWithStatusJSON(401, struct{ Error string }{"Invalid token"})
+			return
+		}
+		c.Set(principalKey, &Principal{Email: claims.Email, SessionID: claims.SessionID})
+		c.Next()
+	}
+}
+
+// adminRequired rejects requests from anybody but admins with a 403. It must
+// come after authRequired.
+func adminRequired(s *GameState) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.isAdmin(principal(c).Email) {
+			c.AbortWithStatusJSON(403, struct{ Error string }{"Only admins can do that"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// principal returns the principal stored by authRequired.
+func principal(c *gin.Context) *Principal {
+	return c.MustGet(principalKey).(*Principal)
+}
+
+// accessToken finds the access token in a request. It's looked for in the
+// Authorization header, then the websocket subprotocols and finally the
+// "token" query parameter.
+func accessToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	for _, p := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(p, bearerProtocolPrefix) {
+			return strings.TrimPrefix(p, bearerProtocolPrefix)
+		}
+	}
+	return r.URL.Query().Get("token")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// get requests path from r as a websocket handshake, with the given headers,
+// returning the status code.
+func get(r *gin.Engine, path string, header http.Header) int {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+// bearer is an Authorization header carrying token.
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+func TestAuthRequired(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s, sessions, clock := newTestSessions(t)
+	s.SetAdmins([]string{"b@example.com"})
+	r := setupRouter(s, sessions, &recordingMailer{}, NewLiveConfig(defaultConfig()))
+	start := func(email string) string {
+		pair, err := sessions.Start(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pair.Token
+	}
+	expired, revoked := start("a@example.com"), start("a@example.com")
+	claims, err := sessions.Validate(revoked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions.End(claims.SessionID)
+	clock.Advance(30 * time.Second)
+	valid, admin := start("a@example.com"), start("b@example.com")
+	// the first access tokens expire, but not their sessions
+	clock.Advance(31 * time.Second)
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		authorized bool
+	}{
+		{"no token", nil, false},
+		{"an expired token", bearer(expired), false},
+		{"a revoked session", bearer(revoked), false},
+		{"garbage", bearer("garbage"), false},
+		{"a valid token", bearer(valid), true},
+	}
+	for _, path := range []string{"/ws", "/account", "/debug/vars"} {
+		for _, test := range tests {
+			if code := get(r, path, test.header); (code != 401) != test.authorized {
+				t.Errorf("%s with %s got %d", path, test.name, code)
+			}
+		}
+	}
+
+	if code := get(r, "/debug/vars", bearer(valid)); code != 403 {
+		t.Errorf("/debug/vars got %d for a player, want 403", code)
+	}
+	if code := get(r, "/debug/vars", bearer(admin)); code != 200 {
+		t.Errorf("/debug/vars got %d for an admin, want 200", code)
+	}
+}
+
+func TestAccessTokenPrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		protocol string
+		query    string
+		want     string
+	}{
+		{"header", "Bearer header", "muhmud, bearer.protocol", "?token=query", "header"},
+		{"protocol", "", "muhmud, bearer.protocol", "?token=query", "protocol"},
+		{"query", "", "muhmud", "?token=query", "query"},
+		{"not a bearer header", "Basic header", "", "?token=query", "query"},
+		{"first bearer protocol", "", "bearer.first, bearer.second", "", "first"},
+		{"nothing", "", "muhmud", "", ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/ws"+test.query, nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		if test.protocol != "" {
+			req.Header.Set("Sec-WebSocket-Protocol", test.protocol)
+		}
+		if got := accessToken(req); got != test.want {
+			t.Errorf("%s: accessToken() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAuthRequiredPrefersTheHeader(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s, sessions, _ := newTestSessions(t)
+	r := setupRouter(s, sessions, &recordingMailer{}, NewLiveConfig(defaultConfig()))
+	pair, err := sessions.Start("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		want   int
+	}{
+		{"valid header, bad query", "/account?token=garbage", bearer(pair.Token), 200},
+		{"bad header, valid query", "/account?token=" + pair.Token, bearer("garbage"), 401},
+		{"valid protocol, bad query", "/account?token=garbage",
+			http.Header{"Sec-Websocket-Protocol": {"muhmud, bearer." + pair.Token}}, 200},
+		{"bad protocol, valid query", "/account?token=" + pair.Token,
+			http.Header{"Sec-Websocket-Protocol": {"muhmud, bearer.garbage"}}, 401},
+		{"valid query", "/account?token=" + pair.Token, nil, 200},
+	}
+	for _, test := range tests {
+		if code := get(r, test.path, test.header); code != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, code, test.want)
+		}
+	}
+}
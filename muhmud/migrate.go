@@ -0,0 +1,186 @@
+// Contains the runner applying the SQL migrations in the migrations directory.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Migration is a single schema change, created by migrations/migration.
+type Migration struct {
+	// Version is the unix timestamp the migration was created at.
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// LoadMigrations reads every migration in dir, ordered by version. Every
+// migration must have both an up and a down file.
+func LoadMigrations(dir string) ([]Migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, f := range files {
+		m := migrationFile.FindStringSubmatch(f.Name())
+		if m == nil || f.IsDir() {
+			continue
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad migration version in %s: %s", f.Name(), err)
+		}
+		bs, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", mig.Name, m[2], version)
+		}
+		if m[3] == "up" {
+			mig.Up = string(bs)
+		} else {
+			mig.Down = string(bs)
+		}
+	}
+
+	var migrations []Migration
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// appliedMigrations returns the versions already applied to db, creating the
+// bookkeeping table if needed.
+func appliedMigrations(db *sql.DB) (map[int64]bool, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int64]bool)
+	for rows.Next() {
+		var v int64
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
+
+// MigrateUp applies every migration that hasn't been applied yet, oldest first.
+// Each migration runs in its own transaction. Returns how many were applied.
+func MigrateUp(db *sql.DB, migrations []Migration) (int, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		log.Printf("Applying migration %d_%s\n", m.Version, m.Name)
+		err := inTx(db, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(m.Up); err != nil {
+				return err
+			}
+			_, err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name)
+			return err
+		})
+		if err != nil {
+			return n, fmt.Errorf("migration %d_%s failed: %s", m.Version, m.Name, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// MigrateDown reverts the steps most recently applied migrations, newest first.
+// Returns how many were reverted.
+func MigrateDown(db *sql.DB, migrations []Migration, steps int) (int, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := len(migrations) - 1; i >= 0 && n < steps; i-- {
+		m := migrations[i]
+		if !applied[m.Version] {
+			continue
+		}
+		log.Printf("Reverting migration %d_%s\n", m.Version, m.Name)
+		err := inTx(db, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(m.Down); err != nil {
+				return err
+			}
+			_, err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.Version)
+			return err
+		})
+		if err != nil {
+			return n, fmt.Errorf("reverting migration %d_%s failed: %s", m.Version, m.Name, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// MigrationStatus describes which migrations have been applied to db, one line
+// per migration.
+func MigrationStatus(db *sql.DB, migrations []Migration) ([]string, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, m := range migrations {
+		state := "pending"
+		if applied[m.Version] {
+			state = "applied"
+		}
+		lines = append(lines, fmt.Sprintf("%d_%s: %s", m.Version, m.Name, state))
+	}
+	return lines, nil
+}
+
+// inTx runs f in a transaction, committing if it returns nil and rolling back
+// otherwise.
+func inTx(db *sql.DB, f func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
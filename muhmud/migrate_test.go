@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// openTestDB opens an empty SQLite database in a temporary directory, which
+// the returned function removes again.
+func openTestDB(t *testing.T) (*sql.DB, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "muhmud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenSQLite(filepath.Join(dir, "test.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return store.DB(), func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func tableExists(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := LoadMigrations("migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations loaded")
+	}
+	for i, m := range migrations {
+		if m.Up == "" || m.Down == "" {
+			t.Errorf("migration %d_%s is missing its up or down", m.Version, m.Name)
+		}
+		if i > 0 && migrations[i-1].Version >= m.Version {
+			t.Errorf("migration %d_%s is out of order", m.Version, m.Name)
+		}
+	}
+	if migrations[0].Name != "initial" {
+		t.Errorf("first migration is %s, want initial", migrations[0].Name)
+	}
+}
+
+func TestLoadMigrationsNeedsBothFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "muhmud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "1_things.up.sql"), []byte("CREATE TABLE things (id INTEGER);"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadMigrations(dir); err == nil || !strings.Contains(err.Error(), "1_things") {
+		t.Errorf("LoadMigrations() = %v, want an error about 1_things", err)
+	}
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	migrations, err := LoadMigrations("migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, done := openTestDB(t)
+	defer done()
+
+	if n, err := MigrateUp(db, migrations); err != nil || n != len(migrations) {
+		t.Fatalf("MigrateUp() = %d, %v; want %d", n, err, len(migrations))
+	}
+	if n, err := MigrateUp(db, migrations); err != nil || n != 0 {
+		t.Errorf("MigrateUp() again = %d, %v; want 0", n, err)
+	}
+	for _, table := range []string{"accounts", "sessions", "inventories"} {
+		if !tableExists(t, db, table) {
+			t.Errorf("table %s is missing after migrating up", table)
+		}
+	}
+
+	// the newest migration adds inventories, the one before it channels
+	if n, err := MigrateDown(db, migrations, 2); err != nil || n != 2 {
+		t.Fatalf("MigrateDown(2) = %d, %v; want 2", n, err)
+	}
+	if tableExists(t, db, "inventories") || tableExists(t, db, "character_channels") {
+		t.Error("the reverted migrations' tables are still there")
+	}
+	if !tableExists(t, db, "sessions") {
+		t.Error("MigrateDown reverted too much")
+	}
+	status, err := MigrationStatus(db, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for i, m := range migrations {
+		state := "applied"
+		if i >= len(migrations)-2 {
+			state = "pending"
+		}
+		want = append(want, m.Name+": "+state)
+	}
+	for i := range status {
+		status[i] = status[i][strings.Index(status[i], "_")+1:]
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("MigrationStatus() = %v, want %v", status, want)
+	}
+
+	if n, err := MigrateUp(db, migrations); err != nil || n != 2 {
+		t.Errorf("MigrateUp() after reverting = %d, %v; want 2", n, err)
+	}
+	if n, err := MigrateDown(db, migrations, len(migrations)+1); err != nil || n != len(migrations) {
+		t.Errorf("MigrateDown(all) = %d, %v; want %d", n, err, len(migrations))
+	}
+	if tableExists(t, db, "accounts") {
+		t.Error("accounts is still there after reverting everything")
+	}
+}
+
+func TestMigrateUpRollsBackFailures(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+	migrations := []Migration{
+		{Version: 1, Name: "good", Up: "CREATE TABLE good (id INTEGER);", Down: "DROP TABLE good;"},
+		{Version: 2, Name: "bad", Up: "CREATE TABLE half (id INTEGER); NOT SQL;", Down: "DROP TABLE half;"},
+	}
+	n, err := MigrateUp(db, migrations)
+	if err == nil || !strings.Contains(err.Error(), "2_bad") || n != 1 {
+		t.Fatalf("MigrateUp() = %d, %v; want 1 and an error about 2_bad", n, err)
+	}
+	if !tableExists(t, db, "good") {
+		t.Error("the good migration wasn't applied")
+	}
+	if tableExists(t, db, "half") {
+		t.Error("the bad migration was partly applied")
+	}
+	status, err := MigrationStatus(db, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1_good: applied", "2_bad: pending"}; !reflect.DeepEqual(status, want) {
+		t.Errorf("MigrationStatus() = %v, want %v", status, want)
+	}
+}
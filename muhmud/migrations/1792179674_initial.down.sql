@@ -0,0 +1,4 @@
+DROP TABLE door_states;
+DROP INDEX characters_account;
+DROP TABLE characters;
+DROP TABLE accounts;
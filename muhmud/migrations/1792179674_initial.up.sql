@@ -0,0 +1,21 @@
+CREATE TABLE accounts (
+    email TEXT PRIMARY KEY,
+    pass_hash BLOB NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE characters (
+    name TEXT PRIMARY KEY COLLATE NOCASE,
+    account TEXT NOT NULL REFERENCES accounts (email) ON DELETE CASCADE,
+    location INTEGER NOT NULL,
+    stats TEXT NOT NULL
+);
+
+CREATE INDEX characters_account ON characters (account);
+
+CREATE TABLE door_states (
+    room_id INTEGER NOT NULL,
+    exit TEXT NOT NULL,
+    state INTEGER NOT NULL,
+    PRIMARY KEY (room_id, exit)
+);
@@ -0,0 +1,3 @@
+DROP INDEX account_tokens_email;
+DROP TABLE account_tokens;
+DROP TABLE verified_emails;
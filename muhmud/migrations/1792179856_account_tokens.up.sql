@@ -0,0 +1,17 @@
+CREATE TABLE verified_emails (
+    email TEXT PRIMARY KEY REFERENCES accounts (email) ON DELETE CASCADE,
+    verified_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- accounts created before registration existed were made by hand
+INSERT INTO verified_emails (email) SELECT email FROM accounts;
+
+CREATE TABLE account_tokens (
+    token_hash TEXT PRIMARY KEY,
+    email TEXT NOT NULL REFERENCES accounts (email) ON DELETE CASCADE,
+    purpose TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX account_tokens_email ON account_tokens (email);
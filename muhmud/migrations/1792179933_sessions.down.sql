@@ -0,0 +1,4 @@
+DROP INDEX refresh_tokens_session;
+DROP TABLE refresh_tokens;
+DROP INDEX sessions_email;
+DROP TABLE sessions;
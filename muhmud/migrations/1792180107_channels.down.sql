@@ -0,0 +1,2 @@
+DROP TABLE character_channels;
+DROP TABLE ignores;
@@ -0,0 +1,16 @@
+CREATE TABLE ignores (
+    email TEXT NOT NULL REFERENCES accounts (email) ON DELETE CASCADE,
+    name TEXT NOT NULL COLLATE NOCASE,
+    PRIMARY KEY (email, name)
+);
+
+CREATE TABLE character_channels (
+    name TEXT NOT NULL REFERENCES characters (name) ON DELETE CASCADE,
+    channel TEXT NOT NULL,
+    muted INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (name, channel)
+);
+
+-- existing characters start out on the same channels as new ones
+INSERT INTO character_channels (name, channel) SELECT name, 'gossip' FROM characters;
+INSERT INTO character_channels (name, channel) SELECT name, 'newbie' FROM characters;
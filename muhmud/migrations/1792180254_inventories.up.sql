@@ -0,0 +1,4 @@
+CREATE TABLE inventories (
+    name TEXT PRIMARY KEY REFERENCES characters (name) ON DELETE CASCADE,
+    items TEXT NOT NULL
+);
@@ -0,0 +1,283 @@
+// Contains commands for looking around and moving through the world.
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// movementLag is how long a character has to wait after walking into a room
+// before doing anything else.
+const movementLag = 500 * time.Millisecond
+
+// registerMovementCommands adds the commands for getting around. They're
+// registered before everything else so that "n", "e" and friends always mean a
+// direction.
+func registerMovementCommands(r *CommandRegistry) {
+	for _, d := range []Direction{North, East, South, West, Up, Down} {
+		d := d
+		r.Register(&Command{
+			Name:    d.String(),
+			Aliases: []string{d.String()[:1]},
+			Help:    fmt.Sprintf("Walk %s.", d),
+			Handler: func(ctx *CommandContext) { moveThrough(ctx, ctx.State.currentRoom(ctx.Character).Exit(d)) },
+		})
+	}
+	r.Register(&Command{
+		Name:    "look",
+		Aliases: []string{"l"},
+		Usage:   "[direction|item|character]",
+		Help:    "Look at the room you're in, through one of its exits, at an item or at someone.",
+		Handler: cmdLook,
+	})
+	r.Register(&Command{
+		Name:    "exits",
+		Help:    "List the obvious ways out of the room.",
+		Handler: cmdExits,
+	})
+	r.Register(&Command{
+		Name:    "go",
+		Aliases: []string{"enter"},
+		Usage:   "<exit>",
+		Help:    "Leave through an exit, e.g. \"go north\" or \"enter portal\".",
+		Handler: cmdGo,
+	})
+	r.Register(&Command{
+		Name:    "open",
+		Usage:   "<door|direction>",
+		Help:    "Open a door.",
+		Handler: func(ctx *CommandContext) { setDoor(ctx, DoorClosed, DoorOpen) },
+	})
+	r.Register(&Command{
+		Name:    "close",
+		Usage:   "<door|direction>",
+		Help:    "Close a door.",
+		Handler: func(ctx *CommandContext) { setDoor(ctx, DoorOpen, DoorClosed) },
+	})
+	r.Register(&Command{
+		Name:    "lock",
+		Usage:   "<door|direction>",
+		Help:    "Lock a closed door, if you have its key.",
+		Handler: func(ctx *CommandContext) { setDoor(ctx, DoorClosed, DoorLocked) },
+	})
+	r.Register(&Command{
+		Name:    "unlock",
+		Usage:   "<door|direction>",
+		Help:    "Unlock a door, if you have its key.",
+		Handler: func(ctx *CommandContext) { setDoor(ctx, DoorLocked, DoorClosed) },
+	})
+}
+
+// currentRoom returns the room a character is in. It must be called from the
+// game loop.
+func (s *GameState) currentRoom(c *Character) *Room {
+	return s.World.Rooms[c.Location]
+}
+
+// describeRoom renders what a character sees when looking around a room. It
+// must be called from the game loop.
+func (s *GameState) describeRoom(viewer *Character, room *Room) string {
+	lines := []string{room.Name, room.Description, exitSummary(room)}
+	for _, it := range room.Items {
+		lines = append(lines, it.Proto.Long)
+	}
+	for _, c := range s.CharactersIn(room.ID) {
+		switch {
+		case c == viewer:
+		case c.NPC != nil && c.fighting == nil:
+			lines = append(lines, c.NPC.Long)
+		case c.fighting != nil:
+			lines = append(lines, fmt.Sprintf("%s is here, fighting %s.", capitalize(c.Name), c.fighting.Name))
+		default:
+			lines = append(lines, fmt.Sprintf("%s is here.", c.Name))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// exitSummary renders the line listing a room's exits, e.g. "[Exits: north
+// east (closed)]".
+func exitSummary(room *Room) string {
+	if len(room.Exits) == 0 {
+		return "[Exits: none]"
+	}
+	var labels []string
+	for _, e := range room.Exits {
+		label := e.Label()
+		if e.Door != nil && e.Door.State != DoorOpen {
+			label += " (closed)"
+		}
+		labels = append(labels, label)
+	}
+	return "[Exits: " + strings.Join(labels, " ") + "]"
+}
+
+func cmdLook(ctx *CommandContext) {
+	c := ctx.Character
+	room := ctx.State.currentRoom(c)
+	if len(ctx.Args) == 0 {
+		ctx.Respond(ctx.State.describeRoom(c, room))
+		return
+	}
+	// directions win over items, so that "look n" doesn't look at a necklace
+	if d, ok := ParseDirection(ctx.Args[0]); !ok || room.Exit(d) == nil {
+		t := ParseTarget(ctx.Args[0])
+		t.All = false
+		if items := selectItems(t, append(append([]*Item(nil), c.Inventory...), room.Items...)); len(items) > 0 {
+			ctx.Respond(describeItem(items[0]))
+			return
+		}
+		chars := ctx.State.CharactersIn(room.ID)
+		if picked := t.Select(len(chars), func(i int) []string { return chars[i].Keywords() }); len(picked) > 0 {
+			ctx.Respond(describeCharacter(chars[picked[0]]))
+			return
+		}
+	}
+	exit := room.FindExit(ctx.Args[0])
+	if exit == nil {
+		ctx.Respond("You don't see that here.")
+		return
+	}
+	if !exit.Passable() {
+		ctx.Respondf("The %s is closed.", exit.Door.Name)
+		return
+	}
+	ctx.Respondf("Looking %s you see %s.", exit.Label(), ctx.State.World.Rooms[exit.To].Name)
+}
+
+func cmdExits(ctx *CommandContext) {
+	ctx.Respond(exitSummary(ctx.State.currentRoom(ctx.Character)))
+}
+
+func cmdGo(ctx *CommandContext) {
+	if len(ctx.Args) == 0 {
+		ctx.Respond("Go where?")
+		return
+	}
+	moveThrough(ctx, ctx.State.currentRoom(ctx.Character).FindExit(ctx.Args[0]))
+}
+
+// moveThrough moves the acting character through exit, which may be nil if there
+// is no such exit.
+func moveThrough(ctx *CommandContext, exit *Exit) {
+	s, c := ctx.State, ctx.Character
+	if exit == nil {
+		ctx.Respond("You can't go that way.")
+		return
+	}
+	if !exit.Passable() {
+		ctx.Respondf("The %s is closed.", exit.Door.Name)
+		return
+	}
+	to, ok := s.World.Rooms[exit.To]
+	if !ok {
+		ctx.Respond("You can't go that way.")
+		return
+	}
+	if c.fighting != nil {
+		ctx.Respond("You're fighting for your life! Try fleeing instead.")
+		return
+	}
+	if c.Stats.Move < 1 {
+		ctx.Respond("You're too exhausted to go any further.")
+		return
+	}
+
+	c.Stats.Move--
+	s.move(c, exit, to)
+	ctx.Lag(movementLag)
+	ctx.Respond(s.describeRoom(c, to))
+}
+
+// move takes c through exit into to, telling everyone who sees it happen. It
+// must be called from the game loop.
+func (s *GameState) move(c *Character, exit *Exit, to *Room) {
+	from := c.Location
+	name := capitalize(c.Name)
+	if exit.Direction == NoDirection {
+		s.NotifyRoom(from, fmt.Sprintf("%s leaves through the %s.", name, exit.Name), c)
+	} else {
+		s.NotifyRoom(from, fmt.Sprintf("%s leaves %s.", name, exit.Direction), c)
+	}
+	c.Location = to.ID
+	s.NotifyRoom(to.ID, fmt.Sprintf("%s arrives %s.", name, fromDirection(exit.Direction.Opposite())), c)
+	s.SendGMCPCharacter(c, "Room.Info", newRoomInfo(to))
+	s.sendVitals(c)
+}
+
+// describeCharacter renders what a character sees when looking at someone.
+func describeCharacter(c *Character) string {
+	desc := fmt.Sprintf("You see nothing special about %s.", c.Name)
+	if c.NPC != nil && c.NPC.Description != "" {
+		desc = c.NPC.Description
+	}
+	var lines []string
+	for _, slot := range wearSlots {
+		if it := wearing(c, slot); it != nil {
+			lines = append(lines, fmt.Sprintf("  <%s> %s", slot, it.Name()))
+		}
+	}
+	if len(lines) == 0 {
+		return desc
+	}
+	return fmt.Sprintf("%s\n%s is using:\n%s", desc, capitalize(c.Name), strings.Join(lines, "\n"))
+}
+
+// setDoor changes the door named by the command's argument from state from to
+// state to, e.g. from closed to open. Locking and unlocking takes its key.
+func setDoor(ctx *CommandContext, from, to DoorState) {
+	verb := ctx.Command.Name
+	if len(ctx.Args) == 0 {
+		ctx.Respondf("%s what?", strings.Title(verb))
+		return
+	}
+	room := ctx.State.currentRoom(ctx.Character)
+	exit := room.FindExit(ctx.Args[0])
+	if exit == nil || exit.Door == nil {
+		ctx.Respondf("You see nothing to %s there.", verb)
+		return
+	}
+	door := exit.Door
+	locking := from == DoorLocked || to == DoorLocked
+	switch {
+	case locking && door.Key == 0:
+		ctx.Respondf("The %s has no lock.", door.Name)
+		return
+	case door.State == from:
+	case door.State == DoorLocked && to == DoorOpen:
+		ctx.Respondf("The %s is locked.", door.Name)
+		return
+	case door.State == DoorOpen && to == DoorLocked:
+		ctx.Respondf("You have to close the %s first.", door.Name)
+		return
+	case from == DoorLocked:
+		ctx.Respondf("The %s isn't locked.", door.Name)
+		return
+	default:
+		ctx.Respondf("The %s is already %s.", door.Name, door.State)
+		return
+	}
+	if locking && !hasKey(ctx.Character, door) {
+		ctx.Respondf("You don't have the key to the %s.", door.Name)
+		return
+	}
+	door.State = to
+	if err := ctx.State.Store.SaveDoorState(ctx.State.World.DoorKey(room, exit), to); err != nil {
+		log.Printf("Unable to save door state: %s", err)
+	}
+	ctx.Respondf("You %s the %s.", verb, door.Name)
+	ctx.State.NotifyRoom(room.ID, fmt.Sprintf("%s %ss the %s.", ctx.Character.Name, verb, door.Name), ctx.Character)
+	ctx.State.NotifyRoom(exit.To, fmt.Sprintf("Someone %ss the %s from the other side.", verb, door.Name), nil)
+}
+
+// hasKey reports whether c is carrying the key to door, in hand or not.
+func hasKey(c *Character, door *Door) bool {
+	for _, it := range c.Inventory {
+		if it.Proto.ID == door.Key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockingDoors(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	alice, out := enterGame(t, s, "a@example.com", "Alice")
+	// the inn, where the key to the trapdoor down to the cellar is
+	s.do(func() { s.character("Alice").Location = 3 })
+	received(out)
+
+	for _, tt := range []struct{ line, want string }{
+		{"lock trapdoor", "You don't have the key to the trapdoor."},
+		{"get key", "You get an iron key."},
+		{"unlock trapdoor", "The trapdoor isn't locked."},
+		{"open trapdoor", "You open the trapdoor."},
+		{"lock trapdoor", "You have to close the trapdoor first."},
+		{"close trapdoor", "You close the trapdoor."},
+		{"lock trapdoor", "You lock the trapdoor."},
+		{"lock down", "The trapdoor is already locked."},
+		{"open trapdoor", "The trapdoor is locked."},
+		{"down", "The trapdoor is closed."},
+		{"lock west", "The door has no lock."},
+		{"drop key", "You drop an iron key."},
+		{"unlock trapdoor", "You don't have the key to the trapdoor."},
+		{"get key", "You get an iron key."},
+		{"unlock trapdoor", "You unlock the trapdoor."},
+		{"open trapdoor", "You open the trapdoor."},
+	} {
+		s.HandleCommand(alice, "", tt.line)
+		if got := received(out); !strings.Contains(got, tt.want) {
+			t.Errorf("after %q got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestLockedDoorsAreSaved(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	alice, out := enterGame(t, s, "a@example.com", "Alice")
+	s.do(func() { s.character("Alice").Location = 3 })
+	for _, line := range []string{"get key", "close trapdoor", "lock trapdoor"} {
+		s.HandleCommand(alice, "", line)
+	}
+	received(out)
+
+	doors, err := s.Store.LoadDoorStates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	world := testWorld(t)
+	world.ApplyDoorStates(doors)
+	for _, room := range []RoomID{3, 4} {
+		for _, e := range world.Rooms[room].Exits {
+			if e.Door != nil && e.Door.Name == "trapdoor" && e.Door.State != DoorLocked {
+				t.Errorf("the trapdoor is %s from room %d after loading the world again", e.Door.State, room)
+			}
+		}
+	}
+}
+
+func TestRoomScoping(t *testing.T) {
+	s := newTestGame(t, "a@example.com", "b@example.com", "c@example.com")
+	clock := startFakeClock(s)
+	alice, aliceOut := enterGame(t, s, "a@example.com", "Alice")
+	bob, bobOut := enterGame(t, s, "b@example.com", "Bob")
+	_, carolOut := enterGame(t, s, "c@example.com", "Carol")
+	// Carol waits in the grove, through the portal from the square
+	s.do(func() { s.character("Carol").Location = 5 })
+	lag := time.Duration(s.pulses(movementLag)) * defaultPulseLength
+	for _, out := range []*Outbox{aliceOut, bobOut, carolOut} {
+		received(out)
+	}
+
+	conns := map[string]ConnectionID{"Alice": alice, "Bob": bob}
+	outs := map[string]*Outbox{"Alice": aliceOut, "Bob": bobOut, "Carol": carolOut}
+	for _, tt := range []struct {
+		who, line string
+		// want is what each character should get; those not in it, other
+		// than who, are elsewhere and shouldn't hear not
+		want map[string]string
+		not  string
+	}{
+		{"Alice", "say hello", map[string]string{"Bob": `Alice says, "hello"`}, "hello"},
+		{"Alice", "enter portal", map[string]string{"Alice": "A Quiet Grove", "Bob": "Alice leaves through the portal.", "Carol": "Alice arrives from somewhere."}, ""},
+		{"Alice", "say hi Carol", map[string]string{"Carol": `Alice says, "hi Carol"`}, "hi Carol"},
+		{"Bob", "say where did she go?", nil, "where did she go?"},
+		{"Alice", "go portal", map[string]string{"Alice": "The Town Square", "Bob": "Alice arrives from somewhere.", "Carol": "Alice leaves through the portal."}, ""},
+		{"Alice", "north", map[string]string{"Alice": "North Road", "Bob": "Alice leaves north."}, ""},
+		{"Alice", "south", map[string]string{"Alice": "Bob is here.", "Bob": "Alice arrives from the north."}, ""},
+	} {
+		s.HandleCommand(conns[tt.who], "", tt.line)
+		// the lag of walking is over before the next line
+		clock.Advance(lag)
+		for name, out := range outs {
+			got := received(out)
+			want, ok := tt.want[name]
+			switch {
+			case ok && !strings.Contains(got, want):
+				t.Errorf("after %s's %q %s got %q, want %q", tt.who, tt.line, name, got, want)
+			case !ok && name != tt.who && tt.not != "" && strings.Contains(got, tt.not):
+				t.Errorf("after %s's %q %s, who is elsewhere, got %q", tt.who, tt.line, name, got)
+			}
+		}
+	}
+}
+
+func TestLook(t *testing.T) {
+	s := newTestGame(t, "a@example.com", "b@example.com")
+	startFakeClock(s)
+	alice, out := enterGame(t, s, "a@example.com", "Alice")
+	enterGame(t, s, "b@example.com", "Bob")
+
+	runLines(t, s, alice, out, []struct{ line, want string }{
+		{"look", "The Town Square\nCobblestones stretch out"},
+		{"look", "[Exits: north east (closed) portal]\nA rusty sword lies forgotten in the dust."},
+		{"look", "A town guard leans on the fountain, keeping an eye on things."},
+		{"look", "Bob is here."},
+		{"exits", "[Exits: north east (closed) portal]"},
+		{"look north", "Looking north you see North Road."},
+		{"look n", "Looking north you see North Road."},
+		{"look portal", "you see A Quiet Grove."},
+		{"look east", "The door is closed."},
+		{"look west", "You don't see that here."},
+		{"look sword", "Its edge is notched"},
+		{"look guard", "A bored looking guard in a dented breastplate.\nA town guard is using:\n  <wield> a rusty sword"},
+		{"look bob", "You see nothing special about Bob."},
+		{"open east", "You open the door."},
+		{"look east", "Looking east you see The Sleepy Dragon Inn."},
+	})
+	s.HandleCommand(alice, "", "look")
+	if got := received(out); strings.Contains(got, "Alice is here.") {
+		t.Errorf("Alice sees herself:\n%s", got)
+	}
+}
+
+func TestNamedExits(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	clock := startFakeClock(s)
+	alice, out := enterGame(t, s, "a@example.com", "Alice")
+	lag := time.Duration(s.pulses(movementLag)) * defaultPulseLength
+
+	for _, tt := range []struct{ line, want string }{
+		{"go portal", "A Quiet Grove"},
+		{"go north", "You can't go that way."},
+		{"enter portal", "The Town Square"},
+		{"enter p", "A Quiet Grove"},
+		{"go portal", "The Town Square"},
+		{"go n", "North Road"},
+		{"enter portal", "You can't go that way."},
+		{"go", "Go where?"},
+	} {
+		received(out)
+		s.HandleCommand(alice, "", tt.line)
+		clock.Advance(lag)
+		if got := received(out); !strings.Contains(got, tt.want) {
+			t.Errorf("after %q got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Contains what happens when a player connects more than once, and the
+// sessions command listing who is connected how.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/diddydum/muhmud/muhmud/markup"
+)
+
+// SessionPolicy decides what happens when a player connects while already
+// connected elsewhere. Whatever the policy, a character is only ever played
+// on one connection at a time; see enterWorld.
+type SessionPolicy string
+
+const (
+	// AllowSessions lets a player have any number of connections.
+	AllowSessions SessionPolicy = "allow"
+	// TakeoverSessions disconnects the player's other connections, telling
+	// them why.
+	TakeoverSessions SessionPolicy = "takeover"
+	// DenySessions refuses the new connection while the player has another,
+	// unless that one is link-dead.
+	DenySessions SessionPolicy = "deny"
+)
+
+// UnmarshalYAML implements yaml.Unmarshaler, rejecting unknown policies.
+func (p *SessionPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch policy := SessionPolicy(s); policy {
+	case AllowSessions, TakeoverSessions, DenySessions:
+		*p = policy
+		return nil
+	}
+	return fmt.Errorf("unknown session policy %q; expected %s, %s or %s", s, AllowSessions, TakeoverSessions, DenySessions)
+}
+
+// errAlreadyConnected is returned when connecting is refused by DenySessions.
+var errAlreadyConnected = errors.New("already connected from somewhere else")
+
+// applySessionPolicy applies the session policy to the player's connections
+// other than the newly made conn, returning errAlreadyConnected if conn isn't
+// allowed. Link-dead connections never stand in the way, since their player
+// is obviously back. It must be called from the game loop.
+func (s *GameState) applySessionPolicy(conn *Connection) error {
+	var others []*Connection
+	for connID := range conn.Player.Connections {
+		if connID != conn.ID {
+			others = append(others, s.Connections[connID])
+		}
+	}
+	switch s.SessionPolicy {
+	case TakeoverSessions:
+		for _, other := range others {
+			other.send(NewNotification("%rYou have connected from somewhere else, so this connection is closing.%n"))
+			s.disconnect(other.ID)
+		}
+	case DenySessions:
+		for _, other := range others {
+			if !other.linkDead {
+				return errAlreadyConnected
+			}
+		}
+		for _, other := range others {
+			s.disconnect(other.ID)
+		}
+	}
+	return nil
+}
+
+// returnToMenu stops playing the character on conn without it leaving the
+// world, because it's being played on another connection now. It must be
+// called from the game loop.
+func (s *GameState) returnToMenu(conn *Connection) {
+	c := conn.Character
+	delete(c.Connections, conn.ID)
+	conn.Character = nil
+	conn.send(NewNotification(fmt.Sprintf("%s is being played from somewhere else now.\n%s", c.Name, characterMenu(conn.Player))))
+}
+
+// describeConnection describes a connection for the sessions command.
+func (s *GameState) describeConnection(conn *Connection) string {
+	parts := []string{"websocket"}
+	if conn.telnet != nil {
+		parts[0] = "telnet"
+	}
+	if conn.linkDead {
+		parts = append(parts, "link-dead")
+	}
+	if conn.Character != nil {
+		parts = append(parts, "playing "+conn.Character.Name)
+	} else {
+		parts = append(parts, "choosing a character")
+	}
+	parts = append(parts, "connected for "+s.Clock.Now().Sub(conn.Connected).Round(time.Second).String())
+	if len(conn.SessionID) > 8 {
+		parts = append(parts, "session "+conn.SessionID[:8])
+	}
+	return fmt.Sprintf("#%d: %s", conn.ID, strings.Join(parts, ", "))
+}
+
+func cmdSessions(ctx *CommandContext) {
+	s := ctx.State
+	var players []*Player
+	if len(ctx.Args) == 0 {
+		for _, p := range s.Players {
+			if len(p.Connections) > 0 {
+				players = append(players, p)
+			}
+		}
+		sort.Slice(players, func(i, j int) bool { return players[i].Email < players[j].Email })
+	} else if p, ok := s.Players[normalizeEmail(ctx.Args[0])]; ok {
+		players = append(players, p)
+	} else if c, ok := s.Characters[strings.ToLower(ctx.Args[0])]; ok {
+		players = append(players, s.Players[c.Account])
+	} else {
+		ctx.Respondf("There's no account or character called %s.", markup.Escape(ctx.Args[0]))
+		return
+	}
+
+	lines := []string{fmt.Sprintf("Session policy: %s", s.SessionPolicy)}
+	for _, p := range players {
+		var conns []*Connection
+		for connID := range p.Connections {
+			conns = append(conns, s.Connections[connID])
+		}
+		sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+		lines = append(lines, fmt.Sprintf("%s (%d connected):", p.Email, len(conns)))
+		for _, conn := range conns {
+			lines = append(lines, "  "+s.describeConnection(conn))
+		}
+	}
+	ctx.Respond(strings.Join(lines, "\n"))
+}
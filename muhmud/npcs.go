@@ -0,0 +1,206 @@
+// Contains non-player characters: their prototypes, the resets that spawn them
+// and the little bit of thinking they do.
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// resetInterval is how often the world's resets run, replacing NPCs that were
+// killed and restocking the ones still around.
+const resetInterval = 5 * time.Minute
+
+// npcInterval is how often NPCs get to act on their behaviour.
+const npcInterval = 4 * time.Second
+
+// wanderChance is the one in wanderChance chance of a wandering NPC moving on
+// each time it acts.
+const wanderChance = 3
+
+// NPCPrototypeID identifies a kind of NPC in the world.
+type NPCPrototypeID int
+
+// NPCFlags describe how an NPC behaves.
+type NPCFlags uint
+
+// The flags an NPC prototype can have. NPCs without NPCWander stay in the room
+// they were spawned in.
+const (
+	// NPCWander NPCs sometimes wander off through a random exit.
+	NPCWander NPCFlags = 1 << iota
+	// NPCAggressive NPCs attack any player they see.
+	NPCAggressive
+	// NPCShopkeeper NPCs buy and sell items; see shops.go.
+	NPCShopkeeper
+)
+
+// npcFlagNames are what the flags are called in area files.
+var npcFlagNames = map[string]NPCFlags{"wander": NPCWander, "aggressive": NPCAggressive, "shopkeeper": NPCShopkeeper}
+
+// Has reports whether every flag in f2 is set in f.
+func (f NPCFlags) Has(f2 NPCFlags) bool {
+	return f&f2 == f2
+}
+
+// NPCPrototype describes a kind of NPC. Every NPC is a character spawned from
+// a prototype.
+type NPCPrototype struct {
+	ID NPCPrototypeID
+	// Keywords are the words a player can use to refer to the NPC.
+	Keywords []string
+	// Short is what the NPC is called in sentences, e.g. "a giant rat".
+	Short string
+	// Long is the line shown when the NPC is in a room, e.g. "A giant rat
+	// sniffs around for scraps."
+	Long string
+	// Description is what a character sees when looking at the NPC.
+	Description string
+	// Stats are the NPC's stats, which it's spawned with at full hit points,
+	// mana and movement.
+	Stats Stats
+	// Damage is the damage done by the NPC when it isn't wielding anything,
+	// or fists if it's zero.
+	Damage Dice
+	Flags  NPCFlags
+}
+
+// Reset spawns NPCs in a room, keeping up to Max of them alive.
+type Reset struct {
+	NPC  NPCPrototypeID
+	Room RoomID
+	Max  int
+	// Equip are the prototypes of the items the NPCs wear, each in its slot,
+	// and Give the prototypes of the items they carry. NPCs still alive when
+	// the reset runs are given any of them they're missing.
+	Equip []ItemPrototypeID
+	Give  []ItemPrototypeID
+}
+
+// AddReset adds a reset to the world, checking that everything it refers to
+// exists.
+func (w *World) AddReset(r *Reset) error {
+	if _, ok := w.NPCPrototypes[r.NPC]; !ok {
+		return fmt.Errorf("unknown NPC prototype %d", r.NPC)
+	}
+	if _, ok := w.Rooms[r.Room]; !ok {
+		return fmt.Errorf("unknown room %d", r.Room)
+	}
+	for _, ids := range [][]ItemPrototypeID{r.Equip, r.Give} {
+		for _, id := range ids {
+			if _, ok := w.Prototypes[id]; !ok {
+				return fmt.Errorf("unknown item prototype %d", id)
+			}
+		}
+	}
+	w.Resets = append(w.Resets, r)
+	return nil
+}
+
+// newNPC creates a character from an NPC prototype.
+func newNPC(proto *NPCPrototype, room RoomID) *Character {
+	c := newCharacter(proto.Short, "", room)
+	c.NPC = proto
+	c.Stats = proto.Stats
+	c.Stats.HP, c.Stats.Mana, c.Stats.Move = c.Stats.MaxHP, c.Stats.MaxMana, c.Stats.MaxMove
+	return c
+}
+
+// reset runs every reset of the world. It must be called from the game loop.
+func (s *GameState) reset() {
+	for _, r := range s.World.Resets {
+		alive := 0
+		for _, c := range s.NPCs {
+			if c.reset == r {
+				s.restock(c)
+				alive++
+			}
+		}
+		for ; alive < r.Max; alive++ {
+			c := newNPC(s.World.NPCPrototypes[r.NPC], r.Room)
+			c.reset = r
+			s.restock(c)
+			s.NPCs = append(s.NPCs, c)
+		}
+	}
+}
+
+// restock gives an NPC whichever of the items of its reset it's missing. It
+// must be called from the game loop.
+func (s *GameState) restock(c *Character) {
+	if c.reset == nil {
+		// its reset went away in a reload
+		return
+	}
+	have := make(map[ItemPrototypeID]int)
+	for _, it := range c.Inventory {
+		have[it.Proto.ID]++
+	}
+	give := func(id ItemPrototypeID, wear bool) {
+		if have[id] > 0 {
+			have[id]--
+			return
+		}
+		it, err := s.World.Spawn(id)
+		if err != nil {
+			log.Printf("Unable to restock %s: %s", c.Name, err)
+			return
+		}
+		if wear && it.Proto.Slot != WearNone && wearing(c, it.Proto.Slot) == nil {
+			it.Worn = it.Proto.Slot
+		}
+		c.Inventory = append(c.Inventory, it)
+	}
+	for _, id := range c.reset.Equip {
+		give(id, true)
+	}
+	for _, id := range c.reset.Give {
+		give(id, false)
+	}
+}
+
+// npcsAct has every NPC that isn't busy fighting do what it does. It must be
+// called from the game loop.
+func (s *GameState) npcsAct() {
+	for _, c := range append([]*Character(nil), s.NPCs...) {
+		if c.fighting != nil {
+			continue
+		}
+		if c.NPC.Flags.Has(NPCAggressive) {
+			if victim := s.victimFor(c); victim != nil {
+				s.NotifyCharacter(victim, fmt.Sprintf("%%r%s attacks you!%%n", capitalize(c.Name)))
+				s.startFight(c, victim)
+				continue
+			}
+		}
+		if !c.NPC.Flags.Has(NPCWander) || s.Rand.Intn(wanderChance) != 0 {
+			continue
+		}
+		if exit := s.randomExit(s.currentRoom(c)); exit != nil {
+			s.move(c, exit, s.World.Rooms[exit.To])
+		}
+	}
+}
+
+// victimFor picks the player an aggressive NPC attacks, or nil if there's
+// nobody in its room. It must be called from the game loop.
+func (s *GameState) victimFor(npc *Character) *Character {
+	for _, c := range s.CharactersIn(npc.Location) {
+		if c.NPC == nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// removeNPC takes an NPC out of the world for good. It must be called from the
+// game loop.
+func (s *GameState) removeNPC(npc *Character) {
+	for i, c := range s.NPCs {
+		if c == npc {
+			s.NPCs = append(s.NPCs[:i], s.NPCs[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// npcsOf returns the NPCs spawned from the prototype id. It must be called
+// from the game loop.
+func (s *GameState) npcsOf(id NPCPrototypeID) []*Character {
+	var npcs []*Character
+	for _, c := range s.NPCs {
+		if c.NPC.ID == id {
+			npcs = append(npcs, c)
+		}
+	}
+	return npcs
+}
+
+// countItems counts the items of each prototype in items.
+func countItems(items []*Item) map[ItemPrototypeID]int {
+	counts := make(map[ItemPrototypeID]int)
+	for _, it := range items {
+		counts[it.Proto.ID]++
+	}
+	return counts
+}
+
+func TestReset(t *testing.T) {
+	s := newTestGame(t)
+	clock := startFakeClock(s)
+	s.do(func() {
+		s.Rand = rand.New(rand.NewSource(1))
+		if len(s.NPCs) != 5 {
+			t.Errorf("spawned %d NPCs, want 5", len(s.NPCs))
+		}
+		for _, rat := range s.npcsOf(3) {
+			if rat.Location != 4 || rat.Stats.HP != rat.Stats.MaxHP {
+				t.Errorf("spawned a rat in %d with %d/%d hit points", rat.Location, rat.Stats.HP, rat.Stats.MaxHP)
+			}
+		}
+		// running it again spawns no more
+		s.reset()
+		if rats := s.npcsOf(3); len(rats) != 2 {
+			t.Errorf("%d rats after running the reset again, want 2", len(rats))
+		}
+
+		s.die(s.npcsOf(3)[0], s.npcsOf(1)[0])
+		if rats := s.npcsOf(3); len(rats) != 1 {
+			t.Errorf("%d rats after killing one, want 1", len(rats))
+		}
+	})
+
+	clock.Advance(resetInterval)
+	s.do(func() {
+		if rats := s.npcsOf(3); len(rats) != 2 {
+			t.Errorf("%d rats once the reset ran, want 2", len(rats))
+		}
+		s.reset()
+		if rats := s.npcsOf(3); len(rats) != 2 {
+			t.Errorf("%d rats after running the reset again, want 2", len(rats))
+		}
+		if len(s.NPCs) != 5 {
+			t.Errorf("%d NPCs, want 5", len(s.NPCs))
+		}
+	})
+}
+
+func TestRestock(t *testing.T) {
+	s := newTestGame(t)
+	startFakeClock(s)
+	s.do(func() {
+		keeper := s.npcsOf(2)[0]
+		want := map[ItemPrototypeID]int{4: 3, 3: 1, 6: 1}
+		if got := countItems(keeper.Inventory); len(got) != len(want) || got[4] != 3 || got[3] != 1 || got[6] != 1 {
+			t.Errorf("the innkeeper spawned with %v, want %v", got, want)
+		}
+		for _, it := range keeper.Inventory {
+			if it.Worn != WearNone {
+				t.Errorf("the innkeeper is wearing %s, which it was only given", it.Name())
+			}
+		}
+
+		// sell the backpack and a loaf of bread
+		var kept []*Item
+		sold := map[ItemPrototypeID]bool{}
+		for _, it := range keeper.Inventory {
+			if (it.Proto.ID == 3 || it.Proto.ID == 4) && !sold[it.Proto.ID] {
+				sold[it.Proto.ID] = true
+				continue
+			}
+			kept = append(kept, it)
+		}
+		keeper.Inventory = kept
+		s.restock(keeper)
+		s.restock(keeper)
+		if got := countItems(keeper.Inventory); len(keeper.Inventory) != 5 || got[4] != 3 || got[3] != 1 || got[6] != 1 {
+			t.Errorf("the innkeeper was restocked with %v, want %v", got, want)
+		}
+
+		guard := s.npcsOf(1)[0]
+		if len(guard.Inventory) != 1 || guard.Inventory[0].Worn != WearWield {
+			t.Fatalf("the guard spawned with %v", guard.Inventory)
+		}
+		guard.Inventory = nil
+		s.restock(guard)
+		if len(guard.Inventory) != 1 || guard.Inventory[0].Proto.ID != 1 || guard.Inventory[0].Worn != WearWield {
+			t.Errorf("the guard was restocked with %v", guard.Inventory)
+		}
+	})
+}
+
+func TestNPCsWander(t *testing.T) {
+	s := newTestGame(t)
+	startFakeClock(s)
+	s.do(func() {
+		s.Rand = rand.New(rand.NewSource(1))
+		guard, keeper, rabbit, rats := s.npcsOf(1)[0], s.npcsOf(2)[0], s.npcsOf(4)[0], s.npcsOf(3)
+		// NPCs stay put unless they're flagged to wander; the rabbit can get
+		// between the square, the road and the grove, but not through the
+		// closed door of the inn; the rats are shut in the cellar by the
+		// trapdoor
+		allowed := map[RoomID]bool{1: true, 2: true, 5: true}
+		visited := map[RoomID]bool{}
+		for i := 0; i < 100; i++ {
+			s.npcsAct()
+			if guard.Location != 1 || keeper.Location != 3 {
+				t.Fatalf("the guard wandered off to %d and the innkeeper to %d", guard.Location, keeper.Location)
+			}
+			if !allowed[rabbit.Location] {
+				t.Fatalf("the rabbit got into %d", rabbit.Location)
+			}
+			visited[rabbit.Location] = true
+			for _, rat := range rats {
+				if rat.Location != 4 {
+					t.Fatalf("a rat got out to %d", rat.Location)
+				}
+			}
+		}
+		if len(visited) < 2 {
+			t.Errorf("the rabbit only went to %v", visited)
+		}
+	})
+}
+
+func TestAggressiveNPCs(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	startFakeClock(s)
+	_, out := enterGame(t, s, "a@example.com", "Alice")
+	s.do(func() {
+		s.Rand = rand.New(rand.NewSource(1))
+		// the rats never go for another NPC
+		rabbit, rats := s.npcsOf(4)[0], s.npcsOf(3)
+		rabbit.Location = 4
+		for _, rat := range rats {
+			if victim := s.victimFor(rat); victim != nil {
+				t.Errorf("a rat picked %s", victim.Name)
+			}
+		}
+		s.npcsAct()
+		for _, c := range append(rats, rabbit) {
+			if c.fighting != nil {
+				t.Errorf("%s is fighting %s", c.Name, c.fighting.Name)
+			}
+		}
+
+		alice := s.character("Alice")
+		alice.Location, alice.Stats.HP = 4, 1000
+		for _, rat := range rats {
+			if victim := s.victimFor(rat); victim != alice {
+				t.Errorf("a rat picked %v, want Alice", victim)
+			}
+		}
+		s.npcsAct()
+		for _, rat := range rats {
+			if rat.fighting != alice {
+				t.Errorf("a rat is fighting %v, want Alice", rat.fighting)
+			}
+		}
+		if rabbit.fighting != nil {
+			t.Errorf("the rabbit is fighting %s", rabbit.fighting.Name)
+		}
+	})
+	if got := received(out); strings.Count(got, "A giant rat attacks you!") != 2 {
+		t.Errorf("Alice got:\n%s", got)
+	}
+}
+
+func TestShop(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	startFakeClock(s)
+	alice, out := enterGame(t, s, "a@example.com", "Alice")
+	s.do(func() {
+		for _, p := range []*ItemPrototype{
+			{ID: 100, Keywords: []string{"ring", "cursed"}, Short: "a cursed ring", Weight: 1, Value: 10, Flags: ItemNoDrop},
+			{ID: 101, Keywords: []string{"pebble"}, Short: "a pebble", Weight: 1},
+		} {
+			s.World.Prototypes[p.ID] = p
+		}
+		// the inn, where the innkeeper is
+		c := s.character("Alice")
+		c.Location, c.Stats.Gold = 3, 20
+		s.npcsOf(2)[0].Stats.Gold = 50
+	})
+	spawnCarried(t, s, "Alice", 100, 101, 8, 1)
+	gold := func() (alice, keeper int) {
+		s.do(func() { alice, keeper = s.character("Alice").Stats.Gold, s.npcsOf(2)[0].Stats.Gold })
+		return alice, keeper
+	}
+
+	runLines(t, s, alice, out, []struct{ line, want string }{
+		{"list", "The innkeeper has for sale:"},
+		{"buy backpack", "You buy a canvas backpack for 8 gold."},
+		{"buy crate", "The innkeeper doesn't have that for sale."},
+	})
+	if a, k := gold(); a != 12 || k != 58 {
+		t.Errorf("after buying Alice has %d gold and the innkeeper %d", a, k)
+	}
+
+	runLines(t, s, alice, out, []struct{ line, want string }{
+		{"sell backpack", "You sell a canvas backpack for 4 gold."},
+		{"sell ring", "You can't let go of a cursed ring."},
+		{"sell pebble", "The innkeeper isn't interested in a pebble."},
+		// worth too little to pay anything for
+		{"sell key", "The innkeeper isn't interested in an iron key."},
+	})
+	if a, k := gold(); a != 16 || k != 54 {
+		t.Errorf("after selling Alice has %d gold and the innkeeper %d", a, k)
+	}
+
+	s.do(func() {
+		s.character("Alice").Stats.Gold = 1
+		s.npcsOf(2)[0].Stats.Gold = 0
+	})
+	runLines(t, s, alice, out, []struct{ line, want string }{
+		{"buy tankard", "A pewter tankard costs 3 gold, and you only have 1."},
+		{"sell sword", "The innkeeper can't afford a rusty sword."},
+	})
+	if a, k := gold(); a != 1 || k != 0 {
+		t.Errorf("after failing to trade Alice has %d gold and the innkeeper %d", a, k)
+	}
+	s.do(func() {
+		if got := countItems(s.character("Alice").Inventory); got[100] != 1 || got[101] != 1 || got[8] != 1 || got[1] != 1 || got[3] != 0 || got[6] != 0 {
+			t.Errorf("Alice ended up with %v", got)
+		}
+	})
+}
@@ -0,0 +1,280 @@
+// Contains the bounded queue of messages waiting to be written to a
+// connection.
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// defaultOutboxSize is how many messages may be waiting for a connection before
+// its overflow policy kicks in.
+const defaultOutboxSize = 100
+
+// Counters for messages we had to throw away, exported on /debug/vars.
+var outboxMetrics = expvar.NewMap("outbox")
+
+// OverflowPolicy decides what happens when a message is sent to a connection
+// whose outbox is full, i.e. whose client isn't keeping up.
+type OverflowPolicy string
+
+const (
+	// DropOldest throws away the oldest queued message to make room.
+	DropOldest OverflowPolicy = "drop_oldest"
+	// DropNotifications throws away notifications and GMCP messages but keeps
+	// responses, so a client never misses the answer to one of its own
+	// requests. If the outbox is full of nothing but responses the connection
+	// is evicted.
+	DropNotifications OverflowPolicy = "drop_notifications"
+	// Disconnect evicts the connection.
+	Disconnect OverflowPolicy = "disconnect"
+)
+
+// UnmarshalYAML implements yaml.Unmarshaler, rejecting unknown policies.
+func (p *OverflowPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	switch policy := OverflowPolicy(s); policy {
+	case DropOldest, DropNotifications, Disconnect:
+		*p = policy
+		return nil
+	}
+	return fmt.Errorf("unknown overflow policy %q; expected %s, %s or %s", s, DropOldest, DropNotifications, Disconnect)
+}
+
+// Outbox is the queue of messages waiting to be written to a single
+// connection. Pushing never blocks, so a stalled client can't hold up the rest
+// of the game; instead the outbox's OverflowPolicy is applied once it's full.
+type Outbox struct {
+	size   int
+	policy OverflowPolicy
+	queue  []Message
+	// ready has room for a single wakeup, which is pending whenever there is
+	// something for the writer to do.
+	ready   chan struct{}
+	closed  bool
+	evicted bool
+	// shutdown is set if the outbox was closed because the server is going
+	// away, and copyover if it's being handed over to a new process, with
+	// resume being what a websocket client reconnects with.
+	shutdown bool
+	copyover bool
+	resume   string
+	// seq is the number of the last message pushed, and sent are the
+	// messages most recently handed to the writer, kept so that they can be
+	// sent again to a client that resumes after losing its link.
+	seq  uint64
+	sent []Message
+	// finished is closed once the writer has stopped; see Finish.
+	finished chan struct{}
+	mux      sync.Mutex
+}
+
+// NewOutbox creates an empty outbox holding at most size messages.
+func NewOutbox(size int, policy OverflowPolicy) *Outbox {
+	if size < 1 {
+		size = defaultOutboxSize
+	}
+	return &Outbox{size: size, policy: policy, ready: make(chan struct{}, 1), finished: make(chan struct{})}
+}
+
+// Push numbers msg and queues it for writing. Messages pushed after the outbox
+// was closed are silently dropped.
+func (o *Outbox) Push(msg Message) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if o.closed {
+		return
+	}
+	if len(o.queue) >= o.size && !o.makeRoom(msg) {
+		return
+	}
+	o.seq++
+	msg.Seq = o.seq
+	o.queue = append(o.queue, msg)
+	o.wake()
+}
+
+// makeRoom applies the overflow policy to a full queue, returning whether msg
+// should still be queued. Callers must hold o.mux.
+func (o *Outbox) makeRoom(msg Message) bool {
+	switch o.policy {
+	case DropOldest:
+		o.drop(0)
+		return true
+	case DropNotifications:
+		if msg.Type != Response {
+			countDropped(msg)
+			return false
+		}
+		for i, queued := range o.queue {
+			if queued.Type != Response {
+				o.drop(i)
+				return true
+			}
+		}
+	}
+	o.evict()
+	return false
+}
+
+// drop throws away the i'th queued message. Callers must hold o.mux.
+func (o *Outbox) drop(i int) {
+	countDropped(o.queue[i])
+	o.queue = append(o.queue[:i], o.queue[i+1:]...)
+}
+
+// countDropped counts a message thrown away in outboxMetrics.
+func countDropped(msg Message) {
+	switch msg.Type {
+	case Notification:
+		outboxMetrics.Add("dropped_notifications", 1)
+	case GMCP:
+		outboxMetrics.Add("dropped_gmcp", 1)
+	default:
+		outboxMetrics.Add("dropped_responses", 1)
+	}
+}
+
+// evict closes the outbox of a client that isn't keeping up, throwing away
+// whatever it hadn't read yet. Callers must hold o.mux.
+func (o *Outbox) evict() {
+	outboxMetrics.Add("evictions", 1)
+	o.queue = nil
+	o.evicted = true
+	o.closed = true
+	o.wake()
+}
+
+// wake lets the writer know there is something to do. Callers must hold o.mux.
+func (o *Outbox) wake() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Close closes the outbox. Messages already queued are still handed to the
+// writer.
+func (o *Outbox) Close() {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.closed = true
+	o.wake()
+}
+
+// CloseForShutdown closes the outbox because the server is shutting down, so
+// the writer can tell the client why it's being disconnected.
+func (o *Outbox) CloseForShutdown() {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.shutdown = true
+	o.closed = true
+	o.wake()
+}
+
+// CloseForCopyover closes the outbox because the connection is being handed
+// over to a new process. Telnet writers should leave the connection open,
+// websocket writers pass resume on to the client so that it can reconnect
+// where it left off.
+func (o *Outbox) CloseForCopyover(resume string) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.copyover = true
+	o.resume = resume
+	o.closed = true
+	o.wake()
+}
+
+// Finish is called by the writer once it has stopped writing to the
+// connection.
+func (o *Outbox) Finish() {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	select {
+	case <-o.finished:
+	default:
+		close(o.finished)
+	}
+}
+
+// Finished is closed once the writer has called Finish, until another writer
+// takes over.
+func (o *Outbox) Finished() <-chan struct{} {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.finished
+}
+
+// TakeOver hands the outbox to a new writer once the previous one has
+// Finished, for a client that resumed on a new link after the last message it
+// got was numbered seq. It returns the messages after that one which the
+// previous writer already took, for the new writer to send before anything
+// else, and whether those and the queue hold every message since.
+func (o *Outbox) TakeOver(seq uint64) (replay []Message, complete bool) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.finished = make(chan struct{})
+	for _, msg := range o.sent {
+		if msg.Seq > seq {
+			replay = append(replay, msg)
+		}
+	}
+	complete = seq >= o.seq || uint64(len(replay)+len(o.queue)) == o.seq-seq
+	return replay, complete
+}
+
+// Ready receives a value whenever Drain has something new to return.
+func (o *Outbox) Ready() <-chan struct{} {
+	return o.ready
+}
+
+// Drain empties the outbox, returning the messages that were waiting and
+// whether the outbox is still open. Once it isn't, the writer should close the
+// connection after writing the messages.
+func (o *Outbox) Drain() ([]Message, bool) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	msgs := o.queue
+	o.queue = nil
+	o.sent = append(o.sent, msgs...)
+	if extra := len(o.sent) - o.size; extra > 0 {
+		o.sent = o.sent[extra:]
+	}
+	return msgs, !o.closed
+}
+
+// Closed reports whether the outbox was closed, for whatever reason.
+func (o *Outbox) Closed() bool {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.closed
+}
+
+// Evicted reports whether the outbox was closed because its client couldn't
+// keep up.
+func (o *Outbox) Evicted() bool {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.evicted
+}
+
+// ClosedForShutdown reports whether the outbox was closed because the server is
+// shutting down.
+func (o *Outbox) ClosedForShutdown() bool {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.shutdown
+}
+
+// ClosedForCopyover reports whether the outbox was closed because the
+// connection is being handed over to a new process, and if so what its client
+// should resume with.
+func (o *Outbox) ClosedForCopyover() (resume string, ok bool) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.resume, o.copyover
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// metric returns the value of one of the counters in outboxMetrics.
+func metric(name string) int64 {
+	if v, ok := outboxMetrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// push pushes a message to o for each of msgs, which are responses if they
+// start with an r and notifications otherwise.
+func push(o *Outbox, msgs ...string) {
+	for _, msg := range msgs {
+		if strings.HasPrefix(msg, "r") {
+			o.Push(NewResponse(msg, msg))
+		} else {
+			o.Push(NewNotification(msg))
+		}
+	}
+}
+
+// numbered describes msgs as their text and sequence numbers.
+func numbered(msgs []Message) []string {
+	var got []string
+	for _, msg := range msgs {
+		got = append(got, fmt.Sprintf("%s:%d", msg.Msg, msg.Seq))
+	}
+	return got
+}
+
+func TestOutboxOverflow(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  OverflowPolicy
+		push    []string
+		want    []string
+		evicted bool
+	}{
+		{
+			name:   "room to spare",
+			policy: Disconnect,
+			push:   []string{"n1", "r2"},
+			want:   []string{"n1:1", "r2:2"},
+		},
+		{
+			name:   "drop oldest",
+			policy: DropOldest,
+			push:   []string{"n1", "r2", "n3", "n4", "r5"},
+			want:   []string{"n3:3", "n4:4", "r5:5"},
+		},
+		{
+			name:   "drop notifications keeps responses",
+			policy: DropNotifications,
+			push:   []string{"r1", "n2", "r3", "n4", "r5"},
+			// n4 is dropped without being numbered and r5 makes room by
+			// dropping n2
+			want: []string{"r1:1", "r3:3", "r5:4"},
+		},
+		{
+			name:   "drop notifications with only responses queued",
+			policy: DropNotifications,
+			push:   []string{"r1", "r2", "r3", "n4"},
+			want:   []string{"r1:1", "r2:2", "r3:3"},
+		},
+		{
+			name:    "drop notifications evicts when responses overflow",
+			policy:  DropNotifications,
+			push:    []string{"r1", "r2", "r3", "r4", "n5"},
+			evicted: true,
+		},
+		{
+			name:    "disconnect",
+			policy:  Disconnect,
+			push:    []string{"n1", "n2", "n3", "n4", "n5"},
+			evicted: true,
+		},
+	}
+	for _, test := range tests {
+		evictions := metric("evictions")
+		o := NewOutbox(3, test.policy)
+		push(o, test.push...)
+		msgs, open := o.Drain()
+		if got := numbered(msgs); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: queued %v, want %v", test.name, got, test.want)
+		}
+		if open == test.evicted || o.Evicted() != test.evicted {
+			t.Errorf("%s: open %v and evicted %v, want evicted %v", test.name, open, o.Evicted(), test.evicted)
+		}
+		if got := metric("evictions") - evictions; (got == 1) != test.evicted || got > 1 {
+			t.Errorf("%s: counted %d evictions", test.name, got)
+		}
+	}
+}
+
+func TestOutboxDrainAfterClose(t *testing.T) {
+	o := NewOutbox(3, DropOldest)
+	push(o, "n1", "r2")
+	o.Close()
+	push(o, "n3")
+	msgs, open := o.Drain()
+	if got, want := numbered(msgs), []string{"n1:1", "r2:2"}; !reflect.DeepEqual(got, want) || open {
+		t.Errorf("Drain() = %v, %v; want %v, false", got, open, want)
+	}
+	if msgs, open := o.Drain(); len(msgs) != 0 || open {
+		t.Errorf("draining again = %v, %v; want nothing and false", numbered(msgs), open)
+	}
+	if o.Evicted() || o.ClosedForShutdown() {
+		t.Error("closing the outbox evicted it or closed it for shutdown")
+	}
+}
+
+func TestOutboxTakeOver(t *testing.T) {
+	o := NewOutbox(3, DropOldest)
+	push(o, "n1", "n2")
+	o.Drain()
+	push(o, "n3")
+	o.Finish()
+	if replay, complete := o.TakeOver(1); !reflect.DeepEqual(numbered(replay), []string{"n2:2"}) || !complete {
+		t.Errorf("TakeOver(1) = %v, %v; want n2 and complete", numbered(replay), complete)
+	}
+	select {
+	case <-o.Finished():
+		t.Error("Finished() is still closed after TakeOver")
+	default:
+	}
+
+	// only as many messages as fit in the outbox are kept for replaying
+	push(o, "n4", "n5")
+	o.Drain()
+	tests := []struct {
+		seq      uint64
+		replay   []string
+		complete bool
+	}{
+		{5, nil, true},
+		{3, []string{"n4:4", "n5:5"}, true},
+		{2, []string{"n3:3", "n4:4", "n5:5"}, true},
+		{1, []string{"n3:3", "n4:4", "n5:5"}, false},
+		{0, []string{"n3:3", "n4:4", "n5:5"}, false},
+		// the client claims to have got more than we sent
+		{9, nil, true},
+	}
+	for _, test := range tests {
+		replay, complete := o.TakeOver(test.seq)
+		if got := numbered(replay); !reflect.DeepEqual(got, test.replay) || complete != test.complete {
+			t.Errorf("TakeOver(%d) = %v, %v; want %v, %v", test.seq, got, complete, test.replay, test.complete)
+		}
+	}
+}
+
+func TestDropNotificationsDropsGMCP(t *testing.T) {
+	o := NewOutbox(3, DropNotifications)
+	dropped := metric("dropped_gmcp")
+	o.Push(NewNotification("hello"))
+	for i := 0; i < 5; i++ {
+		o.Push(NewGMCP("Char.Vitals", []byte(`{"hp":1}`)))
+	}
+	if o.Evicted() {
+		t.Fatal("evicted a client for not keeping up with GMCP")
+	}
+	// a response makes room for itself by dropping the oldest message that
+	// isn't a response
+	o.Push(NewResponse("1", "done"))
+	msgs, open := o.Drain()
+	if !open {
+		t.Fatal("the outbox was closed")
+	}
+	var types []MessageType
+	for _, msg := range msgs {
+		types = append(types, msg.Type)
+	}
+	if len(types) != 3 || types[0] != GMCP || types[1] != GMCP || types[2] != Response {
+		t.Errorf("queued %v, want two GMCP messages and the response", types)
+	}
+	if got := metric("dropped_gmcp") - dropped; got != 3 {
+		t.Errorf("counted %d dropped GMCP messages, want 3", got)
+	}
+}
@@ -0,0 +1,59 @@
+// Contains rate limiting for the endpoints that send email, so that they can't
+// be used to flood somebody's inbox or run up our mail bill.
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How many emails may be sent to a single address, and how many requests to
+// send them a single client may make, within mailRateWindow.
+const (
+	mailsPerAddress = 3
+	mailsPerClient  = 10
+	mailRateWindow  = time.Hour
+)
+
+// rateLimiter allows up to limit hits per key within any window.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+	hits   map[string][]time.Time
+	// swept is when keys whose hits have all expired were last forgotten.
+	swept time.Time
+	mux   sync.Mutex
+}
+
+// newRateLimiter creates a rateLimiter allowing limit hits per window.
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, now: time.Now, hits: make(map[string][]time.Time)}
+}
+
+// Allow records a hit for key if it's within the limit, reporting whether it
+// was.
+func (l *rateLimiter) Allow(key string) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := l.now()
+	if now.Sub(l.swept) > l.window {
+		for k, hits := range l.hits {
+			if !now.Before(hits[len(hits)-1].Add(l.window)) {
+				delete(l.hits, k)
+			}
+		}
+		l.swept = now
+	}
+
+	hits := l.hits[key]
+	for len(hits) > 0 && !now.Before(hits[0].Add(l.window)) {
+		hits = hits[1:]
+	}
+	if len(hits) >= l.limit {
+		l.hits[key] = hits
+		return false
+	}
+	l.hits[key] = append(hits, now)
+	return true
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(2, time.Hour)
+	l.now = func() time.Time { return now }
+
+	for i, tt := range []struct {
+		after time.Duration
+		key   string
+		want  bool
+	}{
+		{0, "a", true},
+		{time.Minute, "a", true},
+		{time.Minute, "a", false},
+		{0, "b", true},
+		// the first hit on a expires
+		{58 * time.Minute, "a", true},
+		{0, "a", false},
+		{2 * time.Minute, "a", true},
+	} {
+		now = now.Add(tt.after)
+		if got := l.Allow(tt.key); got != tt.want {
+			t.Errorf("%d: Allow(%q) = %v, want %v", i, tt.key, got, tt.want)
+		}
+	}
+
+	now = now.Add(2 * time.Hour)
+	l.Allow("c")
+	if len(l.hits) != 1 {
+		t.Errorf("expired keys weren't forgotten: %v", l.hits)
+	}
+}
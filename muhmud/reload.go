@@ -0,0 +1,383 @@
+// Contains reloading the configuration and the world while the server runs,
+// on SIGHUP or the reload command.
+package main
+
+import (
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"gopkg.in/yaml.v2"
+)
+
+// restartOnlySettings are the settings that are only read at startup, so
+// changing them needs a restart.
+var restartOnlySettings = map[string]bool{
+	"dev_mode":       true,
+	"database":       true,
+	"migrations_dir": true,
+	"public_url":     true,
+	"client_url":     true,
+	"mailer":         true,
+	"mail_dir":       true,
+	"telnet_address": true,
+}
+
+// secretSettings are the settings whose values are never shown in reports.
+var secretSettings = map[string]bool{"jwt_secret": true}
+
+// loadConfig reads the configuration in file over the defaults.
+func loadConfig(file string) (Configuration, error) {
+	config := defaultConfig()
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.UnmarshalStrict(bs, &config); err != nil {
+		return config, err
+	}
+	// links are made by appending paths to these
+	config.PublicURL = strings.TrimRight(config.PublicURL, "/")
+	config.ClientURL = strings.TrimRight(config.ClientURL, "/")
+	return config, config.validate()
+}
+
+// validate checks settings that would break the server.
+func (c Configuration) validate() error {
+	switch {
+	case c.PulseLength <= 0:
+		return fmt.Errorf("pulse_length must be positive")
+	case c.OutboxSize < 1:
+		return fmt.Errorf("outbox_size must be at least 1")
+	case c.PingInterval <= 0 || c.PongTimeout <= 0 || c.WriteTimeout <= 0:
+		return fmt.Errorf("ping_interval, pong_timeout and write_timeout must be positive")
+	case c.CompressionThreshold < 0:
+		return fmt.Errorf("compression_threshold must not be negative")
+	case c.CompressionLevel < flate.HuffmanOnly || c.CompressionLevel > flate.BestCompression:
+		return fmt.Errorf("compression_level must be between %d and %d", flate.HuffmanOnly, flate.BestCompression)
+	case c.LinkDeadGrace < 0:
+		return fmt.Errorf("link_dead_grace must not be negative")
+	case c.ShutdownWarning < 0 || c.ShutdownDeadline <= c.ShutdownWarning:
+		return fmt.Errorf("shutdown_deadline must be longer than shutdown_warning")
+	}
+	return nil
+}
+
+// LiveConfig is the configuration currently in effect. Reloading replaces it
+// while the server runs, so long running code should Get it when it needs it
+// rather than hold on to a copy.
+type LiveConfig struct {
+	mux    sync.RWMutex
+	config Configuration
+}
+
+// NewLiveConfig creates a LiveConfig starting out with config.
+func NewLiveConfig(config Configuration) *LiveConfig {
+	return &LiveConfig{config: config}
+}
+
+// Get returns the configuration currently in effect.
+func (l *LiveConfig) Get() Configuration {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+	return l.config
+}
+
+func (l *LiveConfig) set(config Configuration) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.config = config
+}
+
+// AllowsOrigin reports whether requests from origin are allowed.
+func (l *LiveConfig) AllowsOrigin(origin string) bool {
+	for _, o := range l.Get().AllowedOrigins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// ReloadReport is what a reload changed and what went wrong with it.
+type ReloadReport struct {
+	Changes  []string
+	Failures []string
+}
+
+func (r *ReloadReport) changef(format string, args ...interface{}) {
+	r.Changes = append(r.Changes, fmt.Sprintf(format, args...))
+}
+
+func (r *ReloadReport) failf(format string, args ...interface{}) {
+	r.Failures = append(r.Failures, fmt.Sprintf(format, args...))
+}
+
+func (r ReloadReport) String() string {
+	lines := []string{"Reload finished."}
+	if len(r.Changes) == 0 {
+		lines = append(lines, "Nothing changed.")
+	}
+	for _, c := range r.Changes {
+		lines = append(lines, "  "+c)
+	}
+	if len(r.Failures) > 0 {
+		lines = append(lines, "Problems:")
+		for _, f := range r.Failures {
+			for _, l := range strings.Split(f, "\n") {
+				lines = append(lines, "  "+l)
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Reloader re-reads the configuration file and the area files and applies
+// them to the running server.
+type Reloader struct {
+	// mux makes sure only one reload happens at a time.
+	mux        sync.Mutex
+	configFile string
+	live       *LiveConfig
+	game       *GameState
+	sessions   *SessionManager
+	stopClock  func()
+}
+
+// NewReloader creates a Reloader for the server started with the
+// configuration in live, read from configFile. stopClock stops the game's
+// clock, so that it can be restarted if the pulse length changes.
+func NewReloader(configFile string, live *LiveConfig, game *GameState, sessions *SessionManager, stopClock func()) *Reloader {
+	return &Reloader{configFile: configFile, live: live, game: game, sessions: sessions, stopClock: stopClock}
+}
+
+// Reload reloads the configuration and the world. Either is only applied if
+// it could be loaded completely; if the configuration couldn't be, the world
+// is reloaded from where it was before. It must not be called from the game
+// loop.
+func (r *Reloader) Reload() ReloadReport {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	var report ReloadReport
+	old := r.live.Get()
+	config, err := loadConfig(r.configFile)
+	if err != nil {
+		report.failf("Unable to load %s, keeping the old configuration: %s", r.configFile, err)
+		config = old
+	}
+	world, err := LoadWorld(config.WorldDir)
+	if err != nil {
+		report.failf("Unable to load the world from %s, keeping the old one:\n%s", config.WorldDir, err)
+		world = nil
+	}
+
+	r.applyConfig(old, config, &report)
+	r.game.do(func() {
+		r.game.OutboxSize = config.OutboxSize
+		r.game.OverflowPolicy = config.OverflowPolicy
+		r.game.LinkDeadGrace = config.LinkDeadGrace
+		r.game.SessionPolicy = config.SessionPolicy
+		r.game.setAdmins(config.Admins)
+		if world != nil {
+			r.game.replaceWorld(world, &report)
+			report.changef("world reloaded from %s: %d rooms, %d item prototypes, %d NPC prototypes",
+				config.WorldDir, len(world.Rooms), len(world.Prototypes), len(world.NPCPrototypes))
+		}
+	})
+	if config.PulseLength != old.PulseLength {
+		r.stopClock()
+		r.stopClock = r.game.StartClock(RealClock{}, config.PulseLength)
+	}
+	return report
+}
+
+// applyConfig makes config the configuration in effect, reporting what changed
+// since old. Restart-only settings keep their old values until the restart.
+func (r *Reloader) applyConfig(old, config Configuration, report *ReloadReport) {
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(&config).Elem()
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		a, b := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if reflect.DeepEqual(a, b) {
+			continue
+		}
+		switch {
+		case restartOnlySettings[name]:
+			report.failf("%s changed, but only takes effect after a restart", name)
+			nv.Field(i).Set(ov.Field(i))
+		case secretSettings[name]:
+			report.changef("%s changed", name)
+		default:
+			report.changef("%s changed from %v to %v", name, a, b)
+		}
+	}
+	if config.JWTSecret != old.JWTSecret {
+		r.sessions.RotateSecret([]byte(config.JWTSecret))
+	}
+	r.sessions.SetTTLs(config.AccessTokenTTL, config.SessionTTL)
+	r.live.set(config)
+}
+
+// replaceWorld swaps the world for a freshly loaded one, carrying over what's
+// going on in the old one: characters, NPCs and items lying around stay where
+// they are if their room still exists, items follow any changes to their
+// prototypes, and door states are kept. It must be called from the game loop.
+func (s *GameState) replaceWorld(w *World, report *ReloadReport) {
+	old := s.World
+	reportDiff(report, "rooms", roomIDs(old), roomIDs(w))
+	reportDiff(report, "item prototypes", itemPrototypeIDs(old), itemPrototypeIDs(w))
+	reportDiff(report, "NPC prototypes", npcPrototypeIDs(old), npcPrototypeIDs(w))
+	if len(old.Resets) != len(w.Resets) {
+		report.changef("resets: %d, was %d", len(w.Resets), len(old.Resets))
+	}
+
+	doors, err := s.Store.LoadDoorStates()
+	if err != nil {
+		report.failf("Unable to load door states, doors are as the area files say: %s", err)
+	}
+	w.ApplyDoorStates(doors)
+	// rooms that stayed keep what's lying in them rather than getting what the
+	// area files place there, which only happens at startup
+	for id, room := range old.Rooms {
+		if r, ok := w.Rooms[id]; ok {
+			r.Items = w.ResolveItems(fmt.Sprintf("room %d", id), room.Items)
+		}
+	}
+	s.World = w
+
+	for _, c := range s.Characters {
+		c.Inventory = w.ResolveItems(c.Name, c.Inventory)
+	}
+	var gone []*Character
+	for _, c := range s.NPCs {
+		proto, ok := w.NPCPrototypes[c.NPC.ID]
+		if !ok {
+			gone = append(gone, c)
+			continue
+		}
+		c.NPC = proto
+		c.Inventory = w.ResolveItems(c.Name, c.Inventory)
+		// the NPC belongs to the reset for the same NPC in the same room, if
+		// there still is one
+		var reset *Reset
+		for _, r := range w.Resets {
+			if c.reset != nil && r.NPC == proto.ID && r.Room == c.reset.Room {
+				reset = r
+				break
+			}
+		}
+		c.reset = reset
+	}
+	for _, c := range gone {
+		s.stopFighting(c)
+		s.removeNPC(c)
+	}
+	if len(gone) > 0 {
+		report.changef("removed %d NPCs whose prototypes are gone", len(gone))
+	}
+
+	moved := 0
+	for _, c := range s.everyone() {
+		if _, ok := w.Rooms[c.Location]; ok {
+			continue
+		}
+		moved++
+		s.stopFighting(c)
+		c.Location = w.Start
+		room := s.currentRoom(c)
+		s.NotifyCharacter(c, "The world shifts around you.\n"+s.describeRoom(c, room))
+		s.SendGMCPCharacter(c, "Room.Info", newRoomInfo(room))
+	}
+	if moved > 0 {
+		report.changef("moved %d characters out of rooms that are gone", moved)
+	}
+	// rather than waiting for the next reset to spawn any new NPCs
+	s.reset()
+}
+
+// reportDiff reports the ids added to and removed from a kind of thing.
+func reportDiff(report *ReloadReport, kind string, old, now []int) {
+	was := make(map[int]bool)
+	for _, id := range old {
+		was[id] = true
+	}
+	var added, removed []string
+	for _, id := range now {
+		if !was[id] {
+			added = append(added, fmt.Sprint(id))
+		}
+		delete(was, id)
+	}
+	for _, id := range old {
+		if was[id] {
+			removed = append(removed, fmt.Sprint(id))
+		}
+	}
+	if len(added) > 0 {
+		report.changef("%s added: %s", kind, strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		report.changef("%s removed: %s", kind, strings.Join(removed, ", "))
+	}
+}
+
+func roomIDs(w *World) []int {
+	var ids []int
+	for id := range w.Rooms {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func itemPrototypeIDs(w *World) []int {
+	var ids []int
+	for id := range w.Prototypes {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func npcPrototypeIDs(w *World) []int {
+	var ids []int
+	for id := range w.NPCPrototypes {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// reloadOnHangup reloads whenever the server gets SIGHUP.
+func reloadOnHangup(r *Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Printf("Got SIGHUP. %s", r.Reload())
+	}
+}
+
+func cmdReload(ctx *CommandContext) {
+	s := ctx.State
+	if s.Reload == nil {
+		ctx.Respond("Reloading isn't possible on this server.")
+		return
+	}
+	ctx.Respond("Reloading...")
+	c := ctx.Character
+	// reloading waits on the game loop, so it can't happen on it
+	go func() {
+		report := s.Reload()
+		log.Printf("Reload requested by %s: %s", c.Name, report)
+		s.do(func() { s.NotifyCharacter(c, report.String()) })
+	}()
+}
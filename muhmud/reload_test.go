@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a configuration file with the given settings to a
+// temporary directory, returning its path and a function removing it again.
+func writeConfig(t *testing.T, settings string) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "muhmud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "conf.yaml")
+	if err := ioutil.WriteFile(file, []byte(settings), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return file, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfigTrimsURLs(t *testing.T) {
+	file, done := writeConfig(t, "public_url: https://mud.example.com/\nclient_url: https://play.example.com//\n")
+	defer done()
+	config, err := loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.PublicURL != "https://mud.example.com" || config.ClientURL != "https://play.example.com" {
+		t.Errorf("loaded public_url %q and client_url %q", config.PublicURL, config.ClientURL)
+	}
+}
+
+func TestLoadConfigChecksCompression(t *testing.T) {
+	tests := []struct {
+		settings string
+		want     string
+	}{
+		{"compression_level: -1\ncompression_threshold: 0\n", ""},
+		{"compression_level: -2\n", ""},
+		{"compression_level: 9\n", ""},
+		{"compression_level: 10\n", "compression_level must be between -2 and 9"},
+		{"compression_level: -3\n", "compression_level must be between -2 and 9"},
+		{"compression_threshold: -1\n", "compression_threshold must not be negative"},
+	}
+	for _, test := range tests {
+		file, done := writeConfig(t, test.settings)
+		_, err := loadConfig(file)
+		done()
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.want {
+			t.Errorf("loading %q = %q, want %q", test.settings, got, test.want)
+		}
+	}
+}
+
+func TestReloadKeepsRestartOnlySettings(t *testing.T) {
+	s := newTestGame(t)
+	old := defaultConfig()
+	live := NewLiveConfig(old)
+	sessions := NewSessionManager(s, []byte(old.JWTSecret), old.AccessTokenTTL, old.SessionTTL)
+	file, done := writeConfig(t, `database: other.db
+public_url: https://mud.example.com/
+telnet_address: ":4001"
+outbox_size: 7
+`)
+	defer done()
+	r := NewReloader(file, live, s, sessions, func() {})
+
+	report := r.Reload()
+	config := live.Get()
+	if config.Database != old.Database || config.PublicURL != old.PublicURL || config.TelnetAddress != old.TelnetAddress {
+		t.Errorf("restart-only settings were applied: database %q, public_url %q, telnet_address %q",
+			config.Database, config.PublicURL, config.TelnetAddress)
+	}
+	if config.OutboxSize != 7 {
+		t.Errorf("outbox_size = %d, want 7", config.OutboxSize)
+	}
+	failures := strings.Join(report.Failures, "\n")
+	for _, name := range []string{"database", "public_url", "telnet_address"} {
+		if !strings.Contains(failures, name+" changed, but only takes effect after a restart") {
+			t.Errorf("%s changing wasn't reported:\n%s", name, report)
+		}
+	}
+
+	// reloading again doesn't pick up the restart-only settings either
+	report = r.Reload()
+	if config := live.Get(); config.Database != old.Database {
+		t.Errorf("database = %q after reloading twice", config.Database)
+	}
+	if len(report.Failures) != 3 {
+		t.Errorf("reloading twice reported:\n%s", report)
+	}
+}
@@ -0,0 +1,161 @@
+// Contains the game's pulse: scheduled events and the command queue.
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// defaultPulseLength is how often the game ticks unless configured otherwise.
+const defaultPulseLength = 250 * time.Millisecond
+
+// maxQueuedCommands is how many commands a character may have waiting for its
+// turn before more are refused.
+const maxQueuedCommands = 20
+
+// autosaveInterval is how often the characters in the world are saved, so that
+// not everything is lost if the server dies.
+const autosaveInterval = 5 * time.Minute
+
+// The game advances in pulses, ticks of the game clock every PulseLength. On
+// each pulse the scheduled events that are due run first, and then every
+// character in the world gets a turn at its command queue.
+//
+// A command handler can make its character wait with Lag, e.g. after walking
+// into another room. Whatever the player types while their character is
+// waiting is queued and run once the wait is over, one command per pulse, so
+// nobody can act faster than the game allows however fast they type. Commands
+// typed while the character isn't waiting run straight away.
+
+// scheduledEvent is a function run on the pulse, either once or repeatedly.
+type scheduledEvent struct {
+	// every is how often the event repeats, or zero if it only runs once.
+	every time.Duration
+	// next is when the event is next due.
+	next time.Time
+	fn   func()
+}
+
+// queuedCommand is a command waiting for its character's turn.
+type queuedCommand struct {
+	connID    ConnectionID
+	requestID string
+	line      string
+}
+
+// StartClock starts the game ticking every pulse of clock. Events scheduled
+// before it was started keep the time they had left. The returned function
+// stops the clock again.
+func (s *GameState) StartClock(clock Clock, pulse time.Duration) (stop func()) {
+	s.do(func() {
+		before, now := s.Clock.Now(), clock.Now()
+		for _, e := range s.scheduled {
+			e.next = now.Add(e.next.Sub(before))
+		}
+		s.Clock = clock
+		s.PulseLength = pulse
+	})
+	return clock.Every(pulse, func() { s.do(s.pulse) })
+}
+
+// Every schedules fn to run every d, starting d from now. It must be called
+// from the game loop.
+func (s *GameState) Every(d time.Duration, fn func()) {
+	s.schedule(&scheduledEvent{every: d, fn: fn}, d)
+}
+
+// After schedules fn to run once, d from now. It must be called from the game
+// loop.
+func (s *GameState) After(d time.Duration, fn func()) {
+	s.schedule(&scheduledEvent{fn: fn}, d)
+}
+
+func (s *GameState) schedule(e *scheduledEvent, d time.Duration) {
+	e.next = s.Clock.Now().Add(d)
+	s.scheduled = append(s.scheduled, e)
+}
+
+// pulse advances the game by a single pulse. It must be called from the game
+// loop.
+func (s *GameState) pulse() {
+	s.Pulse++
+	s.runScheduled(s.Clock.Now())
+
+	var chars []*Character
+	for _, c := range s.Characters {
+		if c.InWorld() && (c.wait > 0 || len(c.queue) > 0) {
+			chars = append(chars, c)
+		}
+	}
+	sort.Slice(chars, func(i, j int) bool { return chars[i].Name < chars[j].Name })
+	for _, c := range chars {
+		if c.wait > 0 {
+			c.wait--
+		}
+		if c.wait == 0 && len(c.queue) > 0 {
+			cmd := c.queue[0]
+			c.queue = c.queue[1:]
+			// the player may have gone back to the menu since typing it
+			if conn, ok := s.Connections[cmd.connID]; ok && conn.Character == c {
+				s.dispatch(conn, cmd.requestID, cmd.line)
+			}
+		}
+	}
+}
+
+// runScheduled runs every scheduled event due by now, in the order they fall
+// due. It must be called from the game loop.
+func (s *GameState) runScheduled(now time.Time) {
+	var due, later []*scheduledEvent
+	for _, e := range s.scheduled {
+		if e.next.After(now) {
+			later = append(later, e)
+		} else {
+			due = append(due, e)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].next.Before(due[j].next) })
+	// events scheduled while running the due ones land in s.scheduled
+	s.scheduled = later
+	for _, e := range due {
+		e.fn()
+		if e.every > 0 {
+			// don't try to catch up on runs missed while the loop was busy
+			e.next = e.next.Add(e.every)
+			if !e.next.After(now) {
+				e.next = now.Add(e.every)
+			}
+			s.scheduled = append(s.scheduled, e)
+		}
+	}
+}
+
+// pulses returns how many pulses d lasts, rounding up.
+func (s *GameState) pulses(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int((d + s.PulseLength - 1) / s.PulseLength)
+}
+
+// Lag makes the acting character wait at least d before its next command runs.
+func (ctx *CommandContext) Lag(d time.Duration) {
+	if c := ctx.Character; c != nil {
+		if n := ctx.State.pulses(d); n > c.wait {
+			c.wait = n
+		}
+	}
+}
+
+// autosave saves every character in the world. It must be called from the
+// game loop.
+func (s *GameState) autosave() {
+	for _, c := range s.Characters {
+		if c.InWorld() {
+			s.saveCharacter(c)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// startFakeClock switches s over to a FakeClock ticking every pulse.
+func startFakeClock(s *GameState) *FakeClock {
+	clock := NewFakeClock(time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC))
+	s.StartClock(clock, defaultPulseLength)
+	return clock
+}
+
+func TestPulses(t *testing.T) {
+	s := newTestGame(t)
+	clock := startFakeClock(s)
+	pulse := func() (n uint64) {
+		s.do(func() { n = s.Pulse })
+		return n
+	}
+	start := pulse()
+	clock.Advance(defaultPulseLength - time.Millisecond)
+	if got := pulse() - start; got != 0 {
+		t.Errorf("%d pulses before the first one was due", got)
+	}
+	clock.Advance(time.Millisecond)
+	if got := pulse() - start; got != 1 {
+		t.Errorf("%d pulses once the first was due", got)
+	}
+	clock.Advance(10 * defaultPulseLength)
+	if got := pulse() - start; got != 11 {
+		t.Errorf("%d pulses after 11 pulse lengths", got)
+	}
+}
+
+func TestAfterAndEvery(t *testing.T) {
+	s := newTestGame(t)
+	clock := startFakeClock(s)
+	var once, every []time.Time
+	s.do(func() {
+		s.After(time.Second, func() { once = append(once, s.Clock.Now()) })
+		s.Every(time.Second, func() { every = append(every, s.Clock.Now()) })
+	})
+	start := clock.Now()
+
+	clock.Advance(750 * time.Millisecond)
+	s.do(func() {
+		if len(once) != 0 || len(every) != 0 {
+			t.Errorf("ran early: %v, %v", once, every)
+		}
+	})
+	clock.Advance(2250 * time.Millisecond)
+	s.do(func() {
+		if len(once) != 1 || !once[0].Equal(start.Add(time.Second)) {
+			t.Errorf("After ran at %v", once)
+		}
+		if len(every) != 3 || !every[2].Equal(start.Add(3*time.Second)) {
+			t.Errorf("Every ran at %v", every)
+		}
+	})
+}
+
+func TestStartClockKeepsTimeLeft(t *testing.T) {
+	s := newTestGame(t)
+	ran := false
+	s.do(func() { s.After(time.Second, func() { ran = true }) })
+	clock := startFakeClock(s)
+	clock.Advance(750 * time.Millisecond)
+	s.do(func() {
+		if ran {
+			t.Error("ran before its time was up")
+		}
+	})
+	clock.Advance(500 * time.Millisecond)
+	s.do(func() {
+		if !ran {
+			t.Error("didn't run once its time was up")
+		}
+	})
+}
+
+func TestCommandLag(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	clock := startFakeClock(s)
+	connID, out := enterGame(t, s, "a@example.com", "Alice")
+	lag := s.pulses(movementLag)
+	if lag < 1 {
+		t.Fatalf("walking doesn't take a pulse")
+	}
+
+	for _, line := range []string{"north", "south", "say there and back"} {
+		s.HandleCommand(connID, "", line)
+	}
+	if got := received(out); !strings.Contains(got, "North Road") || strings.Contains(got, "Town Square") {
+		t.Fatalf("didn't just walk north:\n%s", got)
+	}
+
+	// each command waits out the lag of the one before it
+	for i := 1; i < lag; i++ {
+		clock.Advance(defaultPulseLength)
+		if got := received(out); got != "" {
+			t.Fatalf("ran a command before the lag was over:\n%s", got)
+		}
+	}
+	clock.Advance(defaultPulseLength)
+	if got := received(out); !strings.Contains(got, "Town Square") {
+		t.Fatalf("didn't walk south once the lag was over:\n%s", got)
+	}
+	clock.Advance(time.Duration(lag-1) * defaultPulseLength)
+	if got := received(out); got != "" {
+		t.Fatalf("said something before the lag was over:\n%s", got)
+	}
+	clock.Advance(defaultPulseLength)
+	if got := received(out); !strings.Contains(got, "there and back") {
+		t.Fatalf("didn't say anything once the lag was over:\n%s", got)
+	}
+
+	// commands run straight away again once nothing is waiting
+	s.HandleCommand(connID, "", "say hi")
+	if got := received(out); !strings.Contains(got, "hi") {
+		t.Errorf("didn't say hi straight away:\n%s", got)
+	}
+}
+
+func TestCommandQueueIsLimited(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	startFakeClock(s)
+	connID, out := enterGame(t, s, "a@example.com", "Alice")
+	s.HandleCommand(connID, "", "north")
+	received(out)
+	for i := 0; i < maxQueuedCommands; i++ {
+		s.HandleCommand(connID, "", "look")
+	}
+	if got := received(out); got != "" {
+		t.Fatalf("didn't queue commands:\n%s", got)
+	}
+	s.HandleCommand(connID, "", "look")
+	if got := received(out); !strings.Contains(got, "slow down") {
+		t.Errorf("queued too many commands:\n%s", got)
+	}
+}
@@ -0,0 +1,323 @@
+// Contains login sessions: short lived access tokens and rotating refresh
+// tokens.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+// Default lifetimes of access tokens and sessions.
+const (
+	defaultAccessTokenTTL = 15 * time.Minute
+	defaultSessionTTL     = 30 * 24 * time.Hour
+)
+
+// tokenIssuer is the issuer of every access token we sign.
+const tokenIssuer = "muhmud"
+
+var (
+	// ErrNoSession is returned when a session doesn't exist.
+	ErrNoSession = errors.New("no such session")
+	// ErrSessionEnded is returned for sessions that were revoked or expired.
+	ErrSessionEnded = errors.New("session has ended")
+	// ErrTokenReused is returned when a refresh token that was already
+	// exchanged is presented again.
+	ErrTokenReused = errors.New("refresh token was already used")
+)
+
+// Session is a single login of a player, e.g. one browser. A session lives
+// until it expires or is revoked; its refresh token changes every time it's
+// used.
+type Session struct {
+	ID        string
+	Email     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	Revoked   bool
+}
+
+// Active reports whether the session can still be used at now.
+func (s Session) Active(now time.Time) bool {
+	return !s.Revoked && now.Before(s.ExpiresAt)
+}
+
+// accessClaims are the claims in an access token.
+type accessClaims struct {
+	Email     string `json:"email"`
+	SessionID string `json:"sid"`
+	jwt.StandardClaims
+}
+
+// Valid implements jwt.Claims. Unlike jwt.StandardClaims it insists that the
+// token expires.
+func (c accessClaims) Valid() error {
+	return c.validAt(jwt.TimeFunc())
+}
+
+// validAt checks the claims as Valid does, at now.
+func (c accessClaims) validAt(now time.Time) error {
+	if c.ExpiresAt == 0 || c.Issuer != tokenIssuer || c.Email == "" || c.SessionID == "" {
+		return errors.New("token is missing required claims")
+	}
+	if !c.VerifyExpiresAt(now.Unix(), true) {
+		return errors.New("token is expired")
+	}
+	if !c.VerifyIssuedAt(now.Unix(), false) || !c.VerifyNotBefore(now.Unix(), false) {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
+
+// TokenPair is what a client receives when logging in or refreshing.
+type TokenPair struct {
+	// Token is the access token, sent with every request.
+	Token string
+	// RefreshToken is exchanged for a new pair before Token expires. It can
+	// only be used once.
+	RefreshToken string
+	// ExpiresAt is when Token expires, in seconds since the epoch.
+	ExpiresAt int64
+}
+
+// SessionManager issues, refreshes and revokes sessions.
+type SessionManager struct {
+	game  *GameState
+	store Store
+	// mux guards the secrets and lifetimes, which change when the
+	// configuration is reloaded.
+	mux    sync.RWMutex
+	secret []byte
+	// previous is the secret before the last rotation. Tokens signed with it
+	// are still accepted so that rotating doesn't log everybody out.
+	previous   []byte
+	accessTTL  time.Duration
+	sessionTTL time.Duration
+	// clock is where the time comes from, which tests replace.
+	clock Clock
+}
+
+// NewSessionManager creates a SessionManager signing access tokens with secret.
+func NewSessionManager(game *GameState, secret []byte, accessTTL, sessionTTL time.Duration) *SessionManager {
+	return &SessionManager{game: game, store: game.Store, secret: secret, accessTTL: accessTTL, sessionTTL: sessionTTL, clock: RealClock{}}
+}
+
+// now returns the current time in UTC.
+func (m *SessionManager) now() time.Time {
+	return m.clock.Now().UTC()
+}
+
+// RotateSecret starts signing access tokens with secret. Tokens signed with the
+// secret before it stay valid until they expire.
+func (m *SessionManager) RotateSecret(secret []byte) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.previous, m.secret = m.secret, secret
+}
+
+// SetTTLs changes the lifetimes of access tokens and sessions started from now
+// on.
+func (m *SessionManager) SetTTLs(accessTTL, sessionTTL time.Duration) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.accessTTL, m.sessionTTL = accessTTL, sessionTTL
+}
+
+// Start starts a new session for a player who has just logged in.
+func (m *SessionManager) Start(email string) (TokenPair, error) {
+	now := m.now()
+	sess, err := m.create(email, now)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return m.issue(sess, now)
+}
+
+// StartConnected starts a session for a player who logged in on a connection
+// that lasts as long as the session, such as telnet, so no tokens are issued.
+// End the session when the connection closes.
+func (m *SessionManager) StartConnected(email string) (Session, error) {
+	return m.create(email, m.now())
+}
+
+// End ends a single session, closing its connections.
+func (m *SessionManager) End(sessionID string) {
+	m.revoke(sessionID)
+}
+
+// create stores a new session for email.
+func (m *SessionManager) create(email string, now time.Time) (Session, error) {
+	id, _, err := newToken()
+	if err != nil {
+		return Session{}, err
+	}
+	m.mux.RLock()
+	sess := Session{ID: id, Email: email, CreatedAt: now, ExpiresAt: now.Add(m.sessionTTL)}
+	m.mux.RUnlock()
+	return sess, m.store.CreateSession(sess)
+}
+
+// Refresh exchanges a refresh token for a new token pair. Presenting a refresh
+// token a second time means it has been stolen (or the client is badly
+// broken), so the whole session is revoked.
+func (m *SessionManager) Refresh(refreshToken string) (TokenPair, error) {
+	now := m.now()
+	sessionID, err := m.store.UseRefreshToken(hashToken(refreshToken), now)
+	if err == ErrTokenReused {
+		log.Printf("Refresh token for session %s was reused; revoking the session\n", sessionID)
+		m.revoke(sessionID)
+		return TokenPair{}, err
+	}
+	if err != nil {
+		return TokenPair{}, err
+	}
+	sess, err := m.store.LoadSession(sessionID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if !sess.Active(now) {
+		return TokenPair{}, ErrSessionEnded
+	}
+	return m.issue(sess, now)
+}
+
+// Logout ends the session a refresh token belongs to, or every session of its
+// player if everywhere is set. Live connections of the ended sessions are
+// closed.
+func (m *SessionManager) Logout(refreshToken string, everywhere bool) error {
+	sessionID, err := m.store.RefreshTokenSession(hashToken(refreshToken))
+	if err != nil {
+		return err
+	}
+	if !everywhere {
+		m.revoke(sessionID)
+		return nil
+	}
+	sess, err := m.store.LoadSession(sessionID)
+	if err != nil {
+		return err
+	}
+	return m.LogoutEverywhere(sess.Email)
+}
+
+// LogoutEverywhere ends every session of a player and closes all of their
+// connections.
+func (m *SessionManager) LogoutEverywhere(email string) error {
+	if err := m.store.RevokeSessions(email, m.now()); err != nil {
+		return err
+	}
+	m.game.DisconnectAccount(email, "You have been logged out.")
+	return nil
+}
+
+// Validate parses and checks an access token, returning its claims if it's
+// valid and its session is still active.
+func (m *SessionManager) Validate(tokenString string) (*accessClaims, error) {
+	m.mux.RLock()
+	secrets := [][]byte{m.secret}
+	if m.previous != nil {
+		secrets = append(secrets, m.previous)
+	}
+	m.mux.RUnlock()
+	// the claims are checked against our own clock below
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	var claims *accessClaims
+	var err error
+	for _, secret := range secrets {
+		claims = &accessClaims{}
+		_, err = parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+			}
+			return secret, nil
+		})
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	if err := claims.validAt(now); err != nil {
+		return nil, err
+	}
+	sess, err := m.store.LoadSession(claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if !sess.Active(now) || sess.Email != claims.Email {
+		return nil, ErrSessionEnded
+	}
+	return claims, nil
+}
+
+// revoke ends a single session and closes its connections.
+func (m *SessionManager) revoke(sessionID string) {
+	if err := m.store.RevokeSession(sessionID, m.now()); err != nil {
+		log.Printf("Unable to revoke session %s: %s\n", sessionID, err)
+	}
+	m.game.DisconnectSession(sessionID, "You have been logged out.")
+}
+
+// issue creates a new access token and refresh token for sess.
+func (m *SessionManager) issue(sess Session, now time.Time) (TokenPair, error) {
+	refresh, hash, err := newToken()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if err := m.store.SaveRefreshToken(hash, sess.ID, now); err != nil {
+		return TokenPair{}, err
+	}
+
+	m.mux.RLock()
+	secret, expires := m.secret, now.Add(m.accessTTL)
+	m.mux.RUnlock()
+	if expires.After(sess.ExpiresAt) {
+		expires = sess.ExpiresAt
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims{
+		Email:     sess.Email,
+		SessionID: sess.ID,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    tokenIssuer,
+			Subject:   sess.Email,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: expires.Unix(),
+		},
+	})
+	tokenString, err := token.SignedString(secret)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{Token: tokenString, RefreshToken: refresh, ExpiresAt: expires.Unix()}, nil
+}
+
+// registerSessionRoutes adds the HTTP endpoints for refreshing tokens and
+// logging out.
+func registerSessionRoutes(r *gin.Engine, sessions *SessionManager) {
+	r.POST("/token/refresh", func(c *gin.Context) {
+		pair, err := sessions.Refresh(c.PostForm("refresh_token"))
+		if err != nil {
+			c.JSON(401, struct{ Error string }{"Invalid refresh token"})
+			return
+		}
+		c.JSON(200, pair)
+	})
+
+	r.POST("/logout", func(c *gin.Context) {
+		everywhere := c.PostForm("everywhere") == "true"
+		if err := sessions.Logout(c.PostForm("refresh_token"), everywhere); err != nil {
+			c.JSON(401, struct{ Error string }{"Invalid refresh token"})
+			return
+		}
+		c.JSON(200, nil)
+	})
+}
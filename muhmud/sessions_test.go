@@ -0,0 +1,244 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/diddydum/muhmud/muhmud/markup"
+)
+
+// newTestSessions creates a SessionManager for a game with the players
+// a@example.com and b@example.com, with time standing still until the returned
+// clock is advanced.
+func newTestSessions(t *testing.T) (*GameState, *SessionManager, *FakeClock) {
+	t.Helper()
+	s := newTestGame(t, "a@example.com", "b@example.com")
+	sessions := NewSessionManager(s, []byte("secret"), time.Minute, time.Hour)
+	clock := NewFakeClock(time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC))
+	sessions.clock = clock
+	return s, sessions, clock
+}
+
+// connectSession connects email to the game on the session its access token
+// belongs to.
+func connectSession(t *testing.T, s *GameState, sessions *SessionManager, pair TokenPair) *Outbox {
+	t.Helper()
+	claims, err := sessions.Validate(pair.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, out, err := s.ConnectPlayer(claims.Email, claims.SessionID, markup.ANSI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	_, sessions, clock := newTestSessions(t)
+	first, err := sessions.Start("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(30 * time.Second)
+	second, err := sessions.Refresh(first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.RefreshToken == first.RefreshToken || second.Token == first.Token {
+		t.Error("refreshing didn't issue new tokens")
+	}
+	if want := clock.Now().Add(time.Minute).Unix(); second.ExpiresAt != want {
+		t.Errorf("the new access token expires at %d, want %d", second.ExpiresAt, want)
+	}
+	firstClaims, err := sessions.Validate(first.Token)
+	if err != nil {
+		t.Fatalf("the old access token is no longer valid: %s", err)
+	}
+	secondClaims, err := sessions.Validate(second.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secondClaims.SessionID != firstClaims.SessionID || secondClaims.Email != "a@example.com" {
+		t.Errorf("refreshing issued a token for %s in session %s", secondClaims.Email, secondClaims.SessionID)
+	}
+	if _, err := sessions.Refresh(second.RefreshToken); err != nil {
+		t.Errorf("the new refresh token can't be used: %s", err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	s, sessions, _ := newTestSessions(t)
+	first, err := sessions.Start("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := connectSession(t, s, sessions, first)
+	other, err := sessions.Start("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sessions.Refresh(first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sessions.Refresh(first.RefreshToken); err != ErrTokenReused {
+		t.Fatalf("reusing a refresh token = %v, want ErrTokenReused", err)
+	}
+	for _, token := range []string{first.Token, second.Token} {
+		if _, err := sessions.Validate(token); err != ErrSessionEnded {
+			t.Errorf("Validate() = %v for a token of the revoked session, want ErrSessionEnded", err)
+		}
+	}
+	if _, err := sessions.Refresh(second.RefreshToken); err != ErrSessionEnded {
+		t.Errorf("refreshing the revoked session = %v, want ErrSessionEnded", err)
+	}
+	if !out.Closed() {
+		t.Error("the revoked session is still connected")
+	}
+	if _, err := sessions.Validate(other.Token); err != nil {
+		t.Errorf("the player's other session was revoked too: %s", err)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	s, sessions, _ := newTestSessions(t)
+	var pairs []TokenPair
+	var outs []*Outbox
+	for _, email := range []string{"a@example.com", "a@example.com", "a@example.com", "b@example.com"} {
+		pair, err := sessions.Start(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pairs = append(pairs, pair)
+		outs = append(outs, connectSession(t, s, sessions, pair))
+	}
+	// active reports which of the sessions can still be used, and are still
+	// connected
+	active := func() (got []bool) {
+		for i, pair := range pairs {
+			_, err := sessions.Validate(pair.Token)
+			got = append(got, err == nil && !outs[i].Closed())
+		}
+		return got
+	}
+
+	if err := sessions.Logout(pairs[0].RefreshToken, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := active(); got[0] || !got[1] || !got[2] || !got[3] {
+		t.Errorf("after logging out of one session, active sessions are %v", got)
+	}
+	if err := sessions.Logout(pairs[1].RefreshToken, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := active(); got[1] || got[2] || !got[3] {
+		t.Errorf("after logging out everywhere, active sessions are %v", got)
+	}
+	if err := sessions.Logout("nonsense", false); err != ErrInvalidToken {
+		t.Errorf("logging out with an unknown refresh token = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestValidateRejectsEndedSessions(t *testing.T) {
+	_, sessions, clock := newTestSessions(t)
+	pair, err := sessions.Start("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute - time.Second)
+	if _, err := sessions.Validate(pair.Token); err != nil {
+		t.Fatalf("Validate() = %v before the token expired", err)
+	}
+	clock.Advance(2 * time.Second)
+	if _, err := sessions.Validate(pair.Token); err == nil {
+		t.Error("an expired access token was accepted")
+	}
+
+	// an access token doesn't outlive its session
+	clock.Advance(time.Hour - 2*time.Minute)
+	pair, err = sessions.Refresh(pair.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(30 * time.Second)
+	if _, err := sessions.Validate(pair.Token); err != nil {
+		t.Fatalf("Validate() = %v before the session expired", err)
+	}
+	clock.Advance(31 * time.Second)
+	if _, err := sessions.Validate(pair.Token); err == nil {
+		t.Error("a token was accepted after its session expired")
+	}
+	if _, err := sessions.Refresh(pair.RefreshToken); err != ErrSessionEnded {
+		t.Errorf("refreshing an expired session = %v, want ErrSessionEnded", err)
+	}
+
+	pair, err = sessions.Start("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := sessions.Validate(pair.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions.End(claims.SessionID)
+	if _, err := sessions.Validate(pair.Token); err != ErrSessionEnded {
+		t.Errorf("Validate() = %v for a revoked session, want ErrSessionEnded", err)
+	}
+}
+
+func TestRotateSecret(t *testing.T) {
+	_, sessions, _ := newTestSessions(t)
+	old, err := sessions.Start("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions.RotateSecret([]byte("new secret"))
+	current, err := sessions.Start("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range []TokenPair{old, current} {
+		if _, err := sessions.Validate(pair.Token); err != nil {
+			t.Errorf("Validate() = %v after rotating the secret once", err)
+		}
+	}
+	// tokens signed with the secret before last are no longer accepted
+	sessions.RotateSecret([]byte("newer secret"))
+	if _, err := sessions.Validate(old.Token); err == nil {
+		t.Error("a token signed two secrets ago was accepted")
+	}
+	if _, err := sessions.Validate(current.Token); err != nil {
+		t.Errorf("Validate() = %v for a token signed with the previous secret", err)
+	}
+}
+
+func TestSetTTLs(t *testing.T) {
+	_, sessions, clock := newTestSessions(t)
+	old, err := sessions.Start("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions.SetTTLs(time.Second, 10*time.Minute)
+	pair, err := sessions.Start("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := clock.Now().Add(time.Second).Unix(); pair.ExpiresAt != want {
+		t.Errorf("the access token expires at %d, want %d", pair.ExpiresAt, want)
+	}
+	clock.Advance(9 * time.Minute)
+	pair, err = sessions.Refresh(pair.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Minute)
+	if _, err := sessions.Refresh(pair.RefreshToken); err != ErrSessionEnded {
+		t.Errorf("refreshing after the new session TTL = %v, want ErrSessionEnded", err)
+	}
+	// sessions started before keep their lifetime
+	if _, err := sessions.Refresh(old.RefreshToken); err != nil {
+		t.Errorf("refreshing a session started before changing the TTLs = %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+// Contains the commands for buying from and selling to shopkeepers.
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// registerShopCommands adds the commands for trading with shopkeepers.
+func registerShopCommands(r *CommandRegistry) {
+	r.Register(&Command{
+		Name:    "list",
+		Help:    "List what the shopkeeper here has for sale.",
+		Handler: cmdList,
+	})
+	r.Register(&Command{
+		Name:    "buy",
+		Usage:   "<item>",
+		Help:    "Buy something from the shopkeeper here.",
+		Handler: cmdBuy,
+	})
+	r.Register(&Command{
+		Name:    "sell",
+		Usage:   "<item>",
+		Help:    "Sell something you're carrying to the shopkeeper here.",
+		Handler: cmdSell,
+	})
+}
+
+// buyPrice is what a shopkeeper charges for an item, and sellPrice what it
+// pays for one.
+func buyPrice(it *Item) int {
+	if it.Proto.Value < 1 {
+		return 1
+	}
+	return it.Proto.Value
+}
+
+func sellPrice(it *Item) int {
+	return it.Proto.Value / 2
+}
+
+// findShopkeeper finds a shopkeeper in the acting character's room, responding
+// and returning nil if there isn't one.
+func findShopkeeper(ctx *CommandContext) *Character {
+	for _, c := range ctx.State.CharactersIn(ctx.Character.Location) {
+		if c.NPC != nil && c.NPC.Flags.Has(NPCShopkeeper) {
+			if c.fighting != nil {
+				ctx.Respondf("%s is a little busy right now.", capitalize(c.Name))
+				return nil
+			}
+			return c
+		}
+	}
+	ctx.Respond("There's nobody here to trade with.")
+	return nil
+}
+
+func cmdList(ctx *CommandContext) {
+	keeper := findShopkeeper(ctx)
+	if keeper == nil {
+		return
+	}
+	stock := carried(keeper)
+	if len(stock) == 0 {
+		ctx.Respondf("%s has nothing for sale.", capitalize(keeper.Name))
+		return
+	}
+	lines := []string{capitalize(keeper.Name) + " has for sale:"}
+	for _, it := range stock {
+		lines = append(lines, fmt.Sprintf("  %-30s %4d gold", it.Name(), buyPrice(it)))
+	}
+	ctx.Respond(strings.Join(lines, "\n"))
+}
+
+func cmdBuy(ctx *CommandContext) {
+	if len(ctx.Args) == 0 {
+		ctx.Respond("Buy what?")
+		return
+	}
+	keeper := findShopkeeper(ctx)
+	if keeper == nil {
+		return
+	}
+	s, c := ctx.State, ctx.Character
+	t := ParseTarget(ctx.Args[0])
+	t.All = false
+	items := selectItems(t, carried(keeper))
+	if len(items) == 0 {
+		ctx.Respondf("%s doesn't have that for sale.", capitalize(keeper.Name))
+		return
+	}
+	it := items[0]
+	price := buyPrice(it)
+	switch {
+	case c.Stats.Gold < price:
+		ctx.Respondf("%s costs %d gold, and you only have %d.", capitalize(it.Name()), price, c.Stats.Gold)
+		return
+	case totalWeight(c.Inventory)+it.Weight() > maxCarryWeight(c):
+		ctx.Respond("You can't carry that much.")
+		return
+	}
+	keeper.Inventory = removeItem(keeper.Inventory, it)
+	c.Inventory = append(c.Inventory, it)
+	c.Stats.Gold -= price
+	keeper.Stats.Gold += price
+	s.saveCharacter(c)
+	s.sendItems(c)
+	ctx.Respondf("You buy %s for %d gold.", it.Name(), price)
+	s.NotifyRoom(c.Location, fmt.Sprintf("%s buys %s.", c.Name, it.Name()), c)
+}
+
+func cmdSell(ctx *CommandContext) {
+	if len(ctx.Args) == 0 {
+		ctx.Respond("Sell what?")
+		return
+	}
+	keeper := findShopkeeper(ctx)
+	if keeper == nil {
+		return
+	}
+	s, c := ctx.State, ctx.Character
+	t := ParseTarget(ctx.Args[0])
+	t.All = false
+	items := selectItems(t, carried(c))
+	if len(items) == 0 {
+		ctx.Respond("You aren't carrying that.")
+		return
+	}
+	it := items[0]
+	price := sellPrice(it)
+	switch {
+	case it.Proto.Flags.Has(ItemNoDrop):
+		ctx.Respondf("You can't let go of %s.", it.Name())
+		return
+	case price < 1:
+		ctx.Respondf("%s isn't interested in %s.", capitalize(keeper.Name), it.Name())
+		return
+	case keeper.Stats.Gold < price:
+		ctx.Respondf("%s can't afford %s.", capitalize(keeper.Name), it.Name())
+		return
+	}
+	c.Inventory = removeItem(c.Inventory, it)
+	keeper.Inventory = append(keeper.Inventory, it)
+	c.Stats.Gold += price
+	keeper.Stats.Gold -= price
+	s.saveCharacter(c)
+	s.sendItems(c)
+	ctx.Respondf("You sell %s for %d gold.", it.Name(), price)
+	s.NotifyRoom(c.Location, fmt.Sprintf("%s sells %s.", c.Name, it.Name()), c)
+}
@@ -0,0 +1,209 @@
+// Contains shutting the server down gracefully on SIGTERM or SIGINT.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Defaults for shutting down.
+const (
+	defaultShutdownWarning  = 10 * time.Second
+	defaultShutdownDeadline = 20 * time.Second
+)
+
+// shutdownCloseReason is the reason given in the websocket close frame sent to
+// every client when the server shuts down.
+const shutdownCloseReason = "server shutting down"
+
+// shutdownAnnouncements are how long before shutting down players are warned
+// again, after the first warning.
+var shutdownAnnouncements = []time.Duration{
+	time.Minute,
+	30 * time.Second,
+	10 * time.Second,
+	5 * time.Second,
+	3 * time.Second,
+	2 * time.Second,
+	time.Second,
+}
+
+// errShuttingDown is returned when connecting to a game that's shutting down.
+var errShuttingDown = errors.New("the server is shutting down")
+
+// Shutting down goes like this:
+//
+//  1. Logins stop: the telnet listener closes and logging in or connecting
+//     over a websocket is refused.
+//  2. Everybody playing is warned, counting down over ShutdownWarning on the
+//     game clock.
+//  3. On the game loop every connection is closed, which takes its character
+//     out of the world and saves it, and the clients are told why.
+//  4. The HTTP server stops and the writers of the connections get to send
+//     what was left in their outboxes.
+//
+// Whatever's left of ShutdownDeadline after the countdown is how long the last
+// step may take; after that the server exits regardless.
+
+// Shutdown takes the server down gracefully.
+type Shutdown struct {
+	live   *LiveConfig
+	game   *GameState
+	server *http.Server
+	// telnet is the telnet listener, or nil if telnet is turned off.
+	telnet net.Listener
+	// once makes sure the server is only shut down once.
+	once sync.Once
+	done chan struct{}
+}
+
+// NewShutdown creates a Shutdown for the server made up of game, the HTTP
+// server and the telnet listener, which may be nil.
+func NewShutdown(live *LiveConfig, game *GameState, server *http.Server, telnet net.Listener) *Shutdown {
+	return &Shutdown{live: live, game: game, server: server, telnet: telnet, done: make(chan struct{})}
+}
+
+// Done is closed once the server has shut down, and the program can exit.
+func (sd *Shutdown) Done() <-chan struct{} {
+	return sd.done
+}
+
+// Run shuts the server down. Anything received on skip cuts the countdown
+// short.
+func (sd *Shutdown) Run(skip <-chan os.Signal) {
+	sd.once.Do(func() { sd.run(true, skip) })
+}
+
+// RunNow shuts the server down without warning anybody first, as after a
+// copyover that failed once everybody had been disconnected for it.
+func (sd *Shutdown) RunNow() {
+	sd.once.Do(func() { sd.run(false, nil) })
+}
+
+// run shuts the server down, counting down first if warn is set.
+func (sd *Shutdown) run(warn bool, skip <-chan os.Signal) {
+	config := sd.live.Get()
+	deadline := time.Now().Add(config.ShutdownDeadline)
+	// in case the game loop is stuck and never gets to the rest
+	time.AfterFunc(config.ShutdownDeadline, func() {
+		log.Println("Shutting down took too long; exiting anyway")
+		os.Exit(1)
+	})
+
+	sd.game.do(func() { sd.game.closing = true })
+	if sd.telnet != nil {
+		sd.telnet.Close()
+	}
+	if warn {
+		sd.countdown(config.ShutdownWarning, skip)
+	}
+	sd.game.do(sd.game.closeAll)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := sd.server.Shutdown(ctx); err != nil {
+		log.Println("Got error when stopping the HTTP server", err)
+	}
+	if open := waitForConnections(deadline); open > 0 {
+		log.Printf("Gave up waiting for %d connections to close\n", open)
+	}
+	close(sd.done)
+}
+
+// countdown warns everybody of the shutdown until warning has passed or
+// something is received on skip.
+func (sd *Shutdown) countdown(warning time.Duration, skip <-chan os.Signal) {
+	over := make(chan struct{})
+	sd.game.do(func() { sd.game.announceShutdown(warning, func() { close(over) }) })
+	select {
+	case <-over:
+	case sig := <-skip:
+		log.Printf("Got %s again, shutting down now\n", sig)
+	}
+}
+
+// announceShutdown warns everybody that the server is shutting down in left,
+// and again at each of shutdownAnnouncements on the way, calling over once left
+// has passed. It must be called from the game loop.
+func (s *GameState) announceShutdown(left time.Duration, over func()) {
+	announce := func(left time.Duration) {
+		s.NotifyEveryone(fmt.Sprintf("%%rThe server is shutting down in %s.%%n", describeDuration(left)))
+	}
+	if left > 0 {
+		announce(left)
+	}
+	for _, next := range shutdownAnnouncements {
+		if next < left {
+			next := next
+			s.After(left-next, func() { announce(next) })
+		}
+	}
+	s.After(left, over)
+}
+
+// describeDuration describes d in whole minutes or seconds, e.g. "1 minute" or
+// "10 seconds".
+func describeDuration(d time.Duration) string {
+	n, unit := int((d+time.Second-1)/time.Second), "second"
+	if d >= time.Minute && d%time.Minute == 0 {
+		n, unit = int(d/time.Minute), "minute"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s", n, unit)
+}
+
+// AcceptingLogins reports whether players may still log in, which they can't
+// once the server has started shutting down.
+func (s *GameState) AcceptingLogins() (ok bool) {
+	s.do(func() { ok = !s.closing })
+	return ok
+}
+
+// closeAll closes every connection, telling its client that the server is
+// shutting down. Taking the characters out of the world saves them. It must be
+// called from the game loop.
+func (s *GameState) closeAll() {
+	for _, conn := range s.Connections {
+		conn.send(NewNotification("%rThe server is shutting down now. See you soon!%n"))
+		// closed first so that nobody hears about everybody else leaving
+		conn.out.CloseForShutdown()
+	}
+	for connID := range s.Connections {
+		s.disconnect(connID)
+	}
+}
+
+// waitForConnections waits until every connection has closed or deadline has
+// passed, returning how many are still open.
+func waitForConnections(deadline time.Time) int {
+	for {
+		liveTrafficMux.Lock()
+		open := len(liveTraffic)
+		liveTrafficMux.Unlock()
+		if open == 0 || time.Now().After(deadline) {
+			return open
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// shutdownOnSignal shuts the server down on SIGTERM or SIGINT. Getting either
+// again skips the rest of the countdown.
+func shutdownOnSignal(sd *Shutdown) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+	log.Printf("Got %s, shutting down\n", sig)
+	sd.Run(sigs)
+}
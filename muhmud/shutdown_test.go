@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diddydum/muhmud/muhmud/markup"
+	"github.com/gin-gonic/gin"
+)
+
+func TestDescribeDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0 seconds"},
+		{time.Second, "1 second"},
+		{1500 * time.Millisecond, "2 seconds"},
+		{59 * time.Second, "59 seconds"},
+		{time.Minute, "1 minute"},
+		{90 * time.Second, "90 seconds"},
+		{2 * time.Minute, "2 minutes"},
+	}
+	for _, test := range tests {
+		if got := describeDuration(test.d); got != test.want {
+			t.Errorf("describeDuration(%s) = %q, want %q", test.d, got, test.want)
+		}
+	}
+}
+
+func TestShutdownCountdown(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+	clock := startFakeClock(s)
+	_, out := enterGame(t, s, "a@example.com", "Alice")
+	over := false
+	s.do(func() { s.announceShutdown(90*time.Second, func() { over = true }) })
+
+	// got are the warnings, each after how many seconds into the countdown it
+	// came
+	var got []string
+	for when := 0; when <= 90; when++ {
+		if when > 0 {
+			clock.Advance(time.Second)
+		}
+		msgs, _ := out.Drain()
+		for _, msg := range msgs {
+			// wandering NPCs come and go meanwhile
+			if strings.Contains(msg.Msg, "shutting down") {
+				got = append(got, fmt.Sprintf("%d: %s", when, msg.Msg))
+			}
+		}
+		var done bool
+		s.do(func() { done = over })
+		if done != (when == 90) {
+			t.Errorf("%d seconds into the countdown it's over: %v", when, done)
+		}
+	}
+	var want []string
+	for _, w := range []struct {
+		when int
+		left string
+	}{
+		{0, "90 seconds"}, {30, "1 minute"}, {60, "30 seconds"}, {80, "10 seconds"},
+		{85, "5 seconds"}, {87, "3 seconds"}, {88, "2 seconds"}, {89, "1 second"},
+	} {
+		msg := fmt.Sprintf("%%rThe server is shutting down in %s.%%n", w.left)
+		want = append(want, fmt.Sprintf("%d: %s", w.when, markup.Render(markup.ANSI{}, msg)))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("warnings were\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestClosingRefusesLogins(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := newTestGame(t, "a@example.com")
+	r := setupRouter(s, NewSessionManager(s, []byte("secret"), time.Minute, time.Hour), &recordingMailer{}, NewLiveConfig(defaultConfig()))
+	form := url.Values{"email": {"a@example.com"}, "password": {"password"}}
+	if code := post(r, "/login", form); code != 200 {
+		t.Fatalf("logging in got %d before shutting down", code)
+	}
+
+	s.do(func() { s.closing = true })
+	if s.AcceptingLogins() {
+		t.Error("still accepting logins")
+	}
+	if code := post(r, "/login", form); code != 503 {
+		t.Errorf("logging in got %d, want 503", code)
+	}
+	if _, _, err := s.ConnectPlayer("a@example.com", "", markup.ANSI{}); err != errShuttingDown {
+		t.Errorf("ConnectPlayer() = %v, want errShuttingDown", err)
+	}
+}
+
+func TestCloseAll(t *testing.T) {
+	s := newTestGame(t, "a@example.com", "b@example.com")
+	alice, aliceOut := enterGame(t, s, "a@example.com", "Alice")
+	_, bobOut := enterGame(t, s, "b@example.com", "Bob")
+	_, menuOut, err := s.ConnectPlayer("a@example.com", "", markup.ANSI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.HandleCommand(alice, "", "north")
+	received(aliceOut)
+	received(bobOut)
+
+	s.do(s.closeAll)
+	for name, out := range map[string]*Outbox{"Alice": aliceOut, "Bob": bobOut, "the menu": menuOut} {
+		if !out.ClosedForShutdown() {
+			t.Errorf("%s's connection wasn't closed for shutting down", name)
+		}
+		got := received(out)
+		if !strings.Contains(got, "The server is shutting down now.") || strings.Contains(got, "left the game") {
+			t.Errorf("%s was sent:\n%s", name, got)
+		}
+	}
+	s.do(func() {
+		if len(s.Connections) != 0 || s.character("Alice").InWorld() {
+			t.Errorf("%d connections are left and Alice is in the world: %v", len(s.Connections), s.character("Alice").InWorld())
+		}
+	})
+	saved := loadPlayer(t, s.Store, "a@example.com").Characters
+	if len(saved) != 1 || saved[0].Location != 2 {
+		t.Errorf("saved characters %+v, want Alice on the north road", saved)
+	}
+}
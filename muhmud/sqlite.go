@@ -0,0 +1,376 @@
+// Contains the SQLite implementation of Store.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	// Registers the sqlite3 driver with database/sql.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStore is a Store backed by an embedded SQLite database.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens (creating if needed) the database at path. The schema isn't
+// touched; run MigrateUp before using the store.
+func OpenSQLite(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=1&_busy_timeout=5000", path))
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer at a time anyway; a single connection
+	// avoids "database is locked" errors between our own goroutines.
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// DB returns the underlying database handle, e.g. for running migrations.
+func (s *SQLiteStore) DB() *sql.DB {
+	return s.db
+}
+
+// LoadPlayers implements Store.
+func (s *SQLiteStore) LoadPlayers() ([]*Player, error) {
+	rows, err := s.db.Query(`SELECT a.email, a.pass_hash, v.email IS NOT NULL
+		FROM accounts a LEFT JOIN verified_emails v ON v.email = a.email`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var players []*Player
+	byEmail := make(map[string]*Player)
+	for rows.Next() {
+		p := &Player{Connections: make(map[ConnectionID]bool)}
+		if err := rows.Scan(&p.Email, &p.PassHash, &p.Verified); err != nil {
+			return nil, err
+		}
+		players = append(players, p)
+		byEmail[p.Email] = p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	irows, err := s.db.Query("SELECT email, name FROM ignores ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer irows.Close()
+	for irows.Next() {
+		var email, name string
+		if err := irows.Scan(&email, &name); err != nil {
+			return nil, err
+		}
+		if p, ok := byEmail[email]; ok {
+			p.Ignoring = append(p.Ignoring, name)
+		}
+	}
+	if err := irows.Err(); err != nil {
+		return nil, err
+	}
+
+	crows, err := s.db.Query("SELECT name, account, location, stats FROM characters ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer crows.Close()
+	byName := make(map[string]*Character)
+	for crows.Next() {
+		c := &Character{Connections: make(map[ConnectionID]bool), Channels: make(map[string]bool)}
+		var stats string
+		if err := crows.Scan(&c.Name, &c.Account, &c.Location, &stats); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(stats), &c.Stats); err != nil {
+			return nil, fmt.Errorf("bad stats for character %s: %s", c.Name, err)
+		}
+		p, ok := byEmail[c.Account]
+		if !ok {
+			return nil, fmt.Errorf("character %s belongs to unknown account %s", c.Name, c.Account)
+		}
+		p.Characters = append(p.Characters, c)
+		byName[strings.ToLower(c.Name)] = c
+	}
+	if err := crows.Err(); err != nil {
+		return nil, err
+	}
+
+	invrows, err := s.db.Query("SELECT name, items FROM inventories")
+	if err != nil {
+		return nil, err
+	}
+	defer invrows.Close()
+	for invrows.Next() {
+		var name, items string
+		if err := invrows.Scan(&name, &items); err != nil {
+			return nil, err
+		}
+		var records []itemRecord
+		if err := json.Unmarshal([]byte(items), &records); err != nil {
+			return nil, fmt.Errorf("bad inventory for character %s: %s", name, err)
+		}
+		if c, ok := byName[strings.ToLower(name)]; ok {
+			c.Inventory = itemsFromRecords(records)
+		}
+	}
+	if err := invrows.Err(); err != nil {
+		return nil, err
+	}
+
+	chrows, err := s.db.Query("SELECT name, channel, muted FROM character_channels")
+	if err != nil {
+		return nil, err
+	}
+	defer chrows.Close()
+	for chrows.Next() {
+		var name, channel string
+		var muted bool
+		if err := chrows.Scan(&name, &channel, &muted); err != nil {
+			return nil, err
+		}
+		if c, ok := byName[strings.ToLower(name)]; ok {
+			c.Channels[channel] = muted
+		}
+	}
+	return players, chrows.Err()
+}
+
+// SavePlayer implements Store.
+func (s *SQLiteStore) SavePlayer(p *Player) error {
+	return inTx(s.db, func(tx *sql.Tx) error {
+		err := upsert(tx, "UPDATE accounts SET pass_hash = ? WHERE email = ?", []interface{}{p.PassHash, p.Email},
+			"INSERT INTO accounts (email, pass_hash) VALUES (?, ?)", []interface{}{p.Email, p.PassHash})
+		if err != nil {
+			return err
+		}
+		if err := setFlag(tx, "verified_emails", p.Email, p.Verified); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM ignores WHERE email = ?", p.Email); err != nil {
+			return err
+		}
+		for _, name := range p.Ignoring {
+			if _, err := tx.Exec("INSERT INTO ignores (email, name) VALUES (?, ?)", p.Email, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// setFlag adds email to or removes it from a table of accounts with some
+// property, such as verified_emails.
+func setFlag(tx *sql.Tx, table, email string, set bool) error {
+	var err error
+	if set {
+		_, err = tx.Exec("INSERT OR IGNORE INTO "+table+" (email) VALUES (?)", email)
+	} else {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE email = ?", email)
+	}
+	return err
+}
+
+// SaveCharacter implements Store.
+func (s *SQLiteStore) SaveCharacter(c *Character) error {
+	stats, err := json.Marshal(c.Stats)
+	if err != nil {
+		return err
+	}
+	items, err := json.Marshal(itemRecords(c.Inventory))
+	if err != nil {
+		return err
+	}
+	return inTx(s.db, func(tx *sql.Tx) error {
+		err := upsert(tx, "UPDATE characters SET location = ?, stats = ? WHERE name = ?",
+			[]interface{}{c.Location, string(stats), c.Name},
+			"INSERT INTO characters (name, account, location, stats) VALUES (?, ?, ?, ?)",
+			[]interface{}{c.Name, c.Account, c.Location, string(stats)})
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT OR REPLACE INTO inventories (name, items) VALUES (?, ?)", c.Name, string(items)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM character_channels WHERE name = ?", c.Name); err != nil {
+			return err
+		}
+		for channel, muted := range c.Channels {
+			if _, err := tx.Exec("INSERT INTO character_channels (name, channel, muted) VALUES (?, ?, ?)",
+				c.Name, channel, muted); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadDoorStates implements Store.
+func (s *SQLiteStore) LoadDoorStates() (map[ExitKey]DoorState, error) {
+	rows, err := s.db.Query("SELECT room_id, exit, state FROM door_states")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	doors := make(map[ExitKey]DoorState)
+	for rows.Next() {
+		var k ExitKey
+		var state DoorState
+		if err := rows.Scan(&k.Room, &k.Exit, &state); err != nil {
+			return nil, err
+		}
+		doors[k] = state
+	}
+	return doors, rows.Err()
+}
+
+// SaveDoorState implements Store.
+func (s *SQLiteStore) SaveDoorState(key ExitKey, state DoorState) error {
+	return inTx(s.db, func(tx *sql.Tx) error {
+		return upsert(tx, "UPDATE door_states SET state = ? WHERE room_id = ? AND exit = ?",
+			[]interface{}{state, key.Room, key.Exit},
+			"INSERT INTO door_states (room_id, exit, state) VALUES (?, ?, ?)",
+			[]interface{}{key.Room, key.Exit, state})
+	})
+}
+
+// SaveToken implements Store.
+func (s *SQLiteStore) SaveToken(t AccountToken) error {
+	_, err := s.db.Exec("INSERT INTO account_tokens (token_hash, email, purpose, expires_at) VALUES (?, ?, ?, ?)",
+		t.Hash, t.Email, string(t.Purpose), t.ExpiresAt)
+	return err
+}
+
+// PeekToken implements Store.
+func (s *SQLiteStore) PeekToken(hash string, purpose TokenPurpose, now time.Time) (string, error) {
+	return peekToken(s.db, hash, purpose, now)
+}
+
+// UseToken implements Store.
+func (s *SQLiteStore) UseToken(hash string, purpose TokenPurpose, now time.Time) (string, error) {
+	var email string
+	err := inTx(s.db, func(tx *sql.Tx) error {
+		var err error
+		if email, err = peekToken(tx, hash, purpose, now); err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE account_tokens SET used_at = ? WHERE token_hash = ?", now, hash)
+		return err
+	})
+	return email, err
+}
+
+// CreateSession implements Store.
+func (s *SQLiteStore) CreateSession(sess Session) error {
+	_, err := s.db.Exec("INSERT INTO sessions (id, email, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		sess.ID, sess.Email, sess.CreatedAt, sess.ExpiresAt)
+	return err
+}
+
+// LoadSession implements Store.
+func (s *SQLiteStore) LoadSession(id string) (Session, error) {
+	sess := Session{ID: id}
+	err := s.db.QueryRow("SELECT email, created_at, expires_at, revoked_at IS NOT NULL FROM sessions WHERE id = ?", id).
+		Scan(&sess.Email, &sess.CreatedAt, &sess.ExpiresAt, &sess.Revoked)
+	if err == sql.ErrNoRows {
+		return Session{}, ErrNoSession
+	}
+	return sess, err
+}
+
+// RevokeSession implements Store.
+func (s *SQLiteStore) RevokeSession(id string, now time.Time) error {
+	_, err := s.db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", now, id)
+	return err
+}
+
+// RevokeSessions implements Store.
+func (s *SQLiteStore) RevokeSessions(email string, now time.Time) error {
+	_, err := s.db.Exec("UPDATE sessions SET revoked_at = ? WHERE email = ? AND revoked_at IS NULL", now, email)
+	return err
+}
+
+// SaveRefreshToken implements Store.
+func (s *SQLiteStore) SaveRefreshToken(hash, sessionID string, now time.Time) error {
+	_, err := s.db.Exec("INSERT INTO refresh_tokens (token_hash, session_id, created_at) VALUES (?, ?, ?)",
+		hash, sessionID, now)
+	return err
+}
+
+// UseRefreshToken implements Store.
+func (s *SQLiteStore) UseRefreshToken(hash string, now time.Time) (string, error) {
+	var sessionID string
+	err := inTx(s.db, func(tx *sql.Tx) error {
+		var used bool
+		err := tx.QueryRow("SELECT session_id, used_at IS NOT NULL FROM refresh_tokens WHERE token_hash = ?", hash).
+			Scan(&sessionID, &used)
+		if err == sql.ErrNoRows {
+			return ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+		if used {
+			return ErrTokenReused
+		}
+		_, err = tx.Exec("UPDATE refresh_tokens SET used_at = ? WHERE token_hash = ?", now, hash)
+		return err
+	})
+	return sessionID, err
+}
+
+// RefreshTokenSession implements Store.
+func (s *SQLiteStore) RefreshTokenSession(hash string) (string, error) {
+	var sessionID string
+	err := s.db.QueryRow("SELECT session_id FROM refresh_tokens WHERE token_hash = ?", hash).Scan(&sessionID)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidToken
+	}
+	return sessionID, err
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func peekToken(q queryer, hash string, purpose TokenPurpose, now time.Time) (string, error) {
+	var email string
+	var expires time.Time
+	var used bool
+	err := q.QueryRow("SELECT email, expires_at, used_at IS NOT NULL FROM account_tokens WHERE token_hash = ? AND purpose = ?",
+		hash, string(purpose)).Scan(&email, &expires, &used)
+	if err == sql.ErrNoRows || (err == nil && (used || !now.Before(expires))) {
+		return "", ErrInvalidToken
+	}
+	return email, err
+}
+
+// upsert runs update, falling back to insert if it didn't touch any rows. The
+// bundled SQLite predates INSERT ... ON CONFLICT DO UPDATE.
+func upsert(tx *sql.Tx, update string, updateArgs []interface{}, insert string, insertArgs []interface{}) error {
+	res, err := tx.Exec(update, updateArgs...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = tx.Exec(insert, insertArgs...)
+	return err
+}
+
+// Close implements Store.
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,313 @@
+// Contains the interface to persistent storage and an in-memory implementation.
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store persists accounts, characters and changes made to the world so that
+// they survive a restart. Implementations must be safe for concurrent use.
+type Store interface {
+	// LoadPlayers returns every account with its characters attached.
+	LoadPlayers() ([]*Player, error)
+	// SavePlayer creates or updates an account. It doesn't save the account's
+	// characters.
+	SavePlayer(p *Player) error
+	// SaveCharacter creates or updates a character.
+	SaveCharacter(c *Character) error
+	// LoadDoorStates returns the saved state of every door that has been
+	// changed, keyed by the room and exit the change was made from.
+	LoadDoorStates() (map[ExitKey]DoorState, error)
+	// SaveDoorState records the state of the door in an exit.
+	SaveDoorState(key ExitKey, state DoorState) error
+	// SaveToken stores a newly issued account token.
+	SaveToken(t AccountToken) error
+	// PeekToken returns the email a token was issued to if it has the given
+	// purpose, hasn't expired at now and hasn't been used. Otherwise it returns
+	// ErrInvalidToken.
+	PeekToken(hash string, purpose TokenPurpose, now time.Time) (string, error)
+	// UseToken is like PeekToken but also marks the token as used, so that it
+	// can't be used again.
+	UseToken(hash string, purpose TokenPurpose, now time.Time) (string, error)
+	// CreateSession stores a new login session.
+	CreateSession(sess Session) error
+	// LoadSession returns the session with the given id, or ErrNoSession.
+	LoadSession(id string) (Session, error)
+	// RevokeSession ends a single session. Revoking a session that doesn't
+	// exist or has already ended does nothing.
+	RevokeSession(id string, now time.Time) error
+	// RevokeSessions ends every session of an account.
+	RevokeSessions(email string, now time.Time) error
+	// SaveRefreshToken stores a newly issued refresh token for a session.
+	SaveRefreshToken(hash, sessionID string, now time.Time) error
+	// UseRefreshToken marks a refresh token as used and returns its session.
+	// If the token was used before it returns ErrTokenReused along with the
+	// session; unknown tokens give ErrInvalidToken.
+	UseRefreshToken(hash string, now time.Time) (string, error)
+	// RefreshTokenSession returns the session a refresh token was issued to,
+	// whether or not it has been used.
+	RefreshTokenSession(hash string) (string, error)
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// ExitKey identifies an exit in the world by the room it leaves from and its
+// label.
+type ExitKey struct {
+	Room RoomID
+	Exit string
+}
+
+func (k ExitKey) String() string {
+	return fmt.Sprintf("%d/%s", k.Room, k.Exit)
+}
+
+// MemoryStore is a Store that keeps everything in memory. It's useful for
+// tests and for playing around without a database.
+type MemoryStore struct {
+	players    map[string]Player
+	characters map[string]Character
+	doors      map[ExitKey]DoorState
+	tokens     map[string]*memoryToken
+	sessions   map[string]Session
+	refresh    map[string]*memoryRefreshToken
+	mux        sync.Mutex
+}
+
+type memoryRefreshToken struct {
+	sessionID string
+	used      bool
+}
+
+type memoryToken struct {
+	AccountToken
+	used bool
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		players:    make(map[string]Player),
+		characters: make(map[string]Character),
+		doors:      make(map[ExitKey]DoorState),
+		tokens:     make(map[string]*memoryToken),
+		sessions:   make(map[string]Session),
+		refresh:    make(map[string]*memoryRefreshToken),
+	}
+}
+
+// LoadPlayers implements Store.
+func (m *MemoryStore) LoadPlayers() ([]*Player, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	players := make(map[string]*Player)
+	var result []*Player
+	for email, saved := range m.players {
+		p := saved
+		p.Connections = make(map[ConnectionID]bool)
+		p.Characters = nil
+		p.Ignoring = append([]string(nil), saved.Ignoring...)
+		players[email] = &p
+		result = append(result, &p)
+	}
+	for _, saved := range m.characters {
+		p, ok := players[saved.Account]
+		if !ok {
+			return nil, fmt.Errorf("character %s belongs to unknown account %s", saved.Name, saved.Account)
+		}
+		c := saved
+		c.Connections = make(map[ConnectionID]bool)
+		c.Channels = copyChannels(saved.Channels)
+		c.Inventory = itemsFromRecords(itemRecords(saved.Inventory))
+		p.Characters = append(p.Characters, &c)
+	}
+	return result, nil
+}
+
+// SavePlayer implements Store.
+func (m *MemoryStore) SavePlayer(p *Player) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	saved := *p
+	saved.Connections = nil
+	saved.Characters = nil
+	saved.Admin = false
+	saved.Ignoring = append([]string(nil), p.Ignoring...)
+	m.players[p.Email] = saved
+	return nil
+}
+
+// SaveCharacter implements Store.
+func (m *MemoryStore) SaveCharacter(c *Character) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.players[c.Account]; !ok {
+		return fmt.Errorf("can't save character %s for unknown account %s", c.Name, c.Account)
+	}
+	saved := *c
+	saved.Connections = nil
+	saved.Channels = copyChannels(c.Channels)
+	saved.Inventory = itemsFromRecords(itemRecords(c.Inventory))
+	saved.wait, saved.queue = 0, nil
+	m.characters[strings.ToLower(c.Name)] = saved
+	return nil
+}
+
+func copyChannels(channels map[string]bool) map[string]bool {
+	copied := make(map[string]bool, len(channels))
+	for k, v := range channels {
+		copied[k] = v
+	}
+	return copied
+}
+
+// LoadDoorStates implements Store.
+func (m *MemoryStore) LoadDoorStates() (map[ExitKey]DoorState, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	doors := make(map[ExitKey]DoorState, len(m.doors))
+	for k, v := range m.doors {
+		doors[k] = v
+	}
+	return doors, nil
+}
+
+// SaveDoorState implements Store.
+func (m *MemoryStore) SaveDoorState(key ExitKey, state DoorState) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.doors[key] = state
+	return nil
+}
+
+// SaveToken implements Store.
+func (m *MemoryStore) SaveToken(t AccountToken) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.players[t.Email]; !ok {
+		return fmt.Errorf("can't save token for unknown account %s", t.Email)
+	}
+	m.tokens[t.Hash] = &memoryToken{AccountToken: t}
+	return nil
+}
+
+// PeekToken implements Store.
+func (m *MemoryStore) PeekToken(hash string, purpose TokenPurpose, now time.Time) (string, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	t, ok := m.tokens[hash]
+	if !ok || t.used || t.Purpose != purpose || !now.Before(t.ExpiresAt) {
+		return "", ErrInvalidToken
+	}
+	return t.Email, nil
+}
+
+// UseToken implements Store.
+func (m *MemoryStore) UseToken(hash string, purpose TokenPurpose, now time.Time) (string, error) {
+	email, err := m.PeekToken(hash, purpose, now)
+	if err != nil {
+		return "", err
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.tokens[hash].used {
+		return "", ErrInvalidToken
+	}
+	m.tokens[hash].used = true
+	return email, nil
+}
+
+// CreateSession implements Store.
+func (m *MemoryStore) CreateSession(sess Session) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.sessions[sess.ID]; ok {
+		return fmt.Errorf("session %s already exists", sess.ID)
+	}
+	if _, ok := m.players[sess.Email]; !ok {
+		return fmt.Errorf("can't create session for unknown account %s", sess.Email)
+	}
+	m.sessions[sess.ID] = sess
+	return nil
+}
+
+// LoadSession implements Store.
+func (m *MemoryStore) LoadSession(id string) (Session, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	sess, ok := m.sessions[id]
+	if !ok {
+		return Session{}, ErrNoSession
+	}
+	return sess, nil
+}
+
+// RevokeSession implements Store.
+func (m *MemoryStore) RevokeSession(id string, now time.Time) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if sess, ok := m.sessions[id]; ok {
+		sess.Revoked = true
+		m.sessions[id] = sess
+	}
+	return nil
+}
+
+// RevokeSessions implements Store.
+func (m *MemoryStore) RevokeSessions(email string, now time.Time) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for id, sess := range m.sessions {
+		if sess.Email == email {
+			sess.Revoked = true
+			m.sessions[id] = sess
+		}
+	}
+	return nil
+}
+
+// SaveRefreshToken implements Store.
+func (m *MemoryStore) SaveRefreshToken(hash, sessionID string, now time.Time) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.sessions[sessionID]; !ok {
+		return fmt.Errorf("can't save refresh token for unknown session %s", sessionID)
+	}
+	m.refresh[hash] = &memoryRefreshToken{sessionID: sessionID}
+	return nil
+}
+
+// UseRefreshToken implements Store.
+func (m *MemoryStore) UseRefreshToken(hash string, now time.Time) (string, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	t, ok := m.refresh[hash]
+	if !ok {
+		return "", ErrInvalidToken
+	}
+	if t.used {
+		return t.sessionID, ErrTokenReused
+	}
+	t.used = true
+	return t.sessionID, nil
+}
+
+// RefreshTokenSession implements Store.
+func (m *MemoryStore) RefreshTokenSession(hash string) (string, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	t, ok := m.refresh[hash]
+	if !ok {
+		return "", ErrInvalidToken
+	}
+	return t.sessionID, nil
+}
+
+// Close implements Store.
+func (m *MemoryStore) Close() error {
+	return nil
+}
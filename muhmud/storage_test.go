@@ -0,0 +1,301 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// forEachStore runs test against a MemoryStore and against a freshly migrated
+// SQLiteStore, which have to behave the same.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "muhmud")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		store, err := OpenSQLite(filepath.Join(dir, "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		migrations, err := LoadMigrations("migrations")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := MigrateUp(store.DB(), migrations); err != nil {
+			t.Fatal(err)
+		}
+		test(t, store)
+	})
+}
+
+// savePlayer saves an account for email, failing the test if it can't.
+func savePlayer(t *testing.T, store Store, email string) *Player {
+	t.Helper()
+	p := &Player{Email: email, PassHash: []byte("hash")}
+	if err := store.SavePlayer(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func loadPlayer(t *testing.T, store Store, email string) *Player {
+	t.Helper()
+	players, err := store.LoadPlayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range players {
+		if p.Email == email {
+			return p
+		}
+	}
+	t.Fatalf("%s wasn't loaded", email)
+	return nil
+}
+
+func TestStorePlayers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		p := &Player{Email: "alice@example.com", PassHash: []byte("hash"), Verified: true, Admin: true, Ignoring: []string{"Bob", "Carol"}}
+		if err := store.SavePlayer(p); err != nil {
+			t.Fatal(err)
+		}
+		savePlayer(t, store, "bob@example.com")
+
+		// who's an admin comes from the configuration, so it isn't saved
+		got := loadPlayer(t, store, "alice@example.com")
+		if string(got.PassHash) != "hash" || !got.Verified || got.Admin {
+			t.Errorf("loaded %+v", got)
+		}
+		if !reflect.DeepEqual(got.Ignoring, p.Ignoring) {
+			t.Errorf("Ignoring = %v, want %v", got.Ignoring, p.Ignoring)
+		}
+		if got.Connections == nil {
+			t.Error("Connections is nil")
+		}
+
+		p.PassHash, p.Verified, p.Ignoring = []byte("other"), false, nil
+		if err := store.SavePlayer(p); err != nil {
+			t.Fatal(err)
+		}
+		got = loadPlayer(t, store, "alice@example.com")
+		if string(got.PassHash) != "other" || got.Verified || len(got.Ignoring) != 0 {
+			t.Errorf("after updating loaded %+v", got)
+		}
+		if players, err := store.LoadPlayers(); err != nil || len(players) != 2 {
+			t.Errorf("LoadPlayers() = %d players, %v; want 2", len(players), err)
+		}
+	})
+}
+
+func TestStoreCharacters(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		savePlayer(t, store, "alice@example.com")
+		c := &Character{
+			Name:     "Alice",
+			Account:  "alice@example.com",
+			Location: 3001,
+			Stats:    Stats{Level: 2, HP: 10, MaxHP: 20},
+			Channels: map[string]bool{"gossip": false, "newbie": true},
+			Inventory: []*Item{
+				{Proto: &ItemPrototype{ID: 1}, Worn: WearWield},
+				{Proto: &ItemPrototype{ID: 2}, Contents: []*Item{{Proto: &ItemPrototype{ID: 3}}}},
+			},
+		}
+		if err := store.SaveCharacter(c); err != nil {
+			t.Fatal(err)
+		}
+		c.Location = 3002
+		c.Channels = map[string]bool{"gossip": true}
+		if err := store.SaveCharacter(c); err != nil {
+			t.Fatal(err)
+		}
+
+		p := loadPlayer(t, store, "alice@example.com")
+		if len(p.Characters) != 1 {
+			t.Fatalf("loaded %d characters, want 1", len(p.Characters))
+		}
+		got := p.Characters[0]
+		if got.Name != "Alice" || got.Account != c.Account || got.Location != 3002 || got.Stats != c.Stats {
+			t.Errorf("loaded %+v", got)
+		}
+		if !reflect.DeepEqual(got.Channels, c.Channels) {
+			t.Errorf("Channels = %v, want %v", got.Channels, c.Channels)
+		}
+		if !reflect.DeepEqual(itemRecords(got.Inventory), itemRecords(c.Inventory)) {
+			t.Errorf("Inventory = %+v, want %+v", itemRecords(got.Inventory), itemRecords(c.Inventory))
+		}
+		if got.Connections == nil {
+			t.Error("Connections is nil")
+		}
+
+		orphan := &Character{Name: "Orphan", Account: "nobody@example.com"}
+		if err := store.SaveCharacter(orphan); err == nil {
+			t.Error("saved a character for an unknown account")
+		}
+	})
+}
+
+func TestStoreDoorStates(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		north, south := ExitKey{Room: 3001, Exit: "north"}, ExitKey{Room: 3002, Exit: "south"}
+		for _, save := range []struct {
+			key   ExitKey
+			state DoorState
+		}{{north, DoorClosed}, {south, DoorOpen}, {north, DoorLocked}} {
+			if err := store.SaveDoorState(save.key, save.state); err != nil {
+				t.Fatal(err)
+			}
+		}
+		doors, err := store.LoadDoorStates()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[ExitKey]DoorState{north: DoorLocked, south: DoorOpen}
+		if !reflect.DeepEqual(doors, want) {
+			t.Errorf("LoadDoorStates() = %v, want %v", doors, want)
+		}
+	})
+}
+
+func TestStoreTokens(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		savePlayer(t, store, "alice@example.com")
+		now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+		tok := AccountToken{Hash: "h", Email: "alice@example.com", Purpose: VerifyEmailToken, ExpiresAt: now.Add(time.Hour)}
+		if err := store.SaveToken(tok); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SaveToken(AccountToken{Hash: "x", Email: "nobody@example.com", Purpose: VerifyEmailToken, ExpiresAt: now}); err == nil {
+			t.Error("saved a token for an unknown account")
+		}
+
+		if _, err := store.PeekToken("h", ResetPasswordToken, now); err != ErrInvalidToken {
+			t.Errorf("PeekToken with the wrong purpose: %v, want ErrInvalidToken", err)
+		}
+		if _, err := store.PeekToken("h", VerifyEmailToken, now.Add(time.Hour)); err != ErrInvalidToken {
+			t.Errorf("PeekToken once expired: %v, want ErrInvalidToken", err)
+		}
+		if _, err := store.PeekToken("unknown", VerifyEmailToken, now); err != ErrInvalidToken {
+			t.Errorf("PeekToken of an unknown token: %v, want ErrInvalidToken", err)
+		}
+		for i := 0; i < 2; i++ {
+			if email, err := store.PeekToken("h", VerifyEmailToken, now); err != nil || email != tok.Email {
+				t.Errorf("PeekToken() = %q, %v; want %q", email, err, tok.Email)
+			}
+		}
+		if email, err := store.UseToken("h", VerifyEmailToken, now); err != nil || email != tok.Email {
+			t.Errorf("UseToken() = %q, %v; want %q", email, err, tok.Email)
+		}
+		if _, err := store.UseToken("h", VerifyEmailToken, now); err != ErrInvalidToken {
+			t.Errorf("using a token twice: %v, want ErrInvalidToken", err)
+		}
+		if _, err := store.PeekToken("h", VerifyEmailToken, now); err != ErrInvalidToken {
+			t.Errorf("PeekToken once used: %v, want ErrInvalidToken", err)
+		}
+	})
+}
+
+func TestStoreSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		savePlayer(t, store, "alice@example.com")
+		savePlayer(t, store, "bob@example.com")
+		now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+		for _, sess := range []Session{
+			{ID: "a1", Email: "alice@example.com", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+			{ID: "a2", Email: "alice@example.com", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+			{ID: "b1", Email: "bob@example.com", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+		} {
+			if err := store.CreateSession(sess); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.CreateSession(Session{ID: "a1", Email: "alice@example.com", CreatedAt: now, ExpiresAt: now}); err == nil {
+			t.Error("created a session with an id already in use")
+		}
+		if err := store.CreateSession(Session{ID: "n1", Email: "nobody@example.com", CreatedAt: now, ExpiresAt: now}); err == nil {
+			t.Error("created a session for an unknown account")
+		}
+
+		sess, err := store.LoadSession("a1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sess.ID != "a1" || sess.Email != "alice@example.com" || !sess.CreatedAt.Equal(now) || !sess.ExpiresAt.Equal(now.Add(time.Hour)) || sess.Revoked {
+			t.Errorf("LoadSession() = %+v", sess)
+		}
+		if _, err := store.LoadSession("unknown"); err != ErrNoSession {
+			t.Errorf("LoadSession of an unknown session: %v, want ErrNoSession", err)
+		}
+
+		for _, id := range []string{"a1", "a1", "unknown"} {
+			if err := store.RevokeSession(id, now); err != nil {
+				t.Errorf("RevokeSession(%q): %v", id, err)
+			}
+		}
+		if err := store.RevokeSessions("bob@example.com", now); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.RevokeSessions("nobody@example.com", now); err != nil {
+			t.Errorf("RevokeSessions of an unknown account: %v", err)
+		}
+		var revoked []string
+		for _, id := range []string{"a1", "a2", "b1"} {
+			sess, err := store.LoadSession(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sess.Revoked {
+				revoked = append(revoked, id)
+			}
+		}
+		sort.Strings(revoked)
+		if want := []string{"a1", "b1"}; !reflect.DeepEqual(revoked, want) {
+			t.Errorf("revoked %v, want %v", revoked, want)
+		}
+	})
+}
+
+func TestStoreRefreshTokens(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		savePlayer(t, store, "alice@example.com")
+		now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+		if err := store.CreateSession(Session{ID: "a1", Email: "alice@example.com", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SaveRefreshToken("r1", "a1", now); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SaveRefreshToken("r2", "unknown", now); err == nil {
+			t.Error("saved a refresh token for an unknown session")
+		}
+
+		if id, err := store.RefreshTokenSession("r1"); err != nil || id != "a1" {
+			t.Errorf("RefreshTokenSession() = %q, %v; want a1", id, err)
+		}
+		if id, err := store.UseRefreshToken("r1", now); err != nil || id != "a1" {
+			t.Errorf("UseRefreshToken() = %q, %v; want a1", id, err)
+		}
+		if id, err := store.UseRefreshToken("r1", now); err != ErrTokenReused || id != "a1" {
+			t.Errorf("reusing a refresh token = %q, %v; want a1, ErrTokenReused", id, err)
+		}
+		if id, err := store.RefreshTokenSession("r1"); err != nil || id != "a1" {
+			t.Errorf("RefreshTokenSession() once used = %q, %v; want a1", id, err)
+		}
+		if _, err := store.UseRefreshToken("unknown", now); err != ErrInvalidToken {
+			t.Errorf("UseRefreshToken of an unknown token: %v, want ErrInvalidToken", err)
+		}
+		if _, err := store.RefreshTokenSession("unknown"); err != ErrInvalidToken {
+			t.Errorf("RefreshTokenSession of an unknown token: %v, want ErrInvalidToken", err)
+		}
+	})
+}
@@ -0,0 +1,300 @@
+// Contains the telnet listener, for playing from classic MUD clients.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diddydum/muhmud/muhmud/markup"
+	"github.com/diddydum/muhmud/muhmud/telnet"
+)
+
+// maxLoginAttempts is how many times a telnet player may get their password
+// wrong before being disconnected.
+const maxLoginAttempts = 3
+
+// telnetPrompt is shown after every response, to let the player know the
+// command has finished.
+const telnetPrompt = "> "
+
+// serveTelnet accepts telnet connections on l. It only returns once the
+// listener fails or is closed.
+func serveTelnet(l net.Listener, s *GameState, sessions *SessionManager, live *LiveConfig) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Println("Got a temporary error when accepting telnet connection", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		config := live.Get()
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetKeepAlive(true)
+			tcp.SetKeepAlivePeriod(config.PingInterval)
+		}
+		go handleTelnet(s, sessions, config, conn)
+	}
+}
+
+// handleTelnet logs a player in on a new telnet connection and then plays the
+// game on it until either side hangs up.
+func handleTelnet(s *GameState, sessions *SessionManager, config Configuration, netConn net.Conn) {
+	traffic := trackTraffic(netConn.RemoteAddr().String(), "telnet")
+	defer traffic.Done()
+	conn := telnet.NewConn(countingConn{Conn: netConn, traffic: traffic})
+	conn.CountWrites(traffic.AddRaw)
+	defer conn.Close()
+
+	if err := conn.Negotiate(); err != nil {
+		return
+	}
+	if config.Compression {
+		conn.OfferCompression(config.CompressionLevel)
+	}
+	conn.Offer(telnet.OptGMCP)
+	// clients say which GMCP packages they want straight away, before they've
+	// logged in, so hold on to their messages until there's a connection
+	var early [][]byte
+	conn.HandleSubnegotiation(func(opt byte, data []byte) {
+		if opt == telnet.OptGMCP {
+			early = append(early, data)
+		}
+	})
+	fmt.Fprint(conn, "Log in with the email address and password of your muhmud account.\n\n")
+
+	loggedIn := s.trackLogin(conn)
+	email, err := telnetLogin(s, conn, config.ClientURL)
+	loggedIn()
+	if err != nil {
+		return
+	}
+	traffic.Identify(email)
+	sess, err := sessions.StartConnected(email)
+	if err != nil {
+		log.Println("Got an error when starting telnet session", err)
+		fmt.Fprint(conn, "Something went wrong; please try again later.\n")
+		return
+	}
+	defer sessions.End(sess.ID)
+
+	log.Printf("Email %s has connected over telnet from %s\n", email, conn.RemoteAddr())
+	connID, out, err := s.ConnectPlayer(email, sess.ID, telnetRenderer(conn))
+	if err == errShuttingDown {
+		fmt.Fprint(conn, "The server is shutting down; please try again later.\n")
+		return
+	} else if err == errAlreadyConnected {
+		fmt.Fprint(conn, "You are already connected from somewhere else.\n")
+		return
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+	traffic.SetConnection(connID)
+	readStopped := s.AttachTelnet(connID, conn, netConn)
+	handleGMCP := telnetGMCPHandler(s, connID)
+	for _, data := range early {
+		handleGMCP(telnet.OptGMCP, data)
+	}
+	conn.HandleSubnegotiation(handleGMCP)
+	telnetLoop(s, conn, connID, out, readStopped, config)
+}
+
+// resumeTelnet carries on playing the game on a telnet connection handed over
+// by a copyover, until either side hangs up.
+func resumeTelnet(s *GameState, sessions *SessionManager, config Configuration, h telnetHandover) {
+	f := os.NewFile(uintptr(h.FD), "telnet")
+	netConn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		log.Printf("Unable to pick up the telnet connection of %s: %s", h.Email, err)
+		sessions.End(h.SessionID)
+		return
+	}
+	traffic := trackTraffic(h.Email, "telnet")
+	defer traffic.Done()
+	conn, err := telnet.Resume(countingConn{Conn: netConn, traffic: traffic}, h.Telnet)
+	if err != nil {
+		log.Printf("Unable to pick up the telnet connection of %s: %s", h.Email, err)
+		netConn.Close()
+		sessions.End(h.SessionID)
+		return
+	}
+	conn.CountWrites(traffic.AddRaw)
+	defer conn.Close()
+	defer sessions.End(h.SessionID)
+
+	connID, out, err := s.Rejoin(h.Email, h.SessionID, telnetRenderer(conn), h.Character, h.GMCP)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	traffic.SetConnection(connID)
+	readStopped := s.AttachTelnet(connID, conn, netConn)
+	conn.HandleSubnegotiation(telnetGMCPHandler(s, connID))
+	telnetLoop(s, conn, connID, out, readStopped, config)
+}
+
+// telnetRenderer picks how to render markup for a telnet client.
+func telnetRenderer(conn *telnet.Conn) markup.Renderer {
+	if strings.EqualFold(conn.TerminalType(), "dumb") {
+		return markup.Plain{}
+	}
+	return markup.ANSI{}
+}
+
+// telnetGMCPHandler returns the subnegotiation handler passing the GMCP
+// messages of a telnet client on to the game.
+func telnetGMCPHandler(s *GameState, connID ConnectionID) func(opt byte, data []byte) {
+	return func(opt byte, data []byte) {
+		if opt != telnet.OptGMCP {
+			return
+		}
+		msg, payload := splitGMCP(data)
+		if err := s.HandleGMCP(connID, msg, payload); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// splitGMCP splits the data of a GMCP subnegotiation into the message name and
+// its JSON payload, which may be empty.
+func splitGMCP(data []byte) (string, []byte) {
+	i := bytes.IndexByte(data, ' ')
+	if i < 0 {
+		return string(data), nil
+	}
+	return string(data[:i]), bytes.TrimSpace(data[i+1:])
+}
+
+// trackLogin records that conn is logging in, until the function it returns
+// is called.
+func (s *GameState) trackLogin(conn *telnet.Conn) func() {
+	s.do(func() { s.loggingIn[conn] = true })
+	return func() {
+		s.do(func() { delete(s.loggingIn, conn) })
+	}
+}
+
+// telnetLogin asks for an email address and password until they're right,
+// returning the email address of the player. New players are pointed at the
+// register page of the web client at clientURL.
+func telnetLogin(s *GameState, conn *telnet.Conn, clientURL string) (string, error) {
+	for attempt := 0; attempt < maxLoginAttempts; attempt++ {
+		fmt.Fprint(conn, "Email: ")
+		email, err := conn.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		email = normalizeEmail(email)
+		if email == "" {
+			fmt.Fprintf(conn, "New here? Create an account at %s/register first.\n", clientURL)
+			continue
+		}
+
+		fmt.Fprint(conn, "Password: ")
+		conn.SetEcho(false)
+		password, err := conn.ReadLine()
+		conn.SetEcho(true)
+		fmt.Fprint(conn, "\n")
+		if err != nil {
+			return "", err
+		}
+
+		if s.CheckPassword(email, password) != nil {
+			fmt.Fprint(conn, "Invalid email/password.\n\n")
+			continue
+		}
+		if !s.isVerified(email) {
+			fmt.Fprint(conn, "Please verify your email address first.\n")
+			return "", fmt.Errorf("%s isn't verified", email)
+		}
+		return email, nil
+	}
+	fmt.Fprint(conn, "Too many failed attempts; goodbye.\n")
+	return "", fmt.Errorf("too many failed logins from %s", conn.RemoteAddr())
+}
+
+// telnetLoop is controlLoop for telnet: lines typed by the player are run as
+// commands and everything in the outbox is written back as text. A copyover
+// stops the reader with a read deadline, after which it closes readStopped
+// and only returns if the copyover fails, leaving the connection to be handed
+// over.
+func telnetLoop(s *GameState, conn *telnet.Conn, connID ConnectionID, out *Outbox, readStopped chan<- struct{}, config Configuration) {
+	// Write until the outbox is closed. If a write fails or takes too long the
+	// connection is closed, which in turn stops the reader below.
+	go func() {
+		defer out.Finish()
+		handedOver := false
+		defer func() {
+			if !handedOver {
+				conn.Close()
+			}
+		}()
+		for range out.Ready() {
+			msgs, open := out.Drain()
+			for _, msg := range msgs {
+				conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+				if msg.Type == GMCP {
+					if !conn.Enabled(telnet.OptGMCP) {
+						continue
+					}
+					data := []byte(msg.Package)
+					if len(msg.Data) > 0 {
+						data = append(append(data, ' '), msg.Data...)
+					}
+					if err := conn.Subnegotiate(telnet.OptGMCP, data); err != nil {
+						return
+					}
+					continue
+				}
+				text := msg.Msg + "\n"
+				if msg.Type == Response {
+					text += telnetPrompt
+				}
+				if _, err := fmt.Fprint(conn, text); err != nil {
+					return
+				}
+			}
+			if !open {
+				if _, ok := out.ClosedForCopyover(); ok {
+					// the next process carries on with the connection
+					handedOver = true
+					return
+				}
+				if out.Evicted() {
+					fmt.Fprint(conn, "You have been disconnected for not keeping up.\n")
+				}
+				return
+			}
+		}
+	}()
+
+	for n := 1; ; n++ {
+		line, err := conn.ReadLine()
+		if err != nil {
+			if _, ok := out.ClosedForCopyover(); ok {
+				// the game loop is busy handing the connection over, which
+				// belongs to the next process from now on, so none of the
+				// cleaning up of the callers may happen unless the copyover
+				// fails; otherwise exec ends this
+				close(readStopped)
+				<-s.copyoverFailed
+				return
+			}
+			s.DisconnectPlayer(connID)
+			return
+		}
+		if err := s.HandleCommand(connID, strconv.Itoa(n), line); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,627 @@
+// Package telnet implements the server side of the telnet protocol (RFC 854)
+// on top of a net.Conn, enough to play a MUD from a classic client: commands
+// are read a line at a time, option negotiation is answered, and the window
+// size (NAWS, RFC 1073) and terminal type (TTYPE, RFC 1091) of the client are
+// recorded. Output can be compressed with MCCP2. Other options, such as GMCP,
+// can be offered with Offer and their subnegotiations handled by the caller.
+package telnet
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Telnet commands.
+const (
+	SE   byte = 240
+	NOP  byte = 241
+	GA   byte = 249
+	SB   byte = 250
+	WILL byte = 251
+	WONT byte = 252
+	DO   byte = 253
+	DONT byte = 254
+	IAC  byte = 255
+)
+
+// Telnet options we know about.
+const (
+	OptEcho            byte = 1
+	OptSuppressGoAhead byte = 3
+	OptTerminalType    byte = 24
+	OptNAWS            byte = 31
+	OptMCCP2           byte = 86
+	OptGMCP            byte = 201
+)
+
+// The TTYPE subnegotiation commands.
+const (
+	terminalTypeIs   byte = 0
+	terminalTypeSend byte = 1
+)
+
+// Limits on what we'll buffer for a client; anything longer is cut short.
+const (
+	maxLineLength           = 4096
+	maxSubnegotiationLength = 4096
+)
+
+// Options the client is allowed to perform.
+var remoteOptions = map[byte]bool{OptTerminalType: true, OptNAWS: true}
+
+// Conn is a telnet connection. ReadLine must only be called from one
+// goroutine at a time, but writes may come from any goroutine.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// cr is set when the last line ended in a carriage return, so that the
+	// line feed or NUL following it isn't taken as an empty line.
+	cr bool
+	// line is what has been read of the line being typed, kept when a read
+	// fails, such as at a read deadline, so that it can be carried on with.
+	line []byte
+
+	// The state of each option on our side (us) and the client's (him), and
+	// which ones we've asked for without an answer yet. See RFC 1143 for why
+	// this is needed to avoid negotiation loops.
+	us, him               map[byte]bool
+	pendingUs, pendingHim map[byte]bool
+	// local are the options we agree to perform when the client asks. Echo
+	// isn't one of them; it's only ever turned on by SetEcho.
+	local         map[byte]bool
+	width, height int
+	terminalType  string
+	handler       func(opt byte, data []byte)
+	mux           sync.Mutex
+
+	// out is where output goes: conn, or z once MCCP2 has started.
+	out              io.Writer
+	z                *zlib.Writer
+	compressionLevel int
+	counter          func(n int)
+	wmux             sync.Mutex
+}
+
+// NewConn wraps conn in a telnet connection.
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		conn:       conn,
+		r:          bufio.NewReader(conn),
+		out:        conn,
+		us:         make(map[byte]bool),
+		him:        make(map[byte]bool),
+		pendingUs:  make(map[byte]bool),
+		pendingHim: make(map[byte]bool),
+		local:      map[byte]bool{OptSuppressGoAhead: true},
+	}
+}
+
+// Offer offers to perform opt, which the client may accept at any time. Use
+// Enabled to find out whether it has.
+func (c *Conn) Offer(opt byte) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.local[opt] = true
+	return c.ask(WILL, opt)
+}
+
+// OfferCompression offers to compress everything we send with MCCP2 at the
+// given zlib level. Compression starts as soon as the client agrees.
+func (c *Conn) OfferCompression(level int) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.compressionLevel = level
+	c.local[OptMCCP2] = true
+	return c.ask(WILL, OptMCCP2)
+}
+
+// CountWrites sets a function called with the size of everything written to
+// the connection before it's compressed, to measure how well compression
+// works.
+func (c *Conn) CountWrites(counter func(n int)) {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	c.counter = counter
+}
+
+// Enabled reports whether the client has agreed to us performing opt.
+func (c *Conn) Enabled(opt byte) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.us[opt]
+}
+
+// HandleSubnegotiation sets the function called with the subnegotiations the
+// client sends for options this package doesn't handle itself. It's called
+// from ReadLine.
+func (c *Conn) HandleSubnegotiation(handler func(opt byte, data []byte)) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.handler = handler
+}
+
+// Subnegotiate sends data for opt to the client.
+func (c *Conn) Subnegotiate(opt byte, data []byte) error {
+	b := []byte{IAC, SB, opt}
+	for _, ch := range data {
+		if ch == IAC {
+			b = append(b, IAC)
+		}
+		b = append(b, ch)
+	}
+	return c.write(append(b, IAC, SE))
+}
+
+// Negotiate asks the client for the options we'd like: its window size and
+// terminal type, and no go-aheads. The answers arrive while reading.
+func (c *Conn) Negotiate() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if err := c.ask(DO, OptNAWS); err != nil {
+		return err
+	}
+	if err := c.ask(DO, OptTerminalType); err != nil {
+		return err
+	}
+	return c.ask(WILL, OptSuppressGoAhead)
+}
+
+// SetEcho turns the client's local echo on or off, e.g. so that passwords
+// aren't shown while they're typed. The server never echoes itself; asking to
+// "echo" is just the conventional way of stopping the client doing it.
+func (c *Conn) SetEcho(echo bool) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if echo {
+		if !c.us[OptEcho] && !c.pendingUs[OptEcho] {
+			return nil
+		}
+		c.us[OptEcho] = false
+		delete(c.pendingUs, OptEcho)
+		return c.command(WONT, OptEcho)
+	}
+	return c.ask(WILL, OptEcho)
+}
+
+// WindowSize returns the size of the client's window in characters, or zeros
+// if it hasn't told us.
+func (c *Conn) WindowSize() (width, height int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.width, c.height
+}
+
+// TerminalType returns the terminal type the client reported, or "" if it
+// hasn't.
+func (c *Conn) TerminalType() string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.terminalType
+}
+
+// ReadLine reads the next line typed by the client, without its line ending.
+// Telnet commands found along the way are handled. Tabs become spaces and
+// other control characters are dropped. Overly long lines are truncated.
+func (c *Conn) ReadLine() (string, error) {
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c.cr {
+			c.cr = false
+			if b == '\n' || b == 0 {
+				continue
+			}
+		}
+		switch b {
+		case IAC:
+			if err := c.readCommand(&c.line); err != nil {
+				return "", err
+			}
+		case '\r':
+			c.cr = true
+			return c.takeLine(), nil
+		case '\n':
+			return c.takeLine(), nil
+		case '\b', 0x7f:
+			if len(c.line) > 0 {
+				c.line = c.line[:len(c.line)-1]
+			}
+		case '\t':
+			if len(c.line) < maxLineLength {
+				c.line = append(c.line, ' ')
+			}
+		default:
+			if b < ' ' {
+				// other control characters, such as escape, mean nothing in
+				// a line of text
+				continue
+			}
+			if len(c.line) < maxLineLength {
+				c.line = append(c.line, b)
+			}
+		}
+	}
+}
+
+// takeLine returns the line read so far, starting a new one.
+func (c *Conn) takeLine() string {
+	line := string(c.line)
+	c.line = nil
+	return line
+}
+
+// readCommand handles the telnet command following an IAC. An escaped IAC is
+// data, so it's added to line.
+func (c *Conn) readCommand(line *[]byte) error {
+	cmd, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case IAC:
+		if len(*line) < maxLineLength {
+			*line = append(*line, IAC)
+		}
+	case WILL, WONT, DO, DONT:
+		opt, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		return c.negotiate(cmd, opt)
+	case SB:
+		opt, data, err := c.readSubnegotiation()
+		if err != nil {
+			return err
+		}
+		c.mux.Lock()
+		handler := c.subnegotiation(opt, data)
+		c.mux.Unlock()
+		if handler != nil {
+			handler(opt, data)
+		}
+	}
+	// everything else (NOP, GA, interrupts...) is ignored
+	return nil
+}
+
+// readSubnegotiation reads the option and data of a subnegotiation up to the
+// IAC SE ending it.
+func (c *Conn) readSubnegotiation() (byte, []byte, error) {
+	opt, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var data []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if b == IAC {
+			if b, err = c.r.ReadByte(); err != nil {
+				return 0, nil, err
+			}
+			if b == SE {
+				return opt, data, nil
+			}
+		}
+		if len(data) < maxSubnegotiationLength {
+			data = append(data, b)
+		}
+	}
+}
+
+// negotiate answers the client's WILL, WONT, DO or DONT for opt. Callers must
+// hold c.mux.
+func (c *Conn) negotiate(cmd, opt byte) error {
+	switch cmd {
+	case WILL:
+		if c.pendingHim[opt] {
+			delete(c.pendingHim, opt)
+			c.him[opt] = true
+			return c.enabledHim(opt)
+		}
+		if c.him[opt] {
+			return nil
+		}
+		if !remoteOptions[opt] {
+			return c.command(DONT, opt)
+		}
+		c.him[opt] = true
+		if err := c.command(DO, opt); err != nil {
+			return err
+		}
+		return c.enabledHim(opt)
+	case WONT:
+		if c.pendingHim[opt] {
+			delete(c.pendingHim, opt)
+			return nil
+		}
+		if c.him[opt] {
+			c.him[opt] = false
+			return c.command(DONT, opt)
+		}
+	case DO:
+		if c.pendingUs[opt] {
+			delete(c.pendingUs, opt)
+			c.us[opt] = true
+			return c.enabledUs(opt)
+		}
+		if c.us[opt] {
+			return nil
+		}
+		if !c.local[opt] {
+			return c.command(WONT, opt)
+		}
+		c.us[opt] = true
+		if err := c.command(WILL, opt); err != nil {
+			return err
+		}
+		return c.enabledUs(opt)
+	case DONT:
+		if c.pendingUs[opt] {
+			delete(c.pendingUs, opt)
+			return nil
+		}
+		if c.us[opt] {
+			c.us[opt] = false
+			if opt == OptMCCP2 {
+				if err := c.stopCompression(); err != nil {
+					return err
+				}
+			}
+			return c.command(WONT, opt)
+		}
+	}
+	return nil
+}
+
+// enabledUs is called once the client has agreed to us performing opt.
+// Callers must hold c.mux.
+func (c *Conn) enabledUs(opt byte) error {
+	if opt == OptMCCP2 {
+		return c.startCompression()
+	}
+	return nil
+}
+
+// startCompression tells the client compression starts here and compresses
+// everything written from now on.
+func (c *Conn) startCompression() error {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	if c.z != nil {
+		return nil
+	}
+	if _, err := c.conn.Write([]byte{IAC, SB, OptMCCP2, IAC, SE}); err != nil {
+		return err
+	}
+	z, err := zlib.NewWriterLevel(c.conn, c.compressionLevel)
+	if err != nil {
+		return err
+	}
+	c.z, c.out = z, z
+	return nil
+}
+
+// stopCompression ends the compressed stream, going back to sending
+// uncompressed output.
+func (c *Conn) stopCompression() error {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	if c.z == nil {
+		return nil
+	}
+	err := c.z.Close()
+	c.z, c.out = nil, c.conn
+	return err
+}
+
+// enabledHim is called once the client has agreed to perform opt. Callers must
+// hold c.mux.
+func (c *Conn) enabledHim(opt byte) error {
+	if opt == OptTerminalType {
+		return c.write([]byte{IAC, SB, OptTerminalType, terminalTypeSend, IAC, SE})
+	}
+	return nil
+}
+
+// subnegotiation handles the data the client sent for opt, returning the
+// handler to pass it on to if it's for an option we don't know. Callers must
+// hold c.mux.
+func (c *Conn) subnegotiation(opt byte, data []byte) func(opt byte, data []byte) {
+	switch opt {
+	case OptNAWS:
+		if len(data) == 4 {
+			c.width = int(data[0])<<8 | int(data[1])
+			c.height = int(data[2])<<8 | int(data[3])
+		}
+	case OptTerminalType:
+		if len(data) > 1 && data[0] == terminalTypeIs {
+			c.terminalType = string(data[1:])
+		}
+	default:
+		return c.handler
+	}
+	return nil
+}
+
+// ask asks the client to agree to cmd (DO or WILL) for opt, unless it already
+// has or we're waiting for its answer. Callers must hold c.mux.
+func (c *Conn) ask(cmd, opt byte) error {
+	state, pending := c.him, c.pendingHim
+	if cmd == WILL {
+		state, pending = c.us, c.pendingUs
+	}
+	if state[opt] || pending[opt] {
+		return nil
+	}
+	pending[opt] = true
+	return c.command(cmd, opt)
+}
+
+// command sends IAC cmd opt.
+func (c *Conn) command(cmd, opt byte) error {
+	return c.write([]byte{IAC, cmd, opt})
+}
+
+// Write sends text to the client, escaping IACs and turning bare line feeds
+// into the CR LF telnet expects.
+func (c *Conn) Write(p []byte) (int, error) {
+	var b bytes.Buffer
+	for i, ch := range p {
+		switch {
+		case ch == IAC:
+			b.WriteByte(IAC)
+		case ch == '\n' && (i == 0 || p[i-1] != '\r'):
+			b.WriteByte('\r')
+		}
+		b.WriteByte(ch)
+	}
+	if err := c.write(b.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// write sends raw bytes to the client, compressing them if MCCP2 is on.
+func (c *Conn) write(p []byte) error {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	if c.counter != nil {
+		c.counter(len(p))
+	}
+	if _, err := c.out.Write(p); err != nil {
+		return err
+	}
+	if c.z != nil {
+		return c.z.Flush()
+	}
+	return nil
+}
+
+// SetReadDeadline sets the deadline for future reads, and for a ReadLine
+// already waiting; see net.Conn. What was read of the line being typed is
+// kept for the next ReadLine.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for future writes; see net.Conn.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// RemoteAddr returns the address of the client.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// State is what has been negotiated on a connection, so that another process
+// can carry on with it; see Suspend and Resume.
+type State struct {
+	// Us and Him are the options enabled on our side and the client's, and
+	// Local the ones we agree to perform.
+	Us, Him, Local   []byte
+	Width, Height    int
+	TerminalType     string
+	Compressed       bool
+	CompressionLevel int
+	// Input is what the client sent that hasn't been read as a line yet,
+	// starting with what was read of the line being typed. CR is set when
+	// the last line read ended in a carriage return.
+	Input []byte
+	CR    bool
+}
+
+// Suspend ends the compressed stream, if there is one, and returns the state
+// of the connection. ReadLine must have stopped, e.g. at a read deadline, and
+// nothing should be written to it afterwards; the underlying connection is
+// left open, to be picked up with Resume.
+func (c *Conn) Suspend() (State, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	var input []byte
+	for _, b := range c.line {
+		if b == IAC {
+			input = append(input, IAC)
+		}
+		input = append(input, b)
+	}
+	buffered, _ := c.r.Peek(c.r.Buffered())
+	input = append(input, buffered...)
+	st := State{
+		Us:               enabledOptions(c.us),
+		Him:              enabledOptions(c.him),
+		Local:            enabledOptions(c.local),
+		Width:            c.width,
+		Height:           c.height,
+		TerminalType:     c.terminalType,
+		Compressed:       c.us[OptMCCP2],
+		CompressionLevel: c.compressionLevel,
+		Input:            input,
+		CR:               c.cr,
+	}
+	return st, c.stopCompression()
+}
+
+// Resume wraps conn, suspended with Suspend, in a telnet connection in the
+// given state. Input the client had already sent is read first. If the
+// connection was compressed a new compressed stream is started straight away.
+func Resume(conn net.Conn, st State) (*Conn, error) {
+	c := NewConn(conn)
+	if len(st.Input) > 0 {
+		c.r = bufio.NewReader(io.MultiReader(bytes.NewReader(st.Input), conn))
+	}
+	c.cr = st.CR
+	for _, opt := range st.Us {
+		c.us[opt] = true
+	}
+	for _, opt := range st.Him {
+		c.him[opt] = true
+	}
+	for _, opt := range st.Local {
+		c.local[opt] = true
+	}
+	c.width, c.height = st.Width, st.Height
+	c.terminalType = st.TerminalType
+	c.compressionLevel = st.CompressionLevel
+	if st.Compressed {
+		if err := c.startCompression(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// enabledOptions lists the options set in opts.
+func enabledOptions(opts map[byte]bool) []byte {
+	var enabled []byte
+	for opt, on := range opts {
+		if on {
+			enabled = append(enabled, opt)
+		}
+	}
+	return enabled
+}
+
+// Close closes the connection, ending the compressed stream first if there
+// is one.
+func (c *Conn) Close() error {
+	c.wmux.Lock()
+	if c.z != nil {
+		c.z.Close()
+		c.z, c.out = nil, c.conn
+	}
+	c.wmux.Unlock()
+	return c.conn.Close()
+}
@@ -0,0 +1,363 @@
+package telnet
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// fakeConn is a net.Conn reading what the client sent from in and keeping
+// what we send in out.
+type fakeConn struct {
+	net.Conn
+	in, out bytes.Buffer
+}
+
+func (c *fakeConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *fakeConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+func (c *fakeConn) Close() error                { return nil }
+
+// startOfCompression is what the server sends right before compressing.
+var startOfCompression = []byte{IAC, SB, OptMCCP2, IAC, SE}
+
+// decompress splits what was sent into what came before compression started,
+// the decompressed stream and whatever was sent uncompressed after it ended.
+func decompress(t *testing.T, sent []byte) (before, compressed, after []byte) {
+	t.Helper()
+	i := bytes.Index(sent, startOfCompression)
+	if i < 0 {
+		t.Fatalf("compression never started in %q", sent)
+	}
+	rest := bytes.NewReader(sent[i+len(startOfCompression):])
+	z, err := zlib.NewReader(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err = ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _ = ioutil.ReadAll(rest)
+	return sent[:i], compressed, after
+}
+
+func TestReadLine(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := NewConn(server)
+	go client.Write([]byte("look\r\n" +
+		"say hi\r\x00" +
+		"\r\n" +
+		"say \x1b[2Jhi\a\n" +
+		"tupo\b\b\bypo\x7f\tto\n" +
+		"na\xff\xffme\r\n"))
+
+	for _, want := range []string{"look", "say hi", "", "say [2Jhi", "typ to", "na\xffme"} {
+		got, err := c.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("read %q, want %q", got, want)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	fake := &fakeConn{}
+	c := NewConn(fake)
+	if err := c.OfferCompression(zlib.BestSpeed); err != nil {
+		t.Fatal(err)
+	}
+	fake.in.Write([]byte{IAC, DO, OptMCCP2})
+	fake.in.WriteString("look\r\n")
+	if line, err := c.ReadLine(); err != nil || line != "look" {
+		t.Fatalf("ReadLine() = %q, %v", line, err)
+	}
+	if !c.Enabled(OptMCCP2) {
+		t.Error("compression isn't enabled")
+	}
+	c.Write([]byte("hello\n"))
+	// the client turns compression off again
+	fake.in.Write([]byte{IAC, DONT, OptMCCP2})
+	fake.in.WriteString("quit\r\n")
+	if line, err := c.ReadLine(); err != nil || line != "quit" {
+		t.Fatalf("ReadLine() = %q, %v", line, err)
+	}
+	c.Write([]byte("bye\n"))
+
+	before, compressed, after := decompress(t, fake.out.Bytes())
+	if want := []byte{IAC, WILL, OptMCCP2}; !bytes.Equal(before, want) {
+		t.Errorf("sent %v before compressing, want %v", before, want)
+	}
+	if string(compressed) != "hello\r\n" {
+		t.Errorf("compressed %q", compressed)
+	}
+	if want := append([]byte{IAC, WONT, OptMCCP2}, "bye\r\n"...); !bytes.Equal(after, want) {
+		t.Errorf("sent %q after compression ended, want %q", after, want)
+	}
+	if c.Enabled(OptMCCP2) {
+		t.Error("compression is still enabled")
+	}
+}
+
+func TestCompressionRefused(t *testing.T) {
+	fake := &fakeConn{}
+	c := NewConn(fake)
+	c.OfferCompression(zlib.BestSpeed)
+	fake.in.Write([]byte{IAC, DONT, OptMCCP2})
+	fake.in.WriteString("look\n")
+	if _, err := c.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("hello\n"))
+	if want := append([]byte{IAC, WILL, OptMCCP2}, "hello\r\n"...); !bytes.Equal(fake.out.Bytes(), want) {
+		t.Errorf("sent %q, want %q", fake.out.Bytes(), want)
+	}
+}
+
+// sortedOptions sorts opts, so that states can be compared.
+func sortedOptions(opts []byte) []byte {
+	sort.Slice(opts, func(i, j int) bool { return opts[i] < opts[j] })
+	return opts
+}
+
+func TestSuspendAndResume(t *testing.T) {
+	fake := &fakeConn{}
+	c := NewConn(fake)
+	c.Negotiate()
+	c.OfferCompression(zlib.BestCompression)
+	fake.in.Write([]byte{IAC, WILL, OptNAWS, IAC, SB, OptNAWS, 0, 100, 0, 30, IAC, SE})
+	fake.in.Write([]byte{IAC, WILL, OptTerminalType, IAC, SB, OptTerminalType, terminalTypeIs})
+	fake.in.WriteString("xterm")
+	fake.in.Write([]byte{IAC, SE, IAC, DO, OptSuppressGoAhead, IAC, DO, OptMCCP2})
+	fake.in.WriteString("look\n")
+	if _, err := c.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("hello\n"))
+
+	st, err := c.Suspend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Us, st.Him, st.Local = sortedOptions(st.Us), sortedOptions(st.Him), sortedOptions(st.Local)
+	want := State{
+		Us:               []byte{OptSuppressGoAhead, OptMCCP2},
+		Him:              []byte{OptTerminalType, OptNAWS},
+		Local:            []byte{OptSuppressGoAhead, OptMCCP2},
+		Width:            100,
+		Height:           30,
+		TerminalType:     "xterm",
+		Compressed:       true,
+		CompressionLevel: zlib.BestCompression,
+	}
+	if !reflect.DeepEqual(st, want) {
+		t.Errorf("Suspend() = %+v, want %+v", st, want)
+	}
+	// the compressed stream was finished, so the client can read all of it
+	_, compressed, after := decompress(t, fake.out.Bytes())
+	if string(compressed) != "hello\r\n" || len(after) != 0 {
+		t.Errorf("before suspending sent %q compressed and %q after", compressed, after)
+	}
+
+	resumed := &fakeConn{}
+	c, err = Resume(resumed, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width, height := c.WindowSize(); width != 100 || height != 30 || c.TerminalType() != "xterm" {
+		t.Errorf("resumed with a %dx%d %q terminal", width, height, c.TerminalType())
+	}
+	if !c.Enabled(OptMCCP2) || !c.Enabled(OptSuppressGoAhead) {
+		t.Error("options enabled before suspending aren't after resuming")
+	}
+	// the client asking again changes nothing
+	resumed.in.Write([]byte{IAC, DO, OptMCCP2, IAC, WILL, OptNAWS})
+	resumed.in.WriteString("look\n")
+	if _, err := c.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("welcome back\n"))
+	c.Close()
+	before, compressed, _ := decompress(t, resumed.out.Bytes())
+	if len(before) != 0 || string(compressed) != "welcome back\r\n" {
+		t.Errorf("after resuming sent %q and compressed %q", before, compressed)
+	}
+}
+
+func TestSuspendKeepsInput(t *testing.T) {
+	fake := &fakeConn{}
+	c := NewConn(fake)
+	fake.in.WriteString("look\r\nsay hel")
+	if line, err := c.ReadLine(); err != nil || line != "look" {
+		t.Fatalf("ReadLine() = %q, %v", line, err)
+	}
+	st, err := c.Suspend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(st.Input) != "\nsay hel" || !st.CR {
+		t.Errorf("suspended between lines with input %q and CR %v", st.Input, st.CR)
+	}
+	resumed := &fakeConn{}
+	resumed.in.WriteString("lo\r\n")
+	c, err = Resume(resumed, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line, err := c.ReadLine(); err != nil || line != "say hello" {
+		t.Errorf("after resuming ReadLine() = %q, %v", line, err)
+	}
+
+	// a read stopping half way through a line keeps what was read of it
+	fake = &fakeConn{}
+	c = NewConn(fake)
+	fake.in.Write([]byte{'h', IAC, IAC, 'i', IAC, NOP, ' '})
+	if line, err := c.ReadLine(); err == nil {
+		t.Fatalf("ReadLine() = %q without a line ending", line)
+	}
+	if st, err = c.Suspend(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{'h', IAC, IAC, 'i', ' '}; !bytes.Equal(st.Input, want) || st.CR {
+		t.Errorf("suspended half way through a line with input %q and CR %v, want %q", st.Input, st.CR, want)
+	}
+	resumed = &fakeConn{}
+	resumed.in.WriteString("there\n")
+	if c, err = Resume(resumed, st); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := c.ReadLine(); err != nil || line != "h\xffi there" {
+		t.Errorf("after resuming ReadLine() = %q, %v", line, err)
+	}
+}
+
+// readAll reads lines until the client has sent nothing more.
+func readAll(c *Conn) {
+	for {
+		if _, err := c.ReadLine(); err != nil {
+			return
+		}
+	}
+}
+
+func TestNegotiationDoesntLoop(t *testing.T) {
+	fake := &fakeConn{}
+	c := NewConn(fake)
+	if err := c.Negotiate(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{IAC, DO, OptNAWS, IAC, DO, OptTerminalType, IAC, WILL, OptSuppressGoAhead}; !bytes.Equal(fake.out.Bytes(), want) {
+		t.Errorf("Negotiate() sent %v, want %v", fake.out.Bytes(), want)
+	}
+	// asking again while waiting for the answers sends nothing
+	c.Negotiate()
+	fake.out.Reset()
+
+	// the client agrees, then says so again as if it had asked itself
+	fake.in.Write([]byte{IAC, WILL, OptNAWS, IAC, DO, OptSuppressGoAhead})
+	fake.in.Write([]byte{IAC, WILL, OptNAWS, IAC, DO, OptSuppressGoAhead})
+	// then offers and asks for options we don't do, which are refused, and
+	// takes them back, which needs no answer
+	fake.in.Write([]byte{IAC, WILL, OptEcho, IAC, DO, OptNAWS})
+	fake.in.Write([]byte{IAC, WONT, OptEcho, IAC, DONT, OptNAWS})
+	fake.in.WriteString("look\n")
+	if _, err := c.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{IAC, DONT, OptEcho, IAC, WONT, OptNAWS}; !bytes.Equal(fake.out.Bytes(), want) {
+		t.Errorf("answered with %v, want %v", fake.out.Bytes(), want)
+	}
+	if !c.Enabled(OptSuppressGoAhead) {
+		t.Error("suppressing go-aheads isn't enabled")
+	}
+
+	// the client turns an agreed option off, which is acknowledged once
+	fake.out.Reset()
+	fake.in.Write([]byte{IAC, DONT, OptSuppressGoAhead, IAC, DONT, OptSuppressGoAhead})
+	fake.in.Write([]byte{IAC, WONT, OptNAWS, IAC, WONT, OptNAWS})
+	readAll(c)
+	if want := []byte{IAC, WONT, OptSuppressGoAhead, IAC, DONT, OptNAWS}; !bytes.Equal(fake.out.Bytes(), want) {
+		t.Errorf("answered turning options off with %v, want %v", fake.out.Bytes(), want)
+	}
+}
+
+func TestTerminalType(t *testing.T) {
+	fake := &fakeConn{}
+	c := NewConn(fake)
+	c.Negotiate()
+	fake.out.Reset()
+	fake.in.Write([]byte{IAC, WILL, OptTerminalType})
+	readAll(c)
+	if want := []byte{IAC, SB, OptTerminalType, terminalTypeSend, IAC, SE}; !bytes.Equal(fake.out.Bytes(), want) {
+		t.Errorf("sent %v once the client agreed, want %v", fake.out.Bytes(), want)
+	}
+	if got := c.TerminalType(); got != "" {
+		t.Errorf("TerminalType() = %q before the client said", got)
+	}
+
+	fake.in.Write([]byte{IAC, SB, OptTerminalType, terminalTypeIs})
+	fake.in.WriteString("XTERM-256COLOR")
+	fake.in.Write([]byte{IAC, SE})
+	// subnegotiations that aren't an IS are ignored
+	fake.in.Write([]byte{IAC, SB, OptTerminalType, terminalTypeSend, IAC, SE})
+	readAll(c)
+	if got := c.TerminalType(); got != "XTERM-256COLOR" {
+		t.Errorf("TerminalType() = %q, want XTERM-256COLOR", got)
+	}
+
+	// a client offering it unasked gets asked for it too
+	fake = &fakeConn{}
+	c = NewConn(fake)
+	fake.in.Write([]byte{IAC, WILL, OptTerminalType})
+	readAll(c)
+	if want := []byte{IAC, DO, OptTerminalType, IAC, SB, OptTerminalType, terminalTypeSend, IAC, SE}; !bytes.Equal(fake.out.Bytes(), want) {
+		t.Errorf("sent %v when offered, want %v", fake.out.Bytes(), want)
+	}
+}
+
+func TestSetEcho(t *testing.T) {
+	fake := &fakeConn{}
+	c := NewConn(fake)
+	// echo is already on
+	c.SetEcho(true)
+	if fake.out.Len() != 0 {
+		t.Errorf("turning echo on sent %v", fake.out.Bytes())
+	}
+
+	c.SetEcho(false)
+	c.SetEcho(false)
+	fake.in.Write([]byte{IAC, DO, OptEcho})
+	readAll(c)
+	if want := []byte{IAC, WILL, OptEcho}; !bytes.Equal(fake.out.Bytes(), want) {
+		t.Errorf("turning echo off sent %v, want %v", fake.out.Bytes(), want)
+	}
+	if !c.Enabled(OptEcho) {
+		t.Error("echo isn't turned off")
+	}
+
+	fake.out.Reset()
+	c.SetEcho(true)
+	c.SetEcho(true)
+	fake.in.Write([]byte{IAC, DONT, OptEcho})
+	readAll(c)
+	if want := []byte{IAC, WONT, OptEcho}; !bytes.Equal(fake.out.Bytes(), want) {
+		t.Errorf("turning echo back on sent %v, want %v", fake.out.Bytes(), want)
+	}
+	if c.Enabled(OptEcho) {
+		t.Error("echo is still turned off")
+	}
+
+	// the client can't turn it off itself
+	fake.out.Reset()
+	fake.in.Write([]byte{IAC, DO, OptEcho})
+	readAll(c)
+	if want := []byte{IAC, WONT, OptEcho}; !bytes.Equal(fake.out.Bytes(), want) {
+		t.Errorf("answered DO ECHO with %v, want %v", fake.out.Bytes(), want)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diddydum/muhmud/muhmud/telnet"
+)
+
+// fakeTelnetConn is a net.Conn reading what the client typed from in and
+// keeping what it's sent in out.
+type fakeTelnetConn struct {
+	net.Conn
+	in, out bytes.Buffer
+}
+
+func (c *fakeTelnetConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *fakeTelnetConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+func (c *fakeTelnetConn) Close() error                { return nil }
+func (c *fakeTelnetConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+func (c *fakeTelnetConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000}
+}
+
+// telnetLoginWith logs in on a telnet connection where the client types lines,
+// returning the email address logged in with, what was sent to the client
+// and any error.
+func telnetLoginWith(s *GameState, lines ...string) (email, sent string, err error) {
+	fake := &fakeTelnetConn{}
+	fake.in.WriteString(strings.Join(lines, "\r\n") + "\r\n")
+	email, err = telnetLogin(s, telnet.NewConn(fake), "http://localhost:4200")
+	return email, fake.out.String(), err
+}
+
+func TestTelnetLogin(t *testing.T) {
+	s := newTestGame(t, "a@example.com")
+
+	email, sent, err := telnetLoginWith(s, "", "A@Example.com ", "wrong", "a@example.com", "password")
+	if err != nil || email != "a@example.com" {
+		t.Fatalf("telnetLogin() = %q, %v; sent:\n%q", email, err, sent)
+	}
+	for _, want := range []string{
+		"New here? Create an account at http://localhost:4200/register first.",
+		"Invalid email/password.",
+	} {
+		if !strings.Contains(sent, want) {
+			t.Errorf("didn't send %q; sent:\n%q", want, sent)
+		}
+	}
+	// echo is turned off for each password and back on after it
+	echoOff := string([]byte{telnet.IAC, telnet.WILL, telnet.OptEcho})
+	echoOn := string([]byte{telnet.IAC, telnet.WONT, telnet.OptEcho})
+	if strings.Count(sent, echoOff) != 2 || strings.Count(sent, echoOn) != 2 {
+		t.Errorf("didn't turn echo off and on around both passwords; sent:\n%q", sent)
+	}
+	for _, password := range strings.Split(sent, "Password: ")[1:] {
+		if !strings.HasPrefix(password, echoOff) || !strings.Contains(password, echoOn) {
+			t.Errorf("didn't turn echo off while the password was typed; sent:\n%q", sent)
+		}
+	}
+
+	_, sent, err = telnetLoginWith(s, "a@example.com", "wrong", "a@example.com", "wrong", "nobody@example.com", "password", "a@example.com", "password")
+	if err == nil {
+		t.Error("logged in after getting the password wrong three times")
+	}
+	if strings.Count(sent, "Invalid email/password.") != 3 || !strings.Contains(sent, "Too many failed attempts; goodbye.") {
+		t.Errorf("sent:\n%q", sent)
+	}
+
+	s.do(func() { s.Players["a@example.com"].Verified = false })
+	_, sent, err = telnetLoginWith(s, "a@example.com", "password")
+	if err == nil {
+		t.Error("logged in to an account that isn't verified")
+	}
+	if !strings.Contains(sent, "Please verify your email address first.") {
+		t.Errorf("sent:\n%q", sent)
+	}
+}
@@ -0,0 +1,145 @@
+// Contains byte counts of what's sent to each connection, to see how well
+// compression is doing.
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Totals over every connection, exported on /debug/vars.
+var trafficMetrics = expvar.NewMap("traffic")
+
+// The traffic of every open connection, exported on /debug/vars as
+// "connections". Connections are only identified by their ConnectionID there,
+// so that the metrics don't give away who is playing.
+var (
+	liveTraffic    = make(map[*Traffic]bool)
+	liveTrafficMux sync.Mutex
+)
+
+func init() {
+	expvar.Publish("connections", expvar.Func(trafficSnapshot))
+}
+
+// Traffic counts the bytes sent to a single connection, both before
+// compression (raw) and as they went over the network (wire). It's safe for
+// concurrent use.
+type Traffic struct {
+	// accessed atomically, so keep them first for alignment
+	raw  int64
+	wire int64
+
+	// who the connection belongs to, for the log, how it's connected and
+	// the game connection it carries, or -1 before there is one; guarded by
+	// liveTrafficMux
+	who       string
+	transport string
+	connID    ConnectionID
+}
+
+// trackTraffic starts counting the traffic of a new connection from who,
+// which is usually an email address. Call Done once it closes.
+func trackTraffic(who, transport string) *Traffic {
+	t := &Traffic{who: who, transport: transport, connID: -1}
+	liveTrafficMux.Lock()
+	defer liveTrafficMux.Unlock()
+	liveTraffic[t] = true
+	return t
+}
+
+// Identify changes who the connection belongs to, e.g. once they've logged in.
+func (t *Traffic) Identify(who string) {
+	liveTrafficMux.Lock()
+	defer liveTrafficMux.Unlock()
+	t.who = who
+}
+
+// SetConnection records the game connection carried by the connection.
+func (t *Traffic) SetConnection(connID ConnectionID) {
+	liveTrafficMux.Lock()
+	defer liveTrafficMux.Unlock()
+	t.connID = connID
+}
+
+// AddRaw counts n bytes about to be compressed.
+func (t *Traffic) AddRaw(n int) {
+	atomic.AddInt64(&t.raw, int64(n))
+	trafficMetrics.Add("raw_bytes", int64(n))
+}
+
+// AddWire counts n bytes written to the network.
+func (t *Traffic) AddWire(n int) {
+	atomic.AddInt64(&t.wire, int64(n))
+	trafficMetrics.Add("wire_bytes", int64(n))
+}
+
+// Raw returns the number of bytes sent before compression.
+func (t *Traffic) Raw() int64 {
+	return atomic.LoadInt64(&t.raw)
+}
+
+// Wire returns the number of bytes written to the network.
+func (t *Traffic) Wire() int64 {
+	return atomic.LoadInt64(&t.wire)
+}
+
+// Done stops tracking the connection, logging how much it was sent.
+func (t *Traffic) Done() {
+	liveTrafficMux.Lock()
+	defer liveTrafficMux.Unlock()
+	delete(liveTraffic, t)
+	log.Printf("Sent %s %d bytes over %s, %d before compression\n", t.who, t.Wire(), t.transport, t.Raw())
+}
+
+// trafficSnapshot lists the traffic of every open connection.
+func trafficSnapshot() interface{} {
+	liveTrafficMux.Lock()
+	defer liveTrafficMux.Unlock()
+	type entry struct {
+		// Connection is -1 while the player is still logging in.
+		Connection ConnectionID
+		Transport  string
+		Raw        int64
+		Wire       int64
+	}
+	snapshot := []entry{}
+	for t := range liveTraffic {
+		snapshot = append(snapshot, entry{t.connID, t.transport, t.Raw(), t.Wire()})
+	}
+	return snapshot
+}
+
+// countingConn is a net.Conn counting what's written to it as wire bytes.
+type countingConn struct {
+	net.Conn
+	traffic *Traffic
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.traffic.AddWire(n)
+	return n, err
+}
+
+// countingWriter is a gin.ResponseWriter whose hijacked connection counts what's
+// written to it, so that websocket traffic can be measured.
+type countingWriter struct {
+	gin.ResponseWriter
+	traffic *Traffic
+}
+
+// Hijack implements http.Hijacker.
+func (w countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := w.ResponseWriter.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return countingConn{Conn: conn, traffic: w.traffic}, brw, nil
+}
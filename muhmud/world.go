@@ -0,0 +1,271 @@
+// Contains the rooms that make up the world and the exits between them.
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RoomID identifies a room in the world.
+type RoomID int
+
+// Direction is a compass direction an exit can lead in.
+type Direction int
+
+// The directions an exit can lead in. NoDirection is used for named exits such
+// as "portal" that aren't in any particular direction.
+const (
+	North Direction = iota
+	East
+	South
+	West
+	Up
+	Down
+	NoDirection
+)
+
+var directionNames = [...]string{"north", "east", "south", "west", "up", "down"}
+
+func (d Direction) String() string {
+	if d < 0 || int(d) >= len(directionNames) {
+		return "nowhere"
+	}
+	return directionNames[d]
+}
+
+// Opposite returns the direction leading back the way you came.
+func (d Direction) Opposite() Direction {
+	switch d {
+	case North:
+		return South
+	case East:
+		return West
+	case South:
+		return North
+	case West:
+		return East
+	case Up:
+		return Down
+	case Down:
+		return Up
+	}
+	return NoDirection
+}
+
+// fromDirection describes arriving from d, e.g. "from the south" or "from
+// below".
+func fromDirection(d Direction) string {
+	switch d {
+	case Up:
+		return "from above"
+	case Down:
+		return "from below"
+	case NoDirection:
+		return "from somewhere"
+	}
+	return "from the " + d.String()
+}
+
+// ParseDirection parses a direction or an abbreviation of one, e.g. "n".
+func ParseDirection(s string) (Direction, bool) {
+	s = strings.ToLower(s)
+	if s == "" {
+		return NoDirection, false
+	}
+	for i, name := range directionNames {
+		if strings.HasPrefix(name, s) {
+			return Direction(i), true
+		}
+	}
+	return NoDirection, false
+}
+
+// DoorState is whether a door can be passed through.
+type DoorState int
+
+// The states a door can be in.
+const (
+	DoorOpen DoorState = iota
+	DoorClosed
+	DoorLocked
+)
+
+func (d DoorState) String() string {
+	switch d {
+	case DoorOpen:
+		return "open"
+	case DoorClosed:
+		return "closed"
+	case DoorLocked:
+		return "locked"
+	}
+	return "unknown"
+}
+
+// parseDoorState parses the name of a door state, e.g. "closed".
+func parseDoorState(s string) (DoorState, bool) {
+	for _, state := range []DoorState{DoorOpen, DoorClosed, DoorLocked} {
+		if strings.EqualFold(s, state.String()) {
+			return state, true
+		}
+	}
+	return DoorOpen, false
+}
+
+// Door blocks an exit while it is closed. Both sides of a door share the same
+// Door so that opening it from either side opens it for both.
+type Door struct {
+	// Name is what the door is called, e.g. "door" or "iron gate".
+	Name string
+	// Keywords are the words a player can use to refer to the door.
+	Keywords []string
+	State    DoorState
+	// Key is the prototype of the items that lock and unlock the door, or 0
+	// if it has no lock.
+	Key ItemPrototypeID
+}
+
+// Exit leads from one room to another.
+type Exit struct {
+	// Direction is the direction the exit leads in, or NoDirection for a named
+	// exit.
+	Direction Direction
+	// Name is the name of a named exit, e.g. "portal". It's empty for exits in
+	// a direction.
+	Name string
+	To   RoomID
+	// Door is the door in the exit, if any.
+	Door *Door
+}
+
+// Label is how the exit is referred to in output.
+func (e *Exit) Label() string {
+	if e.Direction == NoDirection {
+		return e.Name
+	}
+	return e.Direction.String()
+}
+
+// Passable reports whether the exit can currently be walked through.
+func (e *Exit) Passable() bool {
+	return e.Door == nil || e.Door.State == DoorOpen
+}
+
+// Room is a single location in the world.
+type Room struct {
+	ID          RoomID
+	Name        string
+	Description string
+	Exits       []*Exit
+	// Items are the items lying in the room.
+	Items []*Item
+}
+
+// Exit returns the exit leading in direction d, or nil.
+func (r *Room) Exit(d Direction) *Exit {
+	for _, e := range r.Exits {
+		if e.Direction == d && d != NoDirection {
+			return e
+		}
+	}
+	return nil
+}
+
+// FindExit finds an exit by direction, by the name of a named exit, or by the
+// keywords of the door in it.
+func (r *Room) FindExit(word string) *Exit {
+	if d, ok := ParseDirection(word); ok {
+		if e := r.Exit(d); e != nil {
+			return e
+		}
+	}
+	t := ParseTarget(word)
+	for _, e := range r.Exits {
+		if e.Direction == NoDirection && t.Matches([]string{e.Name}) {
+			return e
+		}
+	}
+	for _, e := range r.Exits {
+		if e.Door != nil && t.Matches(e.Door.Keywords) {
+			return e
+		}
+	}
+	return nil
+}
+
+// World is the graph of rooms the game takes place in.
+type World struct {
+	Rooms map[RoomID]*Room
+	// Start is where new characters appear.
+	Start RoomID
+	// Prototypes are the kinds of items found in the world.
+	Prototypes map[ItemPrototypeID]*ItemPrototype
+	// NPCPrototypes are the kinds of NPCs found in the world, and Resets
+	// where they're spawned.
+	NPCPrototypes map[NPCPrototypeID]*NPCPrototype
+	Resets        []*Reset
+}
+
+// NewWorld creates an empty world.
+func NewWorld() *World {
+	return &World{
+		Rooms:         make(map[RoomID]*Room),
+		Prototypes:    make(map[ItemPrototypeID]*ItemPrototype),
+		NPCPrototypes: make(map[NPCPrototypeID]*NPCPrototype),
+	}
+}
+
+// Place spawns an item from a prototype in a room. If container isn't zero the
+// item goes in the first item of that prototype in the room instead.
+func (w *World) Place(room RoomID, proto, container ItemPrototypeID) error {
+	r, ok := w.Rooms[room]
+	if !ok {
+		return fmt.Errorf("unknown room %d", room)
+	}
+	it, err := w.Spawn(proto)
+	if err != nil {
+		return err
+	}
+	if container == 0 {
+		r.Items = append(r.Items, it)
+		return nil
+	}
+	for _, c := range r.Items {
+		if c.Proto.ID == container && c.IsContainer() {
+			c.Contents = append(c.Contents, it)
+			return nil
+		}
+	}
+	return fmt.Errorf("no container %d in room %d", container, room)
+}
+
+// ApplyDoorStates sets the state of doors from what was saved in a Store.
+// Saved states for exits that no longer exist are ignored.
+func (w *World) ApplyDoorStates(doors map[ExitKey]DoorState) {
+	for key, state := range doors {
+		room, ok := w.Rooms[key.Room]
+		if !ok {
+			continue
+		}
+		for _, e := range room.Exits {
+			if e.Label() == key.Exit && e.Door != nil {
+				e.Door.State = state
+			}
+		}
+	}
+}
+
+// DoorKey returns the key the state of the door in exit e of room is saved
+// under. Both sides of a door share a key: that of the side in the room with
+// the lowest id.
+func (w *World) DoorKey(room *Room, e *Exit) ExitKey {
+	key := ExitKey{Room: room.ID, Exit: e.Label()}
+	if other, ok := w.Rooms[e.To]; ok && other.ID < room.ID {
+		for _, back := range other.Exits {
+			if back.Door == e.Door {
+				return ExitKey{Room: other.ID, Exit: back.Label()}
+			}
+		}
+	}
+	return key
+}